@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 type FSProbeInfo struct {
@@ -16,6 +17,9 @@ type FSProbeInfo struct {
 }
 
 type FileServer struct {
+    // Must stay first, see nodeCounters.
+    counters nodeCounters
+
     chunks ChunkDB
     expectations *ExpectationDB
     nsConn NSConnector
@@ -186,9 +190,16 @@ func (s *FileServer) CancelTokenHandler(w http.ResponseWriter, r *http.Request)
         return
     }
 
+    s.CancelToken(token)
+
+    w.WriteHeader(http.StatusOK)
+}
+
+// CancelToken forgets the token. Chunks already written under it are
+// purged.
+func (s *FileServer) CancelToken(token string) {
     exp := s.expectations.Get(token)
     if exp == nil {
-        w.WriteHeader(http.StatusOK)
         return
     }
 
@@ -214,8 +225,6 @@ func (s *FileServer) CancelTokenHandler(w http.ResponseWriter, r *http.Request)
     for _, id := range toPurge {
         go s.chunks.Remove(id)
     }
-
-    w.WriteHeader(http.StatusOK)
 }
 
 func (s *FileServer) PurgeHandler(w http.ResponseWriter, r *http.Request) {
@@ -228,12 +237,17 @@ func (s *FileServer) PurgeHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    s.Purge(chunks...)
+
+    w.WriteHeader(http.StatusOK)
+}
+
+// Purge removes the chunks as soon as no token expects them.
+func (s *FileServer) Purge(chunks ...string) {
     toPurge := s.expectations.MakeObsolete(chunks...)
     for _, id := range toPurge {
         go s.chunks.Remove(id)
     }
-
-    w.WriteHeader(http.StatusOK)
 }
 
 func (s *FileServer) ProbeHandler(w http.ResponseWriter, r *http.Request) {
@@ -244,15 +258,15 @@ func (s *FileServer) ProbeHandler(w http.ResponseWriter, r *http.Request) {
 
     log.Print("Probed")
 
+    s.nsConn.SetNSAddr(r.RemoteAddr)
+
     // TODO: inject this functionality and test it.
     save, err := os.Create(".tsukifs")
     if err == nil {
-        fmt.Fprint(save, r.RemoteAddr)
+        fmt.Fprint(save, strings.Join(s.nsConn.GetNSAddrs(), "\n"))
         save.Close()
     }
 
-    s.nsConn.SetNSAddr(r.RemoteAddr)
-
     info := s.GenerateProbeInfo()
 
     probeBytes, err := json.Marshal(info)
@@ -279,41 +293,71 @@ func (s *FileServer) ReplicateHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    err := s.Replicate(token, destIP, chunks...)
+    if err == errReplicaNotRegistered {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+const errReplicaNotRegistered = ChunkError("replicas could not be registered internally")
+
+// Replicate sends the chunks to the client port of the fileserver at
+// destIP, which should expect them under the same token. It returns the
+// last error encountered, but tries every chunk.
+func (s *FileServer) Replicate(token, destIP string, chunks ...string) error {
+    // All chunks are registered under one token, the same way the client
+    // would get them.
+    err := s.Expect(token, ExpectActionRead, chunks...)
+    if err != nil {
+        log.Printf("error: replicas could not be registered internally, token=%s, chunks=%v: %v", token, chunks, err)
+        return errReplicaNotRegistered
+    }
+
+    var lastErr error
     for _, id := range chunks {
-        err := s.Expect(token, ExpectActionRead, id)
-        if err != nil {
-            log.Printf("error: replica could not be registered internally, token=%s, chunkId=%s", token, id)
-            continue
+        if err := s.replicateChunk(token, id, destIP); err != nil {
+            lastErr = err
         }
+    }
 
-        defer s.fulfillExpectation(token, id)
+    return lastErr
+}
 
-        chunk, closeChunk, err := s.chunks.Get(id)
+func (s *FileServer) replicateChunk(token, id, destIP string) error {
+    defer s.fulfillExpectation(token, id)
+    defer s.counters.beginTransfer()()
 
-        if err != nil {
-            w.WriteHeader(http.StatusBadRequest)
-            return
-        }
-        defer closeChunk()
+    chunk, closeChunk, err := s.chunks.Get(id)
+    defer closeChunk()
 
+    if err != nil {
+        atomic.AddInt64(&s.counters.readErrors, 1)
+        log.Printf("warning: could not read chunk %s for replication, %v.", id, err)
+        return fmt.Errorf("replicate %s: %v", id, err)
+    }
 
-        destAddr := fmt.Sprintf("http://%s/chunks/%s?token=%s", destIP, id, token)
-        resp, err := http.Post(destAddr, "application/octet-stream", chunk)
+    destAddr := fmt.Sprintf("http://%s/chunks/%s?token=%s", destIP, id, token)
+    resp, err := http.Post(destAddr, "application/octet-stream", chunk)
 
-        if err != nil {
-            log.Printf("warning: could not replicate chunk to %s, %v.", destAddr, err)
-            continue
-        }
-        defer resp.Body.Close()
+    if err != nil {
+        atomic.AddInt64(&s.counters.replicationErrors, 1)
+        log.Printf("warning: could not replicate chunk to %s, %v.", destAddr, err)
+        return fmt.Errorf("replicate %s: %v", id, err)
+    }
+    defer resp.Body.Close()
 
-        status := resp.StatusCode
-        if status != http.StatusOK {
-            log.Printf("warning: chunk replica was not accepted by %s, response status code: %d", 
-                        destAddr, status)
-        }
+    status := resp.StatusCode
+    if status != http.StatusOK {
+        atomic.AddInt64(&s.counters.replicationErrors, 1)
+        log.Printf("warning: chunk replica was not accepted by %s, response status code: %d", 
+                    destAddr, status)
+        return fmt.Errorf("replicate %s: not accepted, %d", id, status)
     }
 
-    w.WriteHeader(http.StatusOK)
+    return nil
 }
 
 func (s *FileServer) GenerateProbeInfo() *FSProbeInfo {
@@ -323,8 +367,19 @@ func (s *FileServer) GenerateProbeInfo() *FSProbeInfo {
 }
 
 func (cs *FileServer) ServeClient(w http.ResponseWriter, r *http.Request) {
-    chunkId := strings.TrimPrefix(r.URL.Path, "/chunks/")
     token := r.URL.Query().Get("token")
+
+    if r.URL.Path == "/stream" {
+        if r.Method != http.MethodGet {
+            w.WriteHeader(http.StatusMethodNotAllowed)
+            return
+        }
+
+        cs.StreamChunks(w, r, token)
+        return
+    }
+
+    chunkId := strings.TrimPrefix(r.URL.Path, "/chunks/")
     
     switch r.Method {
     case http.MethodGet:
@@ -344,11 +399,13 @@ func (s *FileServer) SendChunk(w http.ResponseWriter, r *http.Request, id, token
         return
     }
     defer s.fulfillExpectation(token, id)
+    defer s.counters.beginTransfer()()
 
     chunk, closeChunk, err := s.chunks.Get(id)
     defer closeChunk()
 
     if err != nil {
+        atomic.AddInt64(&s.counters.readErrors, 1)
         w.WriteHeader(http.StatusNotFound)
         return
     }
@@ -365,25 +422,130 @@ func (s *FileServer) ReceiveChunk(w http.ResponseWriter, r *http.Request, id, to
         return
     }
     defer s.fulfillExpectation(token, id)
+    defer s.counters.beginTransfer()()
 
     chunk, finishChunk, err := s.chunks.Create(id)
-    defer finishChunk()
 
     if err == ErrChunkExists {
+        finishChunk()
         w.WriteHeader(http.StatusForbidden)
         return
     }
 
     if err != nil {
+        finishChunk()
+        atomic.AddInt64(&s.counters.writeErrors, 1)
         w.WriteHeader(http.StatusInternalServerError)
         log.Printf("internal error: %v", err)
         return
     }
 
-    io.Copy(chunk, r.Body)
+    _, err = io.Copy(chunk, r.Body)
+    finishChunk()
+
+    // A truncated chunk is not kept, so that it is neither confirmed to
+    // the NS nor served as valid data.
+    if err != nil {
+        atomic.AddInt64(&s.counters.writeErrors, 1)
+        log.Printf("warning: chunk %s was not received in full, %v", id, err)
+
+        if err := s.chunks.Remove(id); err != nil {
+            log.Printf("warning: truncated chunk %s is not removed, %v", id, err)
+        }
+
+        w.WriteHeader(http.StatusInternalServerError)
+        return
+    }
 
     s.nsConn.ReceivedChunk(id)
     w.WriteHeader(http.StatusOK)
 
     log.Printf("Chunk WRITE request SUCCESS: id=%s, token=%s", id, token)
 }
+
+// StreamChunks sends the chunks listed in the request body in one response,
+// in the listed order. See FrameChunk for the format. Every chunk must
+// be expected for reading under the token, otherwise nothing is sent.
+func (s *FileServer) StreamChunks(w http.ResponseWriter, r *http.Request, token string) {
+    buf := &bytes.Buffer{}
+    io.Copy(buf, r.Body)
+
+    var chunks []string
+    if err := json.Unmarshal(buf.Bytes(), &chunks); err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, err)
+        return
+    }
+
+    log.Printf("Chunk STREAM request: chunks=%v, token=%s", chunks, token)
+
+    requested := make(map[string]bool, len(chunks))
+    for _, id := range chunks {
+        if requested[id] {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "chunk %s requested twice", id)
+            return
+        }
+        requested[id] = true
+
+        if s.GetTokenExpectationForChunk(token, id) != ExpectActionRead {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+    }
+
+    defer s.counters.beginTransfer()()
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.WriteHeader(http.StatusOK)
+
+    flusher, _ := w.(http.Flusher)
+
+    report := &StreamReport{
+        Delivered: make([]string, 0, len(chunks)),
+    }
+
+    for _, id := range chunks {
+        data, err := s.readChunk(id)
+        if err != nil {
+            atomic.AddInt64(&s.counters.readErrors, 1)
+            report.Error = fmt.Sprintf("chunk %s: %v", id, err)
+            break
+        }
+
+        if err := WriteChunkFrame(w, id, data); err != nil {
+            // The client is gone, nobody will read the report.
+            log.Printf("warning: chunk stream interrupted at %s, delivered %v: %v", id, report.Delivered, err)
+            return
+        }
+
+        s.fulfillExpectation(token, id)
+        report.Delivered = append(report.Delivered, id)
+
+        if flusher != nil {
+            flusher.Flush()
+        }
+    }
+
+    if report.Error != "" {
+        log.Printf("warning: chunk stream stopped, delivered %v: %s", report.Delivered, report.Error)
+    }
+
+    WriteEndFrame(w, report)
+}
+
+func (s *FileServer) readChunk(id string) ([]byte, error) {
+    chunk, closeChunk, err := s.chunks.Get(id)
+    defer closeChunk()
+
+    if err != nil {
+        return nil, err
+    }
+
+    buf := &bytes.Buffer{}
+    if _, err := io.Copy(buf, chunk); err != nil {
+        return nil, err
+    }
+
+    return buf.Bytes(), nil
+}
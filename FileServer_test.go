@@ -1,10 +1,14 @@
 package tsuki_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"reflect"
     "net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -191,6 +195,24 @@ func TestFS_ChunkReceive(t *testing.T) {
         tsuki.AssertReceivedChunkCalls(t, nsConn)
     })
 
+    t.Run("upload chunk 5 cut short",
+    func (t *testing.T) {
+        nsConn.Reset()
+        chunkId := "5"
+        token := chunkId
+        fsd.Expect(token, tsuki.ExpectActionWrite, chunkId)
+
+        body := io.MultiReader(strings.NewReader("the first half"), failingReader{})
+        request, _ := http.NewRequest(http.MethodPost, "/chunks/5?token=5", body)
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusInternalServerError)
+        tsuki.AssertChunkDoesntExists(t, store, chunkId)
+        tsuki.AssertReceivedChunkCalls(t, nsConn)
+    })
+
     t.Run("upload expected, but already present chunk 1",
     func (t *testing.T) {
         nsConn.Reset()
@@ -209,6 +231,13 @@ func TestFS_ChunkReceive(t *testing.T) {
     })
 }
 
+// failingReader fails as a connection that is dropped.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+    return 0, io.ErrUnexpectedEOF
+}
+
 func TestFS_ReceiveExpect(t *testing.T) {
     store := tsuki.NewInMemoryChunkStorage(
         map[string]string {
@@ -570,3 +599,344 @@ func TestFS_ServeNSAccess(t *testing.T) {
         tsuki.AssertStatus(t, response.Code, http.StatusUnauthorized)
     })
 }
+
+func TestFS_StreamChunks(t *testing.T) {
+    store := tsuki.NewInMemoryChunkStorage(
+        map[string]string {
+            "a": "abracadabra",
+            "b": "",
+            "c": "kimimonekodesuka",
+    })
+
+    nsConn := &tsuki.SpyNSConnector{}
+
+    fsd := tsuki.NewFileServer(store, nsConn)
+
+    t.Run("stream all chunks in requested order",
+    func (t *testing.T) {
+        token := "all"
+        fsd.Expect(token, tsuki.ExpectActionRead, "a", "b", "c")
+
+        order := []string{"c", "a", "b"}
+        request := tsuki.NewStreamRequest(token, order...)
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+
+        stream := tsuki.NewChunkStreamReader(response.Body)
+        for _, want := range order {
+            id, chunk, err := stream.Next()
+            if err != nil {
+                t.Fatalf("could not read chunk %s from stream, %v", want, err)
+            }
+
+            if id != want {
+                t.Errorf("got chunk %s, want %s", id, want)
+            }
+
+            got, _ := ioutil.ReadAll(chunk)
+            if string(got) != store.Index[want] {
+                t.Errorf("got chunk %s contents %q, want %q", id, got, store.Index[want])
+            }
+        }
+
+        if _, _, err := stream.Next(); err != io.EOF {
+            t.Fatalf("expected end of stream, got %v", err)
+        }
+
+        report := stream.Report()
+        if report.Error != "" || !reflect.DeepEqual(report.Delivered, order) {
+            t.Errorf("got report %#v, want all of %v delivered", report, order)
+        }
+
+        for _, id := range order {
+            if got := fsd.GetTokenExpectationForChunk(token, id); got != tsuki.ExpectActionNothing {
+                t.Errorf("chunk %s is still expected after being streamed", id)
+            }
+        }
+    })
+
+    t.Run("reject stream with unexpected chunk",
+    func (t *testing.T) {
+        token := "partial"
+        fsd.Expect(token, tsuki.ExpectActionRead, "a")
+
+        request := tsuki.NewStreamRequest(token, "a", "c")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusUnauthorized)
+
+        if got := fsd.GetTokenExpectationForChunk(token, "a"); got != tsuki.ExpectActionRead {
+            t.Errorf("rejected stream fulfilled expectation for chunk a")
+        }
+    })
+
+    t.Run("report delivered chunks when stream fails midway",
+    func (t *testing.T) {
+        token := "broken"
+        fsd.Expect(token, tsuki.ExpectActionRead, "a", "c")
+
+        store.Remove("c")
+
+        request := tsuki.NewStreamRequest(token, "a", "c")
+        response := httptest.NewRecorder()
+
+        fsd.ServeClient(response, request)
+
+        tsuki.AssertStatus(t, response.Code, http.StatusOK)
+
+        stream := tsuki.NewChunkStreamReader(response.Body)
+        for {
+            _, _, err := stream.Next()
+            if err == io.EOF {
+                break
+            }
+
+            if err != nil {
+                t.Fatalf("could not read stream, %v", err)
+            }
+        }
+
+        report := stream.Report()
+        if report.Error == "" {
+            t.Errorf("expected stream to report an error")
+        }
+
+        if !reflect.DeepEqual(report.Delivered, []string{"a"}) {
+            t.Errorf("got delivered chunks %v, want %v", report.Delivered, []string{"a"})
+        }
+
+        if got := fsd.GetTokenExpectationForChunk(token, "c"); got != tsuki.ExpectActionRead {
+            t.Errorf("undelivered chunk c is not expected anymore")
+        }
+    })
+}
+
+func TestChunkStreamReader_Truncated(t *testing.T) {
+    buf := &bytes.Buffer{}
+    tsuki.WriteChunkFrame(buf, "a", []byte("abracadabra"))
+
+    truncated := bytes.NewReader(buf.Bytes()[:buf.Len() - 3])
+    stream := tsuki.NewChunkStreamReader(truncated)
+
+    _, chunk, err := stream.Next()
+    if err != nil {
+        t.Fatalf("could not read chunk header, %v", err)
+    }
+
+    if _, err := ioutil.ReadAll(chunk); err != tsuki.ErrStreamTruncated {
+        t.Errorf("got error %v reading truncated chunk, want %v", err, tsuki.ErrStreamTruncated)
+    }
+
+    if _, _, err := stream.Next(); err != tsuki.ErrStreamTruncated {
+        t.Errorf("got error %v after truncated chunk, want %v", err, tsuki.ErrStreamTruncated)
+    }
+}
+
+func TestFS_Status(t *testing.T) {
+    store := tsuki.NewInMemoryChunkStorage(
+        map[string]string {
+            "0": "chunk0",
+    })
+
+    spyConn := &tsuki.SpyNSConnector{}
+    fsd := tsuki.NewFileServer(store, spyConn)
+    spyConn.Reporter = fsd
+
+    heart := &tsuki.Heart{
+        Poller: spyConn,
+        Sleeper: &tsuki.SpySleeper{},
+    }
+
+    request := tsuki.NewProbeRequest("addr1")
+    response := httptest.NewRecorder()
+    fsd.ServeNS(response, request)
+
+    // One chunk written, one failed read
+    fsd.Expect("write", tsuki.ExpectActionWrite, "1")
+    request = tsuki.NewPostChunkRequest("1", "chunk1", "write")
+    response = httptest.NewRecorder()
+    fsd.ServeClient(response, request)
+
+    fsd.Expect("read", tsuki.ExpectActionRead, "0")
+    store.Remove("0")
+    request = tsuki.NewGetChunkRequest("0", "read")
+    response = httptest.NewRecorder()
+    fsd.ServeClient(response, request)
+
+    heart.Contract()
+    heart.Contract()
+
+    if len(spyConn.Statuses) != 2 {
+        t.Fatalf("got %d heartbeats with status, want %d", len(spyConn.Statuses), 2)
+    }
+
+    first := spyConn.Statuses[0]
+    want := &tsuki.NodeStatus{
+        Available: store.BytesAvailable(),
+        ChunkCount: 1,
+        ReadErrors: 1,
+    }
+
+    if !reflect.DeepEqual(first, want) {
+        t.Errorf("got status %#v, want %#v", first, want)
+    }
+
+    // Errors are only reported once
+    if second := spyConn.Statuses[1]; second.ReadErrors != 0 {
+        t.Errorf("got %d read errors in the second heartbeat, want 0", second.ReadErrors)
+    }
+}
+
+func TestCommandInbox(t *testing.T) {
+    executor := &tsuki.SpyCommandExecutor{}
+    inbox := tsuki.NewCommandInbox(executor)
+
+    cmds := []*tsuki.Command{
+        {ID: 1, Kind: tsuki.CommandPurge},
+        {ID: 2, Kind: "fail"},
+    }
+
+    inbox.Dispatch(cmds)
+    inbox.Wait()
+
+    // The NS repeats commands until they are acknowledged
+    inbox.Dispatch(cmds)
+    inbox.Wait()
+
+    if len(executor.Executed) != 2 {
+        t.Fatalf("got %d commands executed, want %d", len(executor.Executed), 2)
+    }
+
+    acks := map[uint64]tsuki.CommandAck{}
+    for _, ack := range inbox.Acks() {
+        acks[ack.ID] = ack
+    }
+
+    if len(acks) != 2 || acks[1].Error != "" || acks[2].Error == "" {
+        t.Errorf("got acks %#v, want success for 1 and failure for 2", acks)
+    }
+
+    inbox.Acknowledged(inbox.Acks())
+
+    if got := inbox.Acks(); len(got) != 0 {
+        t.Errorf("got acks %#v after they were acknowledged, want none", got)
+    }
+}
+
+func TestFS_HeartbeatCommands(t *testing.T) {
+    store := tsuki.NewInMemoryChunkStorage(
+        map[string]string {
+            "0": "chunk0",
+            "1": "chunk1",
+    })
+
+    spyConn := &tsuki.SpyNSConnector{Addr: "ns"}
+    fsd := tsuki.NewFileServer(store, spyConn)
+    spyConn.Inbox = tsuki.NewCommandInbox(fsd)
+
+    heart := &tsuki.Heart{
+        Poller: spyConn,
+        Sleeper: &tsuki.SpySleeper{},
+    }
+
+    spyConn.Commands = []*tsuki.Command{
+        {ID: 1, Kind: tsuki.CommandPurge, Chunks: []string{"0"}},
+        {ID: 2, Kind: tsuki.CommandExpect, Action: "write", Token: "new", Chunks: []string{"2"}},
+    }
+
+    heart.Contract()
+    spyConn.Inbox.Wait()
+
+    time.Sleep(5 * time.Millisecond)
+
+    tsuki.AssertChunkDoesntExists(t, store, "0")
+
+    request := tsuki.NewPostChunkRequest("2", "chunk2", "new")
+    response := httptest.NewRecorder()
+    fsd.ServeClient(response, request)
+
+    tsuki.AssertStatus(t, response.Code, http.StatusOK)
+
+    spyConn.Commands = []*tsuki.Command{
+        {ID: 3, Kind: tsuki.CommandExpect, Action: "write", Token: "cancelled", Chunks: []string{"3"}},
+    }
+
+    heart.Contract()
+    spyConn.Inbox.Wait()
+
+    spyConn.Commands = []*tsuki.Command{
+        {ID: 4, Kind: tsuki.CommandCancelToken, Token: "cancelled"},
+    }
+
+    heart.Contract()
+    spyConn.Inbox.Wait()
+    heart.Contract()
+
+    request = tsuki.NewPostChunkRequest("3", "chunk3", "cancelled")
+    response = httptest.NewRecorder()
+    fsd.ServeClient(response, request)
+
+    tsuki.AssertStatus(t, response.Code, http.StatusUnauthorized)
+
+    acked := map[uint64]bool{}
+    for _, ack := range spyConn.Acks {
+        if ack.Error != "" {
+            t.Errorf("command %d failed, %s", ack.ID, ack.Error)
+        }
+        acked[ack.ID] = true
+    }
+
+    for id := uint64(1); id <= 4; id++ {
+        if !acked[id] {
+            t.Errorf("command %d was not acknowledged", id)
+        }
+    }
+}
+
+func TestFS_Rebuild(t *testing.T) {
+    rs, _ := tsuki.NewReedSolomon(2, 1)
+    shards := rs.Split([]byte("erasure coded chunk"))
+    rs.Encode(shards)
+
+    stripe := []string{"s0", "s1", "s2"}
+
+    sourceStore := tsuki.NewInMemoryChunkStorage(map[string]string{
+        "s0": string(shards[0]),
+        "s2": string(shards[2]),
+    })
+    source := tsuki.NewFileServer(sourceStore, &tsuki.SpyNSConnector{})
+    source.Expect("rebuild", tsuki.ExpectActionRead, "s0", "s2")
+
+    server := httptest.NewServer(http.HandlerFunc(source.ServeClient))
+    defer server.Close()
+    sourceAddr := strings.TrimPrefix(server.URL, "http://")
+
+    store := tsuki.NewInMemoryChunkStorage(map[string]string{})
+    spyConn := &tsuki.SpyNSConnector{}
+    fsd := tsuki.NewFileServer(store, spyConn)
+
+    err := fsd.Execute(&tsuki.Command{
+        Kind: tsuki.CommandRebuild,
+        Token: "rebuild",
+        Chunks: []string{"s1"},
+        Stripe: stripe,
+        Sources: []string{sourceAddr, "", sourceAddr},
+        DataShards: 2,
+        ParityShards: 1,
+    })
+
+    if err != nil {
+        t.Fatalf("could not rebuild shard, %v", err)
+    }
+
+    if got := store.Index["s1"]; got != string(shards[1]) {
+        t.Errorf("got rebuilt shard %q, want %q", got, shards[1])
+    }
+
+    tsuki.AssertReceivedChunkCalls(t, spyConn, "s1")
+}
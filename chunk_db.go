@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -32,6 +33,13 @@ type ChunkDB interface {
     Remove(id string) error
     
     BytesAvailable() int
+    Count() int
+
+    // List returns the IDs of all stored chunks in sorted order.
+    List() []string
+
+    // Health returns an error if the storage can't be relied upon.
+    Health() error
 }
 
 
@@ -121,6 +129,30 @@ func (s *InMemoryChunkStorage) BytesAvailable() int {
     return 1024 * 1024 * 10
 }
 
+func (s *InMemoryChunkStorage) Count() int {
+    s.Mu.RLock()
+    defer s.Mu.RUnlock()
+
+    return len(s.Index)
+}
+
+func (s *InMemoryChunkStorage) List() []string {
+    s.Mu.RLock()
+    defer s.Mu.RUnlock()
+
+    ids := make([]string, 0, len(s.Index))
+    for id := range s.Index {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    return ids
+}
+
+func (s *InMemoryChunkStorage) Health() error {
+    return nil
+}
+
 /*
     Get(id string) (io.Reader, func(), error)
     Create(id string) (io.Writer, func(), error)
@@ -243,6 +275,10 @@ func (s *FileSystemChunkStorage) Remove(id string) error {
         return fmt.Errorf("remove chunk: %v", err)
     }
 
+    s.mu.Lock()
+    delete(s.index, id)
+    s.mu.Unlock()
+
     return nil
 }
 
@@ -253,4 +289,42 @@ func (s *FileSystemChunkStorage) BytesAvailable() int {
     return int(stat.Bavail * uint64(stat.Bsize))
 }
 
+func (s *FileSystemChunkStorage) Count() int {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    return len(s.index)
+}
+
+func (s *FileSystemChunkStorage) List() []string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    ids := make([]string, 0, len(s.index))
+    for id := range s.index {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    return ids
+}
+
+func (s *FileSystemChunkStorage) Health() error {
+    info, err := os.Stat(s.Dir)
+    if err != nil {
+        return fmt.Errorf("storage health: %v", err)
+    }
+
+    if !info.IsDir() {
+        return fmt.Errorf("storage health: %s is not a directory", s.Dir)
+    }
+
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(s.Dir, &stat); err != nil {
+        return fmt.Errorf("storage health: %v", err)
+    }
+
+    return nil
+}
+
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -11,18 +12,26 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
+	"github.com/kureduro/tsuki"
 	"github.com/urfave/cli/v2"
 )
 
 const (
     TempNS = "tsuki.ns"
     TempCwd = "tsuki.cwd"
+    TempEpoch = "tsuki.epoch"
+    TempAuth = "tsuki.auth"
 )
 
 const EnvDebug = "TSUKI_DEBUG"
 
+// EnvAPIKey overrides the API key kept in the config of the CLI.
+const EnvAPIKey = "TSUKI_API_KEY"
+
 const NSCLIENTPORT = ":7070"
 
 const BarTemplate = ` chunk {{ string . "chunkProgress" }}   {{ percent . }} {{ speed . }}`
@@ -41,6 +50,23 @@ type ClientMessage struct {
 	Objects []string       `json:"objects"`
 	Token   string         `json:"token"`
 	Chunks  []ChunkMessage `json:"chunks"`
+	Coding  *CodingMessage `json:"coding"`
+	Size    int64          `json:"size"`
+	Lease   *LeaseMessage  `json:"lease"`
+}
+
+// LeaseMessage is the lease of an uploaded file. It lasts Seconds more
+// unless it is renewed.
+type LeaseMessage struct {
+	ID      string `json:"id"`
+	Seconds int    `json:"seconds"`
+}
+
+// CodingMessage is set for erasure coded files. Chunks are then the shards
+// of consecutive stripes, Data + Parity of them per stripe.
+type CodingMessage struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
 }
 
 func FullOrRelative(filepath, wd string) string {
@@ -60,9 +86,87 @@ func LocalWd() string {
     return wd
 }
 
+// NSClientConnector talks to the nameserver. NSAddr may list several
+// nameservers separated by commas; requests go to the first one that is
+// the primary of the newest epoch seen.
 type NSClientConnector struct {
 	NSAddr string
     chunkSize int
+    epoch int64
+
+    // user and password are sent with every request to the nameserver,
+    // once logged in, unless there is an API key to send instead.
+    user string
+    password string
+    key string
+}
+
+// authorize adds the credentials to the request to the nameserver. They
+// are added again when it is redirected to the leader, since the redirect
+// may go to another host.
+func (conn *NSClientConnector) authorize(req *http.Request) {
+    if conn.key != "" {
+        req.Header.Set("Authorization", "Bearer "+conn.key)
+    } else if conn.user != "" {
+        req.SetBasicAuth(conn.user, conn.password)
+    }
+}
+
+// get sends the request to the primary nameserver. Standbys refuse
+// requests with ServiceUnavailable, and a deposed primary answers with an
+// epoch older than the one seen before, so both are skipped.
+func (conn *NSClientConnector) get(request string) (*http.Response, error) {
+    var lastErr error
+    for _, addr := range strings.Split(conn.NSAddr, ",") {
+        addr = strings.TrimSpace(addr)
+        if !strings.ContainsRune(addr, ':') {
+            addr += NSCLIENTPORT
+        }
+
+        req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", addr, request), nil)
+        if err != nil {
+            return nil, err
+        }
+        conn.authorize(req)
+
+        client := &http.Client{
+            CheckRedirect: func(req *http.Request, via []*http.Request) error {
+                if len(via) >= 10 {
+                    return fmt.Errorf("stopped after 10 redirects")
+                }
+                conn.authorize(req)
+                return nil
+            },
+        }
+
+        resp, err := client.Do(req)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+
+        if resp.StatusCode == http.StatusServiceUnavailable {
+            resp.Body.Close()
+            lastErr = fmt.Errorf("%s is a standby", addr)
+            continue
+        }
+
+        epoch, _ := strconv.ParseInt(resp.Header.Get(tsuki.EpochHeader), 10, 64)
+        if epoch < conn.epoch {
+            resp.Body.Close()
+            lastErr = fmt.Errorf("%s is deposed: its epoch is %d, but %d is seen", addr, epoch, conn.epoch)
+            continue
+        }
+
+        if epoch > conn.epoch {
+            conn.epoch = epoch
+            saveEpoch(epoch)
+        }
+
+        return resp, nil
+    }
+
+    return nil, lastErr
 }
 
 func UnmarshalNSResponse(response *http.Response) (msg *ClientMessage, err error) {
@@ -79,10 +183,13 @@ func UnmarshalNSResponse(response *http.Response) (msg *ClientMessage, err error
 	return
 }
 
-func (conn *NSClientConnector) GetNS(cmd, path string) (*ClientMessage, error) {
-	addr := fmt.Sprintf("http://%s%s/%s?address=%s", conn.NSAddr, NSCLIENTPORT, cmd, path)
+func (conn *NSClientConnector) GetNS(cmd, path string, params ...string) (*ClientMessage, error) {
+	query := fmt.Sprintf("/%s?address=%s", cmd, path)
+	for _, param := range params {
+		query += "&" + param
+	}
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(query)
 	if err != nil {
 		return nil, fmt.Errorf("request: %v", err)
 	}
@@ -100,9 +207,7 @@ func (conn *NSClientConnector) GetNS(cmd, path string) (*ClientMessage, error) {
 }
 
 func (conn *NSClientConnector) GetNSInit() error {
-	addr := fmt.Sprintf("http://%s%s/init", conn.NSAddr, NSCLIENTPORT)
-
-	resp, err := http.Get(addr)
+	resp, err := conn.get("/init")
 	if err != nil {
 		return fmt.Errorf("request: %v", err)
 	}
@@ -118,10 +223,15 @@ func (conn *NSClientConnector) GetNSInit() error {
 
 	return nil
 }
-func (conn *NSClientConnector) GetNSUpload(path string, size int64) (*ClientMessage, error) {
-	addr := fmt.Sprintf("http://%s%s/upload?address=%s&size=%d", conn.NSAddr, NSCLIENTPORT, path, size)
+// GetNSUpload asks where to upload a new file, or the new content of the
+// file if overwrite is set.
+func (conn *NSClientConnector) GetNSUpload(path string, size int64, overwrite bool) (*ClientMessage, error) {
+	cmd := "upload"
+	if overwrite {
+		cmd = "reupload"
+	}
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(fmt.Sprintf("/%s?address=%s&size=%d", cmd, path, size))
 	if err != nil {
         return nil, fmt.Errorf("request: %v", err)
 	}
@@ -138,10 +248,13 @@ func (conn *NSClientConnector) GetNSUpload(path string, size int64) (*ClientMess
 	return msg, nil
 }
 
-func (conn *NSClientConnector) GetNSFromTo(cmd, from, to string) (*ClientMessage, error) {
-	addr := fmt.Sprintf("http://%s%s/%s?from=%s&to=%s", conn.NSAddr, NSCLIENTPORT, cmd, from, to)
+func (conn *NSClientConnector) GetNSFromTo(cmd, from, to string, params ...string) (*ClientMessage, error) {
+	query := fmt.Sprintf("/%s?from=%s&to=%s", cmd, from, to)
+	for _, param := range params {
+		query += "&" + param
+	}
 
-	resp, err := http.Get(addr)
+	resp, err := conn.get(query)
 	if err != nil {
         return nil, fmt.Errorf("request: %v", err)
 	}
@@ -158,10 +271,58 @@ func (conn *NSClientConnector) GetNSFromTo(cmd, from, to string) (*ClientMessage
 	return msg, nil
 }
 
-func (conn *NSClientConnector) GetNSObjectInfo(path string) (string, error) {
-	addr := fmt.Sprintf("http://%s%s/info?address=%s", conn.NSAddr, NSCLIENTPORT, path)
+func (conn *NSClientConnector) RenewLease(path string, lease *LeaseMessage) (*LeaseMessage, error) {
+	resp, err := conn.get(fmt.Sprintf("/renew?address=%s&lease=%s", path, lease.ID))
+	if err != nil {
+		return nil, fmt.Errorf("request: %v", err)
+	}
+
+	msg, err := UnmarshalNSResponse(resp)
+    if err != nil {
+        return nil, fmt.Errorf("request: %v", err)
+    }
+
+	if msg.Status != http.StatusOK {
+		return nil, fmt.Errorf(msg.Message)
+	}
+
+	return msg.Lease, nil
+}
+
+// leaseKeeper renews the lease of the file being uploaded between its
+// chunks, once a third of the lease is over.
+type leaseKeeper struct {
+    conn  *NSClientConnector
+    path  string
+    lease *LeaseMessage
+    due   time.Time
+}
+
+func newLeaseKeeper(conn *NSClientConnector, path string, lease *LeaseMessage) *leaseKeeper {
+    if lease == nil {
+        return nil
+    }
+
+    return &leaseKeeper{conn: conn, path: path, lease: lease, due: time.Now().Add(time.Duration(lease.Seconds) * time.Second / 3)}
+}
+
+func (keeper *leaseKeeper) keep() error {
+    if keeper == nil || time.Now().Before(keeper.due) {
+        return nil
+    }
+
+    lease, err := keeper.conn.RenewLease(keeper.path, keeper.lease)
+    if err != nil {
+        return fmt.Errorf("renew lease: %v", err)
+    }
 
-	resp, err := http.Get(addr)
+    keeper.lease = lease
+    keeper.due = time.Now().Add(time.Duration(lease.Seconds) * time.Second / 3)
+    return nil
+}
+
+func (conn *NSClientConnector) GetNSObjectInfo(path string) (string, error) {
+	resp, err := conn.get(fmt.Sprintf("/info?address=%s", path))
 	if err != nil {
 		return "", fmt.Errorf("request: %v", err)
 	}
@@ -179,9 +340,7 @@ func (conn *NSClientConnector) GetNSObjectInfo(path string) (string, error) {
 }
 
 func (conn *NSClientConnector) GetChunkSize() (int, error) {
-	addr := fmt.Sprintf("http://%s%s/getChunkSize", conn.NSAddr, NSCLIENTPORT)
-
-	resp, err := http.Get(addr)
+	resp, err := conn.get("/getChunkSize")
 	if err != nil {
 		return 0, fmt.Errorf("send chunk size request: %v", err)
 	}
@@ -222,6 +381,37 @@ func (conn *NSClientConnector) Ls(path string) ([]string, error) {
 	return msg.Objects, nil
 }
 
+// Deletions lists the removed directories whose files are still being
+// purged, with the progress of each.
+func (conn *NSClientConnector) Deletions() ([]string, error) {
+	msg, err := conn.GetNS("deletions", "")
+	if err != nil {
+		return nil, fmt.Errorf("deletions: %v", err)
+	}
+
+	return msg.Objects, nil
+}
+
+func (conn *NSClientConnector) Versions(path string) ([]string, error) {
+	msg, err := conn.GetNS("versions", path)
+	if err != nil {
+		return nil, fmt.Errorf("versions: %v", err)
+	}
+
+	return msg.Objects, nil
+}
+
+func (conn *NSClientConnector) Restore(path string, version int) error {
+	msg, err := conn.GetNS("restore", path, fmt.Sprintf("version=%d", version))
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+
+	fmt.Println(msg.Message)
+
+	return nil
+}
+
 func (conn *NSClientConnector) Touch(path string) error {
 	msg, err := conn.GetNS("touch", path)
 	if err != nil {
@@ -266,6 +456,83 @@ func (conn *NSClientConnector) RemoveDir(path string) error {
 	return nil
 }
 
+func (conn *NSClientConnector) Trash() ([]string, error) {
+	msg, err := conn.GetNS("trash", "")
+	if err != nil {
+		return nil, fmt.Errorf("trash: %v", err)
+	}
+
+	return msg.Objects, nil
+}
+
+// Chmod sets the permission bits of the remote object, given in octal.
+func (conn *NSClientConnector) Chmod(remotePath, mode string) error {
+	msg, err := conn.GetNS("chmod", remotePath, "mode="+mode)
+	if err != nil {
+		return fmt.Errorf("chmod: %v", err)
+	}
+
+	fmt.Println(msg.Message)
+
+	return nil
+}
+
+// Chown gives the remote object to the owner and/or the group.
+func (conn *NSClientConnector) Chown(remotePath, owner, group string) error {
+	msg, err := conn.GetNS("chown", remotePath, "owner="+owner, "group="+group)
+	if err != nil {
+		return fmt.Errorf("chown: %v", err)
+	}
+
+	fmt.Println(msg.Message)
+
+	return nil
+}
+
+// Quota lists the usage of the user and of the directories with quotas
+// against their limits.
+func (conn *NSClientConnector) Quota() ([]string, error) {
+	msg, err := conn.GetNS("quota", "")
+	if err != nil {
+		return nil, fmt.Errorf("quota: %v", err)
+	}
+
+	return msg.Objects, nil
+}
+
+func (conn *NSClientConnector) Undelete(id string) error {
+	msg, err := conn.GetNS("undelete", "", "id="+id)
+	if err != nil {
+		return fmt.Errorf("undelete: %v", err)
+	}
+
+	fmt.Println(msg.Message)
+
+	return nil
+}
+
+func (conn *NSClientConnector) Snapshot(spec string) error {
+	msg, err := conn.GetNS("snapshot", spec)
+	if err != nil {
+		return fmt.Errorf("snapshot: %v", err)
+	}
+
+	fmt.Println(msg.Message)
+
+	return nil
+}
+
+func (conn *NSClientConnector) DeleteSnapshot(spec string) error {
+	msg, err := conn.GetNS("rmsnapshot", spec)
+	if err != nil {
+		return fmt.Errorf("snapshot: %v", err)
+	}
+
+	log.Printf("Received message: %#v", msg)
+
+	return nil
+}
+
 func (conn *NSClientConnector) Copy(from, to string) error {
 	msg, err := conn.GetNSFromTo("cp", from, to)
 	if err != nil {
@@ -277,8 +544,10 @@ func (conn *NSClientConnector) Copy(from, to string) error {
 	return nil
 }
 
-func (conn *NSClientConnector) Move(from, to string) error {
-	msg, err := conn.GetNSFromTo("mv", from, to)
+// Move moves the file or the directory. With replace, it takes the place
+// of the file or the empty directory at the destination.
+func (conn *NSClientConnector) Move(from, to string, replace bool) error {
+	msg, err := conn.GetNSFromTo("mv", from, to, fmt.Sprintf("replace=%v", replace))
 	if err != nil {
 		return fmt.Errorf("mv: %v", err)
 	}
@@ -302,7 +571,7 @@ func (conn *NSClientConnector) writeChunkToFS(addr, chunkId, token string, src i
     return nil
 }
 
-func (conn *NSClientConnector) Upload(file io.Reader, destPath string, fileSize int64) error {
+func (conn *NSClientConnector) Upload(file io.Reader, destPath string, fileSize int64, overwrite bool) error {
     var err error
     if conn.chunkSize == 0 {
         conn.chunkSize, err = conn.GetChunkSize()
@@ -311,13 +580,23 @@ func (conn *NSClientConnector) Upload(file io.Reader, destPath string, fileSize
         }
     }
 
-    msg, err := conn.GetNSUpload(destPath, fileSize)
+    msg, err := conn.GetNSUpload(destPath, fileSize, overwrite)
     if err != nil {
         return fmt.Errorf("upload request: %v", err)
     }
 
+    keeper := newLeaseKeeper(conn, destPath, msg.Lease)
+
+    if msg.Coding != nil {
+        return conn.uploadStripes(file, msg, fileSize, keeper)
+    }
+
     uploaded := 0
     for i, meta := range msg.Chunks {
+        if err := keeper.keep(); err != nil {
+            return fmt.Errorf("upload sequence: %v", err)
+        }
+
         width := len(strconv.Itoa(len(msg.Chunks)))
 
         requestSize := conn.chunkSize
@@ -364,7 +643,9 @@ func (conn *NSClientConnector) downloadChunk(addr, chunkId, token string, dest i
     return nil
 }
 
-func (conn *NSClientConnector) Download(srcPath string, file io.Writer) error {
+// Download fetches the file, or its previous version unless version is
+// zero.
+func (conn *NSClientConnector) Download(srcPath string, version int, file io.Writer) error {
     var err error
     if conn.chunkSize == 0 {
         conn.chunkSize, err = conn.GetChunkSize()
@@ -373,11 +654,20 @@ func (conn *NSClientConnector) Download(srcPath string, file io.Writer) error {
         }
     }
 
-    msg, err := conn.GetNS("download", srcPath)
+    var params []string
+    if version != 0 {
+        params = append(params, fmt.Sprintf("version=%d", version))
+    }
+
+    msg, err := conn.GetNS("download", srcPath, params...)
     if err != nil {
         return fmt.Errorf("download, request stage: %v", err)
     }
 
+    if msg.Coding != nil {
+        return conn.downloadStripes(msg, file)
+    }
+
     for i, meta := range msg.Chunks {
         width := len(strconv.Itoa(len(msg.Chunks)))
 
@@ -401,6 +691,109 @@ func (conn *NSClientConnector) Download(srcPath string, file io.Writer) error {
 	return nil
 }
 
+// uploadStripes erasure codes every chunk of the file and uploads its
+// shards.
+func (conn *NSClientConnector) uploadStripes(file io.Reader, msg *ClientMessage, fileSize int64, keeper *leaseKeeper) error {
+    rs, err := tsuki.NewReedSolomon(msg.Coding.Data, msg.Coding.Parity)
+    if err != nil {
+        return fmt.Errorf("upload init: %v", err)
+    }
+
+    stripes := len(msg.Chunks) / rs.Shards()
+    width := len(strconv.Itoa(stripes))
+    uploaded := int64(0)
+
+    for i := 0; i < stripes; i++ {
+        if err := keeper.keep(); err != nil {
+            return fmt.Errorf("upload sequence: %v", err)
+        }
+
+        stripeSize := int64(conn.chunkSize)
+        if fileSize - uploaded < stripeSize {
+            stripeSize = fileSize - uploaded
+        }
+
+        data := make([]byte, stripeSize)
+        if _, err := io.ReadFull(file, data); err != nil {
+            return fmt.Errorf("upload sequence: %v", err)
+        }
+
+        shards := rs.Split(data)
+        if err := rs.Encode(shards); err != nil {
+            return fmt.Errorf("upload sequence: %v", err)
+        }
+
+        bar := pb.ProgressBarTemplate(BarTemplate).Start(len(shards) * len(shards[0]))
+        bar.Set("chunkProgress", fmt.Sprintf("% *d/%d", width, i + 1, stripes))
+
+        for j, meta := range msg.Chunks[i * rs.Shards() : (i + 1) * rs.Shards()] {
+            barReader := bar.NewProxyReader(bytes.NewReader(shards[j]))
+
+            err := conn.writeChunkToFS(meta.StorageIP, meta.ChunkID, msg.Token, barReader)
+            if err != nil {
+                return fmt.Errorf("upload sequence: %v", err)
+            }
+        }
+
+        uploaded += stripeSize
+        bar.Finish()
+    }
+
+    return nil
+}
+
+// downloadStripes fetches enough shards of every stripe to restore it.
+func (conn *NSClientConnector) downloadStripes(msg *ClientMessage, file io.Writer) error {
+    rs, err := tsuki.NewReedSolomon(msg.Coding.Data, msg.Coding.Parity)
+    if err != nil {
+        return fmt.Errorf("download init: %v", err)
+    }
+
+    stripes := len(msg.Chunks) / rs.Shards()
+    width := len(strconv.Itoa(stripes))
+    left := msg.Size
+
+    for i := 0; i < stripes; i++ {
+        stripeSize := int64(conn.chunkSize)
+        if left < stripeSize {
+            stripeSize = left
+        }
+
+        bar := pb.ProgressBarTemplate(BarTemplate).Start(int(stripeSize))
+        bar.Set("chunkProgress", fmt.Sprintf("% *d/%d", width, i + 1, stripes))
+
+        shards := make([][]byte, rs.Shards())
+        fetched := 0
+        for j, meta := range msg.Chunks[i * rs.Shards() : (i + 1) * rs.Shards()] {
+            if meta.StorageIP == "" || fetched == rs.DataShards {
+                continue
+            }
+
+            buf := &bytes.Buffer{}
+            if err := conn.downloadChunk(meta.StorageIP, meta.ChunkID, msg.Token, bar.NewProxyWriter(buf)); err != nil {
+                log.Printf("shard %s is unavailable, %v", meta.ChunkID, err)
+                continue
+            }
+
+            shards[j] = buf.Bytes()
+            fetched++
+        }
+
+        if err := rs.Reconstruct(shards); err != nil {
+            return fmt.Errorf("download sequence: %v", err)
+        }
+
+        if err := rs.Join(file, shards, int(stripeSize)); err != nil {
+            return fmt.Errorf("download sequence: %v", err)
+        }
+
+        left -= stripeSize
+        bar.Finish()
+    }
+
+    return nil
+}
+
 func saveCwd() {
     filename := path.Join(os.TempDir(), TempCwd)
     file, err := os.Create(filename)
@@ -413,6 +806,53 @@ func saveCwd() {
     fmt.Fprint(file, cwd)
 }
 
+func saveEpoch(epoch int64) {
+    filename := path.Join(os.TempDir(), TempEpoch)
+    if err := ioutil.WriteFile(filename, []byte(strconv.FormatInt(epoch, 10)), 0644); err != nil {
+        log.Printf("warning: could not save NS epoch, %v", err)
+    }
+}
+
+// saveAuth remembers the credentials for future calls. Only the current
+// user can read them.
+func saveAuth(user, password string) error {
+    filename := path.Join(os.TempDir(), TempAuth)
+    return ioutil.WriteFile(filename, []byte(user+":"+password), 0600)
+}
+
+// keyFile is where the API key is kept in the config of the CLI.
+func keyFile() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        dir = os.TempDir()
+    }
+
+    return path.Join(dir, "tsuki", "apikey")
+}
+
+// saveKey keeps the API key for future calls. Only the current user can
+// read it.
+func saveKey(key string) error {
+    if err := os.MkdirAll(path.Dir(keyFile()), 0700); err != nil {
+        return err
+    }
+
+    return ioutil.WriteFile(keyFile(), []byte(key), 0600)
+}
+
+func loadKey() string {
+    if key, ok := os.LookupEnv(EnvAPIKey); ok {
+        return key
+    }
+
+    key, err := ioutil.ReadFile(keyFile())
+    if err != nil && !os.IsNotExist(err) {
+        log.Printf("warning: could not read API key, %v", err)
+    }
+
+    return strings.TrimSpace(string(key))
+}
+
 func loadFromTemp(name string) string {
     filename := path.Join(os.TempDir(), name)
     if _, err := os.Stat(filename); os.IsNotExist(err) {
@@ -443,6 +883,11 @@ func main() {
 	conn := &NSClientConnector{
 		NSAddr: ns,
 	}
+    conn.epoch, _ = strconv.ParseInt(loadFromTemp(TempEpoch), 10, 64)
+    if auth := strings.SplitN(loadFromTemp(TempAuth), ":", 2); len(auth) == 2 {
+        conn.user, conn.password = auth[0], auth[1]
+    }
+    conn.key = loadKey()
 
     cwd = loadFromTemp(TempCwd)
     if cwd == "" {
@@ -456,7 +901,7 @@ func main() {
         Commands: []*cli.Command {
             {
                 Name: "connect",
-                Usage: "Probe and remember name server for future calls",
+                Usage: "Probe and remember name server for future calls; a standby may follow the primary after a comma",
                 Action: func(c *cli.Context) error {
                     conn.NSAddr = c.Args().First()
 
@@ -477,6 +922,79 @@ func main() {
                     return nil
                 },
             },
+            {
+                Name: "login",
+                Usage: "Log in to the name server as USER for future calls",
+                Flags: []cli.Flag{
+                    &cli.BoolFlag{
+                        Name: "key",
+                        Aliases: []string{"k"},
+                        Value: false,
+                        Usage: "Log in with an API key instead, kept in the config of the CLI",
+                    },
+                },
+                Action: func(c *cli.Context) error {
+                    if c.Bool("key") {
+                        if c.Args().Len() != 0 {
+                            return fmt.Errorf("error: provide no arguments")
+                        }
+
+                        fmt.Print("API key: ")
+                        key, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+                        conn.key = strings.TrimSpace(key)
+
+                        if err := conn.Cd("/"); err != nil {
+                            return fmt.Errorf("error: %v", err)
+                        }
+
+                        if err := saveKey(conn.key); err != nil {
+                            return fmt.Errorf("error: could not save API key: %v", err)
+                        }
+
+                        return nil
+                    }
+
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide the user name")
+                    }
+
+                    fmt.Print("Password: ")
+                    password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+                    conn.key = ""
+                    conn.user = c.Args().First()
+                    conn.password = strings.TrimRight(password, "\r\n")
+
+                    if err := conn.Cd("/"); err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    if err := saveAuth(conn.user, conn.password); err != nil {
+                        fmt.Printf("warning: could not save credentials: %v\n", err)
+                    }
+
+                    // The key would be sent instead of the password.
+                    if err := os.Remove(keyFile()); err != nil && !os.IsNotExist(err) {
+                        fmt.Printf("warning: could not forget API key: %v\n", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "logout",
+                Usage: "Forget the password and the API key of the last logins",
+                Action: func(c *cli.Context) error {
+                    for _, filename := range []string{path.Join(os.TempDir(), TempAuth), keyFile()} {
+                        err := os.Remove(filename)
+                        if err != nil && !os.IsNotExist(err) {
+                            return fmt.Errorf("error: %v", err)
+                        }
+                    }
+
+                    return nil
+                },
+            },
             {
                 Name: "init",
                 Usage: "Purge all data and initialize storage",
@@ -609,6 +1127,14 @@ func main() {
             {
                 Name: "upload",
                 Usage: "Upload LOCAL file to REMOTE",
+                Flags: []cli.Flag{
+                    &cli.BoolFlag{
+                        Name: "force",
+                        Aliases: []string{"f"},
+                        Value: false,
+                        Usage: "Overwrite destination, if exists",
+                    },
+                },
                 Action: func(c *cli.Context) error {
                     if c.Args().Len() < 1 {
                         return fmt.Errorf("error: provide local (and, optionally, remote) paths to the file")
@@ -632,7 +1158,7 @@ func main() {
                         return fmt.Errorf("upload: %v", err)
                     }
 
-                    err = conn.Upload(file, remotePath, stat.Size())
+                    err = conn.Upload(file, remotePath, stat.Size(), c.Bool("force"))
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -649,6 +1175,11 @@ func main() {
                         Value: false,
                         Usage: "Overwrite destination, if exists",
                     },
+                    &cli.IntFlag{
+                        Name: "version",
+                        Aliases: []string{"v"},
+                        Usage: "Download the previous `VERSION` of the file",
+                    },
                 },
                 Action: func(c *cli.Context) error {
                     if c.Args().Len() < 1 {
@@ -685,7 +1216,7 @@ func main() {
                     }
                     defer file.Close()
 
-                    err = conn.Download(remotePath, file)
+                    err = conn.Download(remotePath, c.Int("version"), file)
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -696,6 +1227,13 @@ func main() {
             {
                 Name: "mv",
                 Usage: "Move REMOTE object to REMOTE",
+                Flags: []cli.Flag{
+                    &cli.BoolFlag{
+                        Name: "f",
+                        Value: false,
+                        Usage: "Replace destination file or empty directory, if exists",
+                    },
+                },
                 Action: func(c *cli.Context) error {
                     if c.Args().Len() != 2 {
                         return fmt.Errorf("error: provide remote paths to the two objects")
@@ -704,7 +1242,7 @@ func main() {
                     srcPath  := FullOrRelative(c.Args().Get(0), cwd)
                     destPath := FullOrRelative(c.Args().Get(1), cwd)
 
-                    err := conn.Move(srcPath, destPath)
+                    err := conn.Move(srcPath, destPath, c.Bool("f"))
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -723,7 +1261,7 @@ func main() {
                     srcPath  := FullOrRelative(c.Args().Get(0), cwd)
                     destPath := FullOrRelative(c.Args().Get(1), cwd)
 
-                    err := conn.Move(srcPath, destPath)
+                    err := conn.Copy(srcPath, destPath)
                     if err != nil {
                         return fmt.Errorf("error: %v", err)
                     }
@@ -764,6 +1302,190 @@ func main() {
                         return fmt.Errorf("error: %v", err)
                     }
 
+                    return nil
+                },
+            },
+            {
+                Name: "chmod",
+                Usage: "Set the permission bits of REMOTE object to octal MODE, such as 750",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 2 {
+                        return fmt.Errorf("error: provide the mode and the remote path")
+                    }
+
+                    remotePath := FullOrRelative(c.Args().Get(1), cwd)
+
+                    err := conn.Chmod(remotePath, c.Args().Get(0))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "chown",
+                Usage: "Give REMOTE object to OWNER[:GROUP], or to :GROUP only",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 2 {
+                        return fmt.Errorf("error: provide the owner and the remote path")
+                    }
+
+                    owner, group := c.Args().Get(0), ""
+                    if colon := strings.IndexByte(owner, ':'); colon >= 0 {
+                        owner, group = owner[:colon], owner[colon+1:]
+                    }
+
+                    remotePath := FullOrRelative(c.Args().Get(1), cwd)
+
+                    err := conn.Chown(remotePath, owner, group)
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "quota",
+                Usage: "Show the usage of space and files against the quotas",
+                Action: func(c *cli.Context) error {
+                    usages, err := conn.Quota()
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, usage := range usages {
+                        fmt.Println(usage)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "trash",
+                Usage: "Show removed files and directories that can be restored",
+                Action: func(c *cli.Context) error {
+                    items, err := conn.Trash()
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, item := range items {
+                        fmt.Println(item)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "undelete",
+                Usage: "Restore item ID of the trash to where it was removed from",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide the ID of the item, as shown by trash")
+                    }
+
+                    err := conn.Undelete(c.Args().Get(0))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "snapshot",
+                Usage: "Manage read-only snapshots of directories, browsed under /.snapshots",
+                Subcommands: []*cli.Command{
+                    {
+                        Name: "create",
+                        Usage: "Take snapshot NAME of REMOTE directory, given as REMOTE@NAME",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 1 {
+                                return fmt.Errorf("error: provide the remote directory and the snapshot name as directory@name")
+                            }
+
+                            err := conn.Snapshot(FullOrRelative(c.Args().Get(0), cwd))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                    {
+                        Name: "delete",
+                        Usage: "Delete snapshot NAME of REMOTE directory, given as REMOTE@NAME",
+                        Action: func(c *cli.Context) error {
+                            if c.Args().Len() != 1 {
+                                return fmt.Errorf("error: provide the remote directory and the snapshot name as directory@name")
+                            }
+
+                            err := conn.DeleteSnapshot(FullOrRelative(c.Args().Get(0), cwd))
+                            if err != nil {
+                                return fmt.Errorf("error: %v", err)
+                            }
+
+                            return nil
+                        },
+                    },
+                },
+            },
+            {
+                Name: "deletions",
+                Usage: "Show removed directories whose files are still being purged",
+                Action: func(c *cli.Context) error {
+                    deletions, err := conn.Deletions()
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, deletion := range deletions {
+                        fmt.Println(deletion)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "versions",
+                Usage: "List the versions of REMOTE file, newest first",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 1 {
+                        return fmt.Errorf("error: provide the remote path to the file")
+                    }
+
+                    versions, err := conn.Versions(FullOrRelative(c.Args().Get(0), cwd))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    for _, version := range versions {
+                        fmt.Println(version)
+                    }
+
+                    return nil
+                },
+            },
+            {
+                Name: "restore",
+                Usage: "Make VERSION of REMOTE file current again",
+                Action: func(c *cli.Context) error {
+                    if c.Args().Len() != 2 {
+                        return fmt.Errorf("error: provide the remote path to the file and the version to restore")
+                    }
+
+                    version, err := strconv.Atoi(c.Args().Get(1))
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
+                    err = conn.Restore(FullOrRelative(c.Args().Get(0), cwd), version)
+                    if err != nil {
+                        return fmt.Errorf("error: %v", err)
+                    }
+
                     return nil
                 },
             },
@@ -2,11 +2,12 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"io/ioutil"
     "os"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,26 +16,34 @@ import (
 
 var port int
 var ns, dbDir string
+var nsAddrs []string
+var publicHost, privateHost, joinSecret, idFile, outboxFile string
 
 func init() {
     flag.IntVar(&port, "port", 7000, "port for clients")
-    flag.StringVar(&ns, "ns", "", "address of the name server")
+    flag.StringVar(&ns, "ns", "", "comma-separated addresses of the name servers, in order of preference; the fileserver will register itself there")
     flag.StringVar(&dbDir, "db", "chunks", "directory where chunks will be stored, erased on startup")
+    flag.StringVar(&publicHost, "public-host", "", "host clients should use to reach this fileserver, defaults to the private one")
+    flag.StringVar(&privateHost, "private-host", "", "host the name server should use to reach this fileserver, defaults to the address registration comes from")
+    flag.StringVar(&joinSecret, "secret", "", "join secret required by the name server")
+    flag.StringVar(&idFile, "id", ".tsukiid", "file where the persistent node ID is kept")
+    flag.StringVar(&outboxFile, "outbox", ".tsukioutbox", "journal of chunk confirmations not yet received by the name server")
 }
 
 func main() {
 
     flag.Parse()
 
+    nsAddrs = strings.Split(ns, ",")
+
     if _, err := os.Stat(".tsukifs"); err == nil {
-        save, err := os.Open(".tsukifs")
+        save, err := ioutil.ReadFile(".tsukifs")
         if err != nil {
             log.Fatal(err)
         }
-        defer save.Close()
 
-        fmt.Fscanf(save, "%s", &ns)
-        log.Printf("Found .tsukifs: NS=%s", ns)
+        nsAddrs = strings.Fields(string(save))
+        log.Printf("Found .tsukifs: NS=%v", nsAddrs)
     }
 
     addrForClients := ":" + strconv.Itoa(port)
@@ -47,13 +56,48 @@ func main() {
         log.Fatal(err)
     }
 
-    nsConn := &tsuki.HTTPNSConnector{}
-    nsConn.SetNSAddr(ns)
+    nsConn := &tsuki.HTTPNSConnector{PrivatePort: port + 1}
+    nsConn.SetNSAddrs(nsAddrs)
 
-    heart := tsuki.NewHeart(nsConn, 3 * time.Second)
-    go heart.Poll(-1)
+    outbox, err := tsuki.OpenConfirmationOutbox(outboxFile, nsConn.ConfirmChunks)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Chunks that didn't survive the restart must not be confirmed.
+    if err := outbox.Retain(store.Exists); err != nil {
+        log.Fatal(err)
+    }
+
+    nsConn.Outbox = outbox
+    go outbox.Run()
+
+    if len(nsConn.GetNSAddrs()) != 0 {
+        nodeID, err := tsuki.LoadNodeID(idFile)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        log.Printf("registering at NS=%v as node %s", nsConn.GetNSAddrs(), nodeID)
+
+        nsConn.Registration = &tsuki.Registration{
+            NodeID: nodeID,
+            PrivateHost: privateHost,
+            PublicHost: publicHost,
+            PrivatePort: port + 1,
+            PublicPort: port,
+            Available: store.BytesAvailable(),
+            Secret: joinSecret,
+        }
+    }
 
     server := tsuki.NewFileServer(store, nsConn)
+    nsConn.Reporter = server
+    nsConn.Inventory = server
+    nsConn.Inbox = tsuki.NewCommandInbox(server)
+
+    heart := tsuki.NewHeart(nsConn, 3 * time.Second)
+    go heart.Poll(-1)
 
     var wg sync.WaitGroup
     wg.Add(2)
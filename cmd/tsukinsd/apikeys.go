@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scopes of API keys. A key is allowed the operations of its scopes, and
+// admin allows everything.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// APIKey lets a client in by bearer token, "name.secret". The secret is
+// kept hashed, as hashSecret gives it. The client acts
+// as User, or as root if it is not set, within the scopes of the key.
+type APIKey struct {
+	Name   string
+	Key    string
+	Scopes []string
+	User   string
+}
+
+// NewAPIKey makes a key with a random secret. It returns the token given
+// to the client and the hashed key that goes to the config.
+func NewAPIKey(name string) (string, string) {
+	secret := make([]byte, 24)
+	rand.Read(secret)
+
+	token := hex.EncodeToString(secret)
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	return name + "." + token, hashSecret(hex.EncodeToString(salt), token)
+}
+
+// hashSecret salts and hashes the secret of a key as "sha256:salt:hash".
+// Unlike passwords, secrets are random and long, so a fast hash is enough
+// for the check that comes with every request.
+func hashSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return "sha256:" + salt + ":" + hex.EncodeToString(sum[:])
+}
+
+// checkSecret tells whether the secret is the one hashed.
+func checkSecret(hashed, secret string) bool {
+	parts := strings.Split(hashed, ":")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashSecret(parts[1], secret)), []byte(hashed)) == 1
+}
+
+// ValidateAPIKeys checks the API keys of the config against the users.
+func (n *Namenode) ValidateAPIKeys(users map[string]*User) error {
+	names := map[string]bool{}
+	for _, key := range n.APIKeys {
+		if key.Name == "" || strings.Contains(key.Name, ".") {
+			return fmt.Errorf("API key %q needs a name without dots", key.Name)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("API key %s is listed twice", key.Name)
+		}
+		names[key.Name] = true
+
+		if len(strings.Split(key.Key, ":")) != 3 {
+			return fmt.Errorf("API key %s is not hashed", key.Name)
+		}
+
+		for _, scope := range key.Scopes {
+			if scope != ScopeRead && scope != ScopeWrite && scope != ScopeAdmin {
+				return fmt.Errorf("API key %s has unknown scope %q", key.Name, scope)
+			}
+		}
+
+		if _, ok := users[key.User]; key.User != "" && users != nil && !ok {
+			return fmt.Errorf("API key %s is of unknown user %s", key.Name, key.User)
+		}
+	}
+
+	return nil
+}
+
+// authenticationEnabled tells whether requests need credentials at all.
+func authenticationEnabled() bool {
+	return users != nil || len(conf.Namenode.APIKeys) != 0
+}
+
+// keyUser returns the user a bearer token acts as, limited to the scopes
+// of its key, or nil if the token is wrong.
+func keyUser(token string) *User {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return nil
+	}
+
+	for _, key := range conf.Namenode.APIKeys {
+		if key.Name != token[:dot] {
+			continue
+		}
+
+		if !checkSecret(key.Key, token[dot+1:]) {
+			return nil
+		}
+
+		user := &User{Name: Superuser, Scopes: append([]string{}, key.Scopes...)}
+		if key.User != "" {
+			user.Name = key.User
+		}
+		if known, ok := users[user.Name]; ok {
+			user.Groups = known.Groups
+		}
+
+		return user
+	}
+
+	return nil
+}
+
+// HasScope tells whether the user may make requests of the scope. Users
+// logged in with a password have the read and write scopes, and root has
+// the admin one as well.
+func (user *User) HasScope(scope string) bool {
+	if user.Scopes == nil {
+		return scope != ScopeAdmin || user.IsSuperuser()
+	}
+
+	for _, s := range user.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scoped refuses the request unless it is made with the scope.
+func scoped(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requestUser(r).HasScope(scope) {
+			forbid(w, fmt.Sprintf("the %s scope is needed", scope))
+			return
+		}
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAPIKeys(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	defer wal.Close()
+
+	tokens := map[string]string{}
+	for name, scopes := range map[string][]string{
+		"reader": {ScopeRead},
+		"writer": {ScopeRead, ScopeWrite},
+		"ops":    {ScopeAdmin},
+	} {
+		token, hashed := NewAPIKey(name)
+		tokens[name] = token
+		conf.Namenode.APIKeys = append(conf.Namenode.APIKeys, &APIKey{Name: name, Key: hashed, Scopes: scopes})
+	}
+
+	if err := conf.Namenode.ValidateAPIKeys(nil); err != nil {
+		test.Fatal(err)
+	}
+
+	cases := []struct {
+		router *mux.Router
+		token  string
+		query  string
+		code   int
+	}{
+		{publicRouter(), "", "/ls?address=/", http.StatusUnauthorized},
+		{publicRouter(), "reader." + strings.Repeat("0", 48), "/ls?address=/", http.StatusUnauthorized},
+		{publicRouter(), tokens["reader"], "/ls?address=/", http.StatusOK},
+		{publicRouter(), tokens["reader"], "/mkdir?address=/docs", http.StatusForbidden},
+		{publicRouter(), tokens["writer"], "/mkdir?address=/docs", http.StatusOK},
+		{publicRouter(), tokens["writer"], "/init", http.StatusForbidden},
+		{privateRouter(), "", "/pool", http.StatusUnauthorized},
+		{privateRouter(), tokens["writer"], "/pool", http.StatusForbidden},
+		{privateRouter(), tokens["ops"], "/pool", http.StatusOK},
+		{privateRouter(), "", "/leader", http.StatusOK},
+		{publicRouter(), tokens["ops"], "/ls?address=/docs", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", c.query, nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		c.router.ServeHTTP(w, r)
+		if w.Code != c.code {
+			test.Errorf("%s with %q: got %d, want %d, %s", c.query, c.token, w.Code, c.code, w.Body)
+		}
+	}
+
+	conf.Namenode.APIKeys = append(conf.Namenode.APIKeys, &APIKey{Name: "bad", Key: "plain", Scopes: []string{"all"}})
+	if err := conf.Namenode.ValidateAPIKeys(nil); err == nil {
+		test.Errorf("unhashed key with unknown scope is accepted")
+	}
+}
+
+func TestPeerEndpoints(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	defer wal.Close()
+
+	defer func(saved time.Duration) { ShipWait = saved }(ShipWait)
+	ShipWait = 10 * time.Millisecond
+
+	// Raft requests are refused or taken in before they reach the
+	// cluster.
+	defer func() { cluster = nil }()
+	cluster = &Raft{}
+
+	writer, hashed := NewAPIKey("writer")
+	conf.Namenode.APIKeys = append(conf.Namenode.APIKeys, &APIKey{Name: "writer", Key: hashed, Scopes: []string{ScopeWrite}})
+	ops, hashed := NewAPIKey("ops")
+	conf.Namenode.APIKeys = append(conf.Namenode.APIKeys, &APIKey{Name: "ops", Key: hashed, Scopes: []string{ScopeAdmin}})
+	conf.Namenode.ClusterSecret = "s3cr3t"
+	conf.Namenode.JoinAllowlist = []string{"127.0.0.1"}
+
+	register := `{"nodeID":"fs","privatePort":1}`
+	cases := []struct {
+		method, query, body string
+		header, value       string
+		code                int
+	}{
+		{"GET", "/journal?after=0", "", "", "", http.StatusUnauthorized},
+		{"GET", "/journal?after=0", "", SecretHeader, "guess", http.StatusUnauthorized},
+		{"GET", "/journal?after=0", "", "Authorization", "Bearer " + writer, http.StatusForbidden},
+		{"GET", "/journal?after=0", "", "Authorization", "Bearer " + ops, http.StatusOK},
+		{"GET", "/journal?after=0", "", SecretHeader, "s3cr3t", http.StatusOK},
+		{"GET", "/journal/snapshot", "", "", "", http.StatusUnauthorized},
+		{"GET", "/journal/snapshot", "", SecretHeader, "s3cr3t", http.StatusOK},
+		{"POST", "/raft/install", "{", "", "", http.StatusUnauthorized},
+		{"POST", "/raft/vote", "{", "Authorization", "Bearer " + writer, http.StatusForbidden},
+		{"POST", "/raft/vote", "{", SecretHeader, "s3cr3t", http.StatusBadRequest},
+
+		// An allowed host without a join secret needs the admin scope.
+		// The fileserver then cannot be probed.
+		{"POST", "/register", register, "", "", http.StatusForbidden},
+		{"POST", "/register", register, SecretHeader, "s3cr3t", http.StatusForbidden},
+		{"POST", "/register", register, "Authorization", "Bearer " + ops, http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, c.query, strings.NewReader(c.body))
+		r.RemoteAddr = "127.0.0.1:1234"
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+
+		privateRouter().ServeHTTP(w, r)
+		if w.Code != c.code {
+			test.Errorf("%s %s with %s %q: got %d, want %d, %s", c.method, c.query, c.header, c.value, w.Code, c.code, w.Body)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"encoding/gob"
 	"fmt"
-	"os"
+	"net"
+	"strconv"
 	"sync"
 )
 
@@ -16,7 +16,9 @@ const (
 
 type Chunk struct {
 	ChunkID string
-	File    string
+
+	// File is the inode number of the file the chunk was uploaded for.
+	File int64
 	//FServers         []*FileServerInfo
 	FServers      map[string]*FileServerInfo
 	Status        int
@@ -24,42 +26,93 @@ type Chunk struct {
 	ReadyReplicas int
 	AllReplicas   int
 	ssmu          sync.Mutex
+
+	// Refs is the number of files that refer to the chunk. Its replicas
+	// are purged only when it drops to zero.
+	Refs int
+
+	// Stripe lists the shards of the stripe this chunk is a shard of, if
+	// the file is erasure coded.
+	Stripe []string
+	Coding *Coding
 }
 
 type ChunkTable struct {
 	ivmu          sync.Mutex
 	Table         map[string]*Chunk
-	InvertedTable map[string][]*Chunk // node hostname -> []*Chunk
+	InvertedTable map[string][]*Chunk // node private address -> []*Chunk
 }
 
-func (ct *ChunkTable) AddChunk(chunkID string, file string, initNode *FileServerInfo) (*Chunk, bool) {
+func (ct *ChunkTable) AddChunk(chunkID string, file int64, initNode *FileServerInfo) (*Chunk, bool) {
 	chunk := Chunk{
 		ChunkID:     chunkID,
 		File:        file,
-		FServers:    map[string]*FileServerInfo{initNode.PrivateHost: initNode},
+		FServers:    map[string]*FileServerInfo{initNode.Addr(): initNode},
 		Status:      PENDING,
-		Statuses:    map[string]int{initNode.PrivateHost: PENDING},
+		Statuses:    map[string]int{initNode.Addr(): PENDING},
 		AllReplicas: 1,
+		Refs:        1,
 	}
 
 	ct.Table[chunkID] = &chunk
+	chunk.Commit()
 
 	return &chunk, true
 }
 
 func (c *Chunk) AddFSToChunk(fs *FileServerInfo) {
-	c.FServers[fs.PrivateHost] = fs
-	c.Statuses[fs.PrivateHost] = PENDING
+	c.FServers[fs.Addr()] = fs
+	c.Statuses[fs.Addr()] = PENDING
 	c.AllReplicas += 1
+	c.Commit()
+}
+
+// RemoveFSFromChunk forgets the replica of the chunk at fs.
+func (c *Chunk) RemoveFSFromChunk(fs *FileServerInfo) {
+	status, ok := c.Statuses[fs.Addr()]
+	if !ok {
+		return
+	}
+
+	if status == OK {
+		c.ReadyReplicas -= 1
+	}
+	delete(c.FServers, fs.Addr())
+	delete(c.Statuses, fs.Addr())
+	c.AllReplicas -= 1
+	c.Commit()
+}
+
+// Retain counts one more file that refers to the chunks.
+func (ct *ChunkTable) Retain(chunks []string) {
+	for _, chunkName := range chunks {
+		if chunk, ok := ct.Table[chunkName]; ok {
+			chunk.Refs += 1
+			chunk.Commit()
+		}
+	}
 }
 
-func (ct *ChunkTable) SaveChunkTable(saveTo string) bool {
-	file, _ := os.Create(saveTo)
-	defer file.Close()
-	encoder := gob.NewEncoder(file)
+// Release counts one file less that refers to the chunks, and purges
+// those that no file refers to anymore.
+func (ct *ChunkTable) Release(chunks []string) {
+	var unused []string
+	for _, chunkName := range chunks {
+		chunk, ok := ct.Table[chunkName]
+		if !ok {
+			continue
+		}
+
+		chunk.Refs -= 1
+		if chunk.Refs > 0 {
+			chunk.Commit()
+			continue
+		}
 
-	encoder.Encode(ct)
-	return true
+		unused = append(unused, chunkName)
+	}
+
+	ct.PurgeChunks(unused)
 }
 
 func (ct *ChunkTable) PurgeChunks(chunks []string) {
@@ -67,12 +120,13 @@ func (ct *ChunkTable) PurgeChunks(chunks []string) {
 	for _, chunkName := range chunks {
 		chunk := ct.Table[chunkName]
 
-		chunk.Status = OBSOLETE
+		chunk.SetStatus(OBSOLETE)
 		for _, fs := range chunk.FServers {
-			if fs.GetStatus() == LIVE {
-				// todo: add to queue if not alive
-				cock[fs.ID] = append(cock[fs.ID], chunk.ChunkID)
+			// The inventory purges them once the fileserver registers.
+			if fs.ID == unregistered {
+				continue
 			}
+			cock[fs.ID] = append(cock[fs.ID], chunk.ChunkID)
 		}
 	}
 
@@ -81,16 +135,92 @@ func (ct *ChunkTable) PurgeChunks(chunks []string) {
 	}
 }
 
-func LoadChunkTable(openFrom string) *ChunkTable {
-	file, _ := os.Open(openFrom)
-	defer file.Close()
+// Relink points the chunks to the fileservers of the pool and rebuilds the
+// inverted table. Fileservers unknown to the pool get placeholders until
+// they register. Replicas recorded by bare host, before fileservers were
+// told apart by port, go to the fileserver on that host.
+func (ct *ChunkTable) Relink(pool *PoolInfo) {
+	byAddr := map[string]*FileServerInfo{}
+	for _, fs := range pool.StorageNodes {
+		byAddr[fs.Addr()] = fs
+		if _, ok := byAddr[fs.PrivateHost]; !ok {
+			byAddr[fs.PrivateHost] = fs
+		}
+	}
+
+	inverted := map[string][]*Chunk{}
+	for _, chunk := range ct.Table {
+		fservers := make(map[string]*FileServerInfo, len(chunk.Statuses))
+		statuses := make(map[string]int, len(chunk.Statuses))
+		for addr, status := range chunk.Statuses {
+			fs, ok := byAddr[addr]
+			if !ok {
+				fs = placeholder(addr)
+				byAddr[addr] = fs
+			}
+
+			fservers[fs.Addr()] = fs
+			statuses[fs.Addr()] = status
+			inverted[fs.Addr()] = append(inverted[fs.Addr()], chunk)
+		}
+		chunk.FServers = fservers
+		chunk.Statuses = statuses
+	}
+
+	ct.ivmu.Lock()
+	ct.InvertedTable = inverted
+	ct.ivmu.Unlock()
+}
+
+// unregistered is the ID of placeholders, which are not in the pool.
+const unregistered = -1
+
+// placeholder stands for the fileserver at the address until it registers.
+func placeholder(addr string) *FileServerInfo {
+	fs := &FileServerInfo{PrivateHost: addr, ID: unregistered}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		fs.PrivateHost = host
+		fs.Port, _ = strconv.Atoi(port)
+	}
+
+	return fs
+}
+
+// Adopt points the replicas at the address of the fileserver to it, in
+// place of the placeholder or the fileserver they had.
+func (ct *ChunkTable) Adopt(fs *FileServerInfo) {
+	ct.ivmu.Lock()
+	chunks := ct.InvertedTable[fs.Addr()]
+	ct.ivmu.Unlock()
 
-	decoder := gob.NewDecoder(file)
+	for _, chunk := range chunks {
+		if _, ok := chunk.Statuses[fs.Addr()]; ok {
+			chunk.FServers[fs.Addr()] = fs
+		}
+	}
+}
 
-	var chunkTable ChunkTable
-	decoder.Decode(&chunkTable)
+// Readdress moves the replicas kept at the previous address of the
+// fileserver to its current one, after it registered at another port.
+func (ct *ChunkTable) Readdress(previous string, fs *FileServerInfo) {
+	ct.ivmu.Lock()
+	chunks := ct.InvertedTable[previous]
+	delete(ct.InvertedTable, previous)
+	ct.InvertedTable[fs.Addr()] = append(ct.InvertedTable[fs.Addr()], chunks...)
+	ct.ivmu.Unlock()
+
+	for _, chunk := range chunks {
+		status, ok := chunk.Statuses[previous]
+		if !ok {
+			continue
+		}
 
-	return &chunkTable
+		delete(chunk.FServers, previous)
+		delete(chunk.Statuses, previous)
+		chunk.FServers[fs.Addr()] = fs
+		chunk.Statuses[fs.Addr()] = status
+		chunk.Commit()
+	}
 }
 
 func (ct *ChunkTable) String() string {
@@ -98,11 +228,13 @@ func (ct *ChunkTable) String() string {
 }
 
 func (c *Chunk) String() string {
-	return fmt.Sprintf("Chunk{ChunkID: %s, File: %s, FServers: %v, Status: %d}", c.ChunkID, c.File, c.FServers, c.Status)
+	return fmt.Sprintf("Chunk{ChunkID: %s, File: %d, FServers: %v, Status: %d}", c.ChunkID, c.File, c.FServers, c.Status)
 }
 
 func (c *Chunk) SetStatus(status int) {
 	c.ssmu.Lock()
-	defer c.ssmu.Unlock()
 	c.Status = status
+	c.ssmu.Unlock()
+
+	c.Commit()
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// In a cluster, the journal of the leader goes to the Raft log instead of
+// the journal file, and its batches are answered only once a majority of
+// the nameservers has them. The other nameservers apply the committed
+// batches and redirect clients to the leader. The Raft term is the epoch.
+var cluster *Raft
+
+// clusterIndex is the last Raft entry the state reflects, and
+// clusterVersion is the last journal version of it. Both only grow,
+// except when the state is replaced.
+var clusterIndex int64
+var clusterVersion int64
+
+func storeMax(addr *int64, value int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if value <= old || atomic.CompareAndSwapInt64(addr, old, value) {
+			return
+		}
+	}
+}
+
+// startCluster joins the Raft cluster. The state must be recovered
+// already.
+func startCluster() error {
+	timeout := conf.Namenode.ElectionTimeout * time.Millisecond
+	if timeout == 0 {
+		timeout = time.Second
+	}
+
+	atomic.StoreInt64(&clusterVersion, wal.Version)
+
+	var err error
+	cluster, err = OpenRaft(RaftConfig{
+		ID:              fmt.Sprintf("%s:%d", conf.Namenode.Host, conf.Namenode.PrivatePort),
+		Dir:             conf.Namenode.SnapshotDir,
+		Members:         conf.Namenode.Cluster,
+		Transport:       newHTTPTransport(timeout),
+		ElectionTimeout: timeout,
+		Apply:           applyCommitted,
+		Install:         installSnapshot,
+		Snapshot:        latestSnapshot,
+		OnRole:          onRole,
+	}, atomic.LoadInt64(&clusterIndex))
+	if err != nil {
+		return err
+	}
+
+	wal.Commit = commitBatch
+	cluster.Start()
+
+	log.Printf("Joined the cluster as %s at Raft index %d", cluster.ID, atomic.LoadInt64(&clusterIndex))
+	return nil
+}
+
+// commitBatch is the Commit of the journal of the leader. The batch is
+// applied to the state already, so a leader that fails to commit it gives
+// up the leadership and reloads the state.
+func commitBatch(batch []*LogEntry) error {
+	storeMax(&clusterVersion, batch[len(batch)-1].Version)
+
+	index, err := cluster.Propose(batch)
+	if err != nil {
+		cluster.StepDown()
+		return err
+	}
+
+	storeMax(&clusterIndex, index)
+	return nil
+}
+
+// applyCommitted applies a committed entry. The leader has the entries it
+// proposed applied already.
+func applyCommitted(entry *RaftEntry) {
+	state.Lock()
+	defer state.Unlock()
+
+	var fresh []*LogEntry
+	for _, e := range entry.Batch {
+		if e.Version > atomic.LoadInt64(&clusterVersion) {
+			applyEntry(e)
+			fresh = append(fresh, e)
+		}
+	}
+
+	// The index goes first, so that a checkpoint of the batch has it.
+	storeMax(&clusterIndex, entry.Index)
+	if len(fresh) == 0 {
+		return
+	}
+
+	storeMax(&clusterVersion, fresh[len(fresh)-1].Version)
+	if err := wal.Replicate(fresh); err != nil {
+		log.Printf("error: %v", err)
+	}
+}
+
+// installSnapshot replaces the state with the snapshot of the leader.
+func installSnapshot(data []byte, index int64) error {
+	snap, err := DecodeSnapshot(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	t = InitTree(conf.Namenode)
+	ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
+	snap.Restore()
+
+	if err := wal.Reset(snap.Version); err != nil {
+		return err
+	}
+
+	names, _ := listSnapshots(conf.Namenode.SnapshotDir)
+	for _, name := range names {
+		os.Remove(name)
+	}
+
+	name := snapshotFileName(conf.Namenode.SnapshotDir, snap.Version)
+	err = writeFileAtomically(name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("install snapshot: %v", err)
+	}
+
+	atomic.StoreInt64(&clusterVersion, snap.Version)
+	atomic.StoreInt64(&clusterIndex, index)
+
+	log.Printf("Installed the snapshot of the leader at Raft index %d, version %d", index, snap.Version)
+	return nil
+}
+
+// latestSnapshot returns the newest snapshot file for a member that is too
+// far behind.
+func latestSnapshot() ([]byte, int64, error) {
+	names, err := listSnapshots(conf.Namenode.SnapshotDir)
+	if err == nil && len(names) == 0 {
+		err = fmt.Errorf("no snapshot")
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	snap, err := DecodeSnapshot(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return data, snap.RaftIndex, nil
+}
+
+// onRole follows the Raft role of the nameserver. A leader that loses the
+// leadership may have applied batches that are not committed, so it
+// reloads the state from its last snapshot and the Raft log.
+func onRole(role string, term int64) {
+	if role == RaftLeader {
+		lead.Set(RolePrimary, term)
+		startPrimary(term)
+		return
+	}
+
+	wasPrimary := lead.IsPrimary()
+	lead.Set(RoleStandby, term)
+	if !wasPrimary {
+		return
+	}
+
+	log.Printf("No longer the leader in term %d; reloading the state", term)
+	if err := rebuildState(); err != nil {
+		log.Fatalf("Could not reload the state: %v", err)
+	}
+}
+
+func rebuildState() error {
+	snap, err := LoadLatestSnapshot(conf.Namenode.SnapshotDir)
+	if err != nil {
+		return err
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	t = InitTree(conf.Namenode)
+	ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
+
+	// The queues may hold purges of batches that are not committed. Chunks
+	// purged by committed ones are obsolete, and the inventory purges them.
+	for _, fs := range storages.StorageNodes {
+		fs.DropCommands()
+	}
+
+	var index, version int64
+	if snap != nil {
+		snap.Restore()
+		index, version = snap.RaftIndex, snap.Version
+	}
+
+	if err := wal.Reset(version); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&clusterVersion, version)
+	atomic.StoreInt64(&clusterIndex, index)
+	cluster.ResetApplied(index)
+	return nil
+}
+
+// toPrimary redirects clients of a follower to the leader, if it is
+// known.
+func toPrimary(next http.Handler) http.Handler {
+	refuse := primaryOnly(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cluster != nil && !lead.IsPrimary() {
+			if m, ok := cluster.LeaderMember(); ok && m.Private != cluster.ID {
+				http.Redirect(w, r, fmt.Sprintf("http://%s%s", m.Public, r.URL.RequestURI()), http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
+		refuse.ServeHTTP(w, r)
+	})
+}
+
+type httpTransport struct {
+	client  *http.Client
+	install *http.Client
+}
+
+func newHTTPTransport(timeout time.Duration) *httpTransport {
+	return &httpTransport{
+		client:  &http.Client{Timeout: 2 * timeout},
+		install: &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (tr *httpTransport) call(client *http.Client, peer, method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("http://%s/raft/%s", peer, method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(SecretHeader, conf.Namenode.ClusterSecret)
+
+	r, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", peer, r.Status)
+	}
+
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func (tr *httpTransport) RequestVote(peer string, req *VoteRequest) (*VoteResponse, error) {
+	resp := &VoteResponse{}
+	return resp, tr.call(tr.client, peer, "vote", req, resp)
+}
+
+func (tr *httpTransport) AppendEntries(peer string, req *AppendRequest) (*AppendResponse, error) {
+	resp := &AppendResponse{}
+	return resp, tr.call(tr.client, peer, "append", req, resp)
+}
+
+func (tr *httpTransport) InstallSnapshot(peer string, req *InstallRequest) (*AppendResponse, error) {
+	resp := &AppendResponse{}
+	return resp, tr.call(tr.install, peer, "install", req, resp)
+}
+
+func decodeRaft(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return true
+}
+
+func raftVote(w http.ResponseWriter, r *http.Request) {
+	var req VoteRequest
+	if decodeRaft(w, r, &req) {
+		json.NewEncoder(w).Encode(cluster.HandleVote(&req))
+	}
+}
+
+func raftAppend(w http.ResponseWriter, r *http.Request) {
+	var req AppendRequest
+	if decodeRaft(w, r, &req) {
+		json.NewEncoder(w).Encode(cluster.HandleAppend(&req))
+	}
+}
+
+func raftInstall(w http.ResponseWriter, r *http.Request) {
+	var req InstallRequest
+	if decodeRaft(w, r, &req) {
+		json.NewEncoder(w).Encode(cluster.HandleInstall(&req))
+	}
+}
+
+func clusterStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cluster.Status())
+}
+
+// changeCluster adds or removes the member given by its private address.
+// It must be sent to the leader.
+func changeCluster(w http.ResponseWriter, r *http.Request) {
+	private := r.URL.Query().Get("private")
+	if private == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "private address of the member is not specified")
+		return
+	}
+
+	var err error
+	if r.URL.Path == "/cluster/add" {
+		err = cluster.AddMember(Member{Private: private, Public: r.URL.Query().Get("public")})
+	} else {
+		err = cluster.RemoveMember(private)
+	}
+
+	if err == ErrNotLeader {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "the leader is %s", cluster.Status().Leader)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	clusterStatus(w, r)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func (ns *testNS) writeClusterConfig(members []*testNS) error {
+	extra := "electionTimeout = 300\n"
+	for _, m := range members {
+		extra += fmt.Sprintf("[[namenode.cluster]]\nprivate = '127.0.0.1:%d'\npublic = '127.0.0.1:%d'\n", m.privatePort, m.publicPort)
+	}
+
+	return ns.writeConfigWith(extra)
+}
+
+// findLeader waits for one of the nameservers to lead, other than the
+// excluded one.
+func findLeader(nss []*testNS, excluded *testNS) *testNS {
+	var found *testNS
+	waitFor(10*time.Second, func() bool {
+		for _, ns := range nss {
+			if msg, err := ns.leader(); ns != excluded && err == nil && msg.Role == RolePrimary {
+				found = ns
+				return true
+			}
+		}
+		return false
+	})
+
+	return found
+}
+
+// TestCluster_Failover runs three nameservers as a Raft cluster, checks
+// that followers send clients to the leader, kills the leader, and checks
+// that another one takes over with the state intact and that the old one
+// catches up when it comes back.
+func TestCluster_Failover(test *testing.T) {
+	if serveTestNS() {
+		return
+	}
+
+	if testing.Short() {
+		test.Skip("cluster test runs subprocesses")
+	}
+
+	var nss []*testNS
+	for i := 0; i < 3; i++ {
+		dir, _ := ioutil.TempDir("", "tsukinsd")
+		defer os.RemoveAll(dir)
+		nss = append(nss, newTestNS(test.Name(), dir))
+	}
+
+	for _, ns := range nss {
+		if err := ns.writeClusterConfig(nss); err != nil {
+			test.Fatal(err)
+		}
+
+		if err := ns.start(); err != nil {
+			test.Fatal(err)
+		}
+		defer ns.kill()
+	}
+
+	first := findLeader(nss, nil)
+	if first == nil {
+		test.Fatalf("no leader was elected")
+	}
+
+	var follower *testNS
+	for _, ns := range nss {
+		if ns != first {
+			follower = ns
+		}
+	}
+
+	for _, request := range []string{"init", "mkdir?address=/before", "touch?address=/before/file"} {
+		if status := first.call(request); status != http.StatusOK {
+			test.Fatalf("leader answered %s with %d", request, status)
+		}
+	}
+
+	// The follower redirects the client to the leader.
+	if status := follower.call("mkdir?address=/redirected"); status != http.StatusOK {
+		test.Fatalf("follower answered mkdir with %d", status)
+	}
+
+	msg, _ := first.leader()
+	for _, ns := range nss {
+		if !waitFor(5*time.Second, func() bool { return ns.isLeader(RoleStandby, msg.Epoch, msg.Version) || ns == first }) {
+			got, _ := ns.leader()
+			test.Fatalf("follower did not apply version %d: %+v", msg.Version, got)
+		}
+	}
+
+	first.kill()
+
+	second := findLeader(nss, first)
+	if second == nil {
+		test.Fatalf("no leader was elected after the first one was killed")
+	}
+
+	for _, request := range []string{"info?address=/before/file", "ls?address=/redirected", "mkdir?address=/after"} {
+		if status := second.call(request); status != http.StatusOK {
+			test.Errorf("new leader answered %s with %d", request, status)
+		}
+	}
+
+	if err := first.start(); err != nil {
+		test.Fatal(err)
+	}
+
+	msg, _ = second.leader()
+	if !waitFor(10*time.Second, func() bool { return first.isLeader(RoleStandby, msg.Epoch, msg.Version) }) {
+		got, err := first.leader()
+		test.Fatalf("old leader did not catch up with version %d, got %+v, %v", msg.Version, got, err)
+	}
+}
+
+// TestCluster_CommittedChunks applies the committed batches of an upload
+// on a follower, elects it and removes the file, which purges the chunk
+// on the fileserver that holds it.
+func TestCluster_CommittedChunks(test *testing.T) {
+	dirA, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dirA)
+	dirB, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dirB)
+
+	if err := setUpJournaled(dirA); err != nil {
+		test.Fatalf("could not set up the leader, %v", err)
+	}
+	end := wal.Begin()
+	wal.Append(&LogEntry{Op: OpRegister, Register: journalHolder})
+	end()
+	runWorkload("a", 1)
+
+	entries, _ := wal.Since(0)
+	wal.Close()
+
+	if err := setUpJournaled(dirB); err != nil {
+		test.Fatalf("could not set up the follower, %v", err)
+	}
+	defer wal.Close()
+	storages = &PoolInfo{}
+
+	atomic.StoreInt64(&clusterVersion, 0)
+	defer atomic.StoreInt64(&clusterVersion, 0)
+	applyCommitted(&RaftEntry{Index: 1, Term: 1, Batch: entries})
+
+	lead = &Leadership{}
+	defer func() { lead = nil }()
+	lead.Set(RolePrimary, 2)
+
+	if err := checkConsistency(); err != nil {
+		test.Fatal(err)
+	}
+
+	serveClient(test, "/rmfile?address=a-dir0/copy", http.StatusOK, "")
+
+	cmds := storages.StorageNodes[0].PendingCommands()
+	if len(cmds) != 1 || cmds[0].Kind != CommandPurge || len(cmds[0].Chunks) != 1 || cmds[0].Chunks[0] != "a-chunk0" {
+		test.Errorf("got %+v queued for the fileserver, want a purge of a-chunk0", cmds)
+	}
+}
+
+// TestCluster_RebuildDropsPurges removes a file on a leader that then
+// loses the leadership before the batch is committed, and checks that the
+// purge of the chunk the rebuilt state still refers to is not delivered.
+func TestCluster_RebuildDropsPurges(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	defer wal.Close()
+	runWorkload("a", 1)
+
+	if _, err := wal.CheckpointNow(); err != nil {
+		test.Fatal(err)
+	}
+
+	serveClient(test, "/rmfile?address=a-dir0/copy", http.StatusOK, "")
+
+	cluster = &Raft{applyKick: make(chan struct{}, 1)}
+	defer func() { cluster = nil }()
+	if err := rebuildState(); err != nil {
+		test.Fatal(err)
+	}
+
+	if cmds := storages.StorageNodes[0].PendingCommands(); len(cmds) != 0 {
+		test.Errorf("got %+v queued for the fileserver after the rebuild, want none", cmds)
+	}
+
+	if nodeAt("a-dir0/copy") == nil || ct.Table["a-chunk0"].Status == OBSOLETE {
+		test.Errorf("the rebuilt state lost the file or its chunk")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Coding describes Reed-Solomon erasure coding of a file: every chunk of
+// it is stored as Data data shards and Parity parity shards on distinct
+// fileservers. Files without coding are replicated.
+type Coding struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+}
+
+func (c *Coding) Shards() int {
+	return c.Data + c.Parity
+}
+
+func (c *Coding) String() string {
+	return fmt.Sprintf("rs(%d,%d)", c.Data, c.Parity)
+}
+
+// ParseCoding parses a redundancy setting, "rs(data,parity)". Empty string
+// and "replicas" stand for replication and give nil.
+func ParseCoding(setting string) (*Coding, error) {
+	setting = strings.ReplaceAll(setting, " ", "")
+	if setting == "" || setting == "replicas" {
+		return nil, nil
+	}
+
+	coding := &Coding{}
+	var rest string
+	n, _ := fmt.Sscanf(setting, "rs(%d,%d%s", &coding.Data, &coding.Parity, &rest)
+	if n != 3 || rest != ")" {
+		return nil, fmt.Errorf("redundancy %q is neither replicas nor rs(data,parity)", setting)
+	}
+
+	if coding.Data <= 0 || coding.Parity <= 0 || coding.Shards() > 256 {
+		return nil, fmt.Errorf("redundancy %q is out of range", setting)
+	}
+
+	return coding, nil
+}
+
+// CodingFor returns the coding of new files at address. The setting of
+// the deepest directory in DirectoryRedundancy that contains the file
+// wins over the cluster-wide Redundancy.
+func (n *Namenode) CodingFor(address string) (*Coding, error) {
+	return ParseCoding(directorySetting(address, n.Redundancy, n.DirectoryRedundancy))
+}
+
+// directorySetting returns the setting of the deepest directory among
+// settings that contains the file at address, or else the cluster-wide
+// one.
+func directorySetting(address, setting string, settings map[string]string) string {
+	deepest := -1
+	for dir, dirSetting := range settings {
+		dir = path.Clean(strings.Trim(dir, "/"))
+
+		depth := 0
+		if dir != "." {
+			if address != dir && !strings.HasPrefix(address, dir+"/") {
+				continue
+			}
+			depth = strings.Count(dir, "/") + 1
+		}
+
+		if depth > deepest {
+			deepest = depth
+			setting = dirSetting
+		}
+	}
+
+	return setting
+}
+
+// ValidateRedundancy checks every redundancy setting of the config.
+func (n *Namenode) ValidateRedundancy() error {
+	if _, err := ParseCoding(n.Redundancy); err != nil {
+		return err
+	}
+
+	for dir, setting := range n.DirectoryRedundancy {
+		if _, err := ParseCoding(setting); err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// TargetReplicas is the number of copies the chunk should have. Shards of
+// erasure coded chunks are not replicated.
+func (c *Chunk) TargetReplicas() int {
+	if c.Stripe != nil {
+		return 1
+	}
+
+	return conf.Namenode.Replicas
+}
+
+// RebuildShard restores the shard lost at lostAt on another fileserver,
+// which reads the other shards of the stripe from their holders. The
+// shard must not be held by lostAt anymore.
+func (s *PoolInfo) RebuildShard(chunk *Chunk, lostAt *FileServerInfo) {
+	coding := chunk.Coding
+
+	sources := make([]string, len(chunk.Stripe))
+	var holders []*FileServerInfo
+	var held []string
+	except := map[string]*FileServerInfo{lostAt.Addr(): lostAt}
+
+	for i, shardID := range chunk.Stripe {
+		shard, ok := ct.Table[shardID]
+		if !ok {
+			continue
+		}
+
+		for host, fs := range shard.FServers {
+			except[host] = fs
+			if shardID == chunk.ChunkID || sources[i] != "" || len(holders) == coding.Data {
+				continue
+			}
+
+			if shard.Statuses[host] == OK && fs.Alive {
+				sources[i] = fmt.Sprintf("%s:%d", fs.PrivateHost, fs.PublicPort)
+				holders = append(holders, fs)
+				held = append(held, shardID)
+			}
+		}
+	}
+
+	if len(holders) < coding.Data {
+		log.Printf("Shard %s is lost and only %d shards of its stripe are left", chunk.ChunkID, len(holders))
+		chunk.SetStatus(DOWN)
+		return
+	}
+
+	receivers := s.SelectSeveralExcept(except, 1)
+	if len(receivers) == 0 {
+		log.Printf("Shard %s cannot be rebuilt, there is no free fs left", chunk.ChunkID)
+		return
+	}
+	receiver := receivers[0]
+
+	chunk.AddFSToChunk(receiver)
+	ct.ivmu.Lock()
+	ct.InvertedTable[receiver.Addr()] = append(ct.InvertedTable[receiver.Addr()], chunk)
+	ct.ivmu.Unlock()
+
+	log.Printf("Rebuilding shard %s of %s at %s", chunk.ChunkID, coding, receiver.PrivateHost)
+
+	// The holders must expect their shards to be read before the receiver
+	// may read them.
+	token := generateToken()
+	var mu sync.Mutex
+	remaining := len(holders)
+	failed := false
+
+	cancel := func() {
+		for _, fs := range holders {
+			fs.Enqueue(&Command{Kind: CommandCancelToken, Token: token}, nil)
+		}
+	}
+
+	for i, fs := range holders {
+		expect := &Command{Kind: CommandExpect, Action: "read", Token: token, Chunks: []string{held[i]}}
+		fs.Enqueue(expect, func(err error) {
+			mu.Lock()
+			remaining--
+			if err != nil {
+				failed = true
+			}
+			ready := remaining == 0
+			mu.Unlock()
+
+			if !ready {
+				return
+			}
+
+			if failed {
+				log.Printf("Shard %s cannot be rebuilt, some holders did not expect the read", chunk.ChunkID)
+				cancel()
+				return
+			}
+
+			rebuild := &Command{
+				Kind:         CommandRebuild,
+				Token:        token,
+				Chunks:       []string{chunk.ChunkID},
+				Stripe:       chunk.Stripe,
+				Sources:      sources,
+				DataShards:   coding.Data,
+				ParityShards: coding.Parity,
+			}
+
+			receiver.Enqueue(rebuild, func(err error) {
+				if err != nil {
+					log.Printf("%s could not rebuild shard %s: %v", receiver.PrivateHost, chunk.ChunkID, err)
+				}
+				cancel()
+			})
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNamenode_CodingFor(t *testing.T) {
+	n := &Namenode{
+		Redundancy: "rs(6,3)",
+		DirectoryRedundancy: map[string]string{
+			"archive":     "rs(4, 2)",
+			"archive/hot": "replicas",
+		},
+	}
+
+	cases := []struct {
+		address string
+		want    *Coding
+	}{
+		{"file", &Coding{6, 3}},
+		{"archive/file", &Coding{4, 2}},
+		{"archive/hot/file", nil},
+		{"archived/file", &Coding{6, 3}},
+	}
+
+	for _, test := range cases {
+		got, err := n.CodingFor(test.address)
+		if err != nil {
+			t.Fatalf("could not get coding of %s, %v", test.address, err)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got coding %v for %s, want %v", got, test.address, test.want)
+		}
+	}
+
+	for _, setting := range []string{"rs(6)", "rs(0,3)", "rs(6,3)x", "mirror"} {
+		if _, err := ParseCoding(setting); err == nil {
+			t.Errorf("parsed invalid redundancy %q", setting)
+		}
+	}
+}
+
+func TestPoolInfo_RebuildShard(t *testing.T) {
+	a := &FileServerInfo{PrivateHost: "10.0.0.1"}
+	setUpNamespace(1, a)
+
+	var nodes []*FileServerInfo
+	for _, host := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		fs, _ := storages.RegisterFServer(&RegisterMessage{NodeID: host, PrivateHost: host, PublicPort: 7000})
+		nodes = append(nodes, fs)
+	}
+
+	coding := &Coding{Data: 2, Parity: 1}
+	stripe := []string{"s0", "s1", "s2"}
+	var shards []*Chunk
+	for i, id := range stripe {
+		shard, _ := ct.AddChunk(id, 0, nodes[i])
+		shard.Stripe, shard.Coding = stripe, coding
+		shard.Statuses[nodes[i].Addr()] = OK
+		shards = append(shards, shard)
+	}
+
+	lost := shards[1]
+	lost.RemoveFSFromChunk(nodes[1])
+	storages.RebuildShard(lost, nodes[1])
+
+	receiver := nodes[3]
+	if _, ok := lost.FServers[receiver.Addr()]; !ok {
+		t.Fatalf("shard is not rebuilt at the only free fileserver, got %v", lost.FServers)
+	}
+
+	var token string
+	for _, i := range []int{0, 2} {
+		pending := nodes[i].PendingCommands()
+		if len(pending) != 1 || pending[0].Kind != CommandExpect || pending[0].Action != "read" || pending[0].Chunks[0] != stripe[i] {
+			t.Fatalf("got holder commands %v, want read expect of %s", pending, stripe[i])
+		}
+
+		token = pending[0].Token
+		if got := receiver.PendingCommands(); len(got) != 0 {
+			t.Fatalf("receiver got %v before every holder expected the read", got)
+		}
+		nodes[i].Acknowledge([]CommandAck{{ID: pending[0].ID}})
+	}
+
+	pending := receiver.PendingCommands()
+	if len(pending) != 1 || pending[0].Kind != CommandRebuild {
+		t.Fatalf("got receiver commands %v, want one rebuild", pending)
+	}
+
+	rebuild := pending[0]
+	wantSources := []string{"10.0.0.1:7000", "", "10.0.0.3:7000"}
+	if rebuild.Token != token || !reflect.DeepEqual(rebuild.Sources, wantSources) || rebuild.Chunks[0] != "s1" {
+		t.Errorf("got rebuild of %v from %v with token %s, want s1 from %v with %s",
+			rebuild.Chunks, rebuild.Sources, rebuild.Token, wantSources, token)
+	}
+}
+
+func TestUpload_ShortStripes(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	defer wal.Close()
+
+	conf.Namenode.ChunkSize = 1
+	conf.Namenode.Redundancy = "rs(2,1)"
+
+	// The counter of alive fileservers says three, but the third one is
+	// left out of the ring.
+	for _, host := range []string{"10.0.0.2", "10.0.0.3"} {
+		storages.RegisterFServer(&RegisterMessage{NodeID: host, PrivateHost: host, PublicPort: 7000})
+	}
+	storages.StorageNodes[2].Alive = false
+
+	serveClient(test, "/upload?address=/file&size=3000000", http.StatusServiceUnavailable, "")
+	if t.Exists("file") {
+		test.Errorf("file is created without its stripes")
+	}
+
+	end := wal.Begin()
+	file, _ := t.CreateFile("broken", 1)
+	file.Coding = &Coding{Data: 2, Parity: 1}
+	file.Chunks = []string{"s0", "s1", "s2", "s3"}
+	t.CommitUpdate(OpUpdate, file)
+	end()
+
+	serveClient(test, "/download?address=/broken", http.StatusBadRequest, "")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+// Commands for fileservers are not sent directly. They are queued on the
+// FileServerInfo and handed out in responses to heartbeats until the
+// fileserver acknowledges them.
+const (
+	CommandPurge       = "purge"
+	CommandReplicate   = "replicate"
+	CommandCancelToken = "cancelToken"
+	CommandExpect      = "expect"
+	CommandRebuild     = "rebuild"
+)
+
+type Command struct {
+	ID     uint64   `json:"id"`
+	Kind   string   `json:"kind"`
+	Token  string   `json:"token,omitempty"`
+	Action string   `json:"action,omitempty"`
+	Addr   string   `json:"addr,omitempty"`
+	Chunks []string `json:"chunks,omitempty"`
+
+	Stripe       []string `json:"stripe,omitempty"`
+	Sources      []string `json:"sources,omitempty"`
+	DataShards   int      `json:"dataShards,omitempty"`
+	ParityShards int      `json:"parityShards,omitempty"`
+}
+
+type CommandAck struct {
+	ID    uint64 `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+type HeartbeatMessage struct {
+	NodeStatus
+	Acks      []CommandAck      `json:"acks"`
+	Inventory *InventoryMessage `json:"inventory"`
+
+	// Epoch is the newest NS epoch the fileserver has seen.
+	Epoch int64 `json:"epoch"`
+}
+
+// InventoryMessage lists every chunk a fileserver holds.
+type InventoryMessage struct {
+	Chunks []string `json:"chunks"`
+}
+
+type queuedCommand struct {
+	cmd   *Command
+	onAck func(error)
+}
+
+// lastCommandID starts from a random boot prefix in the upper half. Fileservers
+// skip commands whose IDs they have run but not yet acknowledged, so the IDs
+// must not repeat after the nameserver restarts or another one takes over.
+var lastCommandID = bootCommandID()
+
+func bootCommandID() uint64 {
+	var prefix [4]byte
+	rand.Read(prefix[:])
+
+	return uint64(binary.BigEndian.Uint32(prefix[:])) << 32
+}
+
+// Enqueue schedules cmd for the fileserver. onAck, if not nil, is called
+// with the outcome once the fileserver acknowledges the command.
+func (fs *FileServerInfo) Enqueue(cmd *Command, onAck func(error)) {
+	cmd.ID = atomic.AddUint64(&lastCommandID, 1)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.commands = append(fs.commands, &queuedCommand{cmd: cmd, onAck: onAck})
+}
+
+func (fs *FileServerInfo) PendingCommands() []*Command {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	cmds := make([]*Command, 0, len(fs.commands))
+	for _, queued := range fs.commands {
+		cmds = append(cmds, queued.cmd)
+	}
+
+	return cmds
+}
+
+// DropCommands empties the queue without running the callbacks.
+func (fs *FileServerInfo) DropCommands() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.commands = nil
+}
+
+// Acknowledge removes the acknowledged commands from the queue and runs
+// their callbacks.
+func (fs *FileServerInfo) Acknowledge(acks []CommandAck) {
+	if len(acks) == 0 {
+		return
+	}
+
+	results := map[uint64]error{}
+	for _, ack := range acks {
+		results[ack.ID] = nil
+		if ack.Error != "" {
+			results[ack.ID] = errors.New(ack.Error)
+		}
+	}
+
+	var done []*queuedCommand
+
+	fs.mu.Lock()
+	left := fs.commands[:0]
+	for _, queued := range fs.commands {
+		if _, acked := results[queued.cmd.ID]; acked {
+			done = append(done, queued)
+		} else {
+			left = append(left, queued)
+		}
+	}
+	fs.commands = left
+	fs.mu.Unlock()
+
+	// Callbacks may enqueue commands for this very fileserver.
+	for _, queued := range done {
+		if queued.onAck != nil {
+			queued.onAck(results[queued.cmd.ID])
+		}
+	}
+}
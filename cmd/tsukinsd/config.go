@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"net"
 	"time"
 )
 
@@ -12,19 +14,89 @@ type Config struct {
 }
 
 type Namenode struct {
-	Host              string
-	PublicPort        int
-	PrivatePort       int
-	TreeUpdatePeriod  int64
-	TreeLogName       string
-	TreeGobName       string
-	ChunkTableGobName string
-	SoftDeathTime     time.Duration
-	HardDeathTime     time.Duration
-	ChunkSize         int
-	Replicas          int
-	FSPublicPort      int
-	FSPrivatePort     int
+	Host             string
+	PublicPort       int
+	PrivatePort      int
+	TreeUpdatePeriod int64
+	TreeLogName      string
+	SoftDeathTime    time.Duration
+	HardDeathTime    time.Duration
+	ChunkSize        int
+	Replicas         int
+	FSPublicPort     int
+	FSPrivatePort    int
+
+	// Fileservers may register themselves if they know the join secret
+	// and/or come from an allowed host or network. Registration is
+	// disabled when neither is set. Once requests are authenticated, the
+	// allowlist alone lets in only registrations with the admin scope.
+	JoinSecret    string
+	JoinAllowlist []string
+
+	// Redundancy of new files is either "replicas" (the default) or
+	// "rs(data,parity)". DirectoryRedundancy overrides it for files in
+	// the listed directories.
+	Redundancy          string
+	DirectoryRedundancy map[string]string
+
+	// Snapshots of the whole state are saved to SnapshotDir, and the
+	// SnapshotRetention newest of them are kept. Zero keeps them all.
+	SnapshotDir       string
+	SnapshotRetention int
+
+	// A standby follows the journal of the primary at Peer, the private
+	// address of the other nameserver, and takes over when it doesn't
+	// hear from it for TakeoverTime seconds. A primary that finds Peer
+	// to be the primary of a newer epoch starts as its standby. The
+	// epoch is kept in EpochName.
+	Standby      bool
+	Peer         string
+	TakeoverTime time.Duration
+	EpochName    string
+
+	// Cluster lists the nameservers of a Raft cluster, this one included,
+	// which replaces the primary and the standby. A leader is elected if
+	// a majority doesn't hear from one for ElectionTimeout milliseconds.
+	Cluster         []Member
+	ElectionTimeout time.Duration
+
+	// Nameservers present ClusterSecret to each other when they follow
+	// the journal of the primary or take part in Raft. Requests without
+	// it need the admin scope, like the ones of operators.
+	ClusterSecret string
+
+	// Overwritten files keep their previous versions as Retention says:
+	// "none" (the default), "versions(n)" for the n newest of them, or
+	// "age(d)" for the ones replaced less than d ago, such as
+	// "age(720h)". DirectoryRetention overrides it for files in the
+	// listed directories.
+	Retention          string
+	DirectoryRetention map[string]string
+
+	// Removed files and directories stay in the trash for TrashRetention
+	// hours before they are purged. Zero disables the trash.
+	TrashRetention time.Duration
+
+	// Writers hold the lease of a file for LeaseTime seconds, 30 by
+	// default, unless they renew it.
+	LeaseTime time.Duration
+
+	// Quotas limit the projected size, in MB, and the number of files in
+	// the listed directory trees and of the listed users. The projected
+	// size of a file is its size times its replicas, or the size of all
+	// of its shards if it is erasure coded.
+	DirectoryQuota map[string]Quota
+	UserQuota      map[string]Quota
+
+	// Public requests are authenticated against the users of UsersFile,
+	// and made as root when it is not set.
+	UsersFile string
+
+	// APIKeys let clients and operators in by bearer token, within
+	// their scopes: "read", "write" and "admin". Admin requests to the
+	// private port need a key with the admin scope, or the password of
+	// root, once there are keys or users.
+	APIKeys []*APIKey
 }
 
 type storage struct {
@@ -32,13 +104,60 @@ type storage struct {
 	PublicHost string
 }
 
-func LoadConfig() (*Config, error) {
+func LoadConfig(filename string) (*Config, error) {
 	var conf *Config
 
-	if _, err := toml.DecodeFile("config.toml", &conf); err != nil {
+	if _, err := toml.DecodeFile(filename, &conf); err != nil {
 		// shit
 		return nil, fmt.Errorf("Config file is not found, %v", err)
 	}
 
+	if err := conf.Namenode.ValidateRedundancy(); err != nil {
+		return nil, fmt.Errorf("Config file is not valid, %v", err)
+	}
+
+	if err := conf.Namenode.ValidateRetention(); err != nil {
+		return nil, fmt.Errorf("Config file is not valid, %v", err)
+	}
+
 	return conf, nil
 }
+
+func (n *Namenode) RegistrationEnabled() bool {
+	return n.JoinSecret != "" || len(n.JoinAllowlist) != 0
+}
+
+// IsPeer reports whether the secret is the one of the nameservers.
+func (n *Namenode) IsPeer(secret string) bool {
+	return n.ClusterSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(n.ClusterSecret)) == 1
+}
+
+// Admits reports whether a fileserver at host, presenting secret, may join
+// the pool on its own.
+func (n *Namenode) Admits(host, secret string) bool {
+	if !n.RegistrationEnabled() {
+		return false
+	}
+
+	if n.JoinSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(n.JoinSecret)) != 1 {
+		return false
+	}
+
+	if len(n.JoinAllowlist) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	for _, allowed := range n.JoinAllowlist {
+		if allowed == host {
+			return true
+		}
+
+		_, network, err := net.ParseCIDR(allowed)
+		if err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// purgeBatch is the number of files purged at a time, so that the state is
+// not locked for long.
+var purgeBatch = 100
+
+// purgeWake wakes the purger up when a directory is removed.
+var purgeWake = make(chan struct{}, 1)
+
+func wakePurger() {
+	select {
+	case purgeWake <- struct{}{}:
+	default:
+	}
+}
+
+// purgeDeletions releases the chunks of the files of removed directories
+// in the background, for as long as the nameserver is the primary. The
+// deletions are part of the state, so a new primary or a restarted one
+// carries on with them.
+func purgeDeletions() {
+	for {
+		more := false
+		if lead.IsPrimary() {
+			var err error
+			if more, err = purgeStep(); err != nil {
+				log.Printf("error: could not purge removed files: %v", err)
+			}
+		}
+
+		if more {
+			continue
+		}
+
+		select {
+		case <-purgeWake:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// purgeStep purges up to purgeBatch files of the oldest deletion. It tells
+// whether there are more.
+func purgeStep() (bool, error) {
+	state.Lock()
+	defer state.Unlock()
+
+	if len(t.Deletions) == 0 {
+		return false, nil
+	}
+
+	deletion := t.Deletions[0]
+	end := wal.Begin()
+	for i := 0; i < purgeBatch && len(deletion.Files) != 0; i++ {
+		file := deletion.Files[0]
+		ct.Release(file.AllChunks())
+
+		t.ApplyPurge(deletion.ID, file.Address())
+		wal.Append(&LogEntry{Op: OpPurge, ID: deletion.ID, Address: file.Address()})
+	}
+
+	if err := end(); err != nil {
+		return false, err
+	}
+
+	if len(deletion.Files) == 0 {
+		log.Printf("Purged the %d files of removed directory %s", deletion.Total, deletion.Address)
+	}
+
+	return len(t.Deletions) != 0, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SnapshotsRoot is the reserved directory under which snapshots of
+// directories are browsed: the snapshot "before" of /projects/x is at
+// /.snapshots/projects/x@before. A snapshot copies the nodes of the
+// directory, and shares the chunks of its files with them. Nothing under
+// SnapshotsRoot can be changed, but a snapshot can be deleted as a whole.
+const SnapshotsRoot = ".snapshots"
+
+// readOnly tells whether the address is in a reserved directory, the one
+// of the snapshots or the trash.
+func readOnly(address string) bool {
+	for _, root := range []string{SnapshotsRoot, TrashRoot} {
+		if address == root || strings.HasPrefix(address, root+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkWritable(address string) error {
+	if readOnly(address) {
+		return fmt.Errorf("/%s is reserved and read-only", address)
+	}
+
+	return nil
+}
+
+// ParseSnapshotName splits "dir@name" into the directory and the name of
+// its snapshot.
+func ParseSnapshotName(spec string) (string, string, error) {
+	at := strings.LastIndex(spec, "@")
+	if at < 0 {
+		return "", "", fmt.Errorf("%s is not of the form directory@name", spec)
+	}
+
+	dir, _ := CleanAddress(spec[:at])
+	if dir == "" {
+		dir = "."
+	}
+
+	name := spec[at+1:]
+	if name == "" || strings.ContainsAny(name, "/@") {
+		return "", "", fmt.Errorf("%q is not a valid snapshot name", name)
+	}
+
+	return dir, name, nil
+}
+
+// snapshotAddress returns where the snapshot of the directory is browsed.
+func snapshotAddress(dir string, name string) string {
+	if dir == "." {
+		return path.Join(SnapshotsRoot, "@"+name)
+	}
+
+	return path.Join(SnapshotsRoot, dir+"@"+name)
+}
+
+// SnapshotDirectory captures the directory as the snapshot spec names. It
+// returns the chunks of the captured files, which the caller retains.
+func (t *Tree) SnapshotDirectory(spec string) (string, []string, error) {
+	dir, name, err := ParseSnapshotName(spec)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := checkWritable(dir); err != nil {
+		return "", nil, err
+	}
+	if !t.DirectoryExists(dir) {
+		return "", nil, fmt.Errorf("/%s/ directory does not exist", dir)
+	}
+
+	address := snapshotAddress(dir, name)
+	if _, ok := t.Lookup(address); ok {
+		return "", nil, fmt.Errorf("snapshot /%s already exists", address)
+	}
+
+	chunks := t.ApplySnapshotDirectory(dir, name)
+	wal.Append(&LogEntry{Op: OpSnapdir, Address: dir, ID: name})
+
+	return address, chunks, nil
+}
+
+// ApplySnapshotDirectory copies the nodes of the directory under its
+// snapshot address, and returns the chunks of the copied files. Files that
+// are still being uploaded are left out, as are the reserved directories.
+// The copies are given the next inode numbers in the order of the names,
+// so that they are the same wherever the journal is replayed.
+func (t *Tree) ApplySnapshotDirectory(dir string, name string) []string {
+	source, ok := t.Lookup(dir)
+	if !ok {
+		return nil
+	}
+
+	address := snapshotAddress(dir, name)
+	t.ensureDirectories(path.Dir(address))
+	parent, _ := t.Lookup(path.Dir(address))
+
+	var chunks []string
+	var capture func(parent *Node, node *Node, name string)
+	capture = func(parent *Node, node *Node, name string) {
+		copied := &Node{
+			Name:        name,
+			IsDirectory: node.IsDirectory,
+			CreatedOn:   node.CreatedOn,
+			Owner:       node.Owner,
+			Group:       node.Group,
+			Mode:        node.Mode,
+		}
+
+		if !node.IsDirectory {
+			copied.Pending = map[string]bool{}
+			copied.Chunks = append([]string(nil), node.Chunks...)
+			copied.Size = node.Size
+			copied.Coding = node.Coding
+			copied.Version = node.Version
+			chunks = append(chunks, node.Chunks...)
+		}
+
+		t.link(parent, copied)
+
+		var names []string
+		for childName, child := range node.children {
+			if !(node == t.root && readOnly(childName)) && len(child.Pending) == 0 {
+				names = append(names, childName)
+			}
+		}
+		sort.Strings(names)
+
+		for _, childName := range names {
+			capture(copied, node.children[childName], childName)
+		}
+	}
+	capture(parent, source, path.Base(address))
+
+	return chunks
+}
+
+// ensureDirectories creates the directory and its missing parents.
+func (t *Tree) ensureDirectories(address string) {
+	if _, ok := t.Lookup(address); ok {
+		return
+	}
+
+	t.ensureDirectories(path.Dir(address))
+
+	parent, _ := t.Lookup(path.Dir(address))
+	t.link(parent, &Node{Name: path.Base(address), IsDirectory: true, CreatedOn: time.Now()})
+}
+
+// DeleteDirectorySnapshot removes the snapshot the same way RemoveDirectory
+// removes directories, together with the directories it leaves empty in
+// the reserved one.
+func (t *Tree) DeleteDirectorySnapshot(spec string) (*Node, error) {
+	dir, name, err := ParseSnapshotName(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	address := snapshotAddress(dir, name)
+	if !t.DirectoryExists(address) {
+		return nil, fmt.Errorf("snapshot /%s does not exist", address)
+	}
+
+	id, _ := uuid.NewUUID()
+	node := t.ApplyRemoveDirectory(address, id.String())
+	wal.Append(&LogEntry{Op: OpRmdir, Address: address, ID: id.String()})
+
+	for parent := path.Dir(address); parent != "."; parent = path.Dir(parent) {
+		if dir, ok := t.Lookup(parent); !ok || !t.isEmpty(dir) {
+			break
+		}
+
+		t.ApplyRemoveDirectory(parent, "")
+		wal.Append(&LogEntry{Op: OpRmdir, Address: parent})
+	}
+
+	return node, nil
+}
@@ -1,48 +1,189 @@
 package main
 
 import (
-	"encoding/gob"
 	"fmt"
-	"log"
 	"os"
 	"path"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type Tree struct {
-	Nodes   map[string]*Node
+	// Inodes are the nodes in the tree by their inode numbers, and
+	// LastInode is the number given out last. Nodes are found by their
+	// addresses through the children of the directories, see Lookup.
+	Inodes    map[int64]*Node
+	LastInode int64
+	root      *Node
+
 	Version int64
 	Removed []*Node
 	Conf    Namenode
+
+	// Deletions are the removed directories whose files are still to be
+	// purged, oldest first.
+	Deletions []*Deletion
+
+	// Trash lists the items in the trash, oldest first.
+	Trash []*TrashItem
+
+	// UserUsage and DirectoryUsage are what the files of each user, and
+	// of each directory with a quota, are counted for. They are kept up
+	// to date as files change, and are not journaled.
+	UserUsage      map[string]*Usage
+	DirectoryUsage map[string]*Usage
+}
+
+// Deletion is a removed directory whose files still refer to chunks. They
+// are purged in the background, a few at a time, and are out of the tree
+// already.
+type Deletion struct {
+	ID      string
+	Address string
+	Total   int
+	Files   []*Node
 }
 
 type Node struct {
-	Address     string
+	// ID is the inode number of the node. It stays the same as the node
+	// is moved, so chunks refer to their files by it.
+	ID int64
+
+	// Name is the base name of the node. A node out of the tree, such as
+	// a file of a deletion, has its whole address as its name instead.
+	Name string
+
 	IsDirectory bool
 	Childs      []*Node
-	Parent      string
 	Removed     bool
 	Pending     map[string]bool
 	Chunks      []string
 	CreatedOn   time.Time
 	Size        int
+
+	// Coding is set for erasure coded files. Their Chunks are the shards
+	// of consecutive stripes.
+	Coding *Coding
+
+	// Update is the new content of the file while it is being uploaded
+	// over the old one: its chunks, the pending ones among them, its size
+	// and coding. It is not in the tree.
+	Update *Node
+
+	// Lease is held by the client writing the file.
+	Lease *Lease
+
+	// Version is the number of the current content of the file, and
+	// Versions are the previous ones kept by retention, oldest first.
+	Version  int
+	Versions []*Version
+
+	// Owner and Group are the user and the group the node belongs to,
+	// and Mode holds their permission bits and the ones of the others.
+	Owner string
+	Group string
+	Mode  os.FileMode
+
+	// charged is what the file is counted for in the usage of quotas.
+	charged *charge
+
+	// parent is the directory the node is in, and children are the nodes
+	// in the directory that are not removed, by name. Removed nodes stay
+	// among Childs until ClearRemoved.
+	parent   *Node
+	children map[string]*Node
 }
 
 func InitTree(conf Namenode) *Tree {
-	root := &Node{Address: ".", IsDirectory: true, Childs: make([]*Node, 0), Parent: "", CreatedOn: time.Now()}
-	tree := &Tree{Nodes: map[string]*Node{".": root}, Conf: conf}
+	root := &Node{Name: ".", IsDirectory: true, Childs: make([]*Node, 0), CreatedOn: time.Now()}
+	tree := &Tree{Inodes: map[int64]*Node{}, Conf: conf, root: root}
+	tree.link(nil, root)
 
 	return tree
 }
 
 func (t *Tree) String() string {
-	return fmt.Sprintf("Tree{FServers: %v}", t.Nodes)
+	return fmt.Sprintf("Tree{Inodes: %v}", t.Inodes)
 }
 
 func (node *Node) String() string {
-	return fmt.Sprintf("Node{Address: %q, IsDirectory: %v, Childs: %v, Parent: %q, Removed: %v, Chunks: %v}", node.Address, node.IsDirectory, node.Childs, node.Parent, node.Removed, node.Chunks)
+	return fmt.Sprintf("Node{ID: %d, Address: %q, IsDirectory: %v, Childs: %v, Removed: %v, Chunks: %v}", node.ID, node.Address(), node.IsDirectory, node.Childs, node.Removed, node.Chunks)
+}
+
+// Address returns the path of the node from the root, which it walks up
+// to.
+func (node *Node) Address() string {
+	if node.parent == nil {
+		return node.Name
+	}
+
+	dir := node.parent.Address()
+	if dir == "." {
+		return node.Name
+	}
+
+	return dir + "/" + node.Name
+}
+
+// Lookup finds the node at the address by walking down from the root, so
+// it takes as long as the address is deep. The address must be clean.
+func (t *Tree) Lookup(address string) (*Node, bool) {
+	node := t.root
+	if address == "." {
+		return node, true
+	}
+
+	for _, name := range strings.Split(address, "/") {
+		if node = node.children[name]; node == nil {
+			return nil, false
+		}
+	}
+
+	return node, true
+}
+
+// link puts the node into the directory, or makes it the root if there is
+// no directory. A node without an inode number is given the next one.
+func (t *Tree) link(dir *Node, node *Node) {
+	if node.ID == 0 {
+		t.LastInode++
+		node.ID = t.LastInode
+	} else if node.ID > t.LastInode {
+		t.LastInode = node.ID
+	}
+
+	node.parent = dir
+	t.Inodes[node.ID] = node
+	if dir == nil {
+		return
+	}
+
+	if dir.children == nil {
+		dir.children = map[string]*Node{}
+	}
+	dir.children[node.Name] = node
+	dir.Childs = append(dir.Childs, node)
+}
+
+// drop takes the node out of the tree the lazy way: it can no longer be
+// found, but stays among the Childs of its directory until ClearRemoved.
+func (t *Tree) drop(node *Node) {
+	if t.Inodes[node.ID] == node {
+		delete(t.Inodes, node.ID)
+	}
+
+	if node.parent != nil && node.parent.children[node.Name] == node {
+		delete(node.parent.children, node.Name)
+	}
+}
+
+// inTree tells whether the node is in the tree, and not removed or out of
+// it.
+func (t *Tree) inTree(node *Node) bool {
+	return t.Inodes[node.ID] == node
 }
 
 func (t *Tree) CreateFile(fileName string, size int) (*Node, error) {
@@ -51,8 +192,11 @@ func (t *Tree) CreateFile(fileName string, size int) (*Node, error) {
 	if !matched {
 		return nil, fmt.Errorf("wrong file name format")
 	}
+	if err := checkWritable(fileName); err != nil {
+		return nil, err
+	}
 
-	_, fileExists := t.Nodes[fileName]
+	_, fileExists := t.Lookup(fileName)
 
 	if fileExists {
 		return nil, fmt.Errorf("/%s file already exists", fileName)
@@ -67,19 +211,18 @@ func (t *Tree) CreateFile(fileName string, size int) (*Node, error) {
 	dir, _ := t.GetNodeByAddress(dirPath)
 
 	newFile := &Node{
-		Address:     fileName,
+		Name:        path.Base(fileName),
 		IsDirectory: false,
 		Childs:      nil,
-		Parent:      dir.Address,
 		Pending:     map[string]bool{},
 		CreatedOn: time.Now(),
 		Size: size,
+		Version: 1,
 	}
 
-	dir.Childs = append(dir.Childs, newFile)
-	t.Nodes[fileName] = newFile
+	t.link(dir, newFile)
 
-	t.CommitUpdate("touch", fileName)
+	t.CommitUpdate(OpTouch, newFile)
 
 	return newFile, nil
 }
@@ -106,6 +249,9 @@ func (t *Tree) RemoveFile(address string) (*Node, error) {
 	if !matched {
 		return nil, fmt.Errorf("/%s wrong file name format", address)
 	}
+	if err := checkWritable(address); err != nil {
+		return nil, err
+	}
 
 	exists, isDirectory := t.PathExists(address)
 	if !exists {
@@ -114,13 +260,13 @@ func (t *Tree) RemoveFile(address string) (*Node, error) {
 		return nil, fmt.Errorf("/%s/ cannot remove directory; use rmdir instead", address)
 	}
 
-	removed := t.Nodes[address]
+	removed, _ := t.Lookup(address)
 	removed.Removed = true // lazy removing
 	t.Removed = append(t.Removed, removed)
 
-	delete(t.Nodes, address)
+	t.drop(removed)
 
-	t.CommitUpdate("rmfile", address)
+	t.CommitUpdate(OpRmfile, removed)
 
 	return removed, nil
 }
@@ -131,6 +277,9 @@ func (t *Tree) CreateDirectory(address string) error {
 	if !matched {
 		return fmt.Errorf("/%s wrong file name format", address)
 	}
+	if err := checkWritable(address); err != nil {
+		return err
+	}
 
 	exists, _ := t.PathExists(address)
 
@@ -143,24 +292,24 @@ func (t *Tree) CreateDirectory(address string) error {
 	if !dirExists {
 		return fmt.Errorf("/%s the parent directory (%s) does not exist", address, dirPath)
 	}
-	dir := t.Nodes[dirPath]
+	dir, _ := t.Lookup(dirPath)
 
 	newDir := &Node{
-		Address:     address,
+		Name:        path.Base(address),
 		IsDirectory: true,
 		Childs:      nil,
-		Parent:      dir.Address,
 		CreatedOn: time.Now(),
 	}
 
-	dir.Childs = append(dir.Childs, newDir)
-	t.Nodes[address] = newDir
+	t.link(dir, newDir)
 
-	t.CommitUpdate("mkdir", address)
+	t.CommitUpdate(OpMkdir, newDir)
 
 	return nil
 }
 
+// RemoveDirectory removes the directory with everything in it. The chunks
+// of its files are purged later, see Deletions.
 func (t *Tree) RemoveDirectory(address string) (*Node, error) {
 	address, matched := CleanAddress(address)
 
@@ -170,22 +319,89 @@ func (t *Tree) RemoveDirectory(address string) (*Node, error) {
 	if !t.DirectoryExists(address) {
 		return nil, fmt.Errorf("/%s/ directory does not exist", address)
 	}
+	if address == "." {
+		return nil, fmt.Errorf("cannot remove the root directory")
+	}
+	if err := checkWritable(address); err != nil {
+		return nil, err
+	}
 
-	node, _ := t.GetNodeByAddress(address)
-	node.Removed = true // lazy removing; will be removed later
-	t.Removed = append(t.Removed, node)
-	delete(t.Nodes, address)
-
-	t.CommitUpdate("rmdir", address)
+	id, _ := uuid.NewUUID()
+	node := t.ApplyRemoveDirectory(address, id.String())
+	wal.Append(&LogEntry{Op: OpRmdir, Address: address, ID: id.String()})
 
 	return node, nil
 }
 
+// ApplyRemoveDirectory takes the directory and everything in it out of the
+// tree, and queues the deletion of its files with the given ID.
+func (t *Tree) ApplyRemoveDirectory(address string, id string) *Node {
+	dir, ok := t.Lookup(address)
+	if !ok {
+		return nil
+	}
+
+	deletion := &Deletion{ID: id, Address: address}
+
+	// The files of the deletion are taken out of the tree with their
+	// addresses as their names, so that they keep them.
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		if !node.IsDirectory {
+			node.Name = node.Address()
+			t.drop(node)
+			node.parent = nil
+			t.recharge(node)
+			deletion.Files = append(deletion.Files, node)
+			return
+		}
+		t.drop(node)
+
+		for _, child := range node.Childs {
+			if !child.Removed {
+				walk(child)
+			}
+		}
+	}
+	walk(dir)
+
+	dir.Removed = true // lazy removing; will be removed later
+	t.Removed = append(t.Removed, dir)
+
+	deletion.Total = len(deletion.Files)
+	if deletion.Total != 0 {
+		t.Deletions = append(t.Deletions, deletion)
+	}
+
+	return dir
+}
+
+// ApplyPurge drops the file from the deletion, and the deletion once it
+// has no files left.
+func (t *Tree) ApplyPurge(id string, address string) {
+	for i, deletion := range t.Deletions {
+		if deletion.ID != id {
+			continue
+		}
+
+		for j, file := range deletion.Files {
+			if file.Address() == address {
+				deletion.Files = append(deletion.Files[:j], deletion.Files[j+1:]...)
+				break
+			}
+		}
+
+		if len(deletion.Files) == 0 {
+			t.Deletions = append(t.Deletions[:i], t.Deletions[i+1:]...)
+		}
+		return
+	}
+}
+
 func (t *Tree) GetNodeByAddress(address string) (*Node, bool) {
 	address, _ = CleanAddress(address)
-	node, ok := t.Nodes[address]
 
-	return node, ok
+	return t.Lookup(address)
 }
 
 func (t *Tree) CD(address string) (string, error) {
@@ -205,74 +421,306 @@ func (t *Tree) CD(address string) (string, error) {
 	return address, nil
 }
 
-func (t *Tree) CopyFile(fileToCopy string, copyTo string) error {
-	fileToCopy, fileToCopyMatched := CleanAddress(fileToCopy)
-	copyTo, copyToMatched := CleanAddress(copyTo)
+// UpdateFile starts replacing the content of the file. The new chunks go
+// to its Update, and the file keeps the old ones until all the new ones
+// are confirmed. An update that is not finished yet is abandoned, and its
+// chunks are returned to be released.
+func (t *Tree) UpdateFile(address string, size int) (*Node, []string, error) {
+	file, err := t.GetFile(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkWritable(file.Address()); err != nil {
+		return nil, nil, err
+	}
 
-	if !fileToCopyMatched {
-		return fmt.Errorf("/%s wrong file name format", fileToCopy)
+	var abandoned []string
+	if file.Update != nil {
+		abandoned = file.Update.Chunks
 	}
-	if !copyToMatched {
-		return fmt.Errorf("/%s wrong file name format", copyTo)
+
+	// The update has the inode number of the file, which its chunks
+	// refer to.
+	file.Update = &Node{
+		ID:        file.ID,
+		Pending:   map[string]bool{},
+		CreatedOn: time.Now(),
+		Size:      size,
 	}
 
-	var fullFilePath string
+	return file, abandoned, nil
+}
 
-	fileToCopyExists, fileToCopyIsDirectory := t.PathExists(fileToCopy)
+// ConfirmUpdate marks the chunk of the update of the file as confirmed.
+// Once all of them are, the file is switched to the new content, which
+// it tells.
+func (node *Node) ConfirmUpdate(chunkID string) bool {
+	update := node.Update
+	if update == nil || !update.Pending[chunkID] {
+		return false
+	}
 
-	if !fileToCopyExists {
-		return fmt.Errorf("/%s file does not exist", fileToCopy)
-	} else if fileToCopyIsDirectory {
-		return fmt.Errorf("/%s/ cannot copy directory", fileToCopy)
+	delete(update.Pending, chunkID)
+	if len(update.Pending) != 0 {
+		return false
 	}
 
-	if t.DirectoryExists(copyTo) {
-		fullFilePath = path.Join(copyTo, path.Base(fileToCopy))
-	} else if t.FileExists(copyTo) {
-		return fmt.Errorf("%s the file already exists", fileToCopy)
-	} else {
-		fullFilePath = copyTo
+	node.SwitchUpdate()
+	return true
+}
+
+// SwitchUpdate switches the file to the content of its update. The old
+// content becomes the newest previous version, to be pruned by the
+// retention of the file.
+func (node *Node) SwitchUpdate() {
+	update := node.Update
+
+	node.Versions = append(node.Versions, &Version{
+		Number:     node.Version,
+		Chunks:     node.Chunks,
+		Size:       node.Size,
+		Coding:     node.Coding,
+		CreatedOn:  node.CreatedOn,
+		ReplacedOn: update.CreatedOn,
+	})
+
+	node.Version++
+	node.Chunks = update.Chunks
+	node.Size = update.Size
+	node.Coding = update.Coding
+	node.CreatedOn = update.CreatedOn
+	node.Update = nil
+}
+
+// AllChunks returns the chunks of the file together with the ones of its
+// update and its previous versions.
+func (node *Node) AllChunks() []string {
+	if node.Update == nil && len(node.Versions) == 0 {
+		return node.Chunks
+	}
+
+	all := append([]string(nil), node.Chunks...)
+	if node.Update != nil {
+		all = append(all, node.Update.Chunks...)
+	}
+	for _, version := range node.Versions {
+		all = append(all, version.Chunks...)
+	}
+
+	return all
+}
+
+// destination returns where the file is copied or moved to: into the
+// directory, if to is one, or else to the path itself.
+func (t *Tree) destination(from, to string) (string, error) {
+	from, fromMatched := CleanAddress(from)
+	to, toMatched := CleanAddress(to)
+
+	if !fromMatched {
+		return "", fmt.Errorf("/%s wrong file name format", from)
+	}
+	if !toMatched {
+		return "", fmt.Errorf("/%s wrong file name format", to)
+	}
+
+	exists, isDirectory := t.PathExists(from)
+	if !exists {
+		return "", fmt.Errorf("/%s file does not exist", from)
+	} else if isDirectory {
+		return "", fmt.Errorf("/%s/ cannot copy or move directory", from)
 	}
 
-	if t.FileExists(fullFilePath) {
-		return fmt.Errorf("/%s the file already exists", fullFilePath)
+	if t.DirectoryExists(to) {
+		to = path.Join(to, path.Base(from))
+	}
+	if err := checkWritable(to); err != nil {
+		return "", err
 	}
 
-	parentDir := t.Nodes[path.Dir(fullFilePath)]
+	// Files that are being uploaded are in the tree already.
+	if _, ok := t.Lookup(to); ok {
+		return "", fmt.Errorf("/%s the file already exists", to)
+	}
 
-	copiedFile := *t.Nodes[fileToCopy]
-	copiedFile.Parent = parentDir.Address
-	copiedFile.Address = fullFilePath
+	if !t.DirectoryExists(path.Dir(to)) {
+		return "", fmt.Errorf("/%s/ directory does not exist", path.Dir(to))
+	}
 
-	t.Nodes[fullFilePath] = &copiedFile
-	parentDir.Childs = append(parentDir.Childs, &copiedFile)
+	return to, nil
+}
 
-	t.CommitUpdate("copy", fileToCopy, copyTo)
+// place puts a copy of the file at the address. The copy has the same
+// chunks, but doesn't share its slices with the file.
+func (t *Tree) place(file *Node, address string) *Node {
+	parent, _ := t.Lookup(path.Dir(address))
 
-	return nil
+	placed := &Node{
+		Name:      path.Base(address),
+		Pending:   map[string]bool{},
+		Chunks:    append([]string(nil), file.Chunks...),
+		CreatedOn: file.CreatedOn,
+		Size:      file.Size,
+		Coding:    file.Coding,
+		Version:   1,
+	}
+
+	t.link(parent, placed)
+
+	return placed
 }
 
-func (t *Tree) MoveFile(fileToMove string, moveTo string) error {
-	fileToMove, fileToMoveMatched := CleanAddress(fileToMove)
-	moveTo, moveToMatched := CleanAddress(moveTo)
+// CopyFile copies the file, sharing its chunks with the copy. A file that
+// is still being uploaded cannot be copied.
+func (t *Tree) CopyFile(fileToCopy string, copyTo string) (*Node, error) {
+	copyTo, err := t.destination(fileToCopy, copyTo)
+	if err != nil {
+		return nil, err
+	}
+
+	file, _ := t.GetNodeByAddress(fileToCopy)
+	copied := t.place(file, copyTo)
+	copied.CreatedOn = time.Now()
+
+	t.CommitUpdate(OpCopy, copied)
 
-	if !fileToMoveMatched {
-		return fmt.Errorf("/%s wrong file name format", fileToMove)
+	return copied, nil
+}
+
+// Move moves the file or the directory with everything in it to the new
+// address, or into the directory at it. With replace, it takes the place
+// of the file or the empty directory there, which is removed and returned.
+// The caller is to release the chunks of the replaced file.
+func (t *Tree) Move(from string, to string, replace bool) (moved *Node, replaced *Node, err error) {
+	from, fromMatched := CleanAddress(from)
+	to, toMatched := CleanAddress(to)
+
+	if !fromMatched {
+		return nil, nil, fmt.Errorf("/%s wrong file name format", from)
+	}
+	if !toMatched {
+		return nil, nil, fmt.Errorf("/%s wrong file name format", to)
 	}
-	if !moveToMatched {
-		return fmt.Errorf("/%s wrong file name format", moveTo)
 
+	moved, ok := t.GetNodeByAddress(from)
+	if !ok || !t.Exists(from) || moved == t.root {
+		return nil, nil, fmt.Errorf("/%s path does not exist", from)
 	}
 
-	err := t.CopyFile(fileToMove, moveTo)
+	if t.DirectoryExists(to) {
+		to = path.Join(to, moved.Name)
+	}
+	to, _ = CleanAddress(to)
 
-	if err != nil {
-		return fmt.Errorf("impossible to move file: %e", err)
+	if err := checkWritable(from); err != nil {
+		return nil, nil, err
+	}
+	if err := checkWritable(to); err != nil {
+		return nil, nil, err
+	}
+
+	if to == from || strings.HasPrefix(to, from+"/") {
+		return nil, nil, fmt.Errorf("/%s cannot move into itself", to)
 	}
 
-	_, _ = t.RemoveFile(fileToMove)
+	if !t.DirectoryExists(path.Dir(to)) {
+		return nil, nil, fmt.Errorf("/%s/ directory does not exist", path.Dir(to))
+	}
 
-	return nil
+	// Files that are being uploaded are in the tree already.
+	if existing, ok := t.Lookup(to); ok {
+		switch {
+		case !replace:
+			return nil, nil, fmt.Errorf("/%s the path already exists", to)
+		case !t.Exists(to):
+			return nil, nil, fmt.Errorf("/%s the file is being uploaded", to)
+		case existing.IsDirectory != moved.IsDirectory:
+			return nil, nil, fmt.Errorf("/%s cannot replace a file with a directory or the other way round", to)
+		case existing.IsDirectory && !t.isEmpty(existing):
+			return nil, nil, fmt.Errorf("/%s/ cannot replace directory that is not empty", to)
+		}
+
+		replaced = existing
+		replaced.Removed = true // lazy removing
+		t.Removed = append(t.Removed, replaced)
+		t.drop(replaced)
+
+		if replaced.IsDirectory {
+			t.CommitUpdate(OpRmdir, replaced)
+		} else {
+			t.CommitUpdate(OpRmfile, replaced)
+		}
+	}
+
+	t.ApplyRename(from, to)
+	wal.Append(&LogEntry{Op: OpRename, Address: from, To: to})
+
+	return moved, replaced, nil
+}
+
+func (t *Tree) isEmpty(dir *Node) bool {
+	for _, child := range dir.Childs {
+		if !child.Removed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ApplyRename moves the node to the address, which must be free. Its
+// descendants go along with it without being touched, as their addresses
+// are made up of the names on the way from the root. Only a move that
+// changes what the files are counted for, into the trash for one, walks
+// them to count them anew.
+func (t *Tree) ApplyRename(from string, to string) {
+	node, ok := t.Lookup(from)
+	if !ok {
+		return
+	}
+
+	parent, ok := t.Lookup(path.Dir(to))
+	if !ok {
+		return
+	}
+
+	t.unlink(node)
+	node.Name = path.Base(to)
+	t.link(parent, node)
+
+	if chargeMoves(from, to) {
+		t.rechargeAll(node)
+	}
+}
+
+// unlink takes the node from the children of its parent.
+func (t *Tree) unlink(node *Node) {
+	parent := node.parent
+	if parent == nil {
+		return
+	}
+
+	if parent.children[node.Name] == node {
+		delete(parent.children, node.Name)
+	}
+
+	for i, child := range parent.Childs {
+		if child == node {
+			parent.Childs = append(parent.Childs[:i], parent.Childs[i+1:]...)
+			return
+		}
+	}
+}
+
+// rechargeAll counts the node, and everything under it, anew.
+func (t *Tree) rechargeAll(node *Node) {
+	if node.Removed {
+		return
+	}
+
+	t.recharge(node)
+	for _, child := range node.Childs {
+		t.rechargeAll(child)
+	}
 }
 
 func (t *Tree) LS(address string) ([]string, error) {
@@ -289,10 +737,11 @@ func (t *Tree) LS(address string) ([]string, error) {
 	var list = []string{}
 
 	for _, node := range dir.Childs {
-		if !t.Exists(node.Address) || node.Removed {
+		// Files that are being uploaded are hidden.
+		if node.Removed || len(node.Pending) != 0 {
 			continue
 		}
-		name := path.Base(node.Address)
+		name := node.Name
 		if node.IsDirectory {
 			name += "/"
 		}
@@ -304,10 +753,10 @@ func (t *Tree) LS(address string) ([]string, error) {
 
 func (t *Tree) PathExists(address string) (exists bool, isDirectory bool) {
 	address, _ = CleanAddress(address)
-	node, ok := t.Nodes[address]
+	node, ok := t.Lookup(address)
 
 	if ok {
-		return ok && len(node.Pending) == 0 && !t.Nodes[address].Removed && t.ParentsExist(node), t.Nodes[address].IsDirectory
+		return ok && len(node.Pending) == 0 && !node.Removed && t.ParentsExist(node), node.IsDirectory
 	}
 	return ok, false
 }
@@ -318,22 +767,18 @@ func (t *Tree) Exists(address string) bool {
 }
 
 func (t *Tree) ParentsExist(node *Node) bool {
-	if node.Address == "." {
+	if node == t.root {
 		return true
 	}
 
-	parent, _ := t.GetNodeByAddress(node.Parent)
-	if parent.Removed {
+	parent := node.parent
+	if parent == nil || parent.Removed {
 		return false
 	}
 
-	result := t.ParentsExist(parent)
-
-	if result == false {
-		node.Removed = true
-	}
-
-	return result
+	// It is called with the state locked only for reading, so it must not
+	// mark the node as removed.
+	return t.ParentsExist(parent)
 }
 func (t *Tree) FileExists(address string) bool {
 	exists, isDirectory := t.PathExists(address)
@@ -348,8 +793,7 @@ func (t *Tree) DirectoryExists(address string) bool {
 }
 
 func (t *Tree) ParentNode(node *Node) *Node {
-	parentNode, _ := t.GetNodeByAddress(node.Parent)
-	return parentNode
+	return node.parent
 }
 
 func (t *Tree) NodeInfo(address string) (string, error) {
@@ -376,6 +820,13 @@ func (t *Tree) NodeInfo(address string) (string, error) {
 	sizeKB := float32(node.Size) / 1024
 	sizeOnDFS := sizeKB * 2 + 1
 
+	lease := "none"
+	if node.Lease != nil {
+		lease = "held until " + node.Lease.Expires.Format("2006-01-02 15:04:05")
+	}
+
+	owner, group, mode := node.Permissions()
+
 	return fmt.Sprintf(
 		"Base name: %s\n"+
 			"Full path: %s\n"+
@@ -383,71 +834,58 @@ func (t *Tree) NodeInfo(address string) (string, error) {
 			"Directory: %v\n"+
 			"Number of chunks: %d\n"+
 			"File size: %d bytes (%.2f KB)\n"+
-			"Real size on dfs: ~%.2f KB",
+			"Real size on dfs: ~%.2f KB\n"+
+			"Version: %d (%d previous kept)\n"+
+			"Write lease: %s\n"+
+			"Owner: %s:%s\n"+
+			"Mode: %03o",
 		path.Base(address),
-		"/" + node.Address,
+		"/" + node.Address(),
 		node.CreatedOn.Format("2006-01-02 15:04:05"),
 		isDirectory,
 		chunksNum,
 		size,
 		sizeKB,
 		sizeOnDFS,
+		node.Version,
+		len(node.Versions),
+		lease,
+		owner,
+		group,
+		mode,
 	), nil
 }
 
-func (t *Tree) SaveTree(saveTo string) bool {
-	file, _ := os.Create(saveTo)
-	defer file.Close()
-	encoder := gob.NewEncoder(file)
-
-	encoder.Encode(t)
-	return true
-}
-
-func LoadTree(openFrom string) *Tree {
-	file, _ := os.Open(openFrom)
-	defer file.Close()
-
-	decoder := gob.NewDecoder(file)
-
-	var tree Tree
-	decoder.Decode(&tree)
-
-	return &tree
-}
-
-func (t *Tree) CommitUpdate(command string, args ...string) {
-	f, err := os.OpenFile(t.Conf.TreeLogName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Println(err)
-	}
-	defer f.Close()
+// CommitUpdate journals the change of the node made by the operation, and
+// counts the node anew for quotas.
+func (t *Tree) CommitUpdate(op string, node *Node) {
+	t.recharge(node)
 
-	if _, err := f.WriteString(fmt.Sprintf("%d\t%s\t%s\n", t.Version, command, strings.Join(args, "\t"))); err != nil {
-		log.Println(err)
+	entry := &LogEntry{Op: op}
+	if op == OpRmfile || op == OpRmdir {
+		entry.Address = node.Address()
+	} else {
+		entry.Node = node.Record()
 	}
 
-	t.Version += 1
-
-	if t.Version%100 == t.Conf.TreeUpdatePeriod {
-		t.ClearRemoved()
-		t.SaveTree(t.Conf.TreeGobName)
-
-		os.Remove(t.Conf.TreeLogName)
-	}
+	wal.Append(entry)
 }
 
 func (t *Tree) PrintTreeStruct() {
-	PrintDir(0, t.Nodes["."])
+	PrintDir(0, t.root)
 }
 
 func (t *Tree) ClearRemoved() {
 	for _, node := range t.Removed {
-		parent := t.ParentNode(node)
+		// The files of removed directories are out of the tree.
+		parent := node.parent
+		if parent == nil {
+			continue
+		}
 
 		toRemoveInd := -1
 		for i, parentChild := range parent.Childs {
-			if parentChild.Address == node.Address {
+			if parentChild == node {
 				toRemoveInd = i
 				break
 			}
@@ -466,7 +904,7 @@ func (t *Tree) ClearRemoved() {
 }
 
 func PrintDir(depth int, dir *Node) {
-	fmt.Printf("%s├── %s\n", strings.Repeat("│   ", depth), path.Base(dir.Address)+"/")
+	fmt.Printf("%s├── %s\n", strings.Repeat("│   ", depth), dir.Name+"/")
 	for _, c := range dir.Childs {
 		if c.Removed {
 			continue
@@ -475,7 +913,7 @@ func PrintDir(depth int, dir *Node) {
 		if c.IsDirectory {
 			PrintDir(depth+1, c)
 		} else {
-			fmt.Printf("%s├── %s\n", strings.Repeat("│   ", depth+1), path.Base(c.Address))
+			fmt.Printf("%s├── %s\n", strings.Repeat("│   ", depth+1), c.Name)
 		}
 	}
 }
@@ -2,29 +2,51 @@ package main
 
 import (
 	"fmt"
-	"reflect"
 	"testing"
 )
 
+// wantNode is what a node in the tree is expected to be.
+type wantNode struct {
+	Address     string
+	IsDirectory bool
+	Parent      string
+	Removed     bool
+}
+
+func assertNode(t *testing.T, got *Node, want *wantNode) {
+	t.Helper()
+
+	if want == nil || got == nil {
+		if (want == nil) != (got == nil) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return
+	}
+
+	if got.Address() != want.Address || got.IsDirectory != want.IsDirectory ||
+		got.parent.Address() != want.Parent || got.Removed != want.Removed {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func TestTree_CreateFile(t *testing.T) {
 	cases := []struct {
 		filename string
-		want     Node
+		want     *wantNode
 	}{
-		{"hello.txt", Node{"hello.txt", false, nil, ".", false}},
-		{".lala.txt", Node{".lala.txt", false, nil, ".", false}},
-		{"ohmydog.tar.gz", Node{"ohmydog.tar.gz", false, nil, ".", false}},
+		{"hello.txt", &wantNode{Address: "hello.txt", IsDirectory: false, Parent: "."}},
+		{".lala.txt", &wantNode{Address: ".lala.txt", IsDirectory: false, Parent: "."}},
+		{"ohmydog.tar.gz", &wantNode{Address: "ohmydog.tar.gz", IsDirectory: false, Parent: "."}},
+		{"notexist/ohmydog.tar.gz", nil},
 	}
 	for _, test := range cases {
 		t.Run(fmt.Sprintf("Creating %v", test.filename),
 			func(t *testing.T) {
-				tree := initTree()
-				tree.CreateFile(test.filename)
+				tree := InitTree(Namenode{})
+				tree.CreateFile(test.filename, 0)
 				got, _ := tree.GetNodeByAddress(test.filename)
 
-				if !reflect.DeepEqual(*got, test.want) {
-					t.Errorf("got %v, want %v", got, test.want)
-				}
+				assertNode(t, got, test.want)
 			})
 	}
 }
@@ -32,27 +54,267 @@ func TestTree_CreateFile(t *testing.T) {
 func TestTree_CreateDirectory(t *testing.T) {
 	cases := []struct {
 		filename string
-		want     *Node
+		want     *wantNode
 	}{
-		{"hello.txt", &Node{"hello.txt", true, nil, ".", false}},
-		{".lala.txt", &Node{".lala.txt", true, nil, ".", false}},
-		{"ohmydog.tar.gz", &Node{"ohmydog.tar.gz", true, nil, ".", false}},
+		{"hello.txt", &wantNode{Address: "hello.txt", IsDirectory: true, Parent: "."}},
+		{".lala.txt", &wantNode{Address: ".lala.txt", IsDirectory: true, Parent: "."}},
+		{"ohmydog.tar.gz", &wantNode{Address: "ohmydog.tar.gz", IsDirectory: true, Parent: "."}},
 		{"notexist/ohmydog.tar.gz", nil},
 	}
 	for _, test := range cases {
 		t.Run(fmt.Sprintf("Creating %v", test.filename),
 			func(t *testing.T) {
-				tree := initTree()
+				tree := InitTree(Namenode{})
 				tree.CreateDirectory(test.filename)
 				got, _ := tree.GetNodeByAddress(test.filename)
 
-				if test.want == nil || got == nil {
-					if test.want != got {
-						t.Errorf("Non nil")
-					}
-				} else if !reflect.DeepEqual(*got, *test.want) {
-					t.Errorf("got %v, want %v", got, test.want)
+				assertNode(t, got, test.want)
+			})
+	}
+}
+
+// fileWithChunk makes a tree with a confirmed file a/file and a directory b.
+func fileWithChunk() *Tree {
+	tree := InitTree(Namenode{})
+	tree.CreateDirectory("a")
+	tree.CreateDirectory("b")
+	file, _ := tree.CreateFile("a/file", 1)
+	file.Chunks = []string{"chunk"}
+
+	return tree
+}
+
+func TestTree_CopyFile(t *testing.T) {
+	cases := []struct {
+		to   string
+		want *wantNode
+	}{
+		{"b", &wantNode{Address: "b/file", Parent: "b"}},
+		{"b/copy", &wantNode{Address: "b/copy", Parent: "b"}},
+		{"a/file", nil},
+		{"a", nil},
+		{"notexist/copy", nil},
+	}
+	for _, test := range cases {
+		t.Run(fmt.Sprintf("Copying to %v", test.to),
+			func(t *testing.T) {
+				tree := fileWithChunk()
+				got, _ := tree.CopyFile("a/file", test.to)
+
+				assertNode(t, got, test.want)
+				if got == nil {
+					return
+				}
+
+				got.Chunks[0] = "changed"
+				if file, _ := tree.GetNodeByAddress("a/file"); file.Chunks[0] != "chunk" {
+					t.Errorf("copy shares the chunk list with the file")
 				}
 			})
 	}
 }
+
+func TestTree_Move(t *testing.T) {
+	defer func(saved *ChunkTable) { ct = saved }(ct)
+	tree := fileWithChunk()
+	file, _ := tree.GetFile("a/file")
+	ct = &ChunkTable{Table: map[string]*Chunk{"chunk": {ChunkID: "chunk", File: file.ID}}}
+	tree.CreateDirectory("a/sub")
+	tree.CreateFile("a/sub/other", 0)
+	pending, _ := tree.CreateFile("b/pending", 1)
+	pending.Pending["chunk"] = true
+
+	got, _, err := tree.Move("a", "b/renamed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertNode(t, got, &wantNode{Address: "b/renamed", IsDirectory: true, Parent: "b"})
+	for _, address := range []string{"b/renamed/file", "b/renamed/sub/other"} {
+		if !tree.FileExists(address) {
+			t.Errorf("%s is not moved with its directory", address)
+		}
+	}
+
+	if tree.Exists("a") || tree.Exists("a/file") || tree.Inodes[ct.Table["chunk"].File].Address() != "b/renamed/file" {
+		t.Errorf("directory is not moved with its files and chunks")
+	}
+
+	cases := []struct {
+		from, to string
+		replace  bool
+	}{
+		{"b/pending", "b/renamed", false},
+		{"b", "b/renamed/sub", false},
+		{"b/renamed/file", "b/renamed/sub/other", false},
+		{"b/renamed/file", "b/pending", true},
+		{"b/renamed/sub", "b/renamed/file", true},
+		{"b/renamed", "b", true},
+	}
+	for _, test := range cases {
+		if _, _, err := tree.Move(test.from, test.to, test.replace); err == nil {
+			t.Errorf("%s is moved to %s", test.from, test.to)
+		}
+	}
+
+	_, replaced, err := tree.Move("b/renamed/file", "b/renamed/sub/other", true)
+	if err != nil || replaced == nil || replaced.Address() != "b/renamed/sub/other" {
+		t.Fatalf("file does not replace another one: %v, %v", replaced, err)
+	}
+
+	if !tree.FileExists("b/renamed/sub/other") || tree.Exists("b/renamed/file") {
+		t.Errorf("replaced file is not moved")
+	}
+}
+
+// TestTree_MoveLargeDirectory moves a directory of 100 000 files back and
+// forth, which must not take longer with the files it has.
+func TestTree_MoveLargeDirectory(t *testing.T) {
+	defer func(saved *Config, journal *Journal) { conf, wal = saved, journal }(conf, wal)
+	conf, wal = &Config{}, nil
+
+	tree := InitTree(Namenode{})
+	tree.CreateDirectory("big")
+	tree.CreateDirectory("other")
+	for i := 0; i < 100; i++ {
+		dir := fmt.Sprintf("big/dir%d", i)
+		tree.CreateDirectory(dir)
+		for j := 0; j < 1000; j++ {
+			tree.CreateFile(fmt.Sprintf("%s/file%d", dir, j), 1)
+		}
+	}
+
+	file, _ := tree.GetNodeByAddress("big/dir99/file999")
+	if len(tree.Inodes) != 100103 || file == nil {
+		t.Fatalf("got %d nodes, want 100103", len(tree.Inodes))
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		tree.Move("big", "other/moved", false)
+		tree.Move("other/moved", "big", false)
+	})
+	if allocs > 1000 {
+		t.Errorf("moving the directory takes %.0f allocations", allocs)
+	}
+
+	if _, _, err := tree.Move("big", "other/moved", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := tree.GetNodeByAddress("other/moved/dir99/file999"); got != file || tree.Inodes[file.ID] != file {
+		t.Errorf("file is not moved with its directory: %v", got)
+	}
+	if tree.Exists("big") || tree.Exists("big/dir99/file999") {
+		t.Errorf("directory is left at its old address")
+	}
+}
+
+func TestTree_RemoveDirectory(t *testing.T) {
+	tree := fileWithChunk()
+	tree.CreateDirectory("a/sub")
+	tree.CreateFile("a/sub/other", 0)
+
+	if _, err := tree.RemoveDirectory("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.Deletions) != 1 || tree.Deletions[0].Total != 2 {
+		t.Fatalf("got deletions %v, want one of 2 files", tree.Deletions)
+	}
+
+	tree.CreateDirectory("a")
+	tree.CreateDirectory("a/sub")
+	for _, address := range []string{"a/file", "a/sub/other"} {
+		if tree.Exists(address) {
+			t.Errorf("%s is back with its directory", address)
+		}
+	}
+
+	if _, err := tree.RemoveDirectory("."); err == nil {
+		t.Errorf("root directory is removed")
+	}
+}
+
+func TestTree_UpdateFile(t *testing.T) {
+	tree := fileWithChunk()
+
+	file, abandoned, err := tree.UpdateFile("a/file", 2)
+	if err != nil || len(abandoned) != 0 {
+		t.Fatalf("got %v, %v", abandoned, err)
+	}
+
+	file.Update.Chunks = []string{"new1", "new2"}
+	file.Update.Pending = map[string]bool{"new1": true, "new2": true}
+
+	if file.ConfirmUpdate("new1") || file.Chunks[0] != "chunk" {
+		t.Errorf("file is switched before all of its new chunks are confirmed")
+	}
+
+	if !file.ConfirmUpdate("new2") || fmt.Sprint(file.Chunks) != "[new1 new2]" || file.Size != 2 || file.Update != nil || file.Version != 2 {
+		t.Errorf("file is not switched to its new content: %v", file)
+	}
+
+	if len(file.Versions) != 1 || file.Versions[0].Number != 1 || fmt.Sprint(file.Versions[0].Chunks) != "[chunk]" {
+		t.Errorf("old content is not kept as a version: %v", file.Versions)
+	}
+
+	file.Update = &Node{Chunks: []string{"unfinished"}}
+	if _, abandoned, _ := tree.UpdateFile("a/file", 1); fmt.Sprint(abandoned) != "[unfinished]" {
+		t.Errorf("got abandoned chunks %v, want the unfinished update", abandoned)
+	}
+}
+
+func TestTree_SnapshotDirectory(t *testing.T) {
+	tree := fileWithChunk()
+	tree.CreateDirectory("a/sub")
+	pending, _ := tree.CreateFile("a/sub/pending", 1)
+	pending.Pending["new"] = true
+
+	address, chunks, err := tree.SnapshotDirectory("/a@before")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if address != ".snapshots/a@before" || fmt.Sprint(chunks) != "[chunk]" {
+		t.Errorf("got %s with chunks %v", address, chunks)
+	}
+
+	if list, _ := tree.LS(".snapshots/a@before"); fmt.Sprint(list) != "[file sub/]" {
+		t.Errorf("got snapshot content %v", list)
+	}
+
+	if _, ok := tree.Lookup(".snapshots/a@before/sub/pending"); ok {
+		t.Errorf("file that is being uploaded is in the snapshot")
+	}
+
+	if _, _, err := tree.SnapshotDirectory("a@before"); err == nil {
+		t.Errorf("took the same snapshot twice")
+	}
+
+	tree.RemoveFile("a/file")
+	if file, err := tree.GetFile(".snapshots/a@before/file"); err != nil || file.Chunks[0] != "chunk" {
+		t.Errorf("snapshot is changed with the directory: %v, %v", file, err)
+	}
+
+	if _, err := tree.RemoveFile(".snapshots/a@before/file"); err == nil {
+		t.Errorf("removed a file of the snapshot")
+	}
+	if err := tree.CreateDirectory(".snapshots/a@before/new"); err == nil {
+		t.Errorf("created a directory in the snapshot")
+	}
+	if _, _, err := tree.Move(".snapshots/a@before/file", "b", false); err == nil {
+		t.Errorf("moved a file out of the snapshot")
+	}
+
+	if _, err := tree.DeleteDirectorySnapshot("a@before"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := tree.Lookup(".snapshots"); ok {
+		t.Errorf("empty reserved directory is left")
+	}
+
+	if len(tree.Deletions) != 1 || len(tree.Deletions[0].Files) != 1 {
+		t.Errorf("files of the snapshot are not queued for purging: %v", tree.Deletions)
+	}
+}
@@ -22,15 +22,65 @@ const (
 
 type FileServerInfo struct {
 	mu          sync.Mutex
+	NodeID      string
 	PrivateHost string
 	PublicHost  string
 	Port        int
+	PublicPort  int
 	Alive       bool
 	Status      FSStatus
 	NextAlive   int
 	LastPulse   time.Time
 	ID          int
 	Available   int
+	Load        NodeStatus
+	commands    []*queuedCommand
+
+	// missing holds the confirmed chunks its last inventory lacked.
+	missing map[string]bool
+}
+
+// Addr is the private address of the fileserver. Several fileservers may
+// share a host, so their replicas are kept by address.
+func (fs *FileServerInfo) Addr() string {
+	return fmt.Sprintf("%s:%d", fs.PrivateHost, fs.Port)
+}
+
+// At returns the fileserver of the pool at the private address, or nil.
+func (s *PoolInfo) At(addr string) *FileServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, fs := range s.StorageNodes {
+		if fs.Addr() == addr {
+			return fs
+		}
+	}
+
+	return nil
+}
+
+// NodeStatus is what fileservers report with each heartbeat.
+type NodeStatus struct {
+	Available         int    `json:"available"`
+	ChunkCount        int    `json:"chunkCount"`
+	ActiveTransfers   int    `json:"activeTransfers"`
+	ReadErrors        int    `json:"readErrors"`
+	WriteErrors       int    `json:"writeErrors"`
+	ReplicationErrors int    `json:"replicationErrors"`
+	DiskError         string `json:"diskError"`
+}
+
+func (fs *FileServerInfo) UpdateLoad(status *NodeStatus) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.Load = *status
+	fs.Available = status.Available
+
+	if status.DiskError != "" {
+		log.Printf("Disk of %s is unhealthy: %s", fs.PrivateHost, status.DiskError)
+	}
 }
 
 type PoolInfo struct {
@@ -60,6 +110,7 @@ func InitFServers(conf *Config) *PoolInfo {
 				PrivateHost: storageNode.Host,
 				PublicHost:  storageNode.PublicHost,
 				Port:        conf.Namenode.FSPrivatePort,
+				PublicPort:  conf.Namenode.FSPublicPort,
 				Alive:       true,
 				Status:      LIVE,
 				NextAlive:   (i + 1) % len(conf.Storage),
@@ -70,15 +121,117 @@ func InitFServers(conf *Config) *PoolInfo {
 		i++
 	}
 
+	storage.Alive = len(storage.StorageNodes)
+
 	if len(storage.StorageNodes) < conf.Namenode.Replicas {
-		log.Fatal("Not enough servers. Please add more and restart or reduce the number of replicas (number of replicas <= number of FSs)")
-	} else {
+		if !conf.Namenode.RegistrationEnabled() {
+			log.Fatal("Not enough servers. Please add more and restart or reduce the number of replicas (number of replicas <= number of FSs)")
+		}
+
+		log.Printf("Not enough servers yet; waiting for fileservers to register")
+	}
+
+	if len(storage.StorageNodes) != 0 {
 		storage.StorageNodes[len(storage.StorageNodes)-1].NextAlive = 0
 	}
 
 	return &storage
 }
 
+type RegisterMessage struct {
+	NodeID      string `json:"nodeID"`
+	PrivateHost string `json:"privateHost"`
+	PublicHost  string `json:"publicHost"`
+	PrivatePort int    `json:"privatePort"`
+	PublicPort  int    `json:"publicPort"`
+	Available   int    `json:"available"`
+	Secret      string `json:"secret"`
+}
+
+// Find returns the fileserver of the pool the registration is of: the one
+// with its node ID, or else the one at its private address.
+func (s *PoolInfo) Find(reg *RegisterMessage) *FileServerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var known *FileServerInfo
+	for _, fs := range s.StorageNodes {
+		if reg.NodeID != "" && fs.NodeID == reg.NodeID {
+			return fs
+		}
+		if known == nil && fs.PrivateHost == reg.PrivateHost && fs.Port == reg.PrivatePort {
+			known = fs
+		}
+	}
+
+	return known
+}
+
+// RegisterFServer admits a fileserver that announced itself. A node coming
+// back with the same ID, or registering at the address of a statically
+// configured node, keeps its place in the pool.
+func (s *PoolInfo) RegisterFServer(reg *RegisterMessage) (*FileServerInfo, error) {
+	known := s.Find(reg)
+
+	if known == nil {
+		fs := &FileServerInfo{
+			NodeID:      reg.NodeID,
+			PrivateHost: reg.PrivateHost,
+			PublicHost:  reg.PublicHost,
+			Port:        reg.PrivatePort,
+			PublicPort:  reg.PublicPort,
+			Available:   reg.Available,
+			Alive:       true,
+			Status:      LIVE,
+			LastPulse:   time.Now(),
+		}
+		s.AddFServer(fs)
+
+		return fs, nil
+	}
+
+	if known.PrivateHost != reg.PrivateHost {
+		return nil, fmt.Errorf("node %s is already registered at %s", reg.NodeID, known.PrivateHost)
+	}
+
+	if known.NodeID != "" && known.NodeID != reg.NodeID {
+		return nil, fmt.Errorf("%s is already registered as node %s", known.Addr(), known.NodeID)
+	}
+
+	known.mu.Lock()
+	known.NodeID = reg.NodeID
+	known.PublicHost = reg.PublicHost
+	known.Port = reg.PrivatePort
+	known.PublicPort = reg.PublicPort
+	known.Available = reg.Available
+	known.mu.Unlock()
+
+	return known, nil
+}
+
+// AddFServer appends a live fileserver to the pool and links it into the
+// ring of alive servers.
+func (s *PoolInfo) AddFServer(fs *FileServerInfo) {
+	s.mu.Lock()
+	fs.ID = len(s.StorageNodes)
+	s.StorageNodes = append(s.StorageNodes, fs)
+
+	num := len(s.StorageNodes)
+	fs.NextAlive = fs.ID
+	for i := 1; i < num; i++ {
+		next := (fs.ID + i) % num
+		if s.StorageNodes[next].Alive {
+			fs.NextAlive = next
+			break
+		}
+	}
+
+	s.Alive += 1
+	s.mu.Unlock()
+
+	s.setNewAlive(fs.ID, fs.ID-1)
+}
+
 func ProbeFServer(host string, port int) (int, bool) {
 	log.Printf("Probing %s:%d", host, port)
 
@@ -113,6 +266,10 @@ func ProbeFServer(host string, port int) (int, bool) {
 }
 
 func (s *PoolInfo) Select() *FileServerInfo {
+	if len(s.StorageNodes) == 0 {
+		return nil
+	}
+
 	next := s.StorageNodes[s.Next]
 
 	if !next.Alive {
@@ -131,17 +288,21 @@ func (s *PoolInfo) SelectSeveralExcept(exceptMap map[string]*FileServerInfo, num
 
 	selected := []*FileServerInfo{}
 
+	if len(s.StorageNodes) == 0 {
+		return selected
+	}
+
 	next := s.StorageNodes[s.Next]
 	start := next
 	for i := 0; i < num; {
-		if !next.Alive || exceptMap[next.PrivateHost] != nil {
+		if !next.Alive || exceptMap[next.Addr()] != nil {
 		} else {
 			selected = append(selected, next)
 			i++
 		}
 		next = s.StorageNodes[next.NextAlive]
 
-		if &next == &start {
+		if next == start {
 			break
 		}
 	}
@@ -158,7 +319,13 @@ func (s *PoolInfo) SelectSeveralExceptArr(except []string, num int) []*FileServe
 	return s.SelectSeveralExcept(exceptMap, num)
 }
 
+// SelectAmong picks one of the fileservers in turn. Downloads pick with
+// the state locked only for reading, so the turn is kept under the lock of
+// the pool.
 func (s *PoolInfo) SelectAmong(among map[string]*FileServerInfo) (*FileServerInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	next := s.Next
 	var chosen *FileServerInfo
 
@@ -233,45 +400,39 @@ func ExpectChunksFromClient(inversed map[string][]string, token string) {
 	}
 }
 
-func Replicate(chunk *Chunk, sender string, receiver *FileServerInfo) {
-	client := &http.Client{}
-	json := []byte(fmt.Sprintf("[\"%s\"]", chunk.ChunkID))
-
+// Replicate asks receiver to expect the chunk and, once it does, asks
+// sender to push the chunk there. Both steps go through the command queues.
+func Replicate(chunk *Chunk, sender *FileServerInfo, receiver *FileServerInfo) {
 	ct.ivmu.Lock()
-	ct.InvertedTable[receiver.PrivateHost] = append(ct.InvertedTable[receiver.PrivateHost], chunk)
+	ct.InvertedTable[receiver.Addr()] = append(ct.InvertedTable[receiver.Addr()], chunk)
 	ct.ivmu.Unlock()
 
 	token := generateToken()
+	chunks := []string{chunk.ChunkID}
 
-	req, _ := http.NewRequest(
-		"GET",
-		fmt.Sprintf("http://%s:%d/expect/%s?action=write", receiver.PrivateHost, conf.Namenode.FSPrivatePort, token),
-		bytes.NewBuffer(json))
-	req.Header.Set("Content-Type", "application/json")
-	//req.Header.Set("mock", "mock")
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("%v\n", resp)
-		// cancel token (cancelToken)
-		return
-	}
-	fmt.Println("response Status:", resp.Status)
-	fmt.Println("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	fmt.Println("response Body:", string(body))
-
-	req, _ = http.NewRequest(
-		"GET",
-		fmt.Sprintf("http://%s:%d/replicate?token=%s&addr=%s",
-			sender, conf.Namenode.FSPrivatePort, token, fmt.Sprintf("%s:%d", receiver.PrivateHost, conf.Namenode.FSPublicPort)),
-		bytes.NewBuffer(json))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err = client.Do(req)
-	if err != nil {
-		fmt.Printf("%v\n", resp)
-		// cancel token (cancelToken)
-		return
-	}
+	expect := &Command{Kind: CommandExpect, Action: "write", Token: token, Chunks: chunks}
+	receiver.Enqueue(expect, func(err error) {
+		if err != nil {
+			log.Printf("%s could not expect replica of %s: %v", receiver.PrivateHost, chunk.ChunkID, err)
+			return
+		}
+
+		replicate := &Command{
+			Kind:   CommandReplicate,
+			Token:  token,
+			Addr:   fmt.Sprintf("%s:%d", receiver.PrivateHost, receiver.PublicPort),
+			Chunks: chunks,
+		}
+
+		sender.Enqueue(replicate, func(err error) {
+			if err == nil {
+				return
+			}
+
+			log.Printf("%s could not replicate %s to %s: %v", sender.PrivateHost, chunk.ChunkID, receiver.PrivateHost, err)
+			receiver.Enqueue(&Command{Kind: CommandCancelToken, Token: token}, nil)
+		})
+	})
 }
 
 func (s *PoolInfo) ChangeStatus(id int, status FSStatus) {
@@ -310,24 +471,10 @@ func (s *PoolInfo) ChangeStatus(id int, status FSStatus) {
 
 }
 
+// PurgeChunks queues a purge for the fileserver. It is delivered with the
+// response to its next heartbeat, even if the fileserver is down now.
 func (s *PoolInfo) PurgeChunks(id int, chunks []string) {
-	fs := s.StorageNodes[id]
-
-	jsonChunks, _ := json.Marshal(chunks)
-
-	client := &http.Client{}
-
-	req, _ := http.NewRequest(
-		"POST",
-		fmt.Sprintf("http://%s:%d/purge", fs.PrivateHost, conf.Namenode.FSPrivatePort),
-		bytes.NewBuffer(jsonChunks))
-
-	req.Header.Set("Content-Type", "application/json")
-	_, err := client.Do(req)
-	if err != nil {
-		// todo: add to queue
-		return
-	}
+	s.StorageNodes[id].Enqueue(&Command{Kind: CommandPurge, Chunks: chunks}, nil)
 }
 
 func (s *PoolInfo) IsDead(id int, soft bool) bool {
@@ -347,8 +494,11 @@ func (s *PoolInfo) NodeIsDead(id int) {
 func (s *PoolInfo) FSIsDown(node *FileServerInfo) {
 	log.Printf("OMG, %s is down", node.PrivateHost)
 
+	state.Lock()
+	defer state.Unlock()
+
 	ct.ivmu.Lock()
-	chunks, ok := ct.InvertedTable[node.PrivateHost]
+	chunks, ok := ct.InvertedTable[node.Addr()]
 	ct.ivmu.Unlock()
 
 	if !ok {
@@ -359,7 +509,7 @@ func (s *PoolInfo) FSIsDown(node *FileServerInfo) {
 	for _, chunk := range chunks {
 		switch chunk.Status {
 		case PENDING:
-			chunk.Status = DOWN
+			chunk.SetStatus(DOWN)
 			log.Printf("Impossible to replicate. The file is dead now. Chunk: %v", chunk)
 			//log.Fatal("Impossible to replicate. The file is dead now.")
 		case OBSOLETE, DOWN:
@@ -367,6 +517,12 @@ func (s *PoolInfo) FSIsDown(node *FileServerInfo) {
 			continue
 		}
 
+		if chunk.Stripe != nil {
+			chunk.RemoveFSFromChunk(node)
+			s.RebuildShard(chunk, node)
+			continue
+		}
+
 		sender, _ := s.SelectAmong(chunk.FServers)
 		newFS := s.SelectSeveralExcept(chunk.FServers, 1)
 
@@ -375,24 +531,24 @@ func (s *PoolInfo) FSIsDown(node *FileServerInfo) {
 			// todo: put it to a queue
 			return
 		}
-		delete(chunk.FServers, node.PrivateHost)
-		chunk.ReadyReplicas -= 1
-		chunk.AllReplicas -= 1
-
+		chunk.RemoveFSFromChunk(node)
 		chunk.AddFSToChunk(newFS[0])
 
 		log.Printf("OMG, %s is down; replicating %s from %s to %s", node.PrivateHost, chunk.ChunkID, sender.PrivateHost, newFS[0].PrivateHost)
-		go Replicate(chunk, sender.PrivateHost, newFS[0])
+		Replicate(chunk, sender, newFS[0])
 	}
 
-	// possible data race with replicate function
-	// will still work, since no one can send something to down fs
-	delete(ct.InvertedTable, node.PrivateHost)
+	ct.ivmu.Lock()
+	delete(ct.InvertedTable, node.Addr())
+	ct.ivmu.Unlock()
 }
 
 func (s *PoolInfo) FSIsUp(node *FileServerInfo) {
 	log.Printf("FS %s became online; removing everything from it", node.PrivateHost)
 
+	state.Lock()
+	defer state.Unlock()
+
 	alive := 0
 	for _, fs := range storages.StorageNodes {
 		if fs.Alive {
@@ -416,6 +572,6 @@ func (s *PoolInfo) FSIsUp(node *FileServerInfo) {
 		}
 
 		log.Printf("FS %s became online; replicate %s from %s", node.PrivateHost, chunk.ChunkID, sender.PrivateHost)
-		go Replicate(chunk, sender.PrivateHost, receiver[1])
+		Replicate(chunk, sender, receiver[0])
 	}
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func assertRing(t *testing.T, pool *PoolInfo) {
+	t.Helper()
+
+	for _, fs := range pool.StorageNodes {
+		next := pool.StorageNodes[fs.NextAlive]
+		if !next.Alive {
+			t.Errorf("node %d points to dead node %d", fs.ID, next.ID)
+		}
+	}
+}
+
+func TestPoolInfo_RegisterFServer(t *testing.T) {
+	pool := &PoolInfo{}
+
+	first, err := pool.RegisterFServer(&RegisterMessage{NodeID: "a", PrivateHost: "10.0.0.1", PrivatePort: 7001, PublicPort: 7000})
+	if err != nil {
+		t.Fatalf("could not register first node, %v", err)
+	}
+
+	if first.ID != 0 || first.NextAlive != 0 {
+		t.Errorf("got first node %d -> %d, want 0 -> 0", first.ID, first.NextAlive)
+	}
+
+	second, err := pool.RegisterFServer(&RegisterMessage{NodeID: "b", PrivateHost: "10.0.0.2", PrivatePort: 7001, PublicPort: 7000})
+	if err != nil {
+		t.Fatalf("could not register second node, %v", err)
+	}
+
+	if len(pool.StorageNodes) != 2 || pool.Alive != 2 {
+		t.Fatalf("got %d nodes, %d alive, want 2 and 2", len(pool.StorageNodes), pool.Alive)
+	}
+
+	if first.NextAlive != second.ID || second.NextAlive != first.ID {
+		t.Errorf("new node is not linked into the ring: %d -> %d, %d -> %d",
+			first.ID, first.NextAlive, second.ID, second.NextAlive)
+	}
+	assertRing(t, pool)
+
+	t.Run("same node registers again",
+		func(t *testing.T) {
+			again, err := pool.RegisterFServer(&RegisterMessage{NodeID: "a", PrivateHost: "10.0.0.1", PrivatePort: 8001, PublicPort: 8000})
+			if err != nil {
+				t.Fatalf("could not register node again, %v", err)
+			}
+
+			if again != first || len(pool.StorageNodes) != 2 {
+				t.Errorf("re-registration added a new node")
+			}
+
+			if again.Port != 8001 || again.PublicPort != 8000 {
+				t.Errorf("re-registration did not update ports, got %d and %d", again.Port, again.PublicPort)
+			}
+		})
+
+	t.Run("another node claims a registered address",
+		func(t *testing.T) {
+			_, err := pool.RegisterFServer(&RegisterMessage{NodeID: "c", PrivateHost: "10.0.0.2", PrivatePort: 7001})
+			if err == nil {
+				t.Errorf("expected conflicting registration to fail")
+			}
+		})
+
+	t.Run("registered node moves to another host",
+		func(t *testing.T) {
+			_, err := pool.RegisterFServer(&RegisterMessage{NodeID: "b", PrivateHost: "10.0.0.3"})
+			if err == nil {
+				t.Errorf("expected conflicting registration to fail")
+			}
+		})
+
+	t.Run("node registers on a dead neighbour",
+		func(t *testing.T) {
+			second.Alive = false
+			first.NextAlive = first.ID
+
+			third, err := pool.RegisterFServer(&RegisterMessage{NodeID: "d", PrivateHost: "10.0.0.4"})
+			if err != nil {
+				t.Fatalf("could not register node, %v", err)
+			}
+
+			if third.NextAlive != first.ID {
+				t.Errorf("got new node pointing to %d, want %d", third.NextAlive, first.ID)
+			}
+			assertRing(t, pool)
+		})
+
+	t.Run("another node on a registered host",
+		func(t *testing.T) {
+			fourth, err := pool.RegisterFServer(&RegisterMessage{NodeID: "e", PrivateHost: "10.0.0.4", PrivatePort: 9001, PublicPort: 9000})
+			if err != nil {
+				t.Fatalf("could not register node, %v", err)
+			}
+
+			if third := pool.StorageNodes[2]; fourth == third || third.Port != 0 || third.NodeID != "d" {
+				t.Errorf("node took over the slot of the one on the same host")
+			}
+			assertRing(t, pool)
+		})
+}
+
+func TestNamenode_Admits(t *testing.T) {
+	cases := []struct {
+		name   string
+		conf   Namenode
+		host   string
+		secret string
+		want   bool
+	}{
+		{"registration disabled", Namenode{}, "10.0.0.1", "", false},
+		{"correct secret", Namenode{JoinSecret: "s3cr3t"}, "10.0.0.1", "s3cr3t", true},
+		{"wrong secret", Namenode{JoinSecret: "s3cr3t"}, "10.0.0.1", "guess", false},
+		{"allowed host", Namenode{JoinAllowlist: []string{"10.0.0.1"}}, "10.0.0.1", "", true},
+		{"allowed network", Namenode{JoinAllowlist: []string{"10.0.0.0/24"}}, "10.0.0.7", "", true},
+		{"foreign network", Namenode{JoinAllowlist: []string{"10.0.0.0/24"}}, "10.0.1.7", "", false},
+		{"allowed host, wrong secret", Namenode{JoinSecret: "s3cr3t", JoinAllowlist: []string{"10.0.0.1"}}, "10.0.0.1", "guess", false},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name,
+			func(t *testing.T) {
+				got := test.conf.Admits(test.host, test.secret)
+				if got != test.want {
+					t.Errorf("got %v, want %v", got, test.want)
+				}
+			})
+	}
+}
+
+func TestReplicate_ThroughCommandQueues(t *testing.T) {
+	sender := &FileServerInfo{PrivateHost: "10.0.0.1", PublicPort: 7000}
+	receiver := &FileServerInfo{PrivateHost: "10.0.0.2", PublicPort: 7000}
+	chunk := &Chunk{ChunkID: "chunk"}
+
+	Replicate(chunk, sender, receiver)
+
+	if got := sender.PendingCommands(); len(got) != 0 {
+		t.Fatalf("sender got %v before receiver expected the chunk", got)
+	}
+
+	pending := receiver.PendingCommands()
+	if len(pending) != 1 || pending[0].Kind != CommandExpect || pending[0].Action != "write" {
+		t.Fatalf("got receiver commands %v, want one write expect", pending)
+	}
+	expect := pending[0]
+
+	receiver.Acknowledge([]CommandAck{{ID: expect.ID}})
+
+	if got := receiver.PendingCommands(); len(got) != 0 {
+		t.Errorf("acknowledged commands are still pending: %v", got)
+	}
+
+	pending = sender.PendingCommands()
+	if len(pending) != 1 || pending[0].Kind != CommandReplicate {
+		t.Fatalf("got sender commands %v, want one replicate", pending)
+	}
+	replicate := pending[0]
+
+	if replicate.Token != expect.Token || replicate.Addr != "10.0.0.2:7000" {
+		t.Errorf("got replicate to %s with token %s, want 10.0.0.2:7000 with %s", replicate.Addr, replicate.Token, expect.Token)
+	}
+
+	sender.Acknowledge([]CommandAck{{ID: replicate.ID, Error: "connection refused"}})
+
+	pending = receiver.PendingCommands()
+	if len(pending) != 1 || pending[0].Kind != CommandCancelToken || pending[0].Token != expect.Token {
+		t.Errorf("got receiver commands %v after failed replication, want token cancellation", pending)
+	}
+}
+
+// setUpNamespace replaces the global NS state with a tree holding one file
+// of one chunk stored at holder.
+func setUpNamespace(replicas int, holder *FileServerInfo) *Chunk {
+	conf = &Config{Namenode: Namenode{Replicas: replicas}}
+	wal = nil
+	t = InitTree(conf.Namenode)
+	ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
+	storages = &PoolInfo{}
+
+	file, _ := t.CreateFile("file", 1)
+	file.Chunks = append(file.Chunks, "chunk")
+	file.Pending["chunk"] = true
+
+	chunk, _ := ct.AddChunk("chunk", file.ID, holder)
+	return chunk
+}
+
+func TestReceivedChunk_Duplicate(t *testing.T) {
+	holder := &FileServerInfo{PrivateHost: "10.0.0.1", PublicPort: 7000}
+	chunk := setUpNamespace(1, holder)
+
+	ReceivedChunk("chunk", holder.Addr())
+	ReceivedChunk("chunk", holder.Addr())
+
+	if chunk.ReadyReplicas != 1 {
+		t.Errorf("got %d ready replicas after a repeated confirmation, want 1", chunk.ReadyReplicas)
+	}
+
+	if chunk.Statuses[holder.Addr()] != OK {
+		t.Errorf("chunk is not confirmed at its holder")
+	}
+
+	// Confirmations of unknown chunks must not crash the NS.
+	ReceivedChunk("unknown", holder.Addr())
+}
+
+func TestChunkTable_ReconcileInventory(t *testing.T) {
+	a := &FileServerInfo{PrivateHost: "10.0.0.1"}
+	chunk := setUpNamespace(2, a)
+
+	a, _ = storages.RegisterFServer(&RegisterMessage{NodeID: "a", PrivateHost: "10.0.0.1"})
+	b, _ := storages.RegisterFServer(&RegisterMessage{NodeID: "b", PrivateHost: "10.0.0.2"})
+	c, _ := storages.RegisterFServer(&RegisterMessage{NodeID: "c", PrivateHost: "10.0.0.3"})
+
+	chunk.FServers = map[string]*FileServerInfo{a.Addr(): a, b.Addr(): b}
+	chunk.Statuses = map[string]int{a.Addr(): OK, b.Addr(): OK}
+	chunk.ReadyReplicas, chunk.AllReplicas = 2, 2
+	ct.InvertedTable[a.Addr()] = []*Chunk{chunk}
+	ct.InvertedTable[b.Addr()] = []*Chunk{chunk}
+
+	t.Run("holder in sync",
+		func(t *testing.T) {
+			ct.ReconcileInventory(a, []string{"chunk"})
+
+			if got := a.PendingCommands(); len(got) != 0 {
+				t.Errorf("got commands %v for a fileserver in sync", got)
+			}
+		})
+
+	t.Run("confirmed after the list was taken",
+		func(t *testing.T) {
+			// The confirmation overtook the inventory that lacks the chunk.
+			ct.ReconcileInventory(a, nil)
+
+			if _, ok := chunk.Statuses[a.Addr()]; !ok || chunk.ReadyReplicas != 2 {
+				t.Errorf("replica missing from one inventory is lost: %v, %d ready", chunk.Statuses, chunk.ReadyReplicas)
+			}
+
+			ct.ReconcileInventory(a, []string{"chunk"})
+			ct.ReconcileInventory(a, nil)
+
+			if _, ok := chunk.Statuses[a.Addr()]; !ok || len(a.PendingCommands()) != 0 {
+				t.Errorf("replica missing from inventories apart is lost: %v, %v", chunk.Statuses, a.PendingCommands())
+			}
+			ct.ReconcileInventory(a, []string{"chunk"})
+		})
+
+	t.Run("stray and lost chunks",
+		func(t *testing.T) {
+			ct.ReconcileInventory(b, []string{"stray"})
+
+			pending := b.PendingCommands()
+			if len(pending) != 1 || pending[0].Kind != CommandPurge || len(pending[0].Chunks) != 1 || pending[0].Chunks[0] != "stray" {
+				t.Errorf("got commands %v, want purge of the stray chunk", pending)
+			}
+
+			if _, ok := chunk.Statuses[b.Addr()]; !ok {
+				t.Errorf("replica is lost after one inventory")
+			}
+
+			ct.ReconcileInventory(b, nil)
+
+			if _, ok := chunk.Statuses[b.Addr()]; ok || chunk.ReadyReplicas != 1 {
+				t.Errorf("lost replica is still counted: %v, %d ready", chunk.Statuses, chunk.ReadyReplicas)
+			}
+
+			if len(ct.InvertedTable[b.Addr()]) != 0 {
+				t.Errorf("lost chunk is still expected at %s", b.PrivateHost)
+			}
+
+			pending = c.PendingCommands()
+			if len(pending) != 1 || pending[0].Kind != CommandExpect {
+				t.Errorf("got commands %v, want the lost chunk replicated to %s", pending, c.PrivateHost)
+			}
+		})
+}
+
+func TestEnqueue_IDsAfterRestart(t *testing.T) {
+	// The fileserver keeps the commands it has run until the nameserver
+	// acknowledges their acks, and skips commands with the same IDs.
+	inbox := map[uint64]bool{}
+
+	before := &FileServerInfo{PrivateHost: "10.0.0.1", PublicPort: 7000}
+	for i := 0; i < 10; i++ {
+		before.Enqueue(&Command{Kind: CommandPurge, Chunks: []string{"old"}}, nil)
+	}
+	for _, cmd := range before.PendingCommands() {
+		inbox[cmd.ID] = true
+	}
+
+	for restart := 0; restart < 3; restart++ {
+		lastCommandID = bootCommandID()
+
+		after := &FileServerInfo{PrivateHost: "10.0.0.1", PublicPort: 7000}
+		for i := 0; i < 10; i++ {
+			after.Enqueue(&Command{Kind: CommandPurge, Chunks: []string{"new"}}, nil)
+		}
+
+		for _, cmd := range after.PendingCommands() {
+			if inbox[cmd.ID] {
+				t.Fatalf("command %d of the restarted nameserver is taken for an unacknowledged one", cmd.ID)
+			}
+			inbox[cmd.ID] = true
+		}
+	}
+}
+
+func TestPulse_SharedHost(t *testing.T) {
+	setUpNamespace(1, &FileServerInfo{})
+	storages = &PoolInfo{SoftPulseQueue: make(chan int, 2), HardPulseQueue: make(chan int, 2)}
+	a, _ := storages.RegisterFServer(&RegisterMessage{NodeID: "a", PrivateHost: "10.0.0.1", PrivatePort: 7001})
+	b, _ := storages.RegisterFServer(&RegisterMessage{NodeID: "b", PrivateHost: "10.0.0.1", PrivatePort: 8001})
+
+	chunk, _ := ct.AddChunk("chunk", 0, a)
+	ct.InvertedTable[a.Addr()] = []*Chunk{chunk}
+
+	request := func(handler http.HandlerFunc, query string, port string, body string) {
+		r := httptest.NewRequest("POST", query, strings.NewReader(body))
+		r.RemoteAddr = "10.0.0.1:40000"
+		r.Header.Set(NodePortHeader, port)
+		handler(httptest.NewRecorder(), r)
+	}
+
+	request(pulse, "/pulse", "8001", `{"available": 5}`)
+	if a.Available == 5 || b.Available != 5 {
+		t.Errorf("heartbeat of the second fileserver is taken for the first one's")
+	}
+
+	request(confirmChunk, "/confirm/receivedChunk?chunkID=chunk", "8001", "")
+	if chunk.Status == OK {
+		t.Fatalf("chunk is confirmed by a fileserver on the same host as its holder")
+	}
+
+	request(confirmChunk, "/confirm/receivedChunk?chunkID=chunk", "7001", "")
+	if chunk.Statuses[a.Addr()] != OK {
+		t.Errorf("chunk is not confirmed by its holder")
+	}
+
+	// The holder comes back at another port.
+	previous := a.Addr()
+	storages.RegisterFServer(&RegisterMessage{NodeID: "a", PrivateHost: "10.0.0.1", PrivatePort: 7101})
+	ct.Readdress(previous, a)
+
+	if chunk.Statuses[a.Addr()] != OK || chunk.FServers[a.Addr()] != a || len(ct.InvertedTable[a.Addr()]) != 1 {
+		t.Errorf("replica is not moved to the new address of its holder: %v", chunk.Statuses)
+	}
+}
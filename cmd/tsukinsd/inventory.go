@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+)
+
+// ReconcileInventory compares the chunks fs reports to hold with the ones
+// the NS expects there. Chunks the NS doesn't expect at fs are purged, and
+// confirmed replicas that fs has lost are made again elsewhere.
+//
+// The list is taken before the heartbeat that carries it is sent, and a
+// confirmation may overtake it, so a replica is lost only once it is
+// missing from two inventories in a row.
+func (ct *ChunkTable) ReconcileInventory(fs *FileServerInfo, held []string) {
+	host := fs.Addr()
+
+	holds := make(map[string]bool, len(held))
+	var stray []string
+	for _, chunkID := range held {
+		holds[chunkID] = true
+
+		chunk, ok := ct.Table[chunkID]
+		if !ok || chunk.Status == OBSOLETE {
+			stray = append(stray, chunkID)
+			continue
+		}
+
+		if _, expected := chunk.Statuses[host]; !expected {
+			stray = append(stray, chunkID)
+		}
+	}
+
+	if len(stray) != 0 {
+		log.Printf("%s holds %d chunks it should not; purging them", host, len(stray))
+		fs.Enqueue(&Command{Kind: CommandPurge, Chunks: stray}, nil)
+	}
+
+	// Pending replicas may still be in flight, so only confirmed ones
+	// can be missing.
+	ct.ivmu.Lock()
+	var kept, lost []*Chunk
+	missing := map[string]bool{}
+	for _, chunk := range ct.InvertedTable[host] {
+		if chunk.Status != OBSOLETE && chunk.Statuses[host] == OK && !holds[chunk.ChunkID] {
+			if fs.missing[chunk.ChunkID] {
+				lost = append(lost, chunk)
+				continue
+			}
+
+			missing[chunk.ChunkID] = true
+		}
+
+		kept = append(kept, chunk)
+	}
+	fs.missing = missing
+	if len(lost) != 0 {
+		ct.InvertedTable[host] = kept
+	}
+	ct.ivmu.Unlock()
+
+	for _, chunk := range lost {
+		chunk.RemoveFSFromChunk(fs)
+		if chunk.Stripe != nil {
+			storages.RebuildShard(chunk, fs)
+		} else {
+			storages.ReplicateLost(chunk, fs)
+		}
+	}
+}
+
+// ReplicateLost makes a new replica of the chunk from one of its ready
+// replicas. The fileserver that lost it is not chosen to hold it again.
+func (s *PoolInfo) ReplicateLost(chunk *Chunk, lostAt *FileServerInfo) {
+	ready := map[string]*FileServerInfo{}
+	for host, fs := range chunk.FServers {
+		if chunk.Statuses[host] == OK {
+			ready[host] = fs
+		}
+	}
+
+	sender, err := s.SelectAmong(ready)
+	if err != nil {
+		log.Printf("Chunk %s is lost and there is no replica left", chunk.ChunkID)
+		chunk.SetStatus(DOWN)
+		return
+	}
+
+	except := map[string]*FileServerInfo{lostAt.Addr(): lostAt}
+	for host, fs := range chunk.FServers {
+		except[host] = fs
+	}
+
+	receivers := s.SelectSeveralExcept(except, 1)
+	if len(receivers) == 0 {
+		log.Printf("Chunk %s is lost and cannot be replicated, there is no free fs left", chunk.ChunkID)
+		return
+	}
+
+	log.Printf("Chunk %s is lost; replicating it from %s to %s", chunk.ChunkID, sender.PrivateHost, receivers[0].PrivateHost)
+	chunk.AddFSToChunk(receivers[0])
+	Replicate(chunk, sender, receivers[0])
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A writer of a file holds its lease, so that two uploads of the same file
+// don't interleave. The lease is granted by upload and reupload, renewed
+// by the client while it uploads the chunks, and released once all of
+// them are confirmed. When the lease expires, whatever is not confirmed
+// yet is rolled back.
+type Lease struct {
+	ID      string
+	Expires time.Time
+}
+
+// LeaseConflict is the error of a writer that comes while another one
+// holds the lease.
+type LeaseConflict struct {
+	Address string
+	Expires time.Time
+}
+
+func (err *LeaseConflict) Error() string {
+	return fmt.Sprintf("/%s is being written by another client; its lease expires at %s",
+		err.Address, err.Expires.Format("2006-01-02 15:04:05"))
+}
+
+func leaseTime() time.Duration {
+	if conf.Namenode.LeaseTime == 0 {
+		return 30 * time.Second
+	}
+
+	return conf.Namenode.LeaseTime * time.Second
+}
+
+// newLease grants a lease for the whole lease time from now. An empty id
+// makes a fresh one.
+func newLease(id string) *Lease {
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	return &Lease{ID: id, Expires: time.Now().Add(leaseTime())}
+}
+
+// Renew extends the lease for the whole lease time from now.
+func (lease *Lease) Renew() {
+	lease.Expires = time.Now().Add(leaseTime())
+}
+
+func (lease *Lease) Expired() bool {
+	return lease != nil && time.Now().After(lease.Expires)
+}
+
+func (lease *Lease) Message() *LeaseMessage {
+	return &LeaseMessage{ID: lease.ID, Seconds: int(time.Until(lease.Expires).Seconds())}
+}
+
+// Written tells whether all the chunks of the file and its update are
+// confirmed, so that its writer is done with it.
+func (node *Node) Written() bool {
+	return node.Update == nil && len(node.Pending) == 0
+}
+
+// checkLease tells whether the file may be written. An expired lease is
+// rolled back first. It must be called within a journal batch.
+func checkLease(address string) error {
+	address, _ = CleanAddress(address)
+
+	file, ok := t.Lookup(address)
+	if !ok || file.Lease == nil {
+		return nil
+	}
+
+	if !file.Lease.Expired() {
+		return &LeaseConflict{Address: file.Address(), Expires: file.Lease.Expires}
+	}
+
+	rollBack(file)
+	return nil
+}
+
+// rollBack drops what the writer of the file did not finish: the update
+// of the file, or the whole file if it is new.
+func rollBack(file *Node) {
+	log.Printf("Lease of %s expired; rolling back its unconfirmed chunks", file.Address())
+	file.Lease = nil
+
+	if file.Update != nil {
+		ct.Release(file.Update.Chunks)
+		file.Update = nil
+	} else if len(file.Pending) != 0 {
+		// A file that is still being uploaded is hidden, so RemoveFile
+		// would not find it.
+		t.ApplyRemove(file.Address())
+		t.CommitUpdate(OpRmfile, file)
+		ct.Release(file.Chunks)
+		return
+	}
+
+	t.CommitUpdate(OpUpdate, file)
+}
+
+// expireLeases rolls back the writes of expired leases, for as long as
+// the nameserver is the primary.
+func expireLeases() {
+	for {
+		time.Sleep(time.Second)
+
+		if lead.IsPrimary() {
+			if err := expireStep(); err != nil {
+				log.Printf("error: could not roll back expired leases: %v", err)
+			}
+		}
+	}
+}
+
+// expireStep looks for expired leases without blocking readers, and rolls
+// back the ones that are still expired once the state is locked.
+func expireStep() error {
+	state.RLock()
+	var expired []*Node
+	for _, node := range t.Inodes {
+		if node.Lease.Expired() {
+			expired = append(expired, node)
+		}
+	}
+	state.RUnlock()
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	end := wal.Begin()
+	for _, file := range expired {
+		if t.inTree(file) && file.Lease.Expired() {
+			rollBack(file)
+		}
+	}
+
+	return end()
+}
+
+// extendLeases gives the writers a whole lease time to find a new
+// primary.
+func extendLeases() {
+	for _, node := range t.Inodes {
+		if node.Lease != nil {
+			node.Lease.Renew()
+		}
+	}
+}
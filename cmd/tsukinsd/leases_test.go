@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLeases writes files concurrently and checks that the second writer
+// is turned away, that leases survive a restart, and that expired ones are
+// rolled back.
+func TestLeases(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	conf.Namenode.ChunkSize = 1
+	runWorkload("a", 2)
+
+	updated := serveClient(test, "/reupload?address=a-dir1/file&size=1", http.StatusOK, "")
+	created := serveClient(test, "/upload?address=a-dir1/new&size=1", http.StatusOK, "")
+	if updated.Lease == nil || created.Lease == nil {
+		test.Fatalf("got leases %v and %v", updated.Lease, created.Lease)
+	}
+
+	serveClient(test, "/reupload?address=a-dir1/file&size=1", http.StatusConflict, "")
+	serveClient(test, "/upload?address=a-dir1/new&size=1", http.StatusConflict, "")
+	serveClient(test, "/renew?address=a-dir1/file&lease="+created.Lease.ID, http.StatusConflict, "")
+
+	if info := serveClient(test, "/info?address=a-dir1/file", http.StatusOK, ""); !strings.Contains(info.Message, "Write lease: held until") {
+		test.Errorf("lease is not shown in %q", info.Message)
+	}
+
+	wal.Close()
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	defer wal.Close()
+	conf.Namenode.ChunkSize = 1
+
+	serveClient(test, "/renew?address=a-dir1/file&lease="+updated.Lease.ID, http.StatusOK, "")
+	serveClient(test, "/renew?address=a-dir1/new&lease="+created.Lease.ID, http.StatusOK, "")
+
+	for _, address := range []string{"a-dir1/file", "a-dir1/new"} {
+		nodeAt(address).Lease.Expires = time.Now().Add(-time.Second)
+	}
+
+	if err := expireStep(); err != nil {
+		test.Fatal(err)
+	}
+
+	file := nodeAt("a-dir1/file")
+	if file.Lease != nil || file.Update != nil || file.Chunks[0] != "a-chunk1" {
+		test.Errorf("update of the file is not rolled back: %v", file)
+	}
+
+	if _, ok := t.Lookup("a-dir1/new"); ok {
+		test.Errorf("new file is not rolled back")
+	}
+
+	if chunk := ct.Table[updated.Chunks[0].ChunkID]; chunk.Refs != 0 || chunk.Status != OBSOLETE {
+		test.Errorf("chunk of the rolled back update is not purged")
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Fatal(err)
+	}
+
+	msg := serveClient(test, "/reupload?address=a-dir1/file&size=1", http.StatusOK, "")
+	ReceivedChunk(msg.Chunks[0].ChunkID, storages.StorageNodes[0].Addr())
+
+	if file.Lease != nil || file.Chunks[0] != msg.Chunks[0].ChunkID {
+		test.Errorf("lease is not released once the file is written: %v", file)
+	}
+
+	serveClient(test, "/renew?address=a-dir1/file&lease="+msg.Lease.ID, http.StatusConflict, "")
+}
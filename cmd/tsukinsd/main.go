@@ -1,9 +1,15 @@
 package main
 
 import (
-	"encoding/gob"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 )
 
 type ChunkMessage struct {
@@ -17,6 +23,21 @@ type ClientMessage struct {
 	Objects []string       `json:"objects"`
 	Token   string         `json:"token"`
 	Chunks  []ChunkMessage `json:"chunks"`
+
+	// Coding and Size are set for erasure coded files. Chunks are then
+	// the shards of consecutive stripes; unavailable shards have no
+	// StorageIP.
+	Coding *Coding `json:"coding,omitempty"`
+	Size   int     `json:"size,omitempty"`
+
+	// Lease is granted to writers, who renew it while they upload.
+	Lease *LeaseMessage `json:"lease,omitempty"`
+}
+
+// LeaseMessage is a lease that lasts Seconds more unless it is renewed.
+type LeaseMessage struct {
+	ID      string `json:"id"`
+	Seconds int    `json:"seconds"`
 }
 
 var t *Tree
@@ -29,55 +50,174 @@ var ct = &ChunkTable{
 
 var tokens = map[string][]*FileServerInfo{}
 
-func loadAll() {
-	file, _ := os.Open("t.gob")
-	defer file.Close()
-	decoder := gob.NewDecoder(file)
-	decoder.Decode(t)
-
-	file, _ = os.Open("st.gob")
-	defer file.Close()
-	decoder = gob.NewDecoder(file)
-	decoder.Decode(storages)
-
-	file, _ = os.Open("ct.gob")
-	defer file.Close()
-	decoder = gob.NewDecoder(file)
-	decoder.Decode(ct)
+var wal *Journal
+
+// writeFileAtomically replaces the file with what write produces, so that
+// the file is never seen half-written, even after a crash.
+func writeFileAtomically(name string, write func(w io.Writer) error) error {
+	tmp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// checkpoint saves a snapshot of the whole state, after which the journal
+// may be truncated. In a cluster, the Raft log is compacted up to it too.
+func checkpoint(version int64) error {
+	t.Version = version
+	t.ClearRemoved()
+
+	snap := CaptureSnapshot(version)
+	snap.RaftIndex = atomic.LoadInt64(&clusterIndex)
+	if _, err := SaveSnapshot(conf.Namenode.SnapshotDir, snap, conf.Namenode.SnapshotRetention); err != nil {
+		return err
+	}
+
+	if cluster == nil {
+		return nil
+	}
+
+	return cluster.Compact(snap.RaftIndex)
+}
+
+// recoverState loads the last snapshot and replays the journal on top of
+// it.
+func recoverState() error {
+	snap, err := LoadLatestSnapshot(conf.Namenode.SnapshotDir)
+	if err != nil {
+		return err
+	}
+
+	t = InitTree(conf.Namenode)
+	ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
+	if snap != nil {
+		snap.Restore()
+		atomic.StoreInt64(&clusterIndex, snap.RaftIndex)
+	}
+
+	// Entries the snapshot has already are left in the journal by a
+	// crash right after the checkpoint. They are skipped, since a removed
+	// directory may have been created again since.
+	wal, err = OpenJournal(conf.Namenode.TreeLogName, func(entry *LogEntry) {
+		if snap == nil || entry.Version > snap.Version {
+			applyEntry(entry)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// The journal may be empty right after a checkpoint.
+	if wal.Version < t.Version {
+		wal.Version = t.Version
+	}
+
+	ct.Relink(storages)
+	wal.Checkpoint = checkpoint
+	wal.CheckpointEvery = conf.Namenode.TreeUpdatePeriod
+
+	log.Printf("Recovered state at version %d: %d nodes, %d chunks", wal.Version, len(t.Inodes), len(ct.Table))
+	return nil
 }
 
-func saveAll() {
-	file, _ := os.Create("t.gob")
-	defer file.Close()
-	decoder := gob.NewEncoder(file)
-	decoder.Encode(t)
-
-	file, _ = os.Create("st.gob")
-	defer file.Close()
-	decoder = gob.NewEncoder(file)
-	decoder.Encode(storages)
-
-	file, _ = os.Create("ct.gob")
-	defer file.Close()
-	decoder = gob.NewEncoder(file)
-	decoder.Encode(ct)
+// serve recovers the state and starts the servers. The nameserver then
+// either joins its cluster, starts as the primary, or follows the one at
+// its peer.
+func serve() error {
+	var err error
+	lead, err = OpenLeadership(conf.Namenode.EpochName)
+	if err != nil {
+		return err
+	}
+
+	storages = InitFServers(conf)
+	if err := recoverState(); err != nil {
+		return err
+	}
+
+	if len(conf.Namenode.Cluster) != 0 {
+		if err := startCluster(); err != nil {
+			return err
+		}
+		go StartPrivateServer()
+	} else {
+		go StartPrivateServer()
+		go startRole()
+	}
+
+	StartPublicServer()
+	return nil
 }
 
 func main() {
+	configName := flag.String("config", "config.toml", "nameserver configuration")
+	hashPassword := flag.Bool("hash-password", false, "hash the password read from stdin for the users file")
+	newAPIKey := flag.String("new-api-key", "", "make an API key with the given name for the config")
+	flag.Parse()
+
+	if *hashPassword {
+		password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		hashed, err := HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hashed)
+		return
+	}
+
+	if *newAPIKey != "" {
+		token, hashed := NewAPIKey(*newAPIKey)
+		fmt.Printf("Give the client this key:\n\t%s\nAdd this to the config, with the scopes of the key:\n", token)
+		fmt.Printf("\t[[namenode.apiKeys]]\n\tname = '%s'\n\tkey = '%s'\n\tscopes = ['read']\n", *newAPIKey, hashed)
+		return
+	}
+
 	var err error
-	conf, err = LoadConfig()
+	conf, err = LoadConfig(*configName)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	users, err = LoadUsers(conf.Namenode.UsersFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	//t = LoadTree(conf.Namenode.TreeGobName)
-	t = InitTree(conf.Namenode)
-	storages = InitFServers(conf)
-	//loadAll()
+	if err := conf.Namenode.ValidateAPIKeys(users); err != nil {
+		log.Fatal(err)
+	}
 
-	go StartPrivateServer()
-	go storages.HeartbeatManager(true)
-	go storages.HeartbeatManager(false)
-	StartPublicServer()
+	// Once requests are authenticated, the other nameservers get in only
+	// with the cluster secret.
+	peered := conf.Namenode.Peer != "" || len(conf.Namenode.Cluster) != 0
+	if peered && conf.Namenode.ClusterSecret == "" && authenticationEnabled() {
+		log.Fatal("Config file is not valid, clusterSecret is needed for the nameservers to follow each other once requests are authenticated")
+	}
+
+	if err := serve(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
@@ -31,11 +33,14 @@ func (s *PoolInfo) HeartbeatManager(soft bool) {
 		queue = s.HardPulseQueue
 	}
 
+	state.RLock()
 	nextDead, deathTime := s.GetFSWithOldestPulse(soft)
+	state.RUnlock()
 
 	for {
 		select {
 		case peerId := <-queue:
+			state.Lock()
 			if s.IsDead(peerId, soft) {
 				// wow, it is alive now! do some stuff to resurrect it
 				log.Printf("%d became live now!; partially: %v", peerId, soft)
@@ -49,17 +54,26 @@ func (s *PoolInfo) HeartbeatManager(soft bool) {
 			} else {
 				nextDead, deathTime = s.GetFSWithOldestPulse(soft)
 			}
+			state.Unlock()
 		case <-time.After(deathTime):
+			// Heartbeats go to the primary.
+			if !lead.IsPrimary() {
+				deathTime = period
+				continue
+			}
+
 			if nextDead == -1 {
 				//deathTime = period
 				continue
 			}
 
 			// Mark as dead
+			state.Lock()
 			s.ChangeStatus(nextDead, deathStatus)
 
 			log.Printf("%d is dead now; partially: %v", nextDead, soft)
 			nextDead, _ = s.GetFSWithOldestPulse(soft)
+			state.Unlock()
 			deathTime = period
 		}
 	}
@@ -88,26 +102,88 @@ func (s *PoolInfo) GetFSWithOldestPulse(soft bool) (int, time.Duration) {
 	return oldest, period - oldestDuration
 }
 
+// NodePortHeader is where fileservers give the port the NS reaches them at.
+const NodePortHeader = "X-Tsuki-Port"
+
+// senderOf returns the private address of the fileserver the request comes
+// from. Fileservers that don't give their port are taken for the first one
+// on their host.
+func senderOf(r *http.Request) string {
+	remoteHost := strings.Split(r.RemoteAddr, ":")[0]
+	if port := r.Header.Get(NodePortHeader); port != "" {
+		return remoteHost + ":" + port
+	}
+
+	for _, fs := range storages.StorageNodes {
+		if fs.PrivateHost == remoteHost {
+			return fs.Addr()
+		}
+	}
+
+	return remoteHost
+}
+
 func pulse(w http.ResponseWriter, r *http.Request) {
 	remoteHost := strings.Split(r.RemoteAddr, ":")[0]
+
+	// Older fileservers send bare heartbeats.
+	var beat *HeartbeatMessage
+	body, _ := ioutil.ReadAll(r.Body)
+	if len(body) != 0 {
+		beat = &HeartbeatMessage{}
+		if err := json.Unmarshal(body, beat); err != nil {
+			log.Printf("Could not parse heart beat from %s: %v", remoteHost, err)
+			beat = nil
+		}
+	}
+
 	//remoteHost := r.Header.Get("addr")
-	unknown := true
+	state.Lock()
+	remoteAddr := senderOf(r)
+	var known *FileServerInfo
 	for _, fs := range storages.StorageNodes {
-		if fs.PrivateHost == remoteHost {
-			// log.Printf("Received heart beat from: %s", remoteHost)
-			// race condition but it is ok
-			// last pulse is also used in GetFSWithOldestPulse() in different thread
-			fs.LastPulse = time.Now()
-			storages.HardPulseQueue <- fs.ID
-			storages.SoftPulseQueue <- fs.ID
-			unknown = false
+		if fs.Addr() == remoteAddr {
+			known = fs
 			break
 		}
 	}
-	if unknown {
-		log.Printf("Received heart beat from unknown host: %s", remoteHost)
+
+	// A registered fileserver that follows a newer primary tells a
+	// deposed one. Other hosts are not taken at their word.
+	if known != nil && cluster == nil && beat != nil && lead.Observe(beat.Epoch) {
+		state.Unlock()
+		stepDown(beat.Epoch)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
+
+	if known != nil {
+		// log.Printf("Received heart beat from: %s", remoteHost)
+		known.LastPulse = time.Now()
+		if beat != nil {
+			known.UpdateLoad(&beat.NodeStatus)
+			known.Acknowledge(beat.Acks)
+			if beat.Inventory != nil {
+				ct.ReconcileInventory(known, beat.Inventory.Chunks)
+			}
+		}
+	}
+	pool := storages
+	state.Unlock()
+
+	if known == nil {
+		// Fileservers that registered themselves will register again.
+		log.Printf("Received heart beat from unknown fileserver: %s", remoteAddr)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// The heartbeat managers need the state lock to take these.
+	pool.HardPulseQueue <- known.ID
+	pool.SoftPulseQueue <- known.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(known.PendingCommands())
 
 }
 
@@ -116,35 +192,84 @@ func confirmChunk(w http.ResponseWriter, r *http.Request) {
 	// we can set it as ready on remote addr and start sending to other servers
 	chunkID := r.URL.Query().Get("chunkID")
 	//remoteAddr := r.Header.Get("addr")
-	remoteAddr := strings.Split(r.RemoteAddr, ":")[0]
+	remoteAddr := senderOf(r)
 	log.Printf("Got ready chunk %s from %s", chunkID, remoteAddr)
 
+	ReceivedChunk(chunkID, remoteAddr)
+}
+
+// confirmChunks is the batch version of confirmChunk. The body is a JSON
+// list of chunk IDs.
+func confirmChunks(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := senderOf(r)
+
+	var chunkIDs []string
+	if err := json.NewDecoder(r.Body).Decode(&chunkIDs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	log.Printf("Got %d ready chunks from %s", len(chunkIDs), remoteAddr)
+	for _, chunkID := range chunkIDs {
+		ReceivedChunk(chunkID, remoteAddr)
+	}
+}
+
+// ReceivedChunk marks the chunk as stored at remoteAddr and replicates it
+// further if needed. Repeated confirmations are ignored.
+func ReceivedChunk(chunkID, remoteAddr string) {
 	chunk, ok := ct.Table[chunkID]
-	chunk.Status = OK
 	if !ok {
 		// here send request to remove chunk since it does not exist on the ns
 		log.Printf("Chunk %s not found; skipping", chunkID)
 		return
 	}
 
-	_, ok = chunk.Statuses[remoteAddr]
+	status, ok := chunk.Statuses[remoteAddr]
 
 	if !ok {
 		log.Printf("Got chunk %s from %s but it should not be there...", chunkID, remoteAddr)
 		return
 	}
 
-	chunk.Statuses[remoteAddr] = OK
+	// Fileservers retry confirmations until they are acknowledged, so the
+	// same one may come several times.
+	if status == OK {
+		log.Printf("Chunk %s from %s is already confirmed; skipping", chunkID, remoteAddr)
+		return
+	}
 
-	file, ok := t.GetNodeByAddress(chunk.File)
-	if !ok {
-		log.Printf("File %s not found; skipping", chunk.File)
+	// The replicas of chunks no file refers to are purged already or
+	// will be by the inventory.
+	if chunk.Refs == 0 {
+		log.Printf("Chunk %s is not used by any file; skipping", chunkID)
 		return
 	}
-	delete(file.Pending, chunkID)
+
+	defer wal.Begin()()
+
+	chunk.Statuses[remoteAddr] = OK
+	chunk.Status = OK
+
+	// The file the chunk was uploaded for may be removed while its
+	// copies still refer to the chunk.
+	if file, ok := t.Inodes[chunk.File]; ok {
+		delete(file.Pending, chunkID)
+		if file.ConfirmUpdate(chunkID) {
+			log.Printf("File %s is switched to its version %d", file.Address(), file.Version)
+			pruneVersions(file)
+		}
+		if file.Lease != nil && file.Written() {
+			log.Printf("File %s is written; its lease is released", file.Address())
+			file.Lease = nil
+		}
+		t.CommitUpdate(OpUpdate, file)
+	}
 
 	chunk.ReadyReplicas += 1
-	remainingReplicas := conf.Namenode.Replicas - chunk.AllReplicas
+	chunk.Commit()
+	remainingReplicas := chunk.TargetReplicas() - chunk.AllReplicas
 
 	senders := []string{}
 	for fs, status := range chunk.Statuses {
@@ -159,18 +284,98 @@ func confirmChunk(w http.ResponseWriter, r *http.Request) {
 	remainingReplicas = Min(remainingReplicas, len(senders))
 	receivers := storages.SelectSeveralExceptArr(senders, remainingReplicas)
 
-	if len(receivers) == 0 && chunk.AllReplicas < conf.Namenode.Replicas {
+	if len(receivers) == 0 && chunk.AllReplicas < chunk.TargetReplicas() {
 		log.Printf("Chunk %s cannot be replicated more, there is no free fs left", chunkID)
 		// todo: add to some queue that is subscribed to events when some fs are up
 	}
 
 	for i, receiver := range receivers {
-		go Replicate(chunk, senders[i], receiver)
+		Replicate(chunk, chunk.FServers[senders[i]], receiver)
 		log.Printf("Sending chunk %s from %s to %v", chunkID, senders[i], receiver)
 		chunk.AddFSToChunk(receiver)
 	}
 }
 
+func register(w http.ResponseWriter, r *http.Request) {
+	remoteHost := strings.Split(r.RemoteAddr, ":")[0]
+
+	var reg RegisterMessage
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	// The allowlist narrows down the hosts that may join, but doesn't
+	// tell who asks: without a join secret, the registration needs the
+	// admin scope, which everyone has while authentication is off.
+	admitted := conf.Namenode.Admits(remoteHost, reg.Secret)
+	if admitted && conf.Namenode.JoinSecret == "" {
+		user := credentials(r)
+		admitted = user != nil && user.HasScope(ScopeAdmin)
+	}
+
+	if !admitted {
+		log.Printf("Rejected registration of node %s from %s", reg.NodeID, remoteHost)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "registration is not allowed")
+		return
+	}
+
+	// Heartbeats are matched by their remote address, so the fileserver
+	// must register from the host the NS will talk to.
+	if reg.PrivateHost == "" {
+		reg.PrivateHost = remoteHost
+	} else if reg.PrivateHost != remoteHost {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "private host %s does not match remote address %s", reg.PrivateHost, remoteHost)
+		return
+	}
+
+	if reg.PublicHost == "" {
+		reg.PublicHost = reg.PrivateHost
+	}
+
+	available, ok := ProbeFServer(reg.PrivateHost, reg.PrivatePort)
+	if !ok {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "could not probe %s:%d", reg.PrivateHost, reg.PrivatePort)
+		return
+	}
+	reg.Available = available
+
+	state.Lock()
+	defer state.Unlock()
+
+	var previous string
+	if known := storages.Find(&reg); known != nil {
+		previous = known.Addr()
+	}
+
+	fs, err := storages.RegisterFServer(&reg)
+	if err != nil {
+		log.Printf("Rejected registration of node %s from %s: %v", reg.NodeID, remoteHost, err)
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	// The secret is not needed to replay the registration.
+	journaled := reg
+	journaled.Secret = ""
+
+	end := wal.Begin()
+	wal.Append(&LogEntry{Op: OpRegister, Register: &journaled})
+	if previous != "" && previous != fs.Addr() {
+		ct.Readdress(previous, fs)
+	}
+	ct.Adopt(fs)
+	end()
+
+	log.Printf("Registered node %s as %d at %s; available: %d", fs.NodeID, fs.ID, fs.PrivateHost, fs.Available)
+	w.WriteHeader(http.StatusOK)
+}
+
 func printTree(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
@@ -178,17 +383,93 @@ func printTree(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("%v", ct.InvertedTable)
 }
 
-func save(w http.ResponseWriter, r *http.Request) {
-	saveAll()
+type PoolNodeView struct {
+	ID          int        `json:"id"`
+	NodeID      string     `json:"nodeID"`
+	PrivateHost string     `json:"privateHost"`
+	PublicHost  string     `json:"publicHost"`
+	Status      FSStatus   `json:"status"`
+	LastPulse   time.Time  `json:"lastPulse"`
+	Load        NodeStatus `json:"load"`
 }
 
-func StartPrivateServer() {
+func printPool(w http.ResponseWriter, r *http.Request) {
+	views := []PoolNodeView{}
+	for _, fs := range storages.StorageNodes {
+		fs.mu.Lock()
+		views = append(views, PoolNodeView{
+			ID:          fs.ID,
+			NodeID:      fs.NodeID,
+			PrivateHost: fs.PrivateHost,
+			PublicHost:  fs.PublicHost,
+			Status:      fs.Status,
+			LastPulse:   fs.LastPulse,
+			Load:        fs.Load,
+		})
+		fs.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// snapshot checkpoints the journal and reports the version of the
+// snapshot taken.
+func snapshot(w http.ResponseWriter, r *http.Request) {
+	state.Lock()
+	version, err := wal.CheckpointNow()
+	state.Unlock()
+
+	if err != nil {
+		log.Printf("Snapshot failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	log.Printf("Saved a snapshot at version %d", version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&SnapshotMessage{
+		Version: version,
+		File:    snapshotFileName(conf.Namenode.SnapshotDir, version),
+	})
+}
+
+func privateRouter() *mux.Router {
 	r :=  mux.NewRouter()
-	r.HandleFunc("/pulse", pulse).Methods("GET", "POST")
-	r.HandleFunc("/confirm/receivedChunk", confirmChunk).Methods("GET", "POST")
-	r.HandleFunc("/print", printTree).Methods("GET", "POST")
-	r.HandleFunc("/save", save).Methods("GET", "POST")
+	r.Use(withEpoch)
+	r.HandleFunc("/leader", leader).Methods("GET")
 
-	http.ListenAndServe(fmt.Sprintf("%s:%d", conf.Namenode.Host, conf.Namenode.PrivatePort), r)
+	// Operators need the admin scope. Other nameservers may present the
+	// cluster secret instead, and fileservers don't authenticate this way.
+	admin := r.NewRoute().Subrouter()
+	admin.Use(authenticate)
+	admin.HandleFunc("/print", scoped(ScopeAdmin, reading(printTree))).Methods("GET", "POST")
+	admin.HandleFunc("/pool", scoped(ScopeAdmin, reading(printPool))).Methods("GET")
+	admin.HandleFunc("/snapshot", scoped(ScopeAdmin, snapshot)).Methods("POST")
+	admin.HandleFunc("/save", scoped(ScopeAdmin, snapshot)).Methods("GET", "POST")
+
+	if cluster != nil {
+		r.HandleFunc("/raft/vote", peersOnly(raftVote)).Methods("POST")
+		r.HandleFunc("/raft/append", peersOnly(raftAppend)).Methods("POST")
+		r.HandleFunc("/raft/install", peersOnly(raftInstall)).Methods("POST")
+		admin.HandleFunc("/cluster", scoped(ScopeAdmin, clusterStatus)).Methods("GET")
+		admin.HandleFunc("/cluster/add", scoped(ScopeAdmin, changeCluster)).Methods("POST")
+		admin.HandleFunc("/cluster/remove", scoped(ScopeAdmin, changeCluster)).Methods("POST")
+	}
+
+	primary := r.NewRoute().Subrouter()
+	primary.Use(primaryOnly)
+	primary.HandleFunc("/pulse", pulse).Methods("GET", "POST")
+	primary.HandleFunc("/register", register).Methods("POST")
+	primary.HandleFunc("/confirm/receivedChunk", writing(confirmChunk)).Methods("GET", "POST")
+	primary.HandleFunc("/confirm/receivedChunks", writing(confirmChunks)).Methods("POST")
+	primary.HandleFunc("/journal", peersOnly(shipJournal)).Methods("GET")
+	primary.HandleFunc("/journal/snapshot", peersOnly(shipSnapshot)).Methods("GET")
+
+	return r
 }
 
+func StartPrivateServer() {
+	http.ListenAndServe(fmt.Sprintf("%s:%d", conf.Namenode.Host, conf.Namenode.PrivatePort), privateRouter())
+}
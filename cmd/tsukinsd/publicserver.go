@@ -8,22 +8,45 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 )
 
 
 func initTree(w http.ResponseWriter, r *http.Request) {
+	if !requestUser(r).IsSuperuser() {
+		forbid(w, "only root can initialize the tree")
+		return
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	wal.Append(&LogEntry{Op: OpInit})
 	t = InitTree(conf.Namenode)
+	ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
 	storages = InitFServers(conf)
-	saveAll()
+	if _, err := wal.CheckpointNow(); err != nil {
+		log.Printf("warning: %v", err)
+	}
+
+	available := 0
+	for _, fs := range storages.StorageNodes {
+		available += fs.Available
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("The tree is initialized; available space: %.2f", )})
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("The tree is initialized; available space: %.2f MB", float64(available)/1024/1024)})
 }
 
 func ls(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	address := r.URL.Query().Get("address")
+	if !allowed(w, r, address, PermRead) {
+		return
+	}
+
 	list, err := t.LS(address)
 	if err == nil {
 		json.NewEncoder(w).Encode(&ClientMessage{
@@ -39,8 +62,20 @@ func ls(w http.ResponseWriter, r *http.Request) {
 func mkdir(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	dirName := r.URL.Query().Get("address")
+	if !allowed(w, r, parentOf(dirName), PermWrite|PermExec) {
+		return
+	}
+
+	// The directory and its owner are journaled together.
+	defer wal.Begin()()
+
 	err := t.CreateDirectory(dirName)
 	if err == nil {
+		cleaned, _ := CleanAddress(dirName)
+		dir, _ := t.Lookup(cleaned)
+		own(dir, requestUser(r))
+		t.CommitUpdate(OpUpdate, dir)
+
 		json.NewEncoder(w).Encode(&ClientMessage{
 			Status:  "OK",
 			Message: fmt.Sprintf("%s directory successfully created", dirName)})
@@ -53,8 +88,22 @@ func mkdir(w http.ResponseWriter, r *http.Request) {
 func touch(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	address := r.URL.Query().Get("address")
-	_, err := t.CreateFile(address, 0)
+	if !allowed(w, r, parentOf(address), PermWrite|PermExec) {
+		return
+	}
+
+	// The file and its owner are journaled together.
+	defer wal.Begin()()
+
+	if !withinQuota(w, address, requestUser(r).Name, Usage{Files: 1}, "") {
+		return
+	}
+
+	file, err := t.CreateFile(address, 0)
 	if err == nil {
+		own(file, requestUser(r))
+		t.CommitUpdate(OpUpdate, file)
+
 		json.NewEncoder(w).Encode(&ClientMessage{
 			Status:  "OK",
 			Message: fmt.Sprintf("%s file successfully created", address)})
@@ -67,6 +116,10 @@ func touch(w http.ResponseWriter, r *http.Request) {
 func cd(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	address := r.URL.Query().Get("address")
+	if !allowed(w, r, address, PermExec) {
+		return
+	}
+
 	address, err := t.CD(address)
 	if err == nil {
 		json.NewEncoder(w).Encode(&ClientMessage{
@@ -81,6 +134,20 @@ func cd(w http.ResponseWriter, r *http.Request) {
 }
 
 func upload(w http.ResponseWriter, r *http.Request) {
+	store(w, r, false)
+}
+
+// reupload replaces the content of the file in three phases: the new
+// chunks are uploaded under a fresh token, the file is switched to them
+// once all of them are confirmed, and only then are the old ones purged.
+// Until the switch, readers get the old content.
+func reupload(w http.ResponseWriter, r *http.Request) {
+	store(w, r, true)
+}
+
+// store allocates the chunks of a new file, or of the new content of the
+// file if overwrite is set, and tells the client where to upload them.
+func store(w http.ResponseWriter, r *http.Request, overwrite bool) {
 	w.Header().Set("Content-Type", "application/json")
 
 	sizeStr := r.URL.Query().Get("size")
@@ -94,14 +161,103 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := t.CreateFile(address, int(size))
+	// A file is overwritten by those who can write it, and created by
+	// those who can write its directory.
+	if overwrite && !allowed(w, r, address, PermWrite) {
+		return
+	}
+	if !overwrite && !allowed(w, r, parentOf(address), PermWrite|PermExec) {
+		return
+	}
+
+	if len(storages.StorageNodes) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: "no fileservers available"})
+		return
+	}
+
+	cleaned, _ := CleanAddress(address)
+	coding, err := conf.Namenode.CodingFor(cleaned)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
 		return
 	}
 
+	if coding != nil && storages.Alive < coding.Shards() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("%s needs %d fileservers, %d available", coding, coding.Shards(), storages.Alive)})
+		return
+	}
+
+	// The projected size of the file is checked against the quotas of
+	// its directories and its owner. New content only adds what it takes
+	// over the current one, unless the current one is kept as a previous
+	// version.
+	added := Usage{Space: projectedSize(int(size), coding), Files: 1}
+	owner := requestUser(r).Name
+	if file, ok := t.Lookup(cleaned); overwrite && ok {
+		owner, _, _ = file.Permissions()
+		added.Files = 0
+		if retention, _ := conf.Namenode.RetentionFor(cleaned); retention == nil {
+			added.Space -= projectedSize(file.Size, file.Coding)
+		}
+	}
+	if !withinQuota(w, address, owner, added, "") {
+		return
+	}
+
 	chunkNum := int(math.Ceil(float64(size) / 1024 / 1024 / float64(conf.Namenode.ChunkSize)))
+
+	// Every stripe needs its shards on distinct fileservers. They are
+	// placed before anything is changed, so that there is nothing to roll
+	// back if the ring of alive fileservers turns out to be short.
+	var stripes [][]*FileServerInfo
+	for i := 0; coding != nil && i < chunkNum; i++ {
+		nodes := storages.SelectSeveralExcept(map[string]*FileServerInfo{}, coding.Shards())
+		if len(nodes) != coding.Shards() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("%s needs %d fileservers, %d available", coding, coding.Shards(), len(nodes))})
+			return
+		}
+		stripes = append(stripes, nodes)
+	}
+
+	// The file and its chunks are journaled together, so that a crash
+	// doesn't leave a file without chunks.
+	end := wal.Begin()
+
+	if err := checkLease(address); err != nil {
+		end()
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	// The chunks go to the file itself, or to its update.
+	var file, target *Node
+	if overwrite {
+		var abandoned []string
+		file, abandoned, err = t.UpdateFile(address, int(size))
+		if err == nil {
+			ct.Release(abandoned)
+			target = file.Update
+		}
+	} else {
+		file, err = t.CreateFile(address, int(size))
+		if err == nil {
+			own(file, requestUser(r))
+		}
+		target = file
+	}
+
+	if err != nil {
+		end()
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
 	var chunks []ChunkMessage
 
 	token := generateToken()
@@ -110,6 +266,20 @@ func upload(w http.ResponseWriter, r *http.Request) {
 
 	inversed := map[string][]string{}
 
+	if coding != nil {
+		target.Coding = coding
+		for _, nodes := range stripes {
+			chunks = append(chunks, addStripe(target, coding, nodes, inversed)...)
+		}
+		lease := grantLease(file)
+		t.CommitUpdate(OpUpdate, file)
+		end()
+
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "Go upload there", Chunks: chunks, Token: token, Coding: coding, Size: int(size), Lease: lease})
+		go ExpectChunksFromClient(inversed, token)
+		return
+	}
+
 	for i := 0; i < chunkNum; i++ {
 		chunkID, _ := uuid.NewUUID()
 		//fmt.Printf("%s\n", chunkID.String())
@@ -118,26 +288,29 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		chunks = append(chunks,
 			ChunkMessage{
 			ChunkID: chunkID.String(),
-			StorageIP: fmt.Sprintf("%s:%d", storageNode.PublicHost, conf.Namenode.FSPublicPort)})
+			StorageIP: fmt.Sprintf("%s:%d", storageNode.PublicHost, storageNode.PublicPort)})
 
-		file.Chunks = append(file.Chunks, chunkID.String())
-		file.Pending[chunkID.String()] = true
+		target.Chunks = append(target.Chunks, chunkID.String())
+		target.Pending[chunkID.String()] = true
 
-		chunk, _ :=ct.AddChunk(chunkID.String(), file.Address, storageNode)
-		fmt.Printf("%v\n", ct)
+		chunk, _ :=ct.AddChunk(chunkID.String(), target.ID, storageNode)
 		address := fmt.Sprintf("%s:%d", storageNode.PrivateHost, storageNode.Port)
 
 		ct.ivmu.Lock()
-		ct.InvertedTable[storageNode.PrivateHost] = append(ct.InvertedTable[storageNode.PrivateHost], chunk)
+		ct.InvertedTable[storageNode.Addr()] = append(ct.InvertedTable[storageNode.Addr()], chunk)
 		ct.ivmu.Unlock()
 
 		inversed[address] = append(inversed[address], chunkID.String())
 	}
 
+	lease := grantLease(file)
+	t.CommitUpdate(OpUpdate, file)
+	end()
+
 	//fmt.Printf("%v", inversed)
 	//fmt.Printf("%v\n", t)
 	//fmt.Printf("%v\n", ct)
-	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "Go upload there", Chunks: chunks, Token: token})
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "Go upload there", Chunks: chunks, Token: token, Lease: lease})
 
 	go ExpectChunksFromClient(inversed, token)
 	// requests to fs's /expect/write?token JSON {chunks: []int}
@@ -150,18 +323,146 @@ func upload(w http.ResponseWriter, r *http.Request) {
 	// fs works like client now
 }
 
+// grantLease gives the file to its writer until all of its chunks are
+// confirmed. An empty update has nothing to wait for and is switched to
+// right away.
+func grantLease(file *Node) *LeaseMessage {
+	if file.Update != nil && len(file.Update.Pending) == 0 {
+		file.SwitchUpdate()
+		pruneVersions(file)
+	}
+
+	if file.Written() {
+		return nil
+	}
+
+	file.Lease = newLease("")
+	return file.Lease.Message()
+}
+
+// renew extends the lease of the file for the writer holding it.
+func renew(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	address, _ := CleanAddress(r.URL.Query().Get("address"))
+	id := r.URL.Query().Get("lease")
+
+	file, ok := t.Lookup(address)
+	if !ok || file.Lease == nil || file.Lease.ID != id || file.Lease.Expired() {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("lease of /%s is lost", address)})
+		return
+	}
+
+	file.Lease.Renew()
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "lease renewed", Lease: file.Lease.Message()})
+}
+
+// addStripe allocates the shards of one more stripe of the file on the
+// fileservers, one shard on each.
+func addStripe(file *Node, coding *Coding, nodes []*FileServerInfo, inversed map[string][]string) []ChunkMessage {
+	stripe := make([]string, len(nodes))
+	for i := range nodes {
+		chunkID, _ := uuid.NewUUID()
+		stripe[i] = chunkID.String()
+	}
+
+	var messages []ChunkMessage
+	for i, storageNode := range nodes {
+		chunk, _ := ct.AddChunk(stripe[i], file.ID, storageNode)
+		chunk.Stripe = stripe
+		chunk.Coding = coding
+		chunk.Commit()
+
+		file.Chunks = append(file.Chunks, stripe[i])
+		file.Pending[stripe[i]] = true
+
+		ct.ivmu.Lock()
+		ct.InvertedTable[storageNode.Addr()] = append(ct.InvertedTable[storageNode.Addr()], chunk)
+		ct.ivmu.Unlock()
+
+		address := fmt.Sprintf("%s:%d", storageNode.PrivateHost, storageNode.Port)
+		inversed[address] = append(inversed[address], stripe[i])
+
+		messages = append(messages, ChunkMessage{
+			ChunkID:   stripe[i],
+			StorageIP: fmt.Sprintf("%s:%d", storageNode.PublicHost, storageNode.PublicPort),
+		})
+	}
+
+	return messages
+}
+
+// downloadStripes lists every shard of the erasure coded file, with the
+// address of a ready holder when there is one. Each stripe must have at
+// least coding.Data shards available.
+func downloadStripes(w http.ResponseWriter, file *Node) {
+	coding := file.Coding
+	downloadChunks := []ChunkMessage{}
+
+	for start := 0; start < len(file.Chunks); start += coding.Shards() {
+		if start+coding.Shards() > len(file.Chunks) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("the file is broken; stripe %d has %d of %d shards", start/coding.Shards(), len(file.Chunks)-start, coding.Shards())})
+			return
+		}
+
+		available := 0
+		for _, chunkID := range file.Chunks[start : start+coding.Shards()] {
+			message := ChunkMessage{ChunkID: chunkID}
+
+			if chunk, ok := ct.Table[chunkID]; ok {
+				for host, fs := range chunk.FServers {
+					if chunk.Statuses[host] == OK && fs.Alive {
+						message.StorageIP = fmt.Sprintf("%s:%d", fs.PublicHost, fs.PublicPort)
+						available++
+						break
+					}
+				}
+			}
+
+			downloadChunks = append(downloadChunks, message)
+		}
+
+		if available < coding.Data {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("the file is broken; stripe %d has %d of %d shards", start/coding.Shards(), available, coding.Data)})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "go download there:", Chunks: downloadChunks, Coding: coding, Size: file.Size})
+}
+
 func download(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	address := r.URL.Query().Get("address")
+	if !allowed(w, r, address, PermRead) {
+		return
+	}
+
 	file, err := t.GetFile(address)
 
+	// A previous version is downloaded the same way as the current one.
+	if number := r.URL.Query().Get("version"); err == nil && number != "" {
+		var version int
+		if version, err = strconv.Atoi(number); err == nil {
+			file, err = file.AtVersion(version)
+		}
+	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
 		return
 	}
 
+	if file.Coding != nil {
+		downloadStripes(w, file)
+		return
+	}
+
 	chunks := file.Chunks
 	downloadChunks := []ChunkMessage{}
 
@@ -189,20 +490,95 @@ func download(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		downloadChunks = append(downloadChunks, ChunkMessage{ChunkID: chunkID, StorageIP: fmt.Sprintf("%s:%d", fs.PublicHost, conf.Namenode.FSPublicPort)})
+		downloadChunks = append(downloadChunks, ChunkMessage{ChunkID: chunkID, StorageIP: fmt.Sprintf("%s:%d", fs.PublicHost, fs.PublicPort)})
 	}
 
 	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "go download there:", Chunks: downloadChunks})
 }
 
-func reupload(w http.ResponseWriter, r *http.Request) {
-	// todo
+// versions lists the current version of the file and the previous ones
+// kept by its retention, newest first.
+func versions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	if !allowed(w, r, address, PermRead) {
+		return
+	}
+
+	file, err := t.GetFile(address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	list := []string{fmt.Sprintf("%d\t%s\t%d bytes\tcurrent", file.Version, file.CreatedOn.Format("2006-01-02 15:04:05"), file.Size)}
+	for i := len(file.Versions) - 1; i >= 0; i-- {
+		version := file.Versions[i]
+		list = append(list, fmt.Sprintf("%d\t%s\t%d bytes\treplaced on %s", version.Number, version.CreatedOn.Format("2006-01-02 15:04:05"), version.Size, version.ReplacedOn.Format("2006-01-02 15:04:05")))
+	}
+
+	retention, _ := conf.Namenode.RetentionFor(file.Address())
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("versions of /%s, kept by %s", file.Address(), retention), Objects: list})
+}
+
+// restore makes a previous version of the file current again. It becomes
+// the newest version, sharing its chunks with the restored one.
+func restore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	number, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	if !allowed(w, r, address, PermWrite) {
+		return
+	}
+
+	defer wal.Begin()()
+
+	if err := checkLease(address); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	file, err := t.RestoreVersion(address, number)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	// The restored chunks are retained before the versions are pruned,
+	// which may drop the restored version itself.
+	ct.Retain(file.Chunks)
+	pruneVersions(file)
+	t.CommitUpdate(OpUpdate, file)
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("version %d of /%s is restored as version %d", number, file.Address(), file.Version)})
 }
 
 func rmfile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	address := r.URL.Query().Get("address")
+	if !allowed(w, r, parentOf(address), PermWrite|PermExec) {
+		return
+	}
+
+	if trashEnabled() {
+		moveToTrash(w, address, false, requestUser(r))
+		return
+	}
+
+	// The file and the references to its chunks are journaled together.
+	defer wal.Begin()()
 
 	file, err := t.RemoveFile(address)
 
@@ -213,14 +589,22 @@ func rmfile(w http.ResponseWriter, r *http.Request) {
 	}
 	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "file successfully removed"})
 
-	// purge chunks
-	go ct.PurgeChunks(file.Chunks)
+	// purge chunks no other file refers to
+	ct.Release(file.AllChunks())
 }
 
 func rmdir(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	address := r.URL.Query().Get("address")
+	if !allowed(w, r, parentOf(address), PermWrite|PermExec) {
+		return
+	}
+
+	if trashEnabled() {
+		moveToTrash(w, address, true, requestUser(r))
+		return
+	}
 
 	dir, err := t.RemoveDirectory(address)
 
@@ -230,8 +614,247 @@ func rmdir(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	wakePurger()
 	json.NewEncoder(w).Encode(&ClientMessage{
-		Message: fmt.Sprintf("%s directory successfully removed", dir.Address),
+		Status:  "OK",
+		Message: fmt.Sprintf("%s directory successfully removed; its files are purged in the background", dir.Address()),
+	})
+}
+
+// moveToTrash removes the file or the directory to the trash of the user,
+// where its chunks are kept until it expires.
+func moveToTrash(w http.ResponseWriter, address string, isDirectory bool, user *User) {
+	item, err := t.MoveToTrash(address, isDirectory, user.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("/%s is moved to the trash as %s", item.Address, item.ID),
+		Objects: []string{item.ID},
+	})
+}
+
+// trash lists the items the user removed, oldest first. The superuser sees
+// the items of everyone.
+func trash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := requestUser(r)
+	list := []string{}
+	for _, item := range t.Trash {
+		if item.Owner != user.Name && !user.IsSuperuser() {
+			continue
+		}
+
+		expires := item.RemovedOn.Add(conf.Namenode.TrashRetention * time.Hour)
+		list = append(list, fmt.Sprintf("%s\t/%s\tremoved on %s, expires on %s", item.ID, item.Address,
+			item.RemovedOn.Format("2006-01-02 15:04:05"), expires.Format("2006-01-02 15:04:05")))
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "the trash", Objects: list})
+}
+
+// undelete restores the item of the trash to where it was removed from.
+func undelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Items of others are not told apart from missing ones.
+	id := r.URL.Query().Get("id")
+	user := requestUser(r)
+	if _, item := t.trashItem(id); item != nil {
+		if item.Owner != user.Name && !user.IsSuperuser() {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("%s is not in the trash", id)})
+			return
+		}
+		if !allowed(w, r, parentOf(item.Address), PermWrite|PermExec) {
+			return
+		}
+	}
+
+	item, err := t.Undelete(id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("/%s is restored", item.Address)})
+}
+
+// snapshotdir captures a read-only view of the directory, "dir@name", which
+// shares the chunks of its files with the directory.
+func snapshotdir(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	spec := r.URL.Query().Get("address")
+
+	// Snapshots of a directory are taken by its owner.
+	if dir, _, err := ParseSnapshotName(spec); err == nil {
+		if !allowed(w, r, dir, PermRead) {
+			return
+		}
+		if !t.owns(requestUser(r), dir) {
+			forbid(w, fmt.Sprintf("/%s/ only its owner can take snapshots", dir))
+			return
+		}
+	}
+
+	// The snapshot and the references to its chunks are journaled
+	// together.
+	defer wal.Begin()()
+
+	address, chunks, err := t.SnapshotDirectory(spec)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+	ct.Retain(chunks)
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("snapshot is taken; browse it at /%s", address),
+		Objects: []string{"/" + address},
+	})
+}
+
+// rmsnapshot deletes the snapshot, "dir@name". Its files are purged in
+// the background like the ones of removed directories.
+func rmsnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	spec := r.URL.Query().Get("address")
+
+	// Snapshots are deleted by the owner of the snapshotted directory.
+	if dir, name, err := ParseSnapshotName(spec); err == nil {
+		address := snapshotAddress(dir, name)
+		if !allowed(w, r, address, 0) {
+			return
+		}
+		if !t.owns(requestUser(r), address) {
+			forbid(w, fmt.Sprintf("/%s only its owner can delete it", address))
+			return
+		}
+	}
+
+	dir, err := t.DeleteDirectorySnapshot(spec)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	wakePurger()
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("snapshot /%s is deleted; its files are purged in the background", dir.Address()),
+	})
+}
+
+// deletions lists the removed directories whose files are still being
+// purged.
+func deletions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	list := []string{}
+	for _, deletion := range t.Deletions {
+		purged := deletion.Total - len(deletion.Files)
+		list = append(list, fmt.Sprintf("/%s: %d of %d files purged", deletion.Address, purged, deletion.Total))
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("%d directories are being purged", len(list)),
+		Objects: list,
+	})
+}
+
+func cp(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	if !allowed(w, r, from, PermRead) || !allowed(w, r, t.target(to), PermWrite|PermExec) {
+		return
+	}
+
+	// The copy counts in full, even though it shares the chunks.
+	if file, err := t.GetFile(from); err == nil {
+		added := Usage{Space: projectedSize(file.Size, file.Coding), Files: 1}
+		if !withinQuota(w, t.target(to), requestUser(r).Name, added, "") {
+			return
+		}
+	}
+
+	// The copy, its owner and the references to its chunks are journaled
+	// together.
+	defer wal.Begin()()
+
+	copied, err := t.CopyFile(from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	own(copied, requestUser(r))
+	t.CommitUpdate(OpUpdate, copied)
+
+	ct.Retain(copied.Chunks)
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("%s file successfully copied to %s", from, copied.Address()),
+	})
+}
+
+func mv(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	replace := r.URL.Query().Get("replace") == "true"
+
+	if !allowed(w, r, parentOf(from), PermWrite|PermExec) || !allowed(w, r, t.target(to), PermWrite|PermExec) {
+		return
+	}
+
+	// The owners keep what they are charged for, but the directories the
+	// files are moved into are charged more. A move that doesn't change
+	// them doesn't count the files.
+	cleaned, _ := CleanAddress(from)
+	target, _ := CleanAddress(t.target(to))
+	var added Usage
+	if chargeMoves(cleaned, target) {
+		added = t.usageOf(cleaned)
+	}
+	if !withinQuota(w, t.target(to), "", added, from) {
+		return
+	}
+
+	// The move and the removal of what it replaces are journaled together.
+	defer wal.Begin()()
+
+	moved, replaced, err := t.Move(from, to, replace)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	if replaced != nil {
+		ct.Release(replaced.AllChunks())
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{
+		Status:  "OK",
+		Message: fmt.Sprintf("%s successfully moved to %s", from, moved.Address()),
 	})
 }
 
@@ -239,6 +862,9 @@ func info(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	address := r.URL.Query().Get("address")
+	if !allowed(w, r, address, 0) {
+		return
+	}
 
 	info, err := t.NodeInfo(address)
 
@@ -253,26 +879,125 @@ func info(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// chmod sets the permission bits of the node, given in octal. Only its
+// owner can.
+func chmod(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	mode, err := strconv.ParseUint(r.URL.Query().Get("mode"), 8, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	if !allowed(w, r, address, 0) {
+		return
+	}
+	if !t.owns(requestUser(r), address) {
+		forbid(w, fmt.Sprintf("%s only its owner can change its mode", address))
+		return
+	}
+
+	node, err := t.Chmod(address, os.FileMode(mode))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("mode of /%s is %03o", node.Address(), node.Mode)})
+}
+
+// chown gives the node to another owner and/or group. Only the superuser
+// can change the owner; the owner can change the group to one of their own.
+func chown(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	address := r.URL.Query().Get("address")
+	owner := r.URL.Query().Get("owner")
+	group := r.URL.Query().Get("group")
+
+	if !allowed(w, r, address, 0) {
+		return
+	}
+
+	user := requestUser(r)
+	switch {
+	case user.IsSuperuser():
+	case owner != "" && owner != user.Name:
+		forbid(w, "only root can give nodes away")
+		return
+	case !t.owns(user, address):
+		forbid(w, fmt.Sprintf("%s only its owner can change its group", address))
+		return
+	case group != "" && !user.InGroup(group):
+		forbid(w, fmt.Sprintf("%s is not in group %s", user.Name, group))
+		return
+	}
+
+	if _, known := users[owner]; owner != "" && users != nil && !known {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: fmt.Sprintf("%s is not a user", owner)})
+		return
+	}
+
+	node, err := t.Chown(address, owner, group)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: fmt.Sprintf("/%s belongs to %s:%s", node.Address(), node.Owner, node.Group)})
+}
+
+// quota shows the usage of the user and of the directories with quotas
+// against their limits.
+func quota(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "OK", Message: "usage against quotas", Objects: t.Quotas(requestUser(r))})
+}
+
 func getChunkSize(w http.ResponseWriter, r *http.Request) {
 	responseBody := []byte(strconv.Itoa(conf.Namenode.ChunkSize * 1024 * 1024))
 	w.Write(responseBody)
 }
 
-func StartPublicServer() {
+func publicRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/init", initTree).Methods("GET")
-	r.HandleFunc("/ls", ls).Methods("GET")
-	r.HandleFunc("/mkdir", mkdir).Methods("GET")
-	r.HandleFunc("/touch", touch).Methods("GET")
-	r.HandleFunc("/cd", cd).Methods("GET")
-	r.HandleFunc("/upload", upload).Methods("GET")
-	r.HandleFunc("/download", download).Methods("GET")
-	r.HandleFunc("/reupload", reupload).Methods("GET")
-	r.HandleFunc("/rmfile", rmfile).Methods("GET")
-	r.HandleFunc("/rmdir", rmdir).Methods("GET")
-	r.HandleFunc("/info", info).Methods("GET")
-	r.HandleFunc("/getChunkSize", getChunkSize).Methods("GET")
-
-
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", conf.Namenode.PublicPort), r))
+	r.Use(withEpoch, toPrimary, authenticate)
+	r.HandleFunc("/init", scoped(ScopeAdmin, initTree)).Methods("GET")
+	r.HandleFunc("/ls", scoped(ScopeRead, reading(ls))).Methods("GET")
+	r.HandleFunc("/mkdir", scoped(ScopeWrite, writing(mkdir))).Methods("GET")
+	r.HandleFunc("/touch", scoped(ScopeWrite, writing(touch))).Methods("GET")
+	r.HandleFunc("/cd", scoped(ScopeRead, reading(cd))).Methods("GET")
+	r.HandleFunc("/upload", scoped(ScopeWrite, writing(upload))).Methods("GET")
+	r.HandleFunc("/download", scoped(ScopeRead, reading(download))).Methods("GET")
+	r.HandleFunc("/reupload", scoped(ScopeWrite, writing(reupload))).Methods("GET")
+	r.HandleFunc("/renew", scoped(ScopeWrite, writing(renew))).Methods("GET")
+	r.HandleFunc("/versions", scoped(ScopeRead, reading(versions))).Methods("GET")
+	r.HandleFunc("/restore", scoped(ScopeWrite, writing(restore))).Methods("GET")
+	r.HandleFunc("/rmfile", scoped(ScopeWrite, writing(rmfile))).Methods("GET")
+	r.HandleFunc("/rmdir", scoped(ScopeWrite, writing(rmdir))).Methods("GET")
+	r.HandleFunc("/deletions", scoped(ScopeRead, reading(deletions))).Methods("GET")
+	r.HandleFunc("/snapshot", scoped(ScopeWrite, writing(snapshotdir))).Methods("GET")
+	r.HandleFunc("/trash", scoped(ScopeRead, reading(trash))).Methods("GET")
+	r.HandleFunc("/undelete", scoped(ScopeWrite, writing(undelete))).Methods("GET")
+	r.HandleFunc("/rmsnapshot", scoped(ScopeWrite, writing(rmsnapshot))).Methods("GET")
+	r.HandleFunc("/cp", scoped(ScopeWrite, writing(cp))).Methods("GET")
+	r.HandleFunc("/mv", scoped(ScopeWrite, writing(mv))).Methods("GET")
+	r.HandleFunc("/info", scoped(ScopeRead, reading(info))).Methods("GET")
+	r.HandleFunc("/chmod", scoped(ScopeWrite, writing(chmod))).Methods("GET")
+	r.HandleFunc("/chown", scoped(ScopeWrite, writing(chown))).Methods("GET")
+	r.HandleFunc("/quota", scoped(ScopeRead, reading(quota))).Methods("GET")
+	r.HandleFunc("/getChunkSize", scoped(ScopeRead, getChunkSize)).Methods("GET")
+
+	return r
+}
+
+func StartPublicServer() {
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", conf.Namenode.PublicPort), publicRouter()))
 }
\ No newline at end of file
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Quota limits the space, in MB of projected size, and the number of files
+// of a directory tree or a user. Zero doesn't limit.
+type Quota struct {
+	Space int64
+	Files int
+}
+
+// Usage is the projected size, in bytes, and the number of files charged
+// to a directory tree or a user. The projected size of a file is its size
+// times its replicas, or the size of all of its shards if it is erasure
+// coded, together with the one of its previous versions.
+type Usage struct {
+	Space int64
+	Files int
+}
+
+// charge is what a file is counted for, to whom.
+type charge struct {
+	Usage
+	owner string
+	dirs  []string
+}
+
+// projectedSize returns the space a file of the size takes on the
+// fileservers.
+func projectedSize(size int, coding *Coding) int64 {
+	if coding != nil {
+		return int64(math.Ceil(float64(size) * float64(coding.Shards()) / float64(coding.Data)))
+	}
+
+	replicas := conf.Namenode.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	return int64(size) * int64(replicas)
+}
+
+// quotaDirectories returns the directories with quotas that the address is
+// in, or is, with their quotas.
+func quotaDirectories(address string) map[string]Quota {
+	dirs := map[string]Quota{}
+	for dir, quota := range conf.Namenode.DirectoryQuota {
+		dir = path.Clean(strings.Trim(dir, "/"))
+		if dir == "." || address == dir || strings.HasPrefix(address, dir+"/") {
+			dirs[dir] = quota
+		}
+	}
+
+	return dirs
+}
+
+// chargeOf returns what the file is to be counted for. Files in the tree
+// are, with their previous versions, apart from the ones in snapshots,
+// which share the chunks of the files they were taken of. Files in the
+// trash keep their chunks, so they are charged to their owner, but no
+// longer to the directories they were removed from.
+func (t *Tree) chargeOf(file *Node) *charge {
+	if !t.inTree(file) || file.Removed {
+		return nil
+	}
+
+	address := file.Address()
+	trashed := address == TrashRoot || strings.HasPrefix(address, TrashRoot+"/")
+	if readOnly(address) && !trashed {
+		return nil
+	}
+
+	owner, _, _ := file.Permissions()
+	space := projectedSize(file.Size, file.Coding)
+	for _, version := range file.Versions {
+		space += projectedSize(version.Size, version.Coding)
+	}
+
+	c := &charge{Usage: Usage{Space: space, Files: 1}, owner: owner}
+	if trashed {
+		return c
+	}
+
+	for dir := range quotaDirectories(address) {
+		c.dirs = append(c.dirs, dir)
+	}
+
+	return c
+}
+
+// recharge counts the file as it is now, in place of what it was counted
+// for before. It is called whenever a file may have been created, removed,
+// moved, resized or given away, and does nothing if none of that changed
+// its charge.
+func (t *Tree) recharge(file *Node) {
+	if file.IsDirectory {
+		return
+	}
+
+	t.add(file.charged, -1)
+	file.charged = t.chargeOf(file)
+	t.add(file.charged, 1)
+}
+
+// chargeMoves tells whether moving the node at from to to may change what
+// the files at it, or under it, are counted for: whether it leaves or
+// enters a reserved directory or a directory with a quota, or has one
+// inside it.
+func chargeMoves(from string, to string) bool {
+	if readOnly(from) != readOnly(to) {
+		return true
+	}
+
+	fromDirs, toDirs := quotaDirectories(from), quotaDirectories(to)
+	if len(fromDirs) != len(toDirs) {
+		return true
+	}
+	for dir := range fromDirs {
+		if _, ok := toDirs[dir]; !ok {
+			return true
+		}
+	}
+
+	for dir := range conf.Namenode.DirectoryQuota {
+		dir = path.Clean(strings.Trim(dir, "/"))
+		if strings.HasPrefix(dir, from+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Tree) add(c *charge, sign int) {
+	if c == nil {
+		return
+	}
+
+	if t.UserUsage == nil {
+		t.UserUsage = map[string]*Usage{}
+		t.DirectoryUsage = map[string]*Usage{}
+	}
+
+	addTo := func(usages map[string]*Usage, key string) {
+		usage, ok := usages[key]
+		if !ok {
+			usage = &Usage{}
+			usages[key] = usage
+		}
+
+		usage.Space += int64(sign) * c.Space
+		usage.Files += sign * c.Files
+	}
+
+	addTo(t.UserUsage, c.owner)
+	for _, dir := range c.dirs {
+		addTo(t.DirectoryUsage, dir)
+	}
+}
+
+// Recount counts every file of the tree anew, as the quotas of the config
+// say.
+func (t *Tree) Recount() {
+	t.UserUsage, t.DirectoryUsage = nil, nil
+	for _, node := range t.Inodes {
+		if !node.IsDirectory {
+			node.charged = nil
+			t.recharge(node)
+		}
+	}
+}
+
+// QuotaExceeded is the error of a change that would take a directory tree
+// or a user over its quota.
+type QuotaExceeded struct {
+	Of    string
+	Quota Quota
+	Usage Usage
+}
+
+func (e *QuotaExceeded) Error() string {
+	return fmt.Sprintf("quota of %s is exceeded: it would use %s", e.Of, describeUsage(e.Usage, e.Quota))
+}
+
+func describeUsage(usage Usage, quota Quota) string {
+	space := fmt.Sprintf("%.2f MB", float64(usage.Space)/1024/1024)
+	if quota.Space != 0 {
+		space += fmt.Sprintf(" of %d MB", quota.Space)
+	}
+
+	files := fmt.Sprintf("%d files", usage.Files)
+	if quota.Files != 0 {
+		files = fmt.Sprintf("%d of %d files", usage.Files, quota.Files)
+	}
+
+	return space + ", " + files
+}
+
+// CheckQuota tells whether the space and the files added at the address,
+// and charged to the owner, fit into their quotas. The directories with
+// quotas that also contain the address the files come from, if any, are
+// not charged more.
+func (t *Tree) CheckQuota(address string, owner string, added Usage, from string) error {
+	check := func(of string, quota Quota, usage *Usage) error {
+		after := added
+		if usage != nil {
+			after.Space += usage.Space
+			after.Files += usage.Files
+		}
+
+		overSpace := quota.Space != 0 && added.Space > 0 && after.Space > quota.Space*1024*1024
+		overFiles := quota.Files != 0 && added.Files > 0 && after.Files > quota.Files
+		if overSpace || overFiles {
+			return &QuotaExceeded{Of: of, Quota: quota, Usage: after}
+		}
+
+		return nil
+	}
+
+	dirs := quotaDirectories(address)
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	var skipped map[string]Quota
+	if from != "" {
+		skipped = quotaDirectories(from)
+	}
+
+	for _, dir := range sorted {
+		if _, ok := skipped[dir]; ok {
+			continue
+		}
+		if err := check("/"+dir, dirs[dir], t.DirectoryUsage[dir]); err != nil {
+			return err
+		}
+	}
+
+	if quota, ok := conf.Namenode.UserQuota[owner]; ok {
+		return check("user "+owner, quota, t.UserUsage[owner])
+	}
+
+	return nil
+}
+
+// usageOf sums up what the files at the address, or under it, are counted
+// for.
+func (t *Tree) usageOf(address string) Usage {
+	var usage Usage
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		if node.charged != nil {
+			usage.Space += node.charged.Space
+			usage.Files += node.charged.Files
+		}
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+
+	if node, ok := t.Lookup(address); ok {
+		walk(node)
+	}
+
+	return usage
+}
+
+// Quotas describes the usage of the user and of the directories with quotas
+// against their limits. The superuser sees every user.
+func (t *Tree) Quotas(user *User) []string {
+	var names []string
+	if user.IsSuperuser() {
+		for name := range t.UserUsage {
+			names = append(names, name)
+		}
+		for name := range conf.Namenode.UserQuota {
+			if t.UserUsage[name] == nil {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	} else {
+		names = []string{user.Name}
+	}
+
+	var list []string
+	for _, name := range names {
+		list = append(list, fmt.Sprintf("user %s: %s", name, describeUsage(t.usage(t.UserUsage, name), conf.Namenode.UserQuota[name])))
+	}
+
+	dirs := map[string]Quota{}
+	var sorted []string
+	for dir, quota := range conf.Namenode.DirectoryQuota {
+		dir = path.Clean(strings.Trim(dir, "/"))
+		dirs[dir] = quota
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	for _, dir := range sorted {
+		shown := "/" + dir
+		if dir == "." {
+			shown = "/"
+		}
+		list = append(list, fmt.Sprintf("%s: %s", shown, describeUsage(t.usage(t.DirectoryUsage, dir), dirs[dir])))
+	}
+
+	return list
+}
+
+func (t *Tree) usage(usages map[string]*Usage, key string) Usage {
+	if usage, ok := usages[key]; ok {
+		return *usage
+	}
+
+	return Usage{}
+}
+
+// withinQuota answers the request with InsufficientStorage unless what is
+// added at the address fits into the quotas.
+func withinQuota(w http.ResponseWriter, address string, owner string, added Usage, from string) bool {
+	address, _ = CleanAddress(address)
+	if from != "" {
+		from, _ = CleanAddress(from)
+	}
+
+	if err := t.CheckQuota(address, owner, added, from); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInsufficientStorage)
+		json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: err.Error()})
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestQuotas(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setUp := func() {
+		if err := setUpJournaled(dir); err != nil {
+			test.Fatalf("could not set up, %v", err)
+		}
+		conf.Namenode.ChunkSize = 1
+		conf.Namenode.Replicas = 2
+		conf.Namenode.DirectoryQuota = map[string]Quota{
+			"projects": {Files: 2},
+			"/media/":  {Space: 1},
+		}
+		conf.Namenode.UserQuota = map[string]Quota{"root": {Files: 4}}
+		t.Recount()
+	}
+
+	setUp()
+
+	serveClient(test, "/mkdir?address=/projects", http.StatusOK, "")
+	serveClient(test, "/mkdir?address=/other", http.StatusOK, "")
+	serveClient(test, "/touch?address=/projects/a", http.StatusOK, "")
+	serveClient(test, "/touch?address=/projects/b", http.StatusOK, "")
+	serveClient(test, "/touch?address=/projects/c", http.StatusInsufficientStorage, "")
+	serveClient(test, "/cp?from=/projects/b&to=/projects/c", http.StatusInsufficientStorage, "")
+
+	// Moves within the directory don't change its usage.
+	serveClient(test, "/mv?from=/projects/a&to=/projects/z", http.StatusOK, "")
+	serveClient(test, "/mv?from=/projects/z&to=/other", http.StatusOK, "")
+	serveClient(test, "/touch?address=/projects/c", http.StatusOK, "")
+	serveClient(test, "/mv?from=/other/z&to=/projects", http.StatusInsufficientStorage, "")
+
+	serveClient(test, "/rmfile?address=/projects/c", http.StatusOK, "")
+	serveClient(test, "/mv?from=/other/z&to=/projects", http.StatusOK, "")
+
+	// Two replicas of 600 KB take more than 1 MB.
+	serveClient(test, "/mkdir?address=/media", http.StatusOK, "")
+	serveClient(test, "/upload?address=/media/big&size=600000", http.StatusInsufficientStorage, "")
+	serveClient(test, "/upload?address=/media/small&size=500000", http.StatusOK, "")
+
+	serveClient(test, "/touch?address=/other/y", http.StatusOK, "")
+	serveClient(test, "/touch?address=/other/x", http.StatusInsufficientStorage, "")
+
+	wal.Close()
+	setUp()
+	defer wal.Close()
+
+	want := map[string]Usage{"projects": {Files: 2}, "media": {Space: 1000000, Files: 1}}
+	for dir, usage := range want {
+		if got := t.usage(t.DirectoryUsage, dir); got != usage {
+			test.Errorf("got usage %+v of /%s, want %+v", got, dir, usage)
+		}
+	}
+	if got := t.usage(t.UserUsage, "root"); got != (Usage{Space: 1000000, Files: 4}) {
+		test.Errorf("got usage %+v of root, want 4 files", got)
+	}
+
+	got := serveClient(test, "/quota", http.StatusOK, "").Objects
+	if len(got) != 3 || got[0] != "user root: 0.95 MB, 4 of 4 files" || got[2] != "/projects: 0.00 MB, 2 of 2 files" {
+		test.Errorf("got quotas %q", got)
+	}
+}
+
+// checkUsage verifies that the usage kept up to date as files change is the
+// same as the one counted anew.
+func checkUsage() error {
+	kept := map[string]Usage{}
+	for name, usage := range t.UserUsage {
+		kept["user "+name] = *usage
+	}
+	for dir, usage := range t.DirectoryUsage {
+		kept["/"+dir] = *usage
+	}
+
+	t.Recount()
+
+	counted := map[string]Usage{}
+	for name, usage := range t.UserUsage {
+		counted["user "+name] = *usage
+	}
+	for dir, usage := range t.DirectoryUsage {
+		counted["/"+dir] = *usage
+	}
+
+	for _, usages := range []map[string]Usage{kept, counted} {
+		for of := range usages {
+			if kept[of] != counted[of] {
+				return fmt.Errorf("usage of %s is kept as %+v, but is %+v", of, kept[of], counted[of])
+			}
+		}
+	}
+
+	return nil
+}
+
+// TestQuotas_VersionsAndTrash checks that previous versions are charged
+// with their file and that files in the trash are still charged to their
+// owner.
+func TestQuotas_VersionsAndTrash(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	defer wal.Close()
+	conf.Namenode.ChunkSize = 1
+	conf.Namenode.Retention = "versions(1)"
+	conf.Namenode.TrashRetention = 1
+	conf.Namenode.DirectoryQuota = map[string]Quota{"/": {}}
+	conf.Namenode.UserQuota = map[string]Quota{"root": {Space: 1}}
+	t.Recount()
+
+	upload := func(query string) {
+		msg := serveClient(test, query, http.StatusOK, "")
+		for _, chunk := range msg.Chunks {
+			ReceivedChunk(chunk.ChunkID, storages.StorageNodes[0].Addr())
+		}
+	}
+
+	upload("/upload?address=/file&size=600000")
+	upload("/reupload?address=/file&size=400000")
+	if got := t.usage(t.UserUsage, "root"); got != (Usage{Space: 1000000, Files: 1}) {
+		test.Errorf("got usage %+v of root, want the file with its previous version", got)
+	}
+
+	// The current content is kept as a version, so it doesn't make room.
+	serveClient(test, "/reupload?address=/file&size=400000", http.StatusInsufficientStorage, "")
+
+	serveClient(test, "/rmfile?address=/file", http.StatusOK, "")
+	if got := t.usage(t.UserUsage, "root"); got != (Usage{Space: 1000000, Files: 1}) {
+		test.Errorf("got usage %+v of root, want the file in the trash", got)
+	}
+	if got := t.usage(t.DirectoryUsage, "."); got != (Usage{}) {
+		test.Errorf("got usage %+v of /, want nothing", got)
+	}
+	serveClient(test, "/upload?address=/other&size=100000", http.StatusInsufficientStorage, "")
+
+	if err := checkUsage(); err != nil {
+		test.Error(err)
+	}
+}
@@ -0,0 +1,1180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Raft keeps the journal of a cluster of nameservers consistent. The
+// leader appends journal batches to the Raft log and answers clients once
+// a majority of the cluster has them; the others apply the committed
+// batches to their own state. The log is compacted up to the snapshots
+// the nameserver takes, and a member that falls behind them is sent the
+// snapshot instead. Membership changes add or remove one member at a time
+// and take effect as soon as they are in the log.
+const (
+	RaftFollower  = "follower"
+	RaftCandidate = "candidate"
+	RaftLeader    = "leader"
+
+	raftStateName = "raft.state"
+	raftLogName   = "raft.log"
+
+	// MaxAppend is the number of entries sent in one request.
+	MaxAppend = 256
+)
+
+var ErrNotLeader = fmt.Errorf("raft: not the leader")
+
+// Member is a nameserver of the cluster. It is identified by its private
+// address; the public one is where clients are redirected.
+type Member struct {
+	Private string `json:"private"`
+	Public  string `json:"public"`
+}
+
+// RaftEntry holds either a journal batch or a new list of members. An
+// entry without either is a no-op the leader appends to start its term.
+type RaftEntry struct {
+	Index   int64       `json:"index"`
+	Term    int64       `json:"term"`
+	Batch   []*LogEntry `json:"batch,omitempty"`
+	Members []Member    `json:"members,omitempty"`
+}
+
+type VoteRequest struct {
+	Term      int64  `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex int64  `json:"lastIndex"`
+	LastTerm  int64  `json:"lastTerm"`
+}
+
+type VoteResponse struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term      int64        `json:"term"`
+	Leader    string       `json:"leader"`
+	PrevIndex int64        `json:"prevIndex"`
+	PrevTerm  int64        `json:"prevTerm"`
+	Entries   []*RaftEntry `json:"entries"`
+	Commit    int64        `json:"commit"`
+}
+
+// AppendResponse answers both AppendRequest and InstallRequest. On
+// failure, Conflict is the index the leader should try next.
+type AppendResponse struct {
+	Term     int64 `json:"term"`
+	Success  bool  `json:"success"`
+	Match    int64 `json:"match"`
+	Conflict int64 `json:"conflict"`
+}
+
+type InstallRequest struct {
+	Term     int64    `json:"term"`
+	Leader   string   `json:"leader"`
+	Index    int64    `json:"index"`
+	LastTerm int64    `json:"lastTerm"`
+	Members  []Member `json:"members"`
+	Data     []byte   `json:"data"`
+}
+
+type RaftTransport interface {
+	RequestVote(peer string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(peer string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(peer string, req *InstallRequest) (*AppendResponse, error)
+}
+
+type RaftConfig struct {
+	// ID is the private address of this member.
+	ID  string
+	Dir string
+
+	// Members form the cluster until the log says otherwise.
+	Members []Member
+
+	Transport       RaftTransport
+	ElectionTimeout time.Duration
+
+	// Apply is called for every committed entry, in order. Install
+	// replaces the state with a snapshot of the leader. Snapshot returns
+	// the latest snapshot and the index it was taken at. OnRole tells
+	// about becoming the leader, once all the entries of the previous
+	// leaders are applied, and about stopping to be one. All of them are
+	// called from one goroutine.
+	Apply    func(entry *RaftEntry)
+	Install  func(data []byte, index int64) error
+	Snapshot func() ([]byte, int64, error)
+	OnRole   func(role string, term int64)
+}
+
+type raftState struct {
+	Term        int64    `json:"term"`
+	VotedFor    string   `json:"votedFor"`
+	SnapIndex   int64    `json:"snapIndex"`
+	SnapTerm    int64    `json:"snapTerm"`
+	SnapMembers []Member `json:"snapMembers"`
+}
+
+type installation struct {
+	req  *InstallRequest
+	done chan error
+}
+
+type Raft struct {
+	RaftConfig
+
+	mu   sync.Mutex
+	file *os.File
+
+	// Persistent state. The log holds the entries after SnapIndex.
+	raftState
+	log []*RaftEntry
+
+	commitIndex int64
+	lastApplied int64
+	members     []Member
+
+	role        string
+	leader      string
+	lastContact time.Time
+	deadline    time.Time
+
+	// Leader state. startIndex is the no-op of the term.
+	startIndex int64
+	nextIndex  map[string]int64
+	matchIndex map[string]int64
+	lastAck    map[string]time.Time
+	sending    map[string]bool
+	waiters    map[int64]chan error
+
+	// What OnRole was told last.
+	toldRole string
+	toldTerm int64
+
+	install   chan *installation
+	applyKick chan struct{}
+	sendKick  chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// OpenRaft loads the Raft state from the directory. applied is the index
+// the state of the nameserver is at.
+func OpenRaft(config RaftConfig, applied int64) (*Raft, error) {
+	r := &Raft{
+		RaftConfig: config,
+		role:       RaftFollower,
+		waiters:    map[int64]chan error{},
+		install:    make(chan *installation),
+		applyKick:  make(chan struct{}, 1),
+		sendKick:   make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(r.Dir, raftStateName))
+	if os.IsNotExist(err) {
+		r.SnapMembers = config.Members
+		err = r.saveState()
+	} else if err == nil {
+		err = json.Unmarshal(data, &r.raftState)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("open raft: %v", err)
+	}
+
+	valid, err := r.loadLog()
+	if err != nil {
+		return nil, fmt.Errorf("open raft: %v", err)
+	}
+
+	r.file, err = os.OpenFile(filepath.Join(r.Dir, raftLogName), os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		err = r.file.Truncate(valid)
+	}
+
+	if err == nil {
+		_, err = r.file.Seek(valid, io.SeekStart)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("open raft: %v", err)
+	}
+
+	if applied < r.SnapIndex {
+		return nil, fmt.Errorf("open raft: the state is at %d, but the log starts after %d", applied, r.SnapIndex)
+	}
+
+	r.members = r.membersAt(r.lastIndex())
+	r.lastApplied = applied
+	r.commitIndex = applied
+	r.resetDeadline()
+
+	return r, nil
+}
+
+// loadLog reads the entries after the snapshot and returns the length of
+// the intact part of the file.
+func (r *Raft) loadLog() (int64, error) {
+	file, err := os.Open(filepath.Join(r.Dir, raftLogName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return valid, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		entry := &RaftEntry{}
+		if !decodeRecord(line, entry) || entry.Index > r.lastIndex()+1 {
+			log.Printf("warning: Raft log is torn at offset %d; dropping the rest", valid)
+			return valid, nil
+		}
+
+		if entry.Index > r.SnapIndex {
+			r.log = append(r.log[:entry.Index-r.SnapIndex-1], entry)
+		}
+		valid += int64(len(line))
+	}
+}
+
+func (r *Raft) Start() {
+	go r.run()
+	go r.applyLoop()
+}
+
+// Stop stops the member as if it crashed.
+func (r *Raft) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+
+		r.mu.Lock()
+		r.file.Close()
+		r.failWaiters()
+		r.mu.Unlock()
+	})
+}
+
+func (r *Raft) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Raft) saveState() error {
+	return writeFileAtomically(filepath.Join(r.Dir, raftStateName), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(&r.raftState)
+	})
+}
+
+func (r *Raft) lastIndex() int64 {
+	return r.SnapIndex + int64(len(r.log))
+}
+
+func (r *Raft) lastTerm() int64 {
+	term, _ := r.termAt(r.lastIndex())
+	return term
+}
+
+func (r *Raft) termAt(index int64) (int64, bool) {
+	if index == r.SnapIndex {
+		return r.SnapTerm, true
+	}
+
+	if index < r.SnapIndex || index > r.lastIndex() {
+		return 0, false
+	}
+
+	return r.log[index-r.SnapIndex-1].Term, true
+}
+
+// membersAt returns the members as of the entry.
+func (r *Raft) membersAt(index int64) []Member {
+	for i := index; i > r.SnapIndex; i-- {
+		if entry := r.log[i-r.SnapIndex-1]; entry.Members != nil {
+			return entry.Members
+		}
+	}
+
+	return r.SnapMembers
+}
+
+func (r *Raft) isMember(id string) bool {
+	for _, m := range r.members {
+		if m.Private == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Raft) quorum() int {
+	return len(r.members)/2 + 1
+}
+
+func (r *Raft) resetDeadline() {
+	timeout := r.ElectionTimeout + time.Duration(rand.Int63n(int64(r.ElectionTimeout)))
+	r.deadline = time.Now().Add(timeout)
+}
+
+// appendLocal writes the entries to the log.
+func (r *Raft) appendLocal(entries []*RaftEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	for _, entry := range entries {
+		line, err := encodeRecord(entry)
+		if err != nil {
+			return err
+		}
+
+		if _, err := r.file.Write(line); err != nil {
+			return err
+		}
+	}
+
+	if err := r.file.Sync(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		r.log = append(r.log, entry)
+		if entry.Members != nil {
+			r.setMembers(entry.Members)
+		}
+	}
+
+	return nil
+}
+
+// rewriteLog replaces the log file with the entries in memory.
+func (r *Raft) rewriteLog() error {
+	name := filepath.Join(r.Dir, raftLogName)
+	err := writeFileAtomically(name, func(w io.Writer) error {
+		for _, entry := range r.log {
+			line, err := encodeRecord(entry)
+			if err != nil {
+				return err
+			}
+
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.file.Close()
+	r.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// truncateFrom drops the entries from the index on.
+func (r *Raft) truncateFrom(index int64) error {
+	r.log = r.log[:index-r.SnapIndex-1]
+	r.setMembers(r.membersAt(r.lastIndex()))
+	return r.rewriteLog()
+}
+
+func (r *Raft) setMembers(members []Member) {
+	r.members = members
+
+	if r.role != RaftLeader {
+		return
+	}
+
+	for _, m := range members {
+		if _, ok := r.nextIndex[m.Private]; !ok {
+			r.nextIndex[m.Private] = r.lastIndex() + 1
+			r.lastAck[m.Private] = time.Now()
+		}
+	}
+}
+
+func (r *Raft) kickApply() {
+	select {
+	case r.applyKick <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) kickSend() {
+	select {
+	case r.sendKick <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) becomeFollower(term int64, leader string) {
+	if term > r.Term {
+		r.Term = term
+		r.VotedFor = ""
+		if err := r.saveState(); err != nil {
+			log.Printf("error: could not save Raft state: %v", err)
+		}
+	}
+
+	if r.role == RaftLeader {
+		log.Printf("Raft: no longer the leader of term %d", r.Term)
+		r.failWaiters()
+	}
+
+	r.role = RaftFollower
+	r.leader = leader
+	r.kickApply()
+}
+
+func (r *Raft) failWaiters() {
+	for index, done := range r.waiters {
+		done <- ErrNotLeader
+		delete(r.waiters, index)
+	}
+}
+
+func (r *Raft) run() {
+	ticker := time.NewTicker(r.ElectionTimeout / 10)
+	defer ticker.Stop()
+
+	heartbeat := time.NewTicker(r.ElectionTimeout / 4)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+
+		case <-ticker.C:
+			r.mu.Lock()
+			switch {
+			case r.role == RaftLeader:
+				r.checkQuorum()
+			case time.Now().After(r.deadline) && r.isMember(r.ID):
+				r.campaign()
+			}
+			r.mu.Unlock()
+
+		case <-heartbeat.C:
+			r.sendAll()
+
+		case <-r.sendKick:
+			r.sendAll()
+		}
+	}
+}
+
+// checkQuorum makes a leader that doesn't hear from a majority step down,
+// so that clients look for another one.
+func (r *Raft) checkQuorum() {
+	heard := 0
+	for _, m := range r.members {
+		if m.Private == r.ID || time.Since(r.lastAck[m.Private]) < 2*r.ElectionTimeout {
+			heard++
+		}
+	}
+
+	if heard < r.quorum() {
+		log.Printf("Raft: lost the majority in term %d", r.Term)
+		r.becomeFollower(r.Term, "")
+	}
+}
+
+func (r *Raft) campaign() {
+	r.Term++
+	r.role = RaftCandidate
+	r.VotedFor = r.ID
+	r.leader = ""
+	r.resetDeadline()
+	if err := r.saveState(); err != nil {
+		log.Printf("error: could not save Raft state: %v", err)
+		return
+	}
+
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+
+	req := &VoteRequest{Term: r.Term, Candidate: r.ID, LastIndex: r.lastIndex(), LastTerm: r.lastTerm()}
+	for _, m := range r.members {
+		if m.Private == r.ID {
+			continue
+		}
+
+		go func(peer string) {
+			resp, err := r.Transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if resp.Term > r.Term {
+				r.becomeFollower(resp.Term, "")
+				return
+			}
+
+			if r.role != RaftCandidate || r.Term != req.Term || !resp.Granted {
+				return
+			}
+
+			votes++
+			if votes == r.quorum() {
+				r.becomeLeader()
+			}
+		}(m.Private)
+	}
+}
+
+func (r *Raft) becomeLeader() {
+	log.Printf("Raft: became the leader of term %d", r.Term)
+
+	r.role = RaftLeader
+	r.leader = r.ID
+	r.nextIndex = map[string]int64{}
+	r.matchIndex = map[string]int64{}
+	r.lastAck = map[string]time.Time{}
+	r.sending = map[string]bool{}
+	r.setMembers(r.members)
+
+	noop := &RaftEntry{Index: r.lastIndex() + 1, Term: r.Term}
+	if err := r.appendLocal([]*RaftEntry{noop}); err != nil {
+		log.Printf("error: could not append to Raft log: %v", err)
+		r.becomeFollower(r.Term, "")
+		return
+	}
+
+	r.startIndex = noop.Index
+	r.advanceCommit()
+	r.kickSend()
+}
+
+func (r *Raft) sendAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role != RaftLeader {
+		return
+	}
+
+	for _, m := range r.members {
+		if m.Private != r.ID && !r.sending[m.Private] {
+			r.sending[m.Private] = true
+			go r.sendTo(m.Private)
+		}
+	}
+}
+
+// sendTo brings the peer up to date with the log, or sends it a snapshot
+// if the entries it lacks are compacted.
+func (r *Raft) sendTo(peer string) {
+	defer func() {
+		r.mu.Lock()
+		r.sending[peer] = false
+		r.mu.Unlock()
+	}()
+
+	r.mu.Lock()
+	term := r.Term
+	next := r.nextIndex[peer]
+	if next <= r.SnapIndex {
+		r.mu.Unlock()
+		r.sendSnapshot(peer, term)
+		return
+	}
+
+	prevTerm, _ := r.termAt(next - 1)
+	req := &AppendRequest{
+		Term:      term,
+		Leader:    r.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Commit:    r.commitIndex,
+	}
+
+	last := r.lastIndex()
+	if last > next+MaxAppend-1 {
+		last = next + MaxAppend - 1
+	}
+	for i := next; i <= last; i++ {
+		req.Entries = append(req.Entries, r.log[i-r.SnapIndex-1])
+	}
+	r.mu.Unlock()
+
+	resp, err := r.Transport.AppendEntries(peer, req)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handleResponse(peer, term, resp)
+}
+
+func (r *Raft) sendSnapshot(peer string, term int64) {
+	data, index, err := r.Snapshot()
+	if err != nil {
+		log.Printf("error: could not read the snapshot for %s: %v", peer, err)
+		return
+	}
+
+	r.mu.Lock()
+	lastTerm, ok := r.termAt(index)
+	if !ok || r.Term != term || r.role != RaftLeader {
+		r.mu.Unlock()
+		return
+	}
+
+	req := &InstallRequest{
+		Term:     term,
+		Leader:   r.ID,
+		Index:    index,
+		LastTerm: lastTerm,
+		Members:  r.membersAt(index),
+		Data:     data,
+	}
+	r.mu.Unlock()
+
+	resp, err := r.Transport.InstallSnapshot(peer, req)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handleResponse(peer, term, resp)
+}
+
+func (r *Raft) handleResponse(peer string, term int64, resp *AppendResponse) {
+	if resp.Term > r.Term {
+		r.becomeFollower(resp.Term, "")
+		return
+	}
+
+	if r.role != RaftLeader || r.Term != term {
+		return
+	}
+
+	r.lastAck[peer] = time.Now()
+
+	if !resp.Success {
+		next := r.nextIndex[peer] - 1
+		if resp.Conflict > 0 && resp.Conflict < next {
+			next = resp.Conflict
+		}
+		if next < 1 {
+			next = 1
+		}
+		r.nextIndex[peer] = next
+		r.kickSend()
+		return
+	}
+
+	if resp.Match > r.matchIndex[peer] {
+		r.matchIndex[peer] = resp.Match
+	}
+	r.nextIndex[peer] = r.matchIndex[peer] + 1
+
+	r.advanceCommit()
+	if r.nextIndex[peer] <= r.lastIndex() {
+		r.kickSend()
+	}
+}
+
+// advanceCommit commits the entries of the term that a majority has.
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if term, _ := r.termAt(n); term != r.Term {
+			break
+		}
+
+		count := 0
+		for _, m := range r.members {
+			if m.Private == r.ID || r.matchIndex[m.Private] >= n {
+				count++
+			}
+		}
+
+		if count >= r.quorum() {
+			r.commitIndex = n
+			break
+		}
+	}
+
+	for index, done := range r.waiters {
+		if index <= r.commitIndex {
+			done <- nil
+			delete(r.waiters, index)
+		}
+	}
+	r.kickApply()
+
+	// A leader that removed itself leaves once the removal is committed.
+	if !r.isMember(r.ID) && r.commitIndex >= r.lastIndex() {
+		log.Printf("Raft: removed from the cluster; stepping down")
+		r.becomeFollower(r.Term, "")
+	}
+}
+
+// HandleVote answers a candidate. A member that hears from a leader
+// ignores candidates, so that a member that was cut off, or is not in the
+// cluster yet, doesn't disrupt it.
+func (r *Raft) HandleVote(req *VoteRequest) *VoteResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term < r.Term {
+		return &VoteResponse{Term: r.Term}
+	}
+
+	if r.role == RaftLeader || r.leader != "" && time.Since(r.lastContact) < r.ElectionTimeout {
+		return &VoteResponse{Term: r.Term}
+	}
+
+	if req.Term > r.Term {
+		r.becomeFollower(req.Term, "")
+	}
+
+	upToDate := req.LastTerm > r.lastTerm() || req.LastTerm == r.lastTerm() && req.LastIndex >= r.lastIndex()
+	if !upToDate || r.VotedFor != "" && r.VotedFor != req.Candidate {
+		return &VoteResponse{Term: r.Term}
+	}
+
+	r.VotedFor = req.Candidate
+	if err := r.saveState(); err != nil {
+		log.Printf("error: could not save Raft state: %v", err)
+		return &VoteResponse{Term: r.Term}
+	}
+	r.resetDeadline()
+
+	return &VoteResponse{Term: r.Term, Granted: true}
+}
+
+// heardFrom acknowledges the leader of the term.
+func (r *Raft) heardFrom(term int64, leader string) {
+	if term > r.Term || r.role != RaftFollower || r.leader != leader {
+		r.becomeFollower(term, leader)
+	}
+
+	r.lastContact = time.Now()
+	r.resetDeadline()
+}
+
+func (r *Raft) HandleAppend(req *AppendRequest) *AppendResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term < r.Term {
+		return &AppendResponse{Term: r.Term}
+	}
+	r.heardFrom(req.Term, req.Leader)
+
+	if req.PrevIndex > r.lastIndex() {
+		return &AppendResponse{Term: r.Term, Conflict: r.lastIndex() + 1}
+	}
+
+	if req.PrevIndex > r.SnapIndex {
+		if term, _ := r.termAt(req.PrevIndex); term != req.PrevTerm {
+			// Skip the whole term that doesn't match.
+			conflict := req.PrevIndex
+			for conflict-1 > r.SnapIndex {
+				if before, _ := r.termAt(conflict - 1); before != term {
+					break
+				}
+				conflict--
+			}
+			return &AppendResponse{Term: r.Term, Conflict: conflict}
+		}
+	}
+
+	var fresh []*RaftEntry
+	for _, entry := range req.Entries {
+		if entry.Index <= r.SnapIndex {
+			continue
+		}
+
+		if entry.Index <= r.lastIndex() {
+			if term, _ := r.termAt(entry.Index); term == entry.Term {
+				continue
+			}
+
+			if err := r.truncateFrom(entry.Index); err != nil {
+				log.Printf("error: could not truncate Raft log: %v", err)
+				return &AppendResponse{Term: r.Term, Conflict: entry.Index}
+			}
+		}
+
+		fresh = append(fresh, entry)
+	}
+
+	if err := r.appendLocal(fresh); err != nil {
+		log.Printf("error: could not append to Raft log: %v", err)
+		return &AppendResponse{Term: r.Term, Conflict: r.lastIndex() + 1}
+	}
+
+	match := req.PrevIndex + int64(len(req.Entries))
+	if commit := req.Commit; commit > r.commitIndex {
+		if commit > match {
+			commit = match
+		}
+		if commit > r.commitIndex {
+			r.commitIndex = commit
+			r.kickApply()
+		}
+	}
+
+	return &AppendResponse{Term: r.Term, Success: true, Match: match}
+}
+
+// HandleInstall replaces the state with the snapshot of the leader. It
+// returns once the snapshot is installed.
+func (r *Raft) HandleInstall(req *InstallRequest) *AppendResponse {
+	r.mu.Lock()
+	if req.Term < r.Term {
+		defer r.mu.Unlock()
+		return &AppendResponse{Term: r.Term}
+	}
+	r.heardFrom(req.Term, req.Leader)
+	r.mu.Unlock()
+
+	inst := &installation{req: req, done: make(chan error, 1)}
+	select {
+	case r.install <- inst:
+	case <-r.stop:
+		return &AppendResponse{Term: req.Term}
+	}
+
+	err := <-inst.done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		log.Printf("error: could not install the snapshot at %d: %v", req.Index, err)
+		return &AppendResponse{Term: r.Term}
+	}
+
+	return &AppendResponse{Term: r.Term, Success: true, Match: req.Index}
+}
+
+// installed moves the log past the snapshot.
+func (r *Raft) installed(req *InstallRequest) error {
+	if term, ok := r.termAt(req.Index); ok && term == req.LastTerm {
+		r.log = r.log[req.Index-r.SnapIndex:]
+	} else {
+		r.log = nil
+	}
+
+	r.SnapIndex = req.Index
+	r.SnapTerm = req.LastTerm
+	r.SnapMembers = req.Members
+	if err := r.saveState(); err != nil {
+		return err
+	}
+
+	if r.commitIndex < req.Index {
+		r.commitIndex = req.Index
+	}
+	r.lastApplied = req.Index
+	r.setMembers(r.membersAt(r.lastIndex()))
+
+	return r.rewriteLog()
+}
+
+// Propose appends the batch to the log and returns once it is committed.
+func (r *Raft) Propose(batch []*LogEntry) (int64, error) {
+	return r.propose(&RaftEntry{Batch: batch})
+}
+
+func (r *Raft) propose(entry *RaftEntry) (int64, error) {
+	r.mu.Lock()
+	if r.role != RaftLeader || r.lastApplied < r.startIndex {
+		r.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+
+	entry.Index = r.lastIndex() + 1
+	entry.Term = r.Term
+	if err := r.appendLocal([]*RaftEntry{entry}); err != nil {
+		r.mu.Unlock()
+		return 0, fmt.Errorf("raft: %v", err)
+	}
+
+	done := make(chan error, 1)
+	r.waiters[entry.Index] = done
+	r.advanceCommit()
+	r.mu.Unlock()
+
+	r.kickSend()
+
+	select {
+	case err := <-done:
+		return entry.Index, err
+	case <-time.After(10 * r.ElectionTimeout):
+		r.mu.Lock()
+		delete(r.waiters, entry.Index)
+		r.mu.Unlock()
+		return 0, fmt.Errorf("raft: entry %d is not committed in time", entry.Index)
+	}
+}
+
+// StepDown gives up the leadership. The nameserver does so when it cannot
+// commit a batch it has already applied to its state.
+func (r *Raft) StepDown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role == RaftLeader {
+		r.becomeFollower(r.Term, "")
+		r.resetDeadline()
+	}
+}
+
+// AddMember adds a member to the cluster. Only one change may be in
+// progress at a time.
+func (r *Raft) AddMember(m Member) error {
+	return r.changeMembers(func(members []Member) ([]Member, error) {
+		for _, known := range members {
+			if known.Private == m.Private {
+				return nil, fmt.Errorf("%s is already a member", m.Private)
+			}
+		}
+		return append(members, m), nil
+	})
+}
+
+func (r *Raft) RemoveMember(id string) error {
+	return r.changeMembers(func(members []Member) ([]Member, error) {
+		var left []Member
+		for _, known := range members {
+			if known.Private != id {
+				left = append(left, known)
+			}
+		}
+
+		if len(left) == len(members) {
+			return nil, fmt.Errorf("%s is not a member", id)
+		}
+
+		if len(left) == 0 {
+			return nil, fmt.Errorf("cannot remove the last member")
+		}
+		return left, nil
+	})
+}
+
+func (r *Raft) changeMembers(change func([]Member) ([]Member, error)) error {
+	r.mu.Lock()
+	for i := r.commitIndex + 1; i <= r.lastIndex(); i++ {
+		if r.log[i-r.SnapIndex-1].Members != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("raft: another membership change is in progress")
+		}
+	}
+
+	members, err := change(append([]Member(nil), r.members...))
+	r.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("raft: %v", err)
+	}
+
+	_, err = r.propose(&RaftEntry{Members: members})
+	return err
+}
+
+// Compact drops the entries up to the index, which the nameserver has a
+// snapshot of.
+func (r *Raft) Compact(index int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if index <= r.SnapIndex || index > r.commitIndex {
+		return nil
+	}
+
+	r.SnapTerm, _ = r.termAt(index)
+	r.SnapMembers = r.membersAt(index)
+	r.log = r.log[index-r.SnapIndex:]
+	r.SnapIndex = index
+
+	if err := r.saveState(); err != nil {
+		return fmt.Errorf("compact: %v", err)
+	}
+
+	return r.rewriteLog()
+}
+
+// ResetApplied makes the entries after the index be applied again. It is
+// used from OnRole, after the nameserver reloads its state.
+func (r *Raft) ResetApplied(index int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if index < r.SnapIndex {
+		log.Printf("error: state at %d is behind the Raft log, which starts after %d", index, r.SnapIndex)
+		index = r.SnapIndex
+	}
+
+	r.lastApplied = index
+	r.kickApply()
+}
+
+// view is the role OnRole should be told about: the leader once it has
+// applied the entries of the previous leaders, or a follower.
+func (r *Raft) view() (string, int64) {
+	if r.role == RaftLeader && r.lastApplied >= r.startIndex {
+		return RaftLeader, r.Term
+	}
+
+	return RaftFollower, r.Term
+}
+
+func (r *Raft) applyLoop() {
+	for {
+		select {
+		case <-r.stop:
+			return
+
+		case inst := <-r.install:
+			err := r.Install(inst.req.Data, inst.req.Index)
+			if err == nil {
+				r.mu.Lock()
+				err = r.installed(inst.req)
+				r.mu.Unlock()
+			}
+			inst.done <- err
+
+		case <-r.applyKick:
+		}
+
+		for r.applyOnce() {
+		}
+	}
+}
+
+// applyOnce tells OnRole about leaving the leadership, applies a portion
+// of committed entries, and tells it about taking the leadership. It
+// reports whether there is more to do. A leader of one term that becomes
+// the leader of another one leaves the leadership in between, since its
+// state may hold entries that did not make it.
+func (r *Raft) applyOnce() bool {
+	r.mu.Lock()
+	role, term := r.view()
+	left := r.toldRole == RaftLeader && (role != RaftLeader || term != r.toldTerm)
+	if left || role != RaftLeader && term != r.toldTerm {
+		r.toldRole, r.toldTerm = RaftFollower, term
+		r.mu.Unlock()
+
+		r.OnRole(RaftFollower, term)
+		return true
+	}
+
+	var entries []*RaftEntry
+	for i := r.lastApplied + 1; i <= r.commitIndex && len(entries) < MaxAppend; i++ {
+		entries = append(entries, r.log[i-r.SnapIndex-1])
+	}
+	r.mu.Unlock()
+
+	for _, entry := range entries {
+		r.Apply(entry)
+
+		r.mu.Lock()
+		if r.lastApplied == entry.Index-1 {
+			r.lastApplied = entry.Index
+		}
+		r.mu.Unlock()
+	}
+
+	if len(entries) != 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	role, term = r.view()
+	if role == RaftLeader && r.toldRole != RaftLeader {
+		r.toldRole, r.toldTerm = role, term
+		r.mu.Unlock()
+
+		r.OnRole(role, term)
+		return true
+	}
+	r.mu.Unlock()
+
+	return false
+}
+
+type RaftStatus struct {
+	ID          string   `json:"id"`
+	Role        string   `json:"role"`
+	Term        int64    `json:"term"`
+	Leader      string   `json:"leader"`
+	Members     []Member `json:"members"`
+	LastIndex   int64    `json:"lastIndex"`
+	CommitIndex int64    `json:"commitIndex"`
+	LastApplied int64    `json:"lastApplied"`
+}
+
+func (r *Raft) Status() *RaftStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &RaftStatus{
+		ID:          r.ID,
+		Role:        r.role,
+		Term:        r.Term,
+		Leader:      r.leader,
+		Members:     r.members,
+		LastIndex:   r.lastIndex(),
+		CommitIndex: r.commitIndex,
+		LastApplied: r.lastApplied,
+	}
+}
+
+// LeaderMember returns the member believed to be the leader.
+func (r *Raft) LeaderMember() (Member, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range r.members {
+		if m.Private == r.leader {
+			return m, true
+		}
+	}
+
+	return Member{}, false
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memNetwork connects Raft members in memory. Members that are down
+// neither send nor receive.
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*raftNode
+	down  map[string]bool
+}
+
+type memTransport struct {
+	net  *memNetwork
+	from string
+}
+
+func (n *memNetwork) reach(from, to string) (*raftNode, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	node, ok := n.nodes[to]
+	if !ok || n.down[from] || n.down[to] {
+		return nil, fmt.Errorf("%s cannot reach %s", from, to)
+	}
+
+	return node, nil
+}
+
+func (n *memNetwork) setDown(id string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.down[id] = down
+}
+
+func (tr *memTransport) RequestVote(peer string, req *VoteRequest) (*VoteResponse, error) {
+	node, err := tr.net.reach(tr.from, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.HandleVote(req), nil
+}
+
+func (tr *memTransport) AppendEntries(peer string, req *AppendRequest) (*AppendResponse, error) {
+	node, err := tr.net.reach(tr.from, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.HandleAppend(req), nil
+}
+
+func (tr *memTransport) InstallSnapshot(peer string, req *InstallRequest) (*AppendResponse, error) {
+	node, err := tr.net.reach(tr.from, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.HandleInstall(req), nil
+}
+
+// raftNode is a Raft member whose state is the list of addresses of the
+// entries it applied.
+type raftNode struct {
+	*Raft
+
+	mu        sync.Mutex
+	applied   []string
+	index     int64
+	snapshot  []byte
+	snapIndex int64
+}
+
+func (node *raftNode) apply(entry *RaftEntry) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	for _, e := range entry.Batch {
+		node.applied = append(node.applied, e.Address)
+	}
+	node.index = entry.Index
+}
+
+func (node *raftNode) install(data []byte, index int64) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	node.applied = nil
+	node.index = index
+	node.snapshot, node.snapIndex = data, index
+	return json.Unmarshal(data, &node.applied)
+}
+
+func (node *raftNode) latest() ([]byte, int64, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	return node.snapshot, node.snapIndex, nil
+}
+
+// compact snapshots the state and compacts the log up to it.
+func (node *raftNode) compact() error {
+	node.mu.Lock()
+	node.snapshot, _ = json.Marshal(node.applied)
+	node.snapIndex = node.index
+	node.mu.Unlock()
+
+	return node.Compact(node.snapIndex)
+}
+
+func (node *raftNode) state() []string {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	return append([]string(nil), node.applied...)
+}
+
+type raftCluster struct {
+	net     *memNetwork
+	dirs    map[string]string
+	members []Member
+}
+
+func newRaftCluster(n int) *raftCluster {
+	c := &raftCluster{
+		net:  &memNetwork{nodes: map[string]*raftNode{}, down: map[string]bool{}},
+		dirs: map[string]string{},
+	}
+
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("ns%d", i)
+		c.members = append(c.members, Member{Private: id, Public: id})
+	}
+
+	for _, m := range c.members {
+		if err := c.start(m.Private, c.members); err != nil {
+			panic(err)
+		}
+	}
+
+	return c
+}
+
+// start starts the member with an empty state.
+func (c *raftCluster) start(id string, members []Member) error {
+	dir, ok := c.dirs[id]
+	if !ok {
+		dir, _ = ioutil.TempDir("", "tsukiraft")
+		c.dirs[id] = dir
+	}
+
+	node := &raftNode{}
+	raft, err := OpenRaft(RaftConfig{
+		ID:              id,
+		Dir:             dir,
+		Members:         members,
+		Transport:       &memTransport{net: c.net, from: id},
+		ElectionTimeout: 100 * time.Millisecond,
+		Apply:           node.apply,
+		Install:         node.install,
+		Snapshot:        node.latest,
+		OnRole:          func(string, int64) {},
+	}, 0)
+	if err != nil {
+		return err
+	}
+	node.Raft = raft
+
+	c.net.mu.Lock()
+	c.net.nodes[id] = node
+	c.net.mu.Unlock()
+
+	raft.Start()
+	return nil
+}
+
+func (c *raftCluster) node(id string) *raftNode {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+
+	return c.net.nodes[id]
+}
+
+func (c *raftCluster) stop() {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+
+	for id, node := range c.net.nodes {
+		node.Stop()
+		os.RemoveAll(c.dirs[id])
+	}
+}
+
+// leader waits for a leader that is up and returns it.
+func (c *raftCluster) leader() *raftNode {
+	var found *raftNode
+	waitFor(5*time.Second, func() bool {
+		c.net.mu.Lock()
+		defer c.net.mu.Unlock()
+
+		for id, node := range c.net.nodes {
+			if !c.net.down[id] && node.Status().Role == RaftLeader {
+				found = node
+				return true
+			}
+		}
+		return false
+	})
+
+	return found
+}
+
+// propose commits an entry through whichever member leads.
+func (c *raftCluster) propose(address string) error {
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		leader := c.leader()
+		if leader == nil {
+			return fmt.Errorf("no leader")
+		}
+
+		if _, err = leader.Propose([]*LogEntry{{Op: OpMkdir, Address: address}}); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// converged waits for the members to apply the same state.
+func (c *raftCluster) converged(want []string, ids ...string) bool {
+	return waitFor(5*time.Second, func() bool {
+		for _, id := range ids {
+			if !reflect.DeepEqual(c.node(id).state(), want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRaft_Replication(test *testing.T) {
+	c := newRaftCluster(3)
+	defer c.stop()
+
+	want := []string{"/a", "/b", "/c"}
+	for _, address := range want {
+		if err := c.propose(address); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if !c.converged(want, "ns0", "ns1", "ns2") {
+		test.Errorf("members did not apply %v: %v, %v, %v", want, c.node("ns0").state(), c.node("ns1").state(), c.node("ns2").state())
+	}
+}
+
+// TestRaft_Failover cuts the leader off while it still takes a proposal,
+// and checks that the rest elect another leader and that the old one
+// drops its uncommitted entry when it comes back.
+func TestRaft_Failover(test *testing.T) {
+	c := newRaftCluster(3)
+	defer c.stop()
+
+	if err := c.propose("/before"); err != nil {
+		test.Fatal(err)
+	}
+
+	old := c.leader()
+	c.net.setDown(old.ID, true)
+
+	lost := make(chan error)
+	go func() {
+		_, err := old.Propose([]*LogEntry{{Op: OpMkdir, Address: "/lost"}})
+		lost <- err
+	}()
+
+	if err := c.propose("/after"); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := <-lost; err == nil {
+		test.Errorf("proposal to a cut off leader is committed")
+	}
+
+	c.net.setDown(old.ID, false)
+
+	want := []string{"/before", "/after"}
+	if !c.converged(want, "ns0", "ns1", "ns2") {
+		test.Errorf("old leader has %v, want %v", c.node(old.ID).state(), want)
+	}
+}
+
+func TestRaft_Restart(test *testing.T) {
+	c := newRaftCluster(3)
+	defer c.stop()
+
+	for _, address := range []string{"/a", "/b"} {
+		if err := c.propose(address); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	// Restarting the whole cluster keeps the committed entries.
+	for _, m := range c.members {
+		c.node(m.Private).Stop()
+	}
+	for _, m := range c.members {
+		if err := c.start(m.Private, c.members); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if err := c.propose("/c"); err != nil {
+		test.Fatal(err)
+	}
+
+	want := []string{"/a", "/b", "/c"}
+	if !c.converged(want, "ns0", "ns1", "ns2") {
+		test.Errorf("members did not apply %v after a restart", want)
+	}
+}
+
+// TestRaft_Membership adds a member after the log is compacted, so that
+// it gets a snapshot, and then removes the leader.
+func TestRaft_Membership(test *testing.T) {
+	c := newRaftCluster(3)
+	defer c.stop()
+
+	for _, address := range []string{"/a", "/b"} {
+		if err := c.propose(address); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	leader := c.leader()
+	if err := leader.compact(); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := c.propose("/c"); err != nil {
+		test.Fatal(err)
+	}
+
+	fresh := Member{Private: "ns3", Public: "ns3"}
+	if err := c.start(fresh.Private, nil); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := c.leader().AddMember(fresh); err != nil {
+		test.Fatal(err)
+	}
+
+	want := []string{"/a", "/b", "/c"}
+	if !c.converged(want, "ns3") {
+		test.Fatalf("new member has %v, want %v", c.node("ns3").state(), want)
+	}
+
+	leader = c.leader()
+	if err := leader.RemoveMember(leader.ID); err != nil {
+		test.Fatal(err)
+	}
+
+	if !waitFor(5*time.Second, func() bool {
+		next := c.leader()
+		return next != nil && next.ID != leader.ID
+	}) {
+		test.Fatalf("removed leader %s is still the leader", leader.ID)
+	}
+
+	if err := c.propose("/d"); err != nil {
+		test.Fatal(err)
+	}
+
+	var rest []string
+	for _, m := range append(c.members, fresh) {
+		if m.Private != leader.ID {
+			rest = append(rest, m.Private)
+		}
+	}
+
+	want = append(want, "/d")
+	if !c.converged(want, rest...) {
+		test.Errorf("remaining members did not apply %v", want)
+	}
+
+	if members := c.leader().Status().Members; len(members) != 3 {
+		test.Errorf("cluster has %d members, want 3", len(members))
+	}
+}
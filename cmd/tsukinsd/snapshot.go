@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A snapshot file starts with a header, followed by the gob-encoded
+// Snapshot:
+//
+//	magic (8 bytes) | format (uint32) | CRC-32 of payload (uint32) | payload length (uint64)
+//
+// All integers are big endian. Snapshots are named after the journal
+// version they capture.
+const (
+	SnapshotFormat = uint32(1)
+	snapshotMagic  = "TSUKISNP"
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+)
+
+// Snapshot is the whole NS state at one journal version.
+type Snapshot struct {
+	Version int64
+	Nodes   []*NodeRecord
+	Chunks  []*ChunkRecord
+
+	// Pool lists the fileservers in the order of their IDs.
+	Pool []*RegisterMessage
+
+	// RaftIndex is the last entry of the Raft log the snapshot reflects.
+	RaftIndex int64
+
+	Deletions []*DeletionRecord
+	Trash     []*TrashItem
+
+	// LastInode is the inode number given out last.
+	LastInode int64
+}
+
+// DeletionRecord is a deletion with the files it has left.
+type DeletionRecord struct {
+	ID      string
+	Address string
+	Total   int
+	Files   []*NodeRecord
+}
+
+type SnapshotMessage struct {
+	Version int64  `json:"version"`
+	File    string `json:"file"`
+}
+
+// CaptureSnapshot copies the current state. It must be called with the
+// journal locked, so that the state matches the version.
+func CaptureSnapshot(version int64) *Snapshot {
+	snap := &Snapshot{Version: version, LastInode: t.LastInode}
+
+	for _, node := range t.Inodes {
+		snap.Nodes = append(snap.Nodes, node.Record())
+	}
+
+	for _, chunk := range ct.Table {
+		snap.Chunks = append(snap.Chunks, chunk.Record())
+	}
+
+	for _, deletion := range t.Deletions {
+		rec := &DeletionRecord{ID: deletion.ID, Address: deletion.Address, Total: deletion.Total}
+		for _, file := range deletion.Files {
+			rec.Files = append(rec.Files, file.Record())
+		}
+		snap.Deletions = append(snap.Deletions, rec)
+	}
+
+	snap.Trash = append(snap.Trash, t.Trash...)
+
+	for _, fs := range storages.StorageNodes {
+		fs.mu.Lock()
+		snap.Pool = append(snap.Pool, &RegisterMessage{
+			NodeID:      fs.NodeID,
+			PrivateHost: fs.PrivateHost,
+			PublicHost:  fs.PublicHost,
+			PrivatePort: fs.Port,
+			PublicPort:  fs.PublicPort,
+			Available:   fs.Available,
+		})
+		fs.mu.Unlock()
+	}
+
+	return snap
+}
+
+// Restore replaces the tree and the chunk table with the ones of the
+// snapshot, and registers the fileservers of the snapshot in the pool.
+func (snap *Snapshot) Restore() {
+	for _, reg := range snap.Pool {
+		if _, err := storages.RegisterFServer(reg); err != nil {
+			log.Printf("warning: could not restore fileserver %s: %v", reg.PrivateHost, err)
+		}
+	}
+
+	// Parents go before their children.
+	nodes := append([]*NodeRecord(nil), snap.Nodes...)
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodeDepth(nodes[i].Address) < nodeDepth(nodes[j].Address)
+	})
+
+	t = InitTree(conf.Namenode)
+	t.Version = snap.Version
+	for _, rec := range nodes {
+		t.ApplyNode(rec)
+	}
+	if snap.LastInode > t.LastInode {
+		t.LastInode = snap.LastInode
+	}
+
+	for _, rec := range snap.Deletions {
+		deletion := &Deletion{ID: rec.ID, Address: rec.Address, Total: rec.Total}
+		for _, file := range rec.Files {
+			deletion.Files = append(deletion.Files, detachedNode(file))
+		}
+		t.Deletions = append(t.Deletions, deletion)
+	}
+
+	t.Trash = append(t.Trash, snap.Trash...)
+
+	ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
+	for _, rec := range snap.Chunks {
+		ct.ApplyChunk(rec)
+	}
+	ct.Relink(storages)
+}
+
+func nodeDepth(address string) int {
+	if address == "." {
+		return -1
+	}
+
+	return strings.Count(address, "/")
+}
+
+func (snap *Snapshot) Encode(w io.Writer) error {
+	payload := &bytes.Buffer{}
+	if err := gob.NewEncoder(payload).Encode(snap); err != nil {
+		return fmt.Errorf("encode snapshot: %v", err)
+	}
+
+	header := &bytes.Buffer{}
+	header.WriteString(snapshotMagic)
+	binary.Write(header, binary.BigEndian, SnapshotFormat)
+	binary.Write(header, binary.BigEndian, crc32.ChecksumIEEE(payload.Bytes()))
+	binary.Write(header, binary.BigEndian, uint64(payload.Len()))
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return fmt.Errorf("encode snapshot: %v", err)
+	}
+
+	if _, err := w.Write(payload.Bytes()); err != nil {
+		return fmt.Errorf("encode snapshot: %v", err)
+	}
+
+	return nil
+}
+
+func DecodeSnapshot(r io.Reader) (*Snapshot, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, fmt.Errorf("decode snapshot: not a snapshot")
+	}
+
+	var format, sum uint32
+	var length uint64
+	binary.Read(r, binary.BigEndian, &format)
+	binary.Read(r, binary.BigEndian, &sum)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("decode snapshot: truncated header")
+	}
+
+	if format != SnapshotFormat {
+		return nil, fmt.Errorf("decode snapshot: unsupported format %d", format)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("decode snapshot: truncated payload")
+	}
+
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, fmt.Errorf("decode snapshot: checksum mismatch")
+	}
+
+	snap := &Snapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(snap); err != nil {
+		return nil, fmt.Errorf("decode snapshot: %v", err)
+	}
+
+	return snap, nil
+}
+
+func snapshotFileName(dir string, version int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, version, snapshotSuffix))
+}
+
+// listSnapshots returns the snapshot files in dir, newest first.
+func listSnapshots(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, filepath.Join(dir, name))
+		}
+	}
+
+	// Zero-padded versions sort as strings.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// SaveSnapshot writes the snapshot to dir and removes the oldest ones,
+// keeping retain of them. Zero retain keeps them all.
+func SaveSnapshot(dir string, snap *Snapshot, retain int) (string, error) {
+	name := snapshotFileName(dir, snap.Version)
+	if err := writeFileAtomically(name, snap.Encode); err != nil {
+		return "", fmt.Errorf("save snapshot: %v", err)
+	}
+
+	names, err := listSnapshots(dir)
+	if err != nil {
+		return name, nil
+	}
+
+	for i, old := range names {
+		if retain > 0 && i >= retain {
+			if err := os.Remove(old); err != nil {
+				log.Printf("warning: could not remove old snapshot %s: %v", old, err)
+			}
+		}
+	}
+
+	return name, nil
+}
+
+// LoadLatestSnapshot loads the newest snapshot in dir, or returns nil if
+// there is none. The journal only goes back to the newest snapshot, so an
+// older one can't stand in for it if it is damaged.
+func LoadLatestSnapshot(dir string) (*Snapshot, error) {
+	names, err := listSnapshots(dir)
+	if os.IsNotExist(err) || err == nil && len(names) == 0 {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(names[0])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	snap, err := DecodeSnapshot(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v; older snapshots are kept for manual recovery", names[0], err)
+	}
+
+	return snap, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot_Recovery(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	runWorkload("a", 5)
+	storages.RegisterFServer(&RegisterMessage{NodeID: "b", PrivateHost: "10.0.0.2", PublicPort: 7000})
+	wantNodes, wantChunks := len(t.Inodes), len(ct.Table)
+
+	version, err := wal.CheckpointNow()
+	if err != nil {
+		test.Fatalf("could not checkpoint, %v", err)
+	}
+	wal.Close()
+
+	// Only the snapshot is left to recover from.
+	os.Remove(conf.Namenode.TreeLogName)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	defer wal.Close()
+
+	if wal.Version != version {
+		test.Errorf("got version %d after recovery, want %d", wal.Version, version)
+	}
+
+	if len(t.Inodes) != wantNodes || len(ct.Table) != wantChunks {
+		test.Errorf("got %d nodes and %d chunks after recovery, want %d and %d", len(t.Inodes), len(ct.Table), wantNodes, wantChunks)
+	}
+
+	if len(storages.StorageNodes) != 2 || storages.StorageNodes[1].NodeID != "b" {
+		test.Errorf("registered fileserver is not recovered, got pool %v", storages.StorageNodes)
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+}
+
+func TestSnapshot_Checksum(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snap := &Snapshot{Version: 1, Nodes: []*NodeRecord{{Address: "a", Parent: ".", IsDirectory: true}}}
+	name, err := SaveSnapshot(dir, snap, 0)
+	if err != nil {
+		test.Fatalf("could not save, %v", err)
+	}
+
+	got, err := LoadLatestSnapshot(dir)
+	if err != nil || got.Version != 1 || len(got.Nodes) != 1 {
+		test.Fatalf("got %v, %v loading the snapshot back", got, err)
+	}
+
+	data, _ := ioutil.ReadFile(name)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(name, data, 0644)
+
+	if _, err := LoadLatestSnapshot(dir); err == nil {
+		test.Errorf("loaded a damaged snapshot, want an error")
+	}
+}
+
+func TestSnapshot_Retention(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for version := int64(1); version <= 5; version++ {
+		if _, err := SaveSnapshot(dir, &Snapshot{Version: version}, 2); err != nil {
+			test.Fatalf("could not save, %v", err)
+		}
+	}
+
+	names, _ := listSnapshots(dir)
+	want := []string{snapshotFileName(dir, 5), snapshotFileName(dir, 4)}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		test.Errorf("got snapshots %v, want %v", names, want)
+	}
+
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		test.Errorf("temporary files are left behind: %v", tmp)
+	}
+
+	got, err := LoadLatestSnapshot(dir)
+	if err != nil || got.Version != 5 {
+		test.Errorf("got %v, %v loading the latest snapshot, want version 5", got, err)
+	}
+}
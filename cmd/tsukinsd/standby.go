@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A nameserver is either the primary or a standby. The standby follows the
+// journal of the primary, applies its entries to its own state, and takes
+// over when the primary is gone. Every takeover starts a new epoch, which
+// tags all responses. Fileservers and clients stick to the newest epoch
+// they have seen, so a deposed primary that comes back is ignored until it
+// finds out and becomes a standby itself.
+//
+// With only two nameservers there is no quorum: if the primary is merely
+// cut off from the standby, both may serve for a while, until the deposed
+// one sees the newer epoch.
+const (
+	RolePrimary = "primary"
+	RoleStandby = "standby"
+
+	EpochHeader = "X-Tsuki-Epoch"
+
+	// SecretHeader carries the cluster secret of a nameserver asking
+	// another one.
+	SecretHeader = "X-Tsuki-Secret"
+)
+
+// ShipWait is how long the primary holds a request of a standby when it
+// has no new entries for it.
+var ShipWait = time.Second
+
+var shipClient = &http.Client{Timeout: ShipWait + 5*time.Second}
+
+type LeaderMessage struct {
+	Role    string `json:"role"`
+	Epoch   int64  `json:"epoch"`
+	Version int64  `json:"version"`
+}
+
+type ShipMessage struct {
+	Epoch   int64       `json:"epoch"`
+	Entries []*LogEntry `json:"entries"`
+}
+
+// Leadership is the role and the epoch of the nameserver. The epoch is
+// the one of its state, so it is saved only when the state is: when the
+// nameserver takes over, or when it loads a snapshot from the primary. A
+// nil Leadership is the primary of epoch zero.
+type Leadership struct {
+	mu       sync.Mutex
+	filename string
+	role     string
+	epoch    int64
+	managers sync.Once
+}
+
+var lead *Leadership
+
+// OpenLeadership reads the epoch saved in the file. The nameserver starts
+// as a standby until it decides otherwise.
+func OpenLeadership(filename string) (*Leadership, error) {
+	l := &Leadership{filename: filename, role: RoleStandby}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("open leadership: %v", err)
+	}
+
+	l.epoch, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("open leadership: malformed epoch in %s", filename)
+	}
+
+	return l, nil
+}
+
+func (l *Leadership) Role() (string, int64) {
+	if l == nil {
+		return RolePrimary, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.role, l.epoch
+}
+
+func (l *Leadership) IsPrimary() bool {
+	role, _ := l.Role()
+	return role == RolePrimary
+}
+
+// setEpoch saves the epoch. It must be called with the lock held.
+func (l *Leadership) setEpoch(epoch int64) error {
+	err := writeFileAtomically(l.filename, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, epoch)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("save epoch: %v", err)
+	}
+
+	l.epoch = epoch
+	return nil
+}
+
+// Lead makes the nameserver the primary. A takeover starts a new epoch.
+func (l *Leadership) Lead(takeover bool) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if takeover || l.epoch == 0 {
+		if err := l.setEpoch(l.epoch + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	l.role = RolePrimary
+	return l.epoch, nil
+}
+
+// Observe learns of an epoch seen elsewhere. A primary that sees a newer
+// one is deposed and becomes a standby; Observe reports whether that
+// happened. The epoch itself is adopted after the state is.
+func (l *Leadership) Observe(epoch int64) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.role != RolePrimary || epoch <= l.epoch {
+		return false
+	}
+
+	l.role = RoleStandby
+	return true
+}
+
+// Adopt moves a standby to the epoch of the primary whose state it loaded.
+func (l *Leadership) Adopt(epoch int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if epoch == l.epoch {
+		return nil
+	}
+
+	return l.setEpoch(epoch)
+}
+
+// Set takes the role and the epoch from the Raft cluster, where the epoch
+// is the term and is kept by Raft itself.
+func (l *Leadership) Set(role string, epoch int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.role = role
+	l.epoch = epoch
+}
+
+// startRole decides whether the nameserver starts as the primary. A
+// nameserver that is not configured as a standby still becomes one if the
+// peer is a primary as new as itself, which is the case when it comes back
+// after a takeover.
+func startRole() {
+	if conf.Namenode.Standby {
+		follow(conf.Namenode.Peer)
+		return
+	}
+
+	if conf.Namenode.Peer != "" {
+		_, epoch := lead.Role()
+		msg, err := askPeer(conf.Namenode.Peer)
+		if err == nil && msg.Role == RolePrimary && msg.Epoch >= epoch {
+			log.Printf("Peer %s is the primary of epoch %d; starting as its standby", conf.Namenode.Peer, msg.Epoch)
+			follow(conf.Namenode.Peer)
+			return
+		}
+	}
+
+	if err := becomePrimary(false); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// becomePrimary makes the nameserver the primary.
+func becomePrimary(takeover bool) error {
+	epoch, err := lead.Lead(takeover)
+	if err != nil {
+		return err
+	}
+
+	startPrimary(epoch)
+	if conf.Namenode.Peer != "" {
+		go watchPeer(conf.Namenode.Peer, epoch)
+	}
+
+	return nil
+}
+
+// startPrimary starts everything the primary runs.
+func startPrimary(epoch int64) {
+	// Heartbeats and lease renewals went to the old primary until now.
+	state.Lock()
+	for _, fs := range storages.StorageNodes {
+		fs.LastPulse = time.Now()
+	}
+	extendLeases()
+	version := wal.Version
+	state.Unlock()
+
+	lead.managers.Do(func() {
+		go storages.HeartbeatManager(true)
+		go storages.HeartbeatManager(false)
+		go purgeDeletions()
+		go expireLeases()
+		go pruneAgedVersions()
+		go expungeTrash()
+	})
+
+	log.Printf("Serving as the primary of epoch %d at version %d", epoch, version)
+}
+
+// stepDown turns a deposed primary into a standby of the peer.
+func stepDown(epoch int64) {
+	log.Printf("Deposed by epoch %d; becoming a standby", epoch)
+	if conf.Namenode.Peer != "" {
+		go follow(conf.Namenode.Peer)
+	}
+}
+
+// watchPeer checks whether the peer took over while the primary was cut
+// off from it, for as long as the primary stays the primary of the epoch.
+func watchPeer(peer string, epoch int64) {
+	period := conf.Namenode.TakeoverTime * time.Second / 2
+	if period < time.Second {
+		period = time.Second
+	}
+
+	for {
+		time.Sleep(period)
+
+		if role, current := lead.Role(); role != RolePrimary || current != epoch {
+			return
+		}
+
+		msg, err := askPeer(peer)
+		if err == nil && msg.Role == RolePrimary && lead.Observe(msg.Epoch) {
+			stepDown(msg.Epoch)
+			return
+		}
+	}
+}
+
+func askPeer(peer string) (*LeaderMessage, error) {
+	resp, err := shipClient.Get(fmt.Sprintf("http://%s/leader", peer))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	msg := &LeaderMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(msg); err != nil {
+		return nil, fmt.Errorf("ask peer: %v", err)
+	}
+
+	return msg, nil
+}
+
+// follow ships the journal of the primary at peer until the nameserver
+// becomes the primary itself.
+func follow(peer string) {
+	log.Printf("Following the primary at %s from version %d", peer, wal.Current())
+
+	heard := time.Now()
+	for !lead.IsPrimary() {
+		alive, err := ship(peer)
+		if alive {
+			heard = time.Now()
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if time.Since(heard) > conf.Namenode.TakeoverTime*time.Second {
+			log.Printf("Primary %s is gone (%v); taking over", peer, err)
+			if err := becomePrimary(true); err != nil {
+				log.Printf("error: could not take over: %v", err)
+				heard = time.Now()
+				continue
+			}
+			return
+		}
+
+		time.Sleep(ShipWait / 4)
+	}
+}
+
+// ship applies the entries of the primary that follow the last one of the
+// journal. It reports whether the primary answered.
+func ship(peer string) (bool, error) {
+	resp, err := getFromPeer(fmt.Sprintf("http://%s/journal?after=%d", peer, wal.Current()))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		// The entries are no longer kept, or the journal went astray.
+		return true, resync(peer)
+	default:
+		return false, fmt.Errorf("%s answered %s", peer, resp.Status)
+	}
+
+	var msg ShipMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return true, fmt.Errorf("ship: %v", err)
+	}
+
+	_, epoch := lead.Role()
+	if msg.Epoch < epoch {
+		return false, fmt.Errorf("%s is deposed: its epoch is %d, ours is %d", peer, msg.Epoch, epoch)
+	}
+
+	// Entries of another epoch may follow a history different from ours.
+	if msg.Epoch > epoch {
+		return true, resync(peer)
+	}
+
+	if len(msg.Entries) == 0 {
+		return true, nil
+	}
+
+	state.Lock()
+	if msg.Entries[0].Version != wal.Version+1 {
+		state.Unlock()
+		return true, resync(peer)
+	}
+
+	for _, entry := range msg.Entries {
+		applyEntry(entry)
+	}
+
+	err = wal.Replicate(msg.Entries)
+	state.Unlock()
+
+	return true, err
+}
+
+// resync replaces the state with a snapshot of the primary.
+func resync(peer string) error {
+	resp, err := getFromPeer(fmt.Sprintf("http://%s/journal/snapshot", peer))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("resync: %s answered %s", peer, resp.Status)
+	}
+
+	epoch, err := strconv.ParseInt(resp.Header.Get(EpochHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("resync: no epoch in the snapshot response")
+	}
+
+	snap, err := DecodeSnapshot(resp.Body)
+	if err != nil {
+		return fmt.Errorf("resync: %v", err)
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	t = InitTree(conf.Namenode)
+	ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
+	snap.Restore()
+
+	if err := wal.Reset(snap.Version); err != nil {
+		return err
+	}
+
+	// Our own snapshots may be newer than this one while belonging to
+	// another history.
+	names, _ := listSnapshots(conf.Namenode.SnapshotDir)
+	for _, name := range names {
+		os.Remove(name)
+	}
+
+	// The epoch is adopted only once the state of the epoch is saved.
+	if _, err := wal.CheckpointNow(); err != nil {
+		return fmt.Errorf("resync: %v", err)
+	}
+
+	if err := lead.Adopt(epoch); err != nil {
+		return fmt.Errorf("resync: %v", err)
+	}
+
+	log.Printf("Loaded the state of epoch %d at version %d from %s", epoch, snap.Version, peer)
+	return nil
+}
+
+// withEpoch tags every response with the epoch of the nameserver.
+func withEpoch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, epoch := lead.Role()
+		w.Header().Set(EpochHeader, strconv.FormatInt(epoch, 10))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// primaryOnly refuses requests to a standby, so that fileservers and
+// clients try the other nameserver.
+func primaryOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lead.IsPrimary() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "this nameserver is a standby")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peersOnly lets in the other nameservers, which present the cluster
+// secret, and operators with the admin scope.
+func peersOnly(handler http.HandlerFunc) http.HandlerFunc {
+	admin := authenticate(scoped(ScopeAdmin, handler))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.Namenode.IsPeer(r.Header.Get(SecretHeader)) {
+			handler(w, r)
+			return
+		}
+
+		admin.ServeHTTP(w, r)
+	}
+}
+
+// getFromPeer gets the URL of the other nameserver with the cluster secret.
+func getFromPeer(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(SecretHeader, conf.Namenode.ClusterSecret)
+
+	return shipClient.Do(req)
+}
+
+func leader(w http.ResponseWriter, r *http.Request) {
+	role, epoch := lead.Role()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&LeaderMessage{Role: role, Epoch: epoch, Version: wal.Current()})
+}
+
+// shipJournal sends a standby the entries that follow its version. If
+// there are none yet, it waits for them for a while.
+func shipJournal(w http.ResponseWriter, r *http.Request) {
+	after, err := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "after must be a version")
+		return
+	}
+
+	changed := wal.Changed()
+	entries, ok := wal.Since(after)
+	if ok && len(entries) == 0 {
+		select {
+		case <-changed:
+		case <-time.After(ShipWait):
+		}
+		entries, ok = wal.Since(after)
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	_, epoch := lead.Role()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ShipMessage{Epoch: epoch, Entries: entries})
+}
+
+// shipSnapshot sends a standby a fresh snapshot.
+func shipSnapshot(w http.ResponseWriter, r *http.Request) {
+	// The snapshot is opened before the lock is released, since later
+	// checkpoints may remove it under the retention.
+	state.Lock()
+	version, err := wal.CheckpointNow()
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(snapshotFileName(conf.Namenode.SnapshotDir, version))
+	}
+	state.Unlock()
+
+	if err != nil {
+		log.Printf("Snapshot for a standby failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, file)
+}
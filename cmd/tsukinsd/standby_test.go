@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNS is a nameserver run by the test binary in a subprocess, by the
+// test that starts it.
+type testNS struct {
+	test        string
+	dir         string
+	publicPort  int
+	privatePort int
+	cmd         *exec.Cmd
+}
+
+func freePort() int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func newTestNS(test, dir string) *testNS {
+	return &testNS{test: test, dir: dir, publicPort: freePort(), privatePort: freePort()}
+}
+
+// serveTestNS runs the nameserver if the test binary is the subprocess of
+// a testNS, and reports whether it is.
+func serveTestNS() bool {
+	config := os.Getenv("TSUKI_NS_CONFIG")
+	if config == "" {
+		return false
+	}
+
+	var err error
+	if conf, err = LoadConfig(config); err != nil {
+		panic(err)
+	}
+
+	if err := serve(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (ns *testNS) writeConfig(standby bool, peer *testNS) error {
+	return ns.writeConfigWith(fmt.Sprintf(`standby = %v
+peer = '127.0.0.1:%d'
+takeoverTime = 1
+`, standby, peer.privatePort))
+}
+
+// writeConfigWith writes the configuration common to the tests, followed
+// by extra namenode settings.
+func (ns *testNS) writeConfigWith(extra string) error {
+	config := fmt.Sprintf(`[namenode]
+host = '127.0.0.1'
+publicPort = %d
+privatePort = %d
+treeUpdatePeriod = 10
+treeLogName = '%s'
+snapshotDir = '%s'
+snapshotRetention = 2
+epochName = '%s'
+softDeathTime = 10
+hardDeathTime = 20
+chunkSize = 1
+replicas = 1
+joinSecret = 'secret'
+`, ns.publicPort, ns.privatePort, path.Join(ns.dir, "tree.log"), ns.dir, path.Join(ns.dir, "epoch"))
+	config += extra
+
+	return ioutil.WriteFile(path.Join(ns.dir, "config.toml"), []byte(config), 0644)
+}
+
+func (ns *testNS) start() error {
+	ns.cmd = exec.Command(os.Args[0], "-test.run=^"+ns.test+"$")
+	ns.cmd.Env = append(os.Environ(), "TSUKI_NS_CONFIG="+path.Join(ns.dir, "config.toml"))
+	return ns.cmd.Start()
+}
+
+func (ns *testNS) kill() {
+	ns.cmd.Process.Kill()
+	ns.cmd.Wait()
+}
+
+func (ns *testNS) leader() (*LeaderMessage, error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/leader", ns.privatePort))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	msg := &LeaderMessage{}
+	return msg, json.NewDecoder(resp.Body).Decode(msg)
+}
+
+// call sends a client request and returns the response status.
+func (ns *testNS) call(request string) int {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/%s", ns.publicPort, request))
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLeader reports whether the nameserver answers with the role and epoch
+// and, unless version is zero, has the version.
+func (ns *testNS) isLeader(role string, epoch, version int64) bool {
+	msg, err := ns.leader()
+	return err == nil && msg.Role == role && msg.Epoch == epoch && (version == 0 || msg.Version == version)
+}
+
+// TestStandby_Takeover runs two nameservers on localhost, kills the
+// primary, and checks that the standby takes over with the state intact
+// and that the old primary comes back as a standby.
+func TestStandby_Takeover(test *testing.T) {
+	if serveTestNS() {
+		return
+	}
+
+	if testing.Short() {
+		test.Skip("standby test runs subprocesses")
+	}
+
+	dirA, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dirA)
+	dirB, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dirB)
+
+	a, b := newTestNS(test.Name(), dirA), newTestNS(test.Name(), dirB)
+	if err := a.writeConfig(false, b); err != nil {
+		test.Fatal(err)
+	}
+	if err := b.writeConfig(true, a); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := a.start(); err != nil {
+		test.Fatal(err)
+	}
+	defer a.kill()
+
+	if !waitFor(5*time.Second, func() bool { return a.isLeader(RolePrimary, 1, 0) }) {
+		test.Fatalf("first nameserver did not become the primary")
+	}
+
+	if err := b.start(); err != nil {
+		test.Fatal(err)
+	}
+	defer b.kill()
+
+	for _, request := range []string{"init", "mkdir?address=/before", "mkdir?address=/before/inner", "touch?address=/before/file"} {
+		if status := a.call(request); status != http.StatusOK {
+			test.Fatalf("primary answered %s with %d", request, status)
+		}
+	}
+
+	msg, _ := a.leader()
+	if !waitFor(5*time.Second, func() bool { return b.isLeader(RoleStandby, 1, msg.Version) }) {
+		test.Fatalf("standby did not catch up with version %d", msg.Version)
+	}
+
+	if status := b.call("ls?address=/"); status != http.StatusServiceUnavailable {
+		test.Errorf("standby answered a client with %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	a.kill()
+
+	if !waitFor(10*time.Second, func() bool { return b.isLeader(RolePrimary, 2, 0) }) {
+		test.Fatalf("standby did not take over")
+	}
+
+	for _, request := range []string{"info?address=/before/file", "ls?address=/before/inner", "mkdir?address=/after"} {
+		if status := b.call(request); status != http.StatusOK {
+			test.Errorf("new primary answered %s with %d", request, status)
+		}
+	}
+
+	// The old primary learns from its peer that it was replaced.
+	if err := a.start(); err != nil {
+		test.Fatal(err)
+	}
+
+	msg, _ = b.leader()
+	if !waitFor(10*time.Second, func() bool { return a.isLeader(RoleStandby, 2, msg.Version) }) {
+		got, err := a.leader()
+		test.Fatalf("old primary did not follow the new one, got %+v, %v", got, err)
+	}
+
+	if status := a.call("mkdir?address=/split"); status != http.StatusServiceUnavailable {
+		test.Errorf("old primary answered a client with %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+// TestStandby_ShippedChunks ships the journal of an upload to a standby,
+// promotes it and removes the file, which purges the chunk on the
+// fileserver that holds it.
+func TestStandby_ShippedChunks(test *testing.T) {
+	dirA, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dirA)
+	dirB, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dirB)
+
+	if err := setUpJournaled(dirA); err != nil {
+		test.Fatalf("could not set up the primary, %v", err)
+	}
+	end := wal.Begin()
+	wal.Append(&LogEntry{Op: OpRegister, Register: journalHolder})
+	end()
+	runWorkload("a", 1)
+
+	entries, _ := wal.Since(0)
+	wal.Close()
+
+	if err := setUpJournaled(dirB); err != nil {
+		test.Fatalf("could not set up the standby, %v", err)
+	}
+	defer wal.Close()
+	storages = &PoolInfo{}
+
+	state.Lock()
+	for _, entry := range entries {
+		applyEntry(entry)
+	}
+	err := wal.Replicate(entries)
+	state.Unlock()
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	lead, _ = OpenLeadership(path.Join(dirB, "epoch"))
+	defer func() { lead = nil }()
+	if _, err := lead.Lead(true); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Fatal(err)
+	}
+
+	holder := storages.StorageNodes[0]
+	if chunks := ct.InvertedTable[holder.Addr()]; len(chunks) != 1 || chunks[0].ChunkID != "a-chunk0" {
+		test.Fatalf("got %v in the inverted table, want a-chunk0", chunks)
+	}
+
+	serveClient(test, "/rmfile?address=a-dir0/copy", http.StatusOK, "")
+
+	cmds := holder.PendingCommands()
+	if len(cmds) != 1 || cmds[0].Kind != CommandPurge || len(cmds[0].Chunks) != 1 || cmds[0].Chunks[0] != "a-chunk0" {
+		test.Errorf("got %+v queued for the fileserver, want a purge of a-chunk0", cmds)
+	}
+}
+
+// TestPulse_Epoch checks that only a registered fileserver deposes the
+// primary with a newer epoch.
+func TestPulse_Epoch(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dir)
+
+	conf = &Config{}
+	setUpNamespace(1, &FileServerInfo{})
+	storages = &PoolInfo{SoftPulseQueue: make(chan int, 1), HardPulseQueue: make(chan int, 1)}
+	storages.RegisterFServer(&RegisterMessage{NodeID: "a", PrivateHost: "10.0.0.1", PrivatePort: 7001})
+
+	lead, _ = OpenLeadership(path.Join(dir, "epoch"))
+	defer func() { lead = nil }()
+	if _, err := lead.Lead(false); err != nil {
+		test.Fatal(err)
+	}
+
+	beat := func(remote, port string) int {
+		r := httptest.NewRequest("POST", "/pulse", strings.NewReader(`{"epoch": 999}`))
+		r.RemoteAddr = remote + ":40000"
+		r.Header.Set(NodePortHeader, port)
+		w := httptest.NewRecorder()
+		pulse(w, r)
+		return w.Code
+	}
+
+	if status := beat("10.0.0.2", "7001"); status != http.StatusNotFound || !lead.IsPrimary() {
+		test.Errorf("unknown host got %d and deposed the primary: %v", status, !lead.IsPrimary())
+	}
+
+	if status := beat("10.0.0.1", "7001"); status != http.StatusServiceUnavailable || lead.IsPrimary() {
+		test.Errorf("registered fileserver got %d and did not depose the primary", status)
+	}
+}
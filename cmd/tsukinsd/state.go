@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// state guards the NS state: the tree, the chunk table, the pool and what
+// the handlers change in its fileservers. Requests that only look at it
+// hold it for reading. Everything that changes it holds it for writing,
+// and so does everything that journals or checkpoints, so that the
+// journal and the snapshots always see a state that is whole.
+//
+// The locks of the pool, the fileservers and the chunks guard only what is
+// touched without the state lock: the command queues, the loads reported
+// by heartbeats, and the round-robin position of the pool.
+//
+// Nothing may wait for a request or a goroutine that needs the state lock
+// while holding it, so heartbeats are handed to the heartbeat managers
+// only after it is released.
+var state sync.RWMutex
+
+// reading runs the handler with the state locked for reading.
+func reading(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state.RLock()
+		defer state.RUnlock()
+
+		handler(w, r)
+	}
+}
+
+// bufferedResponse holds a response until its batch is journaled.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// writing runs the handler with the state locked for writing. The
+// handler's changes also make one batch, and the response is held until
+// the batch is written to the journal or, in a cluster, committed to the
+// Raft log, so that a change that is not kept is not reported as made.
+func writing(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state.Lock()
+		defer state.Unlock()
+
+		buffered := &bufferedResponse{header: http.Header{}}
+		end := wal.Begin()
+		handler(buffered, r)
+		if err := end(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "the change is not kept: %v", err)
+			return
+		}
+
+		for key, values := range buffered.header {
+			w.Header()[key] = values
+		}
+
+		if buffered.status != 0 {
+			w.WriteHeader(buffered.status)
+		}
+		w.Write(buffered.body.Bytes())
+	}
+}
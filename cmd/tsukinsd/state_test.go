@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+)
+
+const stressClients = 200
+
+// setUpStress recovers the NS state from dir with fileservers that are
+// known to the pool but refuse connections. The test sends their
+// heartbeats and confirmations from their loopback addresses.
+func setUpStress(dir string) error {
+	closed := freePort()
+	conf = &Config{Namenode: Namenode{
+		Replicas:          1,
+		ChunkSize:         1,
+		SoftDeathTime:     60,
+		HardDeathTime:     120,
+		FSPrivatePort:     closed,
+		TreeLogName:       path.Join(dir, "tree.log"),
+		SnapshotDir:       dir,
+		SnapshotRetention: 2,
+		TreeUpdatePeriod:  50,
+	}}
+
+	lead, cluster = nil, nil
+	storages = &PoolInfo{SoftPulseQueue: make(chan int, 1), HardPulseQueue: make(chan int, 1)}
+	for _, host := range stressHosts {
+		reg := &RegisterMessage{NodeID: host, PrivateHost: host, PublicHost: host, PrivatePort: closed, PublicPort: closed}
+		if _, err := storages.RegisterFServer(reg); err != nil {
+			return err
+		}
+	}
+
+	return recoverState()
+}
+
+var stressHosts = []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+
+type stressClient struct {
+	public, private string
+
+	// fileservers send from their own addresses.
+	fileservers map[string]*http.Client
+}
+
+func newStressClient(public, private string) *stressClient {
+	c := &stressClient{public: public, private: private, fileservers: map[string]*http.Client{}}
+	for _, host := range stressHosts {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(host)}}
+		c.fileservers[host] = &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	}
+
+	return c
+}
+
+func (c *stressClient) get(request string, msg *ClientMessage) int {
+	resp, err := http.Get(c.public + "/" + request)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	if msg != nil {
+		json.NewDecoder(resp.Body).Decode(msg)
+	}
+	return resp.StatusCode
+}
+
+// post sends the request as the fileserver at host.
+func (c *stressClient) post(host, request string, body interface{}) int {
+	data, _ := json.Marshal(body)
+	resp, err := c.fileservers[host].Post(c.private+"/"+request, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// run makes a directory with files in it, confirms their chunks, looks
+// at them and removes every other one. It returns what it finds wrong.
+func (c *stressClient) run(id int) []string {
+	var problems []string
+	expect := func(request string, status int, want ...int) {
+		for _, ok := range want {
+			if status == ok {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s: got %d, want %v", request, status, want))
+	}
+
+	dir := fmt.Sprintf("/client%d", id)
+	expect("mkdir", c.get("mkdir?address="+dir, nil), http.StatusOK)
+
+	for i := 0; i < 4; i++ {
+		file := fmt.Sprintf("%s/file%d", dir, i)
+
+		var msg ClientMessage
+		expect("upload", c.get(fmt.Sprintf("upload?address=%s&size=%d", file, 2*1024*1024), &msg), http.StatusOK)
+
+		chunks := map[string][]string{}
+		for _, chunk := range msg.Chunks {
+			host, _, _ := net.SplitHostPort(chunk.StorageIP)
+			chunks[host] = append(chunks[host], chunk.ChunkID)
+		}
+		for host, ids := range chunks {
+			expect("confirm", c.post(host, "confirm/receivedChunks", ids), http.StatusOK)
+			expect("pulse", c.post(host, "pulse", &HeartbeatMessage{}), http.StatusOK)
+		}
+
+		expect("info", c.get("info?address="+file, nil), http.StatusOK)
+		expect("ls", c.get("ls?address="+dir, nil), http.StatusOK)
+
+		expect("download", c.get("download?address="+file, nil), http.StatusOK)
+
+		if i%2 == 0 {
+			expect("rmfile", c.get("rmfile?address="+file, nil), http.StatusOK)
+		}
+	}
+
+	var msg ClientMessage
+	expect("ls", c.get("ls?address="+dir, &msg), http.StatusOK)
+	if len(msg.Objects) != 2 {
+		problems = append(problems, fmt.Sprintf("%s holds %v, want 2 files", dir, msg.Objects))
+	}
+
+	return problems
+}
+
+func treeAddresses() []string {
+	var addresses []string
+	for _, node := range t.Inodes {
+		addresses = append(addresses, node.Address())
+	}
+
+	sort.Strings(addresses)
+	return addresses
+}
+
+// TestState_ConcurrentClients lets hundreds of clients and fileservers at
+// the NS at once, while snapshots are taken, and checks that the journal
+// recovers the state they leave behind. It is meant for go test -race.
+func TestState_ConcurrentClients(test *testing.T) {
+	dir, _ := ioutil.TempDir("", "tsukinsd")
+	defer os.RemoveAll(dir)
+
+	if err := setUpStress(dir); err != nil {
+		test.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Stand in for the heartbeat managers.
+	done := make(chan struct{})
+	defer close(done)
+	pool := storages
+	go func() {
+		for {
+			select {
+			case <-pool.SoftPulseQueue:
+			case <-pool.HardPulseQueue:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	public := httptest.NewServer(publicRouter())
+	defer public.Close()
+	private := httptest.NewServer(privateRouter())
+	defer private.Close()
+
+	client := newStressClient(public.URL, private.URL)
+
+	var wg sync.WaitGroup
+	problems := make(chan []string, stressClients)
+	for i := 0; i < stressClients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			problems <- client.run(id)
+
+			if id%20 == 0 {
+				client.post(stressHosts[0], "snapshot", nil)
+				client.get("download?address=missing", nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(problems)
+
+	for found := range problems {
+		for _, problem := range found {
+			test.Error(problem)
+		}
+	}
+
+	state.Lock()
+	want := treeAddresses()
+	chunks := len(ct.Table)
+	wal.Close()
+	state.Unlock()
+
+	if len(want) != 1+3*stressClients {
+		test.Errorf("tree has %d nodes, want %d", len(want), 1+3*stressClients)
+	}
+
+	if err := setUpStress(dir); err != nil {
+		test.Fatal(err)
+	}
+
+	if got := treeAddresses(); fmt.Sprint(got) != fmt.Sprint(want) {
+		test.Errorf("recovered %d nodes, want %d", len(got), len(want))
+	}
+
+	if len(ct.Table) != chunks {
+		test.Errorf("recovered %d chunks, want %d", len(ct.Table), chunks)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TrashRoot is the reserved directory removed files and directories are
+// moved to when the trash is enabled: an item with ID id removed from
+// /a/b is at /.trash/id/b. It can be restored to where it was removed
+// from until it is TrashRetention hours old. Then it is expunged, and its
+// files are purged like the ones of removed directories.
+const TrashRoot = ".trash"
+
+// TrashItem is a file or a directory in the trash.
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	RemovedOn time.Time `json:"removedOn"`
+
+	// Owner is the user who removed the item. Only they can see and
+	// restore it.
+	Owner string `json:"owner,omitempty"`
+}
+
+// trashed returns where the item is in the trash.
+func (item *TrashItem) trashed() string {
+	return path.Join(TrashRoot, item.ID, path.Base(item.Address))
+}
+
+func trashEnabled() bool {
+	return conf.Namenode.TrashRetention != 0
+}
+
+// MoveToTrash removes the file, or the directory if isDirectory is set, to
+// the trash of the owner.
+func (t *Tree) MoveToTrash(address string, isDirectory bool, owner string) (*TrashItem, error) {
+	address, matched := CleanAddress(address)
+
+	if !matched {
+		return nil, fmt.Errorf("/%s wrong file name format", address)
+	}
+	if address == "." {
+		return nil, fmt.Errorf("cannot remove the root directory")
+	}
+	if err := checkWritable(address); err != nil {
+		return nil, err
+	}
+
+	exists, directory := t.PathExists(address)
+	if !exists {
+		return nil, fmt.Errorf("/%s path does not exist", address)
+	} else if directory && !isDirectory {
+		return nil, fmt.Errorf("/%s/ cannot remove directory; use rmdir instead", address)
+	} else if !directory && isDirectory {
+		return nil, fmt.Errorf("/%s is not a directory", address)
+	}
+
+	id, _ := uuid.NewUUID()
+	item := &TrashItem{ID: id.String(), Address: address, RemovedOn: time.Now(), Owner: owner}
+
+	t.ApplyTrash(item)
+	wal.Append(&LogEntry{Op: OpTrash, Address: address, ID: item.ID, Time: item.RemovedOn, User: owner})
+
+	return item, nil
+}
+
+// ApplyTrash moves the item to the trash. The trash can be searched but not
+// listed, and the directory of the item belongs to its owner alone.
+func (t *Tree) ApplyTrash(item *TrashItem) {
+	if _, ok := t.Lookup(item.Address); !ok {
+		return
+	}
+
+	t.ensureDirectories(path.Dir(item.trashed()))
+	root, _ := t.Lookup(TrashRoot)
+	dir, _ := t.Lookup(path.Dir(item.trashed()))
+	root.Owner, root.Group, root.Mode = Superuser, Superuser, 0711
+	dir.Owner, dir.Group, dir.Mode = item.Owner, item.Owner, 0700
+	t.ApplyRename(item.Address, item.trashed())
+	t.Trash = append(t.Trash, item)
+}
+
+func (t *Tree) trashItem(id string) (int, *TrashItem) {
+	for i, item := range t.Trash {
+		if item.ID == id {
+			return i, item
+		}
+	}
+
+	return -1, nil
+}
+
+// Undelete restores the item of the trash to where it was removed from.
+func (t *Tree) Undelete(id string) (*TrashItem, error) {
+	_, item := t.trashItem(id)
+	if item == nil {
+		return nil, fmt.Errorf("%s is not in the trash", id)
+	}
+
+	if _, ok := t.Lookup(item.Address); ok {
+		return nil, fmt.Errorf("/%s the path already exists", item.Address)
+	}
+	if !t.DirectoryExists(path.Dir(item.Address)) {
+		return nil, fmt.Errorf("/%s/ directory does not exist", path.Dir(item.Address))
+	}
+
+	t.ApplyUndelete(id)
+	wal.Append(&LogEntry{Op: OpUndelete, ID: id})
+
+	return item, nil
+}
+
+// ApplyUndelete moves the item of the trash back to where it was removed
+// from.
+func (t *Tree) ApplyUndelete(id string) {
+	i, item := t.trashItem(id)
+	if item == nil {
+		return
+	}
+
+	t.ApplyRename(item.trashed(), item.Address)
+	t.dropTrashItem(i, "")
+}
+
+// ApplyExpunge takes the item out of the trash, and queues the deletion of
+// its files with the ID of the item.
+func (t *Tree) ApplyExpunge(id string) {
+	i, item := t.trashItem(id)
+	if item == nil {
+		return
+	}
+
+	t.dropTrashItem(i, id)
+}
+
+// dropTrashItem removes the directory of the item in the trash with the
+// given deletion ID, and the trash itself once it is empty.
+func (t *Tree) dropTrashItem(i int, id string) {
+	item := t.Trash[i]
+	t.Trash = append(t.Trash[:i], t.Trash[i+1:]...)
+
+	t.ApplyRemoveDirectory(path.Join(TrashRoot, item.ID), id)
+	if len(t.Trash) == 0 {
+		t.ApplyRemoveDirectory(TrashRoot, "")
+	}
+}
+
+// trashCheckInterval is how often the trash is checked for expired items.
+var trashCheckInterval = time.Minute
+
+// expungeTrash expunges the items of the trash older than its retention,
+// for as long as the nameserver is the primary.
+func expungeTrash() {
+	for {
+		time.Sleep(trashCheckInterval)
+
+		if lead.IsPrimary() && trashEnabled() {
+			if err := expungeStep(time.Now()); err != nil {
+				log.Printf("error: could not expunge the trash: %v", err)
+			}
+		}
+	}
+}
+
+// expungeStep expunges the expired items of the trash.
+func expungeStep(now time.Time) error {
+	retention := conf.Namenode.TrashRetention * time.Hour
+
+	state.RLock()
+	var expired []string
+	for _, item := range t.Trash {
+		if now.Sub(item.RemovedOn) >= retention {
+			expired = append(expired, item.ID)
+		}
+	}
+	state.RUnlock()
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	end := wal.Begin()
+	for _, id := range expired {
+		if _, item := t.trashItem(id); item != nil {
+			t.ApplyExpunge(id)
+			wal.Append(&LogEntry{Op: OpExpunge, ID: id})
+			log.Printf("Expunged /%s from the trash", item.Address)
+		}
+	}
+
+	wakePurger()
+	return end()
+}
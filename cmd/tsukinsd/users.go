@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Superuser is allowed everything. Requests are made as the superuser when
+// there are neither users nor API keys.
+const Superuser = "root"
+
+// User is an account of the users file. Its password is kept hashed, as
+// HashPassword gives it. The first of its groups is the group of the nodes
+// it creates; a user without groups has a group of its own name.
+type User struct {
+	Name     string
+	Password string
+	Groups   []string
+
+	// Scopes limit a user acting through an API key.
+	Scopes []string `toml:"-"`
+}
+
+type usersFile struct {
+	Users []*User
+}
+
+// users are the accounts requests are authenticated against, by name. Nil
+// disables authentication by password.
+var users map[string]*User
+
+var superuser = &User{Name: Superuser}
+
+// LoadUsers reads the users file. An empty filename gives nil.
+func LoadUsers(filename string) (map[string]*User, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	var file usersFile
+	if _, err := toml.DecodeFile(filename, &file); err != nil {
+		return nil, fmt.Errorf("users file: %v", err)
+	}
+
+	loaded := map[string]*User{}
+	for _, user := range file.Users {
+		if user.Name == "" {
+			return nil, fmt.Errorf("users file: a user has no name")
+		}
+		if _, ok := loaded[user.Name]; ok {
+			return nil, fmt.Errorf("users file: %s is listed twice", user.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+			return nil, fmt.Errorf("users file: the password of %s is not hashed with bcrypt", user.Name)
+		}
+		loaded[user.Name] = user
+	}
+
+	return loaded, nil
+}
+
+// HashPassword hashes the password with bcrypt, the way the users file
+// keeps it.
+func HashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %v", err)
+	}
+
+	return string(hashed), nil
+}
+
+// CheckPassword tells whether the password is the one of the user.
+func (user *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+}
+
+func (user *User) IsSuperuser() bool {
+	return user.Name == Superuser
+}
+
+// Group returns the group of the nodes the user creates.
+func (user *User) Group() string {
+	if len(user.Groups) == 0 {
+		return user.Name
+	}
+
+	return user.Groups[0]
+}
+
+func (user *User) InGroup(group string) bool {
+	if group == "" {
+		return false
+	}
+
+	for _, g := range user.Groups {
+		if g == group {
+			return true
+		}
+	}
+
+	return group == user.Group()
+}
+
+type userKey struct{}
+
+// authenticate makes the request as the user of its API key, given as a
+// bearer token, or of its basic auth credentials. It answers Unauthorized
+// when they are missing or wrong.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := credentials(r)
+		if user == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Basic realm="tsuki"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: "wrong credentials; log in first"})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// credentials returns the user of the credentials of the request, or nil
+// if they are missing or wrong. Without authentication, it is root.
+func credentials(r *http.Request) *User {
+	if !authenticationEnabled() {
+		return superuser
+	}
+
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		return keyUser(token)
+	}
+
+	if name, password, ok := r.BasicAuth(); ok {
+		if known, ok := users[name]; ok && known.CheckPassword(password) {
+			return known
+		}
+	}
+
+	return nil
+}
+
+// requestUser returns the user the request is made as.
+func requestUser(r *http.Request) *User {
+	if user, ok := r.Context().Value(userKey{}).(*User); ok {
+		return user
+	}
+
+	return superuser
+}
+
+// Permission bits of a mode, as for the owner, the group or the others.
+const (
+	PermRead  os.FileMode = 4
+	PermWrite os.FileMode = 2
+	PermExec  os.FileMode = 1
+)
+
+// defaultMode is the mode of new nodes.
+func defaultMode(isDirectory bool) os.FileMode {
+	if isDirectory {
+		return 0755
+	}
+
+	return 0644
+}
+
+// Permissions returns the owner, the group and the mode of the node. Nodes
+// from before there were users belong to the superuser, with the default
+// mode.
+func (node *Node) Permissions() (string, string, os.FileMode) {
+	if node.Owner == "" {
+		return Superuser, Superuser, defaultMode(node.IsDirectory)
+	}
+
+	return node.Owner, node.Group, node.Mode
+}
+
+// own gives the node created by the request to its user, with the default
+// mode. The caller journals the node.
+func own(node *Node, user *User) {
+	node.Owner = user.Name
+	node.Group = user.Group()
+	node.Mode = defaultMode(node.IsDirectory)
+}
+
+// Can tells whether the user has the wanted permissions on the node.
+func (user *User) Can(node *Node, want os.FileMode) bool {
+	owner, group, mode := node.Permissions()
+	switch {
+	case user.IsSuperuser():
+		return true
+	case user.Name == owner:
+		mode >>= 6
+	case user.InGroup(group):
+		mode >>= 3
+	}
+
+	return mode&want == want
+}
+
+// Access checks that the user may search the directories down to the
+// address, and has the wanted permissions on what is there. Addresses that
+// don't exist are left to the operation to report.
+func (t *Tree) Access(user *User, address string, want os.FileMode) error {
+	address, _ = CleanAddress(address)
+	if address == "" {
+		address = "."
+	}
+
+	var dirs []string
+	for dir := address; dir != "."; {
+		dir = path.Dir(dir)
+		dirs = append(dirs, dir)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir, ok := t.Lookup(dirs[i])
+		if !ok {
+			return nil
+		}
+		if !user.Can(dir, PermExec) {
+			return fmt.Errorf("/%s/ permission denied", dir.Address())
+		}
+	}
+
+	node, ok := t.Lookup(address)
+	if ok && !user.Can(node, want) {
+		return fmt.Errorf("/%s permission denied", node.Address())
+	}
+
+	return nil
+}
+
+// parentOf returns the directory the address is in.
+func parentOf(address string) string {
+	address, _ = CleanAddress(address)
+	return path.Dir(address)
+}
+
+// allowed answers the request with Forbidden unless its user has the wanted
+// permissions on the address.
+func allowed(w http.ResponseWriter, r *http.Request, address string, want os.FileMode) bool {
+	if err := t.Access(requestUser(r), address, want); err != nil {
+		forbid(w, err.Error())
+		return false
+	}
+
+	return true
+}
+
+// owns tells whether the user owns the node at the address, or may act as
+// if they did.
+func (t *Tree) owns(user *User, address string) bool {
+	address, _ = CleanAddress(address)
+	if address == "" {
+		address = "."
+	}
+
+	node, ok := t.Lookup(address)
+	if !ok || user.IsSuperuser() {
+		return true
+	}
+
+	owner, _, _ := node.Permissions()
+	return owner == user.Name
+}
+
+// target returns what has to be writable for a file to be copied or moved
+// to the address: the directory at it, or else the one it is in.
+func (t *Tree) target(address string) string {
+	if t.DirectoryExists(address) {
+		return address
+	}
+
+	return parentOf(address)
+}
+
+// forbid answers the request with Forbidden for the reason.
+func forbid(w http.ResponseWriter, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(&ClientMessage{Status: "ERR", Message: reason})
+}
+
+// Chmod sets the permission bits of the node.
+func (t *Tree) Chmod(address string, mode os.FileMode) (*Node, error) {
+	node, err := t.ownedNode(address)
+	if err != nil {
+		return nil, err
+	}
+	if mode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("%o is not a mode; give permission bits such as 750", mode)
+	}
+
+	node.Owner, node.Group, _ = node.Permissions()
+	node.Mode = mode
+	t.CommitUpdate(OpUpdate, node)
+
+	return node, nil
+}
+
+// Chown gives the node to the owner and the group. Either of them is left
+// as it is when empty.
+func (t *Tree) Chown(address string, owner string, group string) (*Node, error) {
+	node, err := t.ownedNode(address)
+	if err != nil {
+		return nil, err
+	}
+
+	node.Owner, node.Group, node.Mode = node.Permissions()
+	if owner != "" {
+		node.Owner = owner
+	}
+	if group != "" {
+		node.Group = group
+	}
+	t.CommitUpdate(OpUpdate, node)
+
+	return node, nil
+}
+
+func (t *Tree) ownedNode(address string) (*Node, error) {
+	address, matched := CleanAddress(address)
+	if address == "" {
+		address = "."
+	}
+
+	if !matched {
+		return nil, fmt.Errorf("/%s wrong path name format", address)
+	}
+	if err := checkWritable(address); err != nil {
+		return nil, err
+	}
+	if !t.Exists(address) {
+		return nil, fmt.Errorf("/%s path does not exist", address)
+	}
+
+	node, _ := t.Lookup(address)
+	return node, nil
+}
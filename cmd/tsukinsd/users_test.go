@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUser_CheckPassword(test *testing.T) {
+	hashed, err := HashPassword("secret")
+	if err != nil {
+		test.Fatal(err)
+	}
+	user := &User{Name: "alice", Password: hashed}
+
+	if cost, err := bcrypt.Cost([]byte(hashed)); err != nil || cost < bcrypt.DefaultCost {
+		test.Errorf("password is hashed with cost %d, %v", cost, err)
+	}
+	if !user.CheckPassword("secret") {
+		test.Errorf("right password is rejected")
+	}
+	if user.CheckPassword("Secret") || user.CheckPassword("") {
+		test.Errorf("wrong password is accepted")
+	}
+	if other, _ := HashPassword("secret"); other == user.Password {
+		test.Errorf("passwords are not salted")
+	}
+}
+
+func TestLoadUsers(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	for password, ok := range map[string]bool{string(hashed): true, "secret": false, "sha256:salt:hash": false} {
+		name := path.Join(dir, "users.toml")
+		ioutil.WriteFile(name, []byte("[[users]]\nname = 'alice'\npassword = '"+password+"'\n"), 0644)
+
+		if _, err := LoadUsers(name); (err == nil) != ok {
+			test.Errorf("loading password %q: got %v", password, err)
+		}
+	}
+}
+
+func TestPermissions(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setUp := func() {
+		if err := setUpJournaled(dir); err != nil {
+			test.Fatalf("could not set up, %v", err)
+		}
+		conf.Namenode.TrashRetention = 1
+	}
+
+	users = map[string]*User{}
+	for _, user := range []*User{{Name: "root"}, {Name: "alice", Groups: []string{"alice", "staff"}}, {Name: "bob"}} {
+		// The lowest cost keeps the many requests of the test fast.
+		hashed, _ := bcrypt.GenerateFromPassword([]byte(user.Name+"-password"), bcrypt.MinCost)
+		user.Password = string(hashed)
+		users[user.Name] = user
+	}
+	defer func() { users = nil }()
+
+	setUp()
+
+	serveClient(test, "/ls?address=/", http.StatusUnauthorized, "")
+	serveClient(test, "/init", http.StatusForbidden, "alice")
+	serveClient(test, "/mkdir?address=/shared", http.StatusForbidden, "alice")
+
+	serveClient(test, "/mkdir?address=/home", http.StatusOK, "root")
+	serveClient(test, "/chown?address=/home&owner=alice", http.StatusOK, "root")
+	serveClient(test, "/mkdir?address=/home/a", http.StatusOK, "alice")
+	serveClient(test, "/touch?address=/home/a/f", http.StatusOK, "alice")
+
+	serveClient(test, "/ls?address=/home/a", http.StatusOK, "bob")
+	serveClient(test, "/touch?address=/home/a/g", http.StatusForbidden, "bob")
+	serveClient(test, "/rmfile?address=/home/a/f", http.StatusForbidden, "bob")
+	serveClient(test, "/cp?from=/home/a/f&to=/home/a/g", http.StatusForbidden, "bob")
+
+	serveClient(test, "/chmod?address=/home/a&mode=750", http.StatusOK, "alice")
+	serveClient(test, "/ls?address=/home/a", http.StatusForbidden, "bob")
+	serveClient(test, "/info?address=/home/a/f", http.StatusForbidden, "bob")
+	serveClient(test, "/chmod?address=/home/a&mode=777", http.StatusForbidden, "bob")
+
+	serveClient(test, "/chown?address=/home/a&owner=bob", http.StatusForbidden, "alice")
+	serveClient(test, "/chown?address=/home/a&group=wheel", http.StatusForbidden, "alice")
+	serveClient(test, "/chown?address=/home/a&group=staff", http.StatusOK, "alice")
+
+	wal.Close()
+	setUp()
+	defer wal.Close()
+
+	owner, group, mode := nodeAt("home/a").Permissions()
+	if owner != "alice" || group != "staff" || mode != 0750 {
+		test.Errorf("got /home/a of %s:%s with mode %03o, want alice:staff with 750", owner, group, mode)
+	}
+	if owner, _, _ := nodeAt("home/a/f").Permissions(); owner != "alice" {
+		test.Errorf("got /home/a/f of %s, want alice", owner)
+	}
+
+	// Removed items are seen and restored by those who removed them.
+	item := serveClient(test, "/rmfile?address=/home/a/f", http.StatusOK, "alice").Objects[0]
+	if got := serveClient(test, "/trash", http.StatusOK, "bob"); len(got.Objects) != 0 {
+		test.Errorf("bob sees the trash of alice, %q", got.Objects)
+	}
+	serveClient(test, "/undelete?id="+item, http.StatusBadRequest, "bob")
+	serveClient(test, "/ls?address=/.trash", http.StatusForbidden, "bob")
+	serveClient(test, "/info?address=/.trash/"+item+"/f", http.StatusForbidden, "bob")
+
+	if got := serveClient(test, "/trash", http.StatusOK, "alice"); len(got.Objects) != 1 {
+		test.Errorf("alice doesn't see the removed item, %q", got.Objects)
+	}
+	serveClient(test, "/undelete?id="+item, http.StatusOK, "alice")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Version is a previous content of a file. The file keeps referring to
+// its chunks until the version falls out of retention.
+type Version struct {
+	Number     int       `json:"number"`
+	Chunks     []string  `json:"chunks,omitempty"`
+	Size       int       `json:"size"`
+	Coding     *Coding   `json:"coding,omitempty"`
+	CreatedOn  time.Time `json:"createdOn"`
+	ReplacedOn time.Time `json:"replacedOn"`
+}
+
+// Retention says which previous versions of a file are kept: the Versions
+// newest of them, or the ones replaced less than Age ago.
+type Retention struct {
+	Versions int
+	Age      time.Duration
+}
+
+func (r *Retention) String() string {
+	if r == nil {
+		return "none"
+	}
+
+	if r.Age != 0 {
+		return fmt.Sprintf("age(%s)", r.Age)
+	}
+
+	return fmt.Sprintf("versions(%d)", r.Versions)
+}
+
+// ParseRetention parses a retention setting, "versions(n)" or "age(d)".
+// Empty string and "none" keep no versions and give nil.
+func ParseRetention(setting string) (*Retention, error) {
+	setting = strings.ReplaceAll(setting, " ", "")
+	if setting == "" || setting == "none" {
+		return nil, nil
+	}
+
+	retention := &Retention{}
+	var rest string
+	if n, _ := fmt.Sscanf(setting, "versions(%d%s", &retention.Versions, &rest); n == 2 && rest == ")" {
+		if retention.Versions <= 0 {
+			return nil, fmt.Errorf("retention %q is out of range", setting)
+		}
+		return retention, nil
+	}
+
+	if strings.HasPrefix(setting, "age(") && strings.HasSuffix(setting, ")") {
+		age, err := time.ParseDuration(setting[len("age(") : len(setting)-1])
+		if err != nil || age <= 0 {
+			return nil, fmt.Errorf("retention %q has no valid age", setting)
+		}
+		retention.Age = age
+		return retention, nil
+	}
+
+	return nil, fmt.Errorf("retention %q is neither none, versions(n) nor age(d)", setting)
+}
+
+// RetentionFor returns the retention of the versions of the file at
+// address, the same way CodingFor returns its coding.
+func (n *Namenode) RetentionFor(address string) (*Retention, error) {
+	return ParseRetention(directorySetting(address, n.Retention, n.DirectoryRetention))
+}
+
+// ValidateRetention checks every retention setting of the config.
+func (n *Namenode) ValidateRetention() error {
+	if _, err := ParseRetention(n.Retention); err != nil {
+		return err
+	}
+
+	for dir, setting := range n.DirectoryRetention {
+		if _, err := ParseRetention(setting); err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// Keeps tells whether the version is kept when there are newer previous
+// versions of the file.
+func (r *Retention) Keeps(version *Version, newer int, now time.Time) bool {
+	switch {
+	case r == nil:
+		return false
+	case r.Age != 0:
+		return now.Sub(version.ReplacedOn) < r.Age
+	default:
+		return newer < r.Versions
+	}
+}
+
+// PruneVersions drops the versions of the file that the retention doesn't
+// keep, and returns their chunks to be released.
+func (node *Node) PruneVersions(retention *Retention, now time.Time) []string {
+	var kept []*Version
+	var pruned []string
+	for i, version := range node.Versions {
+		if retention.Keeps(version, len(node.Versions)-1-i, now) {
+			kept = append(kept, version)
+		} else {
+			pruned = append(pruned, version.Chunks...)
+		}
+	}
+
+	node.Versions = kept
+	return pruned
+}
+
+// AtVersion returns the file as it was at the version. A previous version
+// is detached from the tree.
+func (node *Node) AtVersion(number int) (*Node, error) {
+	if number == node.Version {
+		return node, nil
+	}
+
+	for _, version := range node.Versions {
+		if version.Number == number {
+			return &Node{
+				ID:        node.ID,
+				Name:      node.Address(),
+				Chunks:    version.Chunks,
+				Size:      version.Size,
+				Coding:    version.Coding,
+				CreatedOn: version.CreatedOn,
+				Version:   version.Number,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("/%s has no version %d", node.Address(), number)
+}
+
+// RestoreVersion makes the content of the previous version current again,
+// as a new version. The caller retains its chunks for the new version.
+func (t *Tree) RestoreVersion(address string, number int) (*Node, error) {
+	file, err := t.GetFile(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWritable(file.Address()); err != nil {
+		return nil, err
+	}
+
+	version, err := file.AtVersion(number)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == file {
+		return nil, fmt.Errorf("/%s is at version %d already", file.Address(), number)
+	}
+
+	file.Update = &Node{
+		ID:        file.ID,
+		Pending:   map[string]bool{},
+		Chunks:    append([]string(nil), version.Chunks...),
+		Size:      version.Size,
+		Coding:    version.Coding,
+		CreatedOn: time.Now(),
+	}
+	file.SwitchUpdate()
+
+	return file, nil
+}
+
+// pruneVersions releases the versions of the file that fall out of its
+// retention. The file is to be committed by the caller.
+func pruneVersions(file *Node) {
+	retention, err := conf.Namenode.RetentionFor(file.Address())
+	if err != nil {
+		log.Printf("error: could not get retention of %s: %v", file.Address(), err)
+		return
+	}
+
+	ct.Release(file.PruneVersions(retention, time.Now()))
+}
+
+// pruneInterval is how often versions are checked for their age.
+var pruneInterval = time.Minute
+
+// pruneAgedVersions drops the versions that get too old, for as long as
+// the nameserver is the primary.
+func pruneAgedVersions() {
+	for {
+		time.Sleep(pruneInterval)
+
+		if lead.IsPrimary() {
+			if err := pruneStep(time.Now()); err != nil {
+				log.Printf("error: could not prune old versions: %v", err)
+			}
+		}
+	}
+}
+
+// pruneStep looks for versions out of retention without blocking readers,
+// and prunes them once the state is locked.
+func pruneStep(now time.Time) error {
+	state.RLock()
+	var aged []*Node
+	for _, node := range t.Inodes {
+		if len(node.Versions) == 0 {
+			continue
+		}
+
+		retention, _ := conf.Namenode.RetentionFor(node.Address())
+		if !retention.Keeps(node.Versions[0], len(node.Versions)-1, now) {
+			aged = append(aged, node)
+		}
+	}
+	state.RUnlock()
+
+	if len(aged) == 0 {
+		return nil
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	end := wal.Begin()
+	for _, file := range aged {
+		if !t.inTree(file) {
+			continue
+		}
+
+		retention, _ := conf.Namenode.RetentionFor(file.Address())
+		versions := len(file.Versions)
+		ct.Release(file.PruneVersions(retention, now))
+		if len(file.Versions) != versions {
+			t.CommitUpdate(OpUpdate, file)
+		}
+	}
+
+	return end()
+}
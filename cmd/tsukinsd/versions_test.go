@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNamenode_RetentionFor(t *testing.T) {
+	n := &Namenode{
+		Retention: "versions(3)",
+		DirectoryRetention: map[string]string{
+			"docs":     "age(720h)",
+			"docs/tmp": "none",
+		},
+	}
+
+	cases := []struct {
+		address string
+		want    string
+	}{
+		{"file", "versions(3)"},
+		{"docs/file", "age(720h0m0s)"},
+		{"docs/tmp/file", "none"},
+	}
+
+	for _, test := range cases {
+		got, err := n.RetentionFor(test.address)
+		if err != nil {
+			t.Fatalf("could not get retention of %s, %v", test.address, err)
+		}
+
+		if got.String() != test.want {
+			t.Errorf("got retention %v for %s, want %v", got, test.address, test.want)
+		}
+	}
+
+	for _, setting := range []string{"versions(0)", "versions(3", "age(forever)", "age(-1h)", "all"} {
+		if _, err := ParseRetention(setting); err == nil {
+			t.Errorf("parsed invalid retention %q", setting)
+		}
+	}
+}
+
+func TestNode_PruneVersions(t *testing.T) {
+	now := time.Now()
+	versions := func() *Node {
+		file := &Node{Version: 4}
+		for i := 1; i < 4; i++ {
+			file.Versions = append(file.Versions, &Version{
+				Number:     i,
+				Chunks:     []string{fmt.Sprintf("chunk%d", i)},
+				ReplacedOn: now.Add(time.Duration(i-4) * time.Hour),
+			})
+		}
+		return file
+	}
+
+	cases := []struct {
+		retention *Retention
+		pruned    string
+		kept      int
+	}{
+		{nil, "[chunk1 chunk2 chunk3]", 0},
+		{&Retention{Versions: 2}, "[chunk1]", 2},
+		{&Retention{Versions: 5}, "[]", 3},
+		{&Retention{Age: 90 * time.Minute}, "[chunk1 chunk2]", 1},
+	}
+
+	for _, test := range cases {
+		file := versions()
+		pruned := file.PruneVersions(test.retention, now)
+		if fmt.Sprint(pruned) != test.pruned || len(file.Versions) != test.kept {
+			t.Errorf("%v: pruned %v and kept %d, want %s and %d", test.retention, pruned, len(file.Versions), test.pruned, test.kept)
+		}
+	}
+}
+
+func TestTree_RestoreVersion(t *testing.T) {
+	tree := fileWithChunk()
+
+	file, _, _ := tree.UpdateFile("a/file", 2)
+	file.Update.Chunks = []string{"new"}
+	file.SwitchUpdate()
+
+	if _, err := tree.RestoreVersion("a/file", 2); err == nil {
+		t.Errorf("restored the current version")
+	}
+
+	if _, err := tree.RestoreVersion("a/file", 5); err == nil {
+		t.Errorf("restored a version that doesn't exist")
+	}
+
+	if _, err := tree.RestoreVersion("a/file", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if file.Version != 3 || fmt.Sprint(file.Chunks) != "[chunk]" || file.Size != 1 {
+		t.Errorf("version 1 is not restored as version 3: %v", file)
+	}
+
+	old, err := file.AtVersion(2)
+	if err != nil || fmt.Sprint(old.Chunks) != "[new]" || old.Size != 2 {
+		t.Errorf("got version 2 %v, %v", old, err)
+	}
+}
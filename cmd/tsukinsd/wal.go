@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Every change of the NS state is appended to the journal (the write-ahead
+// log) before it is acted upon. Entries describe the resulting state
+// rather than the operation, so applying an entry twice is harmless. After
+// a restart, the whole journal is replayed on top of the last snapshot.
+const (
+	OpInit     = "init"
+	OpTouch    = "touch"
+	OpMkdir    = "mkdir"
+	OpCopy     = "copy"
+	OpRename   = "rename"
+	OpPurge    = "purge"
+	OpSnapdir  = "snapdir"
+	OpTrash    = "trash"
+	OpUndelete = "undelete"
+	OpExpunge  = "expunge"
+	OpUpdate   = "update"
+	OpRmfile   = "rmfile"
+	OpRmdir    = "rmdir"
+	OpChunk    = "chunk"
+	OpRegister = "register"
+)
+
+type LogEntry struct {
+	Version  int64            `json:"version"`
+	Op       string           `json:"op"`
+	Address  string           `json:"address,omitempty"`
+	To       string           `json:"to,omitempty"`
+	ID       string           `json:"id,omitempty"`
+	Time     time.Time        `json:"time,omitempty"`
+	User     string           `json:"user,omitempty"`
+	Node     *NodeRecord      `json:"node,omitempty"`
+	Chunk    *ChunkRecord     `json:"chunk,omitempty"`
+	Register *RegisterMessage `json:"register,omitempty"`
+}
+
+// NodeRecord is a tree node without its links to other nodes.
+type NodeRecord struct {
+	ID          int64           `json:"id,omitempty"`
+	Address     string          `json:"address"`
+	IsDirectory bool            `json:"isDirectory"`
+	Parent      string          `json:"parent"`
+	Pending     map[string]bool `json:"pending,omitempty"`
+	Chunks      []string        `json:"chunks,omitempty"`
+	CreatedOn   time.Time       `json:"createdOn"`
+	Size        int             `json:"size"`
+	Coding      *Coding         `json:"coding,omitempty"`
+	Update      *NodeRecord     `json:"update,omitempty"`
+	Lease       string          `json:"lease,omitempty"`
+	Version     int             `json:"version,omitempty"`
+	Versions    []*Version      `json:"versions,omitempty"`
+	Owner       string          `json:"owner,omitempty"`
+	Group       string          `json:"group,omitempty"`
+	Mode        os.FileMode     `json:"mode,omitempty"`
+}
+
+// ChunkRecord is a chunk with its fileservers identified by host.
+type ChunkRecord struct {
+	ChunkID       string         `json:"chunkID"`
+	Inode         int64          `json:"inode,omitempty"`
+	Status        int            `json:"status"`
+	Statuses      map[string]int `json:"statuses"`
+	ReadyReplicas int            `json:"readyReplicas"`
+	AllReplicas   int            `json:"allReplicas"`
+	Refs          int            `json:"refs"`
+	Stripe        []string       `json:"stripe,omitempty"`
+	Coding        *Coding        `json:"coding,omitempty"`
+}
+
+func (node *Node) Record() *NodeRecord {
+	pending := make(map[string]bool, len(node.Pending))
+	for id, p := range node.Pending {
+		pending[id] = p
+	}
+
+	rec := &NodeRecord{
+		ID:          node.ID,
+		Address:     node.Address(),
+		IsDirectory: node.IsDirectory,
+		Pending:     pending,
+		Chunks:      append([]string(nil), node.Chunks...),
+		CreatedOn:   node.CreatedOn,
+		Size:        node.Size,
+		Coding:      node.Coding,
+		Version:     node.Version,
+		Versions:    append([]*Version(nil), node.Versions...),
+		Owner:       node.Owner,
+		Group:       node.Group,
+		Mode:        node.Mode,
+	}
+
+	if node.parent != nil {
+		rec.Parent = node.parent.Address()
+	}
+
+	if node.Update != nil {
+		rec.Update = node.Update.Record()
+	}
+
+	if node.Lease != nil {
+		rec.Lease = node.Lease.ID
+	}
+
+	return rec
+}
+
+// detachedNode makes the node of a record that is not in the tree, such as
+// an update or a file of a deletion.
+func detachedNode(rec *NodeRecord) *Node {
+	if rec == nil {
+		return nil
+	}
+
+	node := &Node{
+		ID:        rec.ID,
+		Name:      rec.Address,
+		Pending:   rec.Pending,
+		Chunks:    rec.Chunks,
+		CreatedOn: rec.CreatedOn,
+		Size:      rec.Size,
+		Coding:    rec.Coding,
+		Update:    detachedNode(rec.Update),
+		Version:   rec.Version,
+		Versions:  rec.Versions,
+	}
+
+	if node.Pending == nil {
+		node.Pending = map[string]bool{}
+	}
+
+	return node
+}
+
+func (c *Chunk) Record() *ChunkRecord {
+	c.ssmu.Lock()
+	defer c.ssmu.Unlock()
+
+	statuses := make(map[string]int, len(c.Statuses))
+	for host, status := range c.Statuses {
+		statuses[host] = status
+	}
+
+	return &ChunkRecord{
+		ChunkID:       c.ChunkID,
+		Inode:         c.File,
+		Status:        c.Status,
+		Statuses:      statuses,
+		ReadyReplicas: c.ReadyReplicas,
+		AllReplicas:   c.AllReplicas,
+		Refs:          c.Refs,
+		Stripe:        c.Stripe,
+		Coding:        c.Coding,
+	}
+}
+
+// Commit journals the current state of the chunk.
+func (c *Chunk) Commit() {
+	wal.Append(&LogEntry{Op: OpChunk, Chunk: c.Record()})
+}
+
+// Journal is the write-ahead log. Each line holds a batch of entries and
+// starts with the batch's CRC-32, so that a batch torn by a crash is
+// detected and dropped as a whole. All methods are no-ops on nil journal.
+type Journal struct {
+	mu       sync.Mutex
+	idle     *sync.Cond // signalled when the last batch ends
+	filename string
+	file     *os.File
+	depth    int
+	batch    []*LogEntry
+
+	// Version is the version of the last entry.
+	Version int64
+
+	// Checkpoint, if set, is called every CheckpointEvery entries with
+	// the journal locked. If it succeeds, the journal is truncated, so it
+	// must save a snapshot of the whole state.
+	Checkpoint      func(version int64) error
+	CheckpointEvery int64
+	sinceCheckpoint int64
+
+	// Commit, if set, replaces writing to the file. It is set in a
+	// cluster, where it returns once the batch is committed to the Raft
+	// log.
+	Commit func(batch []*LogEntry) error
+
+	// The last written entries are kept for shipping to a standby.
+	// changed is closed and replaced whenever more are written.
+	tail    []*LogEntry
+	changed chan struct{}
+}
+
+// ShipBacklog is the number of entries kept for a standby. A standby that
+// falls further behind loads a snapshot instead.
+const ShipBacklog = 4096
+
+// OpenJournal applies the entries found in the file and opens it for
+// appending. A torn batch at the end of the file is cut off.
+func OpenJournal(filename string, apply func(entry *LogEntry)) (*Journal, error) {
+	j := &Journal{filename: filename, changed: make(chan struct{})}
+	j.idle = sync.NewCond(&j.mu)
+
+	valid, err := j.replay(apply)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %v", err)
+	}
+
+	j.file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %v", err)
+	}
+
+	if err := j.file.Truncate(valid); err != nil {
+		return nil, fmt.Errorf("open journal: %v", err)
+	}
+
+	if _, err := j.file.Seek(valid, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("open journal: %v", err)
+	}
+
+	return j, nil
+}
+
+// replay applies every intact batch and returns the length of the intact
+// part of the file.
+func (j *Journal) replay(apply func(entry *LogEntry)) (int64, error) {
+	file, err := os.Open(j.filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				log.Printf("warning: journal ends with an incomplete batch; dropping it")
+			}
+			return valid, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		var batch []*LogEntry
+		if !decodeRecord(line, &batch) {
+			log.Printf("warning: journal has a corrupted batch at offset %d; dropping the rest", valid)
+			return valid, nil
+		}
+
+		for _, entry := range batch {
+			apply(entry)
+			j.Version = entry.Version
+		}
+		valid += int64(len(line))
+	}
+}
+
+// encodeRecord encodes v as a journal line: the CRC-32 of the JSON payload
+// in hex, a tab, the payload and a newline.
+func encodeRecord(v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	line := []byte(fmt.Sprintf("%08x\t", crc32.ChecksumIEEE(payload)))
+	line = append(line, payload...)
+	return append(line, '\n'), nil
+}
+
+// decodeRecord decodes a line written by encodeRecord into v. It fails on
+// lines that are torn or damaged.
+func decodeRecord(line []byte, v interface{}) bool {
+	if len(line) < 10 || line[8] != '\t' {
+		return false
+	}
+
+	var sum uint32
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &sum); err != nil {
+		return false
+	}
+
+	payload := line[9 : len(line)-1]
+	if crc32.ChecksumIEEE(payload) != sum {
+		return false
+	}
+
+	return json.Unmarshal(payload, v) == nil
+}
+
+// Append journals the entry. Inside Begin and its end the entry waits for
+// the rest of the batch.
+func (j *Journal) Append(entry *LogEntry) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Version++
+	entry.Version = j.Version
+	j.batch = append(j.batch, entry)
+
+	if j.depth == 0 {
+		j.flush(false)
+	}
+}
+
+// Begin starts a batch of entries that are written atomically. The
+// returned function ends it and, for the outermost batch, reports whether
+// the batch was written. Batches may nest.
+func (j *Journal) Begin() func() error {
+	if j == nil {
+		return func() error { return nil }
+	}
+
+	j.mu.Lock()
+	j.depth++
+	j.mu.Unlock()
+
+	return func() error {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		j.depth--
+		if j.depth != 0 {
+			return nil
+		}
+
+		err := j.flush(false)
+		j.idle.Broadcast()
+		return err
+	}
+}
+
+// flush writes the batch. With Commit set, the batch goes to the Raft log
+// instead of the file, unless it was replicated from there.
+func (j *Journal) flush(replicated bool) error {
+	if len(j.batch) == 0 {
+		return nil
+	}
+
+	var err error
+	switch {
+	case j.Commit != nil && replicated:
+	case j.Commit != nil:
+		err = j.Commit(j.batch)
+	default:
+		err = j.write(j.batch)
+	}
+
+	if err != nil {
+		log.Printf("error: could not write to journal: %v", err)
+		j.batch = nil
+		return err
+	}
+
+	j.sinceCheckpoint += int64(len(j.batch))
+	j.tail = append(j.tail, j.batch...)
+	if len(j.tail) > ShipBacklog {
+		j.tail = append([]*LogEntry(nil), j.tail[len(j.tail)-ShipBacklog:]...)
+	}
+	j.batch = nil
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+
+	if j.Checkpoint != nil && j.CheckpointEvery > 0 && j.sinceCheckpoint >= j.CheckpointEvery {
+		if err := j.checkpoint(); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (j *Journal) write(batch []*LogEntry) error {
+	line, err := encodeRecord(batch)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(line); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+// CheckpointNow waits for the open batches to end and checkpoints the
+// journal at once. It returns the version of the snapshot.
+func (j *Journal) CheckpointNow() (int64, error) {
+	if j == nil || j.Checkpoint == nil {
+		return 0, fmt.Errorf("checkpoint: the journal is not set up for checkpoints")
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// A half-done batch is already applied to the state but is not in
+	// the journal yet.
+	for j.depth > 0 {
+		j.idle.Wait()
+	}
+
+	return j.Version, j.checkpoint()
+}
+
+func (j *Journal) checkpoint() error {
+	if err := j.Checkpoint(j.Version); err != nil {
+		return fmt.Errorf("could not save a snapshot, keeping the journal: %v", err)
+	}
+
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("could not truncate journal: %v", err)
+	}
+
+	j.file.Seek(0, io.SeekStart)
+	j.sinceCheckpoint = 0
+	return nil
+}
+
+// Current returns the version of the last entry.
+func (j *Journal) Current() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.Version
+}
+
+// Since returns the written entries that follow the version. It fails if
+// they are no longer kept or the version is unknown to the journal.
+func (j *Journal) Since(version int64) ([]*LogEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	written := j.Version - int64(len(j.batch))
+	if version > written {
+		return nil, false
+	}
+
+	if version == written {
+		return nil, true
+	}
+
+	if len(j.tail) == 0 || j.tail[0].Version > version+1 {
+		return nil, false
+	}
+
+	return append([]*LogEntry(nil), j.tail[version+1-j.tail[0].Version:]...), true
+}
+
+// Changed returns a channel that is closed when more entries are written.
+func (j *Journal) Changed() <-chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.changed
+}
+
+// Replicate journals entries shipped from the primary, or committed to
+// the Raft log by the leader, as one batch, keeping their versions. They
+// must follow the last entry of the journal and be applied to the state
+// already, since a checkpoint may follow.
+func (j *Journal) Replicate(entries []*LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if entries[0].Version != j.Version+1 {
+		return fmt.Errorf("replicate: got entry %d after %d", entries[0].Version, j.Version)
+	}
+
+	j.Version = entries[len(entries)-1].Version
+	j.batch = append(j.batch, entries...)
+	return j.flush(true)
+}
+
+// Reset empties the journal and moves it to the version. It is used when
+// the state is replaced with a snapshot from the primary.
+func (j *Journal) Reset(version int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("reset journal: %v", err)
+	}
+
+	j.file.Seek(0, io.SeekStart)
+	j.Version = version
+	j.batch = nil
+	j.tail = nil
+	j.sinceCheckpoint = 0
+	return nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+// applyEntry brings the NS state in line with the entry. It is used
+// during replay, so it must not journal anything itself.
+func applyEntry(entry *LogEntry) {
+	switch entry.Op {
+	case OpInit:
+		t = InitTree(conf.Namenode)
+		ct = &ChunkTable{Table: map[string]*Chunk{}, InvertedTable: map[string][]*Chunk{}}
+
+	case OpTouch, OpMkdir, OpCopy, OpUpdate:
+		t.ApplyNode(entry.Node)
+
+	case OpRmfile:
+		t.ApplyRemove(entry.Address)
+
+	case OpRmdir:
+		t.ApplyRemoveDirectory(entry.Address, entry.ID)
+
+	case OpSnapdir:
+		t.ApplySnapshotDirectory(entry.Address, entry.ID)
+
+	case OpTrash:
+		t.ApplyTrash(&TrashItem{ID: entry.ID, Address: entry.Address, RemovedOn: entry.Time, Owner: entry.User})
+
+	case OpUndelete:
+		t.ApplyUndelete(entry.ID)
+
+	case OpExpunge:
+		t.ApplyExpunge(entry.ID)
+
+	case OpPurge:
+		t.ApplyPurge(entry.ID, entry.Address)
+
+	case OpRename:
+		t.ApplyRename(entry.Address, entry.To)
+
+	case OpChunk:
+		ct.ApplyChunk(entry.Chunk)
+
+	case OpRegister:
+		if fs, err := storages.RegisterFServer(entry.Register); err != nil {
+			log.Printf("warning: could not replay registration of %s: %v", entry.Register.PrivateHost, err)
+		} else {
+			ct.Adopt(fs)
+		}
+
+	default:
+		log.Printf("warning: unknown journal entry %q", entry.Op)
+	}
+
+	t.Version = entry.Version
+}
+
+// ApplyNode creates or updates the node as recorded. The node is found by
+// its inode number.
+func (t *Tree) ApplyNode(rec *NodeRecord) {
+	node, ok := t.Inodes[rec.ID]
+	if !ok {
+		parent, ok := t.Lookup(rec.Parent)
+		if !ok {
+			log.Printf("warning: parent of %s is not in the tree; skipping", rec.Address)
+			return
+		}
+
+		node = &Node{ID: rec.ID, Name: path.Base(rec.Address)}
+		t.link(parent, node)
+	}
+
+	node.IsDirectory = rec.IsDirectory
+	node.Pending = rec.Pending
+	if node.Pending == nil && !rec.IsDirectory {
+		node.Pending = map[string]bool{}
+	}
+	node.Chunks = rec.Chunks
+	node.CreatedOn = rec.CreatedOn
+	node.Size = rec.Size
+	node.Coding = rec.Coding
+	node.Update = detachedNode(rec.Update)
+	node.Version = rec.Version
+	node.Versions = rec.Versions
+	node.Owner = rec.Owner
+	node.Group = rec.Group
+	node.Mode = rec.Mode
+
+	// The expiration is not journaled, so a lease lasts the whole lease
+	// time from when it is applied.
+	if rec.Lease == "" {
+		node.Lease = nil
+	} else if node.Lease == nil || node.Lease.ID != rec.Lease {
+		node.Lease = newLease(rec.Lease)
+	}
+
+	t.recharge(node)
+}
+
+// ApplyRemove removes the node the same lazy way RemoveFile does.
+func (t *Tree) ApplyRemove(address string) {
+	node, ok := t.Lookup(address)
+	if !ok {
+		return
+	}
+
+	node.Removed = true
+	t.Removed = append(t.Removed, node)
+	t.drop(node)
+	t.recharge(node)
+}
+
+// ApplyChunk creates or updates the chunk as recorded. Its replicas are
+// linked to the fileservers of the pool, or to placeholders until they
+// register, and new ones are added to the inverted table, so that a
+// standby or a follower can take over with the chunks it was shipped.
+func (ct *ChunkTable) ApplyChunk(rec *ChunkRecord) {
+	chunk, ok := ct.Table[rec.ChunkID]
+	if !ok {
+		chunk = &Chunk{ChunkID: rec.ChunkID}
+		ct.Table[rec.ChunkID] = chunk
+	}
+
+	chunk.File = rec.Inode
+	chunk.Status = rec.Status
+	chunk.Statuses = rec.Statuses
+	chunk.ReadyReplicas = rec.ReadyReplicas
+	chunk.AllReplicas = rec.AllReplicas
+	chunk.Refs = rec.Refs
+	chunk.Stripe = rec.Stripe
+	chunk.Coding = rec.Coding
+
+	fservers := make(map[string]*FileServerInfo, len(rec.Statuses))
+	for addr := range rec.Statuses {
+		fs, ok := chunk.FServers[addr]
+		if !ok {
+			ct.ivmu.Lock()
+			ct.InvertedTable[addr] = append(ct.InvertedTable[addr], chunk)
+			ct.ivmu.Unlock()
+		}
+
+		if known := storages.At(addr); known != nil {
+			fs = known
+		} else if fs == nil {
+			fs = placeholder(addr)
+		}
+		fservers[addr] = fs
+	}
+	chunk.FServers = fservers
+}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+var journalHolder = &RegisterMessage{NodeID: "a", PrivateHost: "10.0.0.1", PublicPort: 7000}
+
+// setUpJournaled recovers the global NS state from the files in dir.
+func setUpJournaled(dir string) error {
+	conf = &Config{Namenode: Namenode{
+		Replicas:          1,
+		TreeLogName:       path.Join(dir, "tree.log"),
+		SnapshotDir:       dir,
+		SnapshotRetention: 2,
+		TreeUpdatePeriod:  7,
+	}}
+
+	storages = &PoolInfo{}
+	if _, err := storages.RegisterFServer(journalHolder); err != nil {
+		return err
+	}
+
+	return recoverState()
+}
+
+// serveClient sends the request to the public API, as the user unless it is
+// empty, and fails the test unless the response has the code. The
+// password of the user is its name followed by "-password".
+func serveClient(test *testing.T, query string, code int, user string) *ClientMessage {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", query, nil)
+	if user != "" {
+		r.SetBasicAuth(user, user+"-password")
+	}
+
+	publicRouter().ServeHTTP(w, r)
+	if w.Code != code {
+		test.Fatalf("%s %s: got %d, want %d, %s", user, query, w.Code, code, w.Body)
+	}
+
+	msg := &ClientMessage{}
+	json.NewDecoder(w.Body).Decode(msg)
+	return msg
+}
+
+// runWorkload uploads, confirms and removes files the way the handlers
+// do. Negative n means forever.
+func runWorkload(prefix string, n int) {
+	for i := 0; n < 0 || i < n; i++ {
+		dir := fmt.Sprintf("%s-dir%d", prefix, i)
+		t.CreateDirectory(dir)
+
+		end := wal.Begin()
+		file, err := t.CreateFile(dir+"/file", 1)
+		if err != nil {
+			end()
+			panic(err)
+		}
+
+		id := fmt.Sprintf("%s-chunk%d", prefix, i)
+		ct.AddChunk(id, file.ID, storages.StorageNodes[0])
+		file.Chunks = append(file.Chunks, id)
+		file.Pending[id] = true
+		t.CommitUpdate(OpUpdate, file)
+		end()
+
+		ReceivedChunk(id, storages.StorageNodes[0].Addr())
+
+		if i%2 == 0 {
+			end := wal.Begin()
+			if copied, err := t.CopyFile(dir+"/file", dir+"/copy"); err == nil {
+				ct.Retain(copied.Chunks)
+			}
+			end()
+		}
+
+		if i%3 == 0 {
+			end := wal.Begin()
+			if removed, err := t.RemoveFile(dir + "/file"); err == nil {
+				ct.Release(removed.Chunks)
+			}
+			end()
+		}
+	}
+}
+
+// nodeAt returns the node at the address, or nil.
+func nodeAt(address string) *Node {
+	node, _ := t.Lookup(address)
+	return node
+}
+
+// checkConsistency verifies that the tree is linked correctly and that
+// every file's chunks are known and confirmed unless pending.
+func checkConsistency() error {
+	for _, node := range t.Inodes {
+		if node == t.root {
+			continue
+		}
+
+		address := node.Address()
+		if parent := node.parent; parent == nil || t.Inodes[parent.ID] != parent {
+			return fmt.Errorf("parent of %s is missing", address)
+		}
+
+		linked := false
+		for _, child := range node.parent.Childs {
+			linked = linked || child == node
+		}
+		if !linked || node.parent.children[node.Name] != node {
+			return fmt.Errorf("%s is not among children of %s", address, node.parent.Address())
+		}
+
+		if found, _ := t.Lookup(address); found != node {
+			return fmt.Errorf("%s is not found at its address", address)
+		}
+
+		if node.IsDirectory {
+			continue
+		}
+
+		if len(node.Chunks) == 0 {
+			return fmt.Errorf("file %s has no chunks", address)
+		}
+
+		for _, id := range node.Chunks {
+			chunk, ok := ct.Table[id]
+			if !ok {
+				return fmt.Errorf("chunk %s of %s is not in the chunk table", id, address)
+			}
+
+			if !node.Pending[id] && chunk.Statuses[storages.StorageNodes[0].Addr()] != OK {
+				return fmt.Errorf("chunk %s of %s is not pending but not confirmed either", id, address)
+			}
+
+			if chunk.FServers[storages.StorageNodes[0].Addr()] != storages.StorageNodes[0] {
+				return fmt.Errorf("chunk %s is not linked to its fileserver", id)
+			}
+		}
+	}
+
+	if err := checkUsage(); err != nil {
+		return err
+	}
+
+	return checkRefs()
+}
+
+// checkRefs verifies that every chunk counts the files that refer to it,
+// including the files of removed directories that are not purged yet, and
+// that the chunks no file refers to are purged.
+func checkRefs() error {
+	refs := map[string]int{}
+	for _, node := range t.Inodes {
+		for _, id := range node.AllChunks() {
+			refs[id]++
+		}
+	}
+
+	for _, deletion := range t.Deletions {
+		for _, file := range deletion.Files {
+			for _, id := range file.AllChunks() {
+				refs[id]++
+			}
+		}
+	}
+
+	for id, chunk := range ct.Table {
+		if chunk.Refs != refs[id] {
+			return fmt.Errorf("chunk %s counts %d files, %d refer to it", id, chunk.Refs, refs[id])
+		}
+
+		if chunk.Refs == 0 && chunk.Status != OBSOLETE {
+			return fmt.Errorf("chunk %s is not used but not purged", id)
+		}
+	}
+
+	return nil
+}
+
+func TestJournal_Replay(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	runWorkload("a", 10)
+	wantNodes, wantChunks := len(t.Inodes), len(ct.Table)
+	wal.Close()
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	defer wal.Close()
+
+	if len(t.Inodes) != wantNodes || len(ct.Table) != wantChunks {
+		test.Errorf("got %d nodes and %d chunks after recovery, want %d and %d", len(t.Inodes), len(ct.Table), wantNodes, wantChunks)
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+
+	if t.FileExists("a-dir0/file") || !t.FileExists("a-dir1/file") {
+		test.Errorf("removed and kept files are not recovered as such")
+	}
+}
+
+func TestJournal_TornBatch(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	conf.Namenode.TreeUpdatePeriod = 0
+	wal.CheckpointEvery = 0
+	t.CreateDirectory("kept")
+	wal.Close()
+
+	logFile, _ := os.OpenFile(conf.Namenode.TreeLogName, os.O_APPEND|os.O_WRONLY, 0644)
+	logFile.WriteString(`0badc0de	[{"version":2,"op":"mkdir","node":{"addre`)
+	logFile.Close()
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	t.CreateDirectory("after")
+	wal.Close()
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover again, %v", err)
+	}
+	defer wal.Close()
+
+	if !t.DirectoryExists("kept") || !t.DirectoryExists("after") {
+		test.Errorf("entries around the torn batch are lost, got %v", t.Inodes)
+	}
+}
+
+// TestJournal_CrashRecovery kills a nameserver-like process in the middle
+// of its work several times and checks that the state recovers intact.
+func TestJournal_CrashRecovery(test *testing.T) {
+	if dir := os.Getenv("TSUKI_CRASH_DIR"); dir != "" {
+		if err := setUpJournaled(dir); err != nil {
+			panic(err)
+		}
+		runWorkload(os.Getenv("TSUKI_CRASH_ROUND"), -1)
+		return
+	}
+
+	if testing.Short() {
+		test.Skip("crash test runs subprocesses")
+	}
+
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for round := 0; round < 3; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestJournal_CrashRecovery$")
+		cmd.Env = append(os.Environ(), "TSUKI_CRASH_DIR="+dir, fmt.Sprintf("TSUKI_CRASH_ROUND=r%d", round))
+		if err := cmd.Start(); err != nil {
+			test.Fatal(err)
+		}
+
+		time.Sleep(time.Duration(150+50*round) * time.Millisecond)
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		if err := setUpJournaled(dir); err != nil {
+			test.Fatalf("round %d: could not recover, %v", round, err)
+		}
+
+		err := checkConsistency()
+		nodes := len(t.Inodes)
+		wal.Close()
+
+		if err != nil {
+			test.Fatalf("round %d: %v", round, err)
+		}
+
+		if nodes <= 1 {
+			test.Fatalf("round %d: nothing was recovered", round)
+		}
+	}
+}
+
+// TestJournal_CopyAndMove copies and moves files and a directory through
+// the handlers and checks that the journal recovers them with their chunks.
+func TestJournal_CopyAndMove(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	runWorkload("a", 3)
+	t.CreateDirectory("b")
+
+	for _, request := range []string{"/cp?from=a-dir1/file&to=b/copy", "/mv?from=a-dir2/file&to=b", "/mv?from=a-dir0&to=b/dir0"} {
+		serveClient(test, request, http.StatusOK, "")
+	}
+	wal.Close()
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	defer wal.Close()
+
+	copied, err := t.GetFile("b/copy")
+	if err != nil || !t.FileExists("a-dir1/file") || copied.Chunks[0] != "a-chunk1" {
+		test.Errorf("copy is not recovered with the chunks of the file: %v, %v", copied, err)
+	}
+
+	moved, err := t.GetFile("b/file")
+	if err != nil || t.Exists("a-dir2/file") || t.Inodes[ct.Table["a-chunk2"].File] != moved {
+		test.Errorf("move is not recovered with the chunks of the file: %v, %v", moved, err)
+	}
+
+	if !t.FileExists("b/dir0/copy") || t.Exists("a-dir0") || t.Exists("a-dir0/copy") {
+		test.Errorf("directory is not recovered as moved")
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+}
+
+// TestJournal_SharedChunks removes a file and then its copy, and checks
+// that their chunk is purged only with the last of them, also after a
+// restart in between.
+func TestJournal_SharedChunks(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	runWorkload("a", 2)
+
+	purged := func() bool {
+		for _, cmd := range storages.StorageNodes[0].PendingCommands() {
+			for _, id := range cmd.Chunks {
+				if cmd.Kind == CommandPurge && id == "a-chunk1" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for i, request := range []string{"/cp?from=a-dir1/file&to=a-dir1/copy", "/rmfile?address=a-dir1/file", "/rmfile?address=a-dir1/copy"} {
+		if i == 2 {
+			wal.Close()
+			if err := setUpJournaled(dir); err != nil {
+				test.Fatalf("could not recover, %v", err)
+			}
+			defer wal.Close()
+		}
+
+		serveClient(test, request, http.StatusOK, "")
+
+		if err := checkConsistency(); err != nil {
+			test.Fatalf("after %s: %v", request, err)
+		}
+
+		if purged() != (i == 2) {
+			test.Errorf("after %s: chunk is purged: %v", request, purged())
+		}
+	}
+}
+
+// TestJournal_RecursiveRmdir removes a directory with files in it and
+// restarts while they are being purged, with a snapshot in between.
+func TestJournal_RecursiveRmdir(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(saved int) { purgeBatch = saved }(purgeBatch)
+	purgeBatch = 1
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	runWorkload("a", 4)
+	t.CreateDirectory("big")
+	for _, from := range []string{"a-dir1", "a-dir2", "a-dir3"} {
+		t.Move(from, "big", false)
+	}
+
+	serveClient(test, "/rmdir?address=big", http.StatusOK, "")
+
+	// a-dir1 has a file, a-dir2 a file and its copy, a-dir3 nothing.
+	if len(t.Deletions) != 1 || t.Deletions[0].Total != 3 {
+		test.Fatalf("got deletions %v, want one of 3 files", t.Deletions)
+	}
+
+	purgeStep()
+	if _, err := wal.CheckpointNow(); err != nil {
+		test.Fatal(err)
+	}
+	purgeStep()
+	wal.Close()
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	defer wal.Close()
+
+	if len(t.Deletions) != 1 || len(t.Deletions[0].Files) != 1 {
+		test.Fatalf("got deletions %v after a restart, want one with 1 file left", t.Deletions)
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Fatal(err)
+	}
+
+	t.CreateDirectory("big")
+	if t.Exists("big/a-dir1") || t.Exists("big/a-dir1/file") {
+		test.Errorf("removed files are back with the directory")
+	}
+
+	for more := true; more; {
+		if more, err = purgeStep(); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if len(t.Deletions) != 0 {
+		test.Errorf("got deletions %v, want none", t.Deletions)
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+}
+
+// TestJournal_Reupload overwrites a file and checks that it keeps its old
+// content until the new one is confirmed, also across a restart, and that
+// the old chunk is purged only then.
+func TestJournal_Reupload(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	conf.Namenode.ChunkSize = 1
+	runWorkload("a", 2)
+
+	msg := serveClient(test, "/reupload?address=a-dir1/file&size=1", http.StatusOK, "")
+	if len(msg.Chunks) != 1 || msg.Token == "" {
+		test.Fatalf("got %+v, want a chunk to upload under a token", msg)
+	}
+	id := msg.Chunks[0].ChunkID
+
+	wal.Close()
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	defer wal.Close()
+	conf.Namenode.ChunkSize = 1
+
+	if got := serveClient(test, "/download?address=a-dir1/file", http.StatusOK, ""); len(got.Chunks) != 1 || got.Chunks[0].ChunkID != "a-chunk1" {
+		test.Errorf("got %+v before the new content is confirmed, want the old chunk", got.Chunks)
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Fatal(err)
+	}
+
+	ReceivedChunk(id, storages.StorageNodes[0].Addr())
+
+	if got := serveClient(test, "/download?address=a-dir1/file", http.StatusOK, ""); len(got.Chunks) != 1 || got.Chunks[0].ChunkID != id {
+		test.Errorf("got %+v after the new content is confirmed, want the new chunk", got.Chunks)
+	}
+
+	if ct.Table["a-chunk1"].Status != OBSOLETE {
+		test.Errorf("old chunk is not purged")
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+}
+
+// TestJournal_Versions overwrites a file keeping one previous version, and
+// checks that the versions survive a restart and can be downloaded and
+// restored.
+func TestJournal_Versions(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setUp := func() {
+		if err := setUpJournaled(dir); err != nil {
+			test.Fatalf("could not set up, %v", err)
+		}
+		conf.Namenode.ChunkSize = 1
+		conf.Namenode.Retention = "versions(1)"
+	}
+
+	setUp()
+	runWorkload("a", 2)
+
+	var uploaded []string
+	for i := 0; i < 2; i++ {
+		msg := serveClient(test, "/reupload?address=a-dir1/file&size=1", http.StatusOK, "")
+		ReceivedChunk(msg.Chunks[0].ChunkID, storages.StorageNodes[0].Addr())
+		uploaded = append(uploaded, msg.Chunks[0].ChunkID)
+	}
+
+	if ct.Table["a-chunk1"].Status != OBSOLETE {
+		test.Errorf("chunk of the version out of retention is not purged")
+	}
+
+	wal.Close()
+	setUp()
+	defer wal.Close()
+
+	if got := serveClient(test, "/versions?address=a-dir1/file", http.StatusOK, ""); len(got.Objects) != 2 || !strings.HasPrefix(got.Objects[1], "2\t") {
+		test.Errorf("got versions %q, want 3 and 2", got.Objects)
+	}
+
+	if got := serveClient(test, "/download?address=a-dir1/file&version=2", http.StatusOK, ""); len(got.Chunks) != 1 || got.Chunks[0].ChunkID != uploaded[0] {
+		test.Errorf("got %+v for version 2, want its chunk", got.Chunks)
+	}
+
+	serveClient(test, "/restore?address=a-dir1/file&version=2", http.StatusOK, "")
+
+	file := nodeAt("a-dir1/file")
+	if file.Version != 4 || file.Chunks[0] != uploaded[0] || len(file.Versions) != 1 || file.Versions[0].Number != 3 {
+		test.Errorf("version 2 is not restored as version 4: %v, %v", file, file.Versions)
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+}
+
+// TestJournal_DirectorySnapshots takes a snapshot of a directory and
+// checks that it keeps the chunks of removed files alive across a restart
+// until it is deleted.
+func TestJournal_DirectorySnapshots(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	runWorkload("a", 2)
+
+	serveClient(test, "/snapshot?address=/a-dir1@before", http.StatusOK, "")
+	serveClient(test, "/rmfile?address=/a-dir1/file", http.StatusOK, "")
+
+	wal.Close()
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not recover, %v", err)
+	}
+	defer wal.Close()
+
+	if got := serveClient(test, "/download?address=/.snapshots/a-dir1@before/file", http.StatusOK, ""); len(got.Chunks) != 1 || got.Chunks[0].ChunkID != "a-chunk1" {
+		test.Errorf("got %+v from the snapshot, want the chunk of the removed file", got.Chunks)
+	}
+
+	if chunk := ct.Table["a-chunk1"]; chunk.Refs != 1 || chunk.Status == OBSOLETE {
+		test.Errorf("chunk of the snapshot is purged")
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Fatal(err)
+	}
+
+	serveClient(test, "/rmsnapshot?address=/a-dir1@before", http.StatusOK, "")
+	for more := true; more; {
+		if more, err = purgeStep(); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if ct.Table["a-chunk1"].Status != OBSOLETE {
+		test.Errorf("chunk of the deleted snapshot is not purged")
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+}
+
+// TestJournal_Trash removes a file and a directory to the trash, and
+// checks that the file can be restored after a restart and that the
+// directory is purged once it expires.
+func TestJournal_Trash(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setUp := func() {
+		if err := setUpJournaled(dir); err != nil {
+			test.Fatalf("could not set up, %v", err)
+		}
+		conf.Namenode.TrashRetention = 1
+	}
+
+	setUp()
+	runWorkload("a", 3)
+
+	file := serveClient(test, "/rmfile?address=/a-dir1/file", http.StatusOK, "").Objects[0]
+	serveClient(test, "/rmdir?address=/a-dir2", http.StatusOK, "")
+
+	if ct.Table["a-chunk1"].Status == OBSOLETE || t.Exists("a-dir1/file") {
+		test.Errorf("file is not moved to the trash")
+	}
+
+	wal.Close()
+	setUp()
+	defer wal.Close()
+
+	if got := serveClient(test, "/trash", http.StatusOK, ""); len(got.Objects) != 2 || !strings.HasPrefix(got.Objects[0], file) {
+		test.Errorf("got trash %q", got.Objects)
+	}
+
+	serveClient(test, "/undelete?id="+file, http.StatusOK, "")
+	if got := serveClient(test, "/download?address=/a-dir1/file", http.StatusOK, ""); len(got.Chunks) != 1 || got.Chunks[0].ChunkID != "a-chunk1" {
+		test.Errorf("got %+v, want the restored file", got.Chunks)
+	}
+
+	if err := expungeStep(time.Now().Add(2 * time.Hour)); err != nil {
+		test.Fatal(err)
+	}
+	for more := true; more; {
+		if more, err = purgeStep(); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	if _, ok := t.Lookup(TrashRoot); ok || len(t.Trash) != 0 {
+		test.Errorf("trash is not emptied")
+	}
+
+	if ct.Table["a-chunk2"].Status != OBSOLETE {
+		test.Errorf("chunk of the expired directory is not purged")
+	}
+
+	if err := checkConsistency(); err != nil {
+		test.Error(err)
+	}
+}
+
+// TestJournal_UnregisteredHolder links chunks to a pool their fileserver
+// is not registered with, removes a file and checks that the purge waits
+// for the fileserver instead of going to another one.
+func TestJournal_UnregisteredHolder(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	defer wal.Close()
+	runWorkload("a", 1)
+
+	storages = &PoolInfo{}
+	other, _ := storages.RegisterFServer(&RegisterMessage{NodeID: "b", PrivateHost: "10.0.0.2", PublicPort: 7000})
+	ct.Relink(storages)
+
+	serveClient(test, "/rmfile?address=a-dir0/copy", http.StatusOK, "")
+
+	if cmds := other.PendingCommands(); len(cmds) != 0 {
+		test.Errorf("got %+v queued for another fileserver", cmds)
+	}
+
+	holder, _ := storages.RegisterFServer(journalHolder)
+	ct.Adopt(holder)
+	ct.ReconcileInventory(holder, []string{"a-chunk0"})
+
+	cmds := holder.PendingCommands()
+	if len(cmds) != 1 || cmds[0].Kind != CommandPurge || len(cmds[0].Chunks) != 1 || cmds[0].Chunks[0] != "a-chunk0" {
+		test.Errorf("got %+v queued for the registered holder, want a purge of a-chunk0", cmds)
+	}
+}
+
+// TestJournal_WriteFailure checks that a change the journal could not
+// keep is not reported as made.
+func TestJournal_WriteFailure(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tsukinsd")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setUpJournaled(dir); err != nil {
+		test.Fatalf("could not set up, %v", err)
+	}
+	wal.file.Close()
+
+	serveClient(test, "/mkdir?address=/dir", http.StatusServiceUnavailable, "")
+}
@@ -0,0 +1,175 @@
+package tsuki
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Commands are queued by the NS for each fileserver and delivered in
+// responses to heartbeats. This way the NS doesn't need to reach the
+// fileserver's private port, and commands for a server that is down wait
+// until it comes back.
+const (
+    CommandPurge = "purge"
+    CommandReplicate = "replicate"
+    CommandCancelToken = "cancelToken"
+    CommandExpect = "expect"
+    CommandRebuild = "rebuild"
+)
+
+type Command struct {
+    ID uint64 `json:"id"`
+    Kind string `json:"kind"`
+    Token string `json:"token,omitempty"`
+
+    // Action is "read" or "write", for CommandExpect.
+    Action string `json:"action,omitempty"`
+
+    // Addr is the client address of the destination, for CommandReplicate.
+    Addr string `json:"addr,omitempty"`
+    Chunks []string `json:"chunks,omitempty"`
+
+    // For CommandRebuild, Stripe lists the shards of an erasure coded
+    // stripe in order, and Sources the client addresses they may be read
+    // from under Token. Empty source means the shard is not available.
+    Stripe []string `json:"stripe,omitempty"`
+    Sources []string `json:"sources,omitempty"`
+    DataShards int `json:"dataShards,omitempty"`
+    ParityShards int `json:"parityShards,omitempty"`
+}
+
+// CommandAck tells the NS that a command has been carried out. Error is
+// empty on success.
+type CommandAck struct {
+    ID uint64 `json:"id"`
+    Error string `json:"error,omitempty"`
+}
+
+// Heartbeat is the body of every heartbeat.
+type Heartbeat struct {
+    NodeStatus
+    Acks []CommandAck `json:"acks,omitempty"`
+    Inventory *Inventory `json:"inventory,omitempty"`
+
+    // Epoch is the newest NS epoch seen. It tells a deposed NS that it
+    // was replaced.
+    Epoch int64 `json:"epoch,omitempty"`
+}
+
+type CommandExecutor interface {
+    Execute(cmd *Command) error
+}
+
+func (s *FileServer) Execute(cmd *Command) error {
+    switch cmd.Kind {
+    case CommandPurge:
+        s.Purge(cmd.Chunks...)
+        return nil
+
+    case CommandReplicate:
+        return s.Replicate(cmd.Token, cmd.Addr, cmd.Chunks...)
+
+    case CommandCancelToken:
+        s.CancelToken(cmd.Token)
+        return nil
+
+    case CommandExpect:
+        action, correct := strToExpectAction[cmd.Action]
+        if !correct {
+            return fmt.Errorf("expect: not correct action %q", cmd.Action)
+        }
+
+        return s.Expect(cmd.Token, action, cmd.Chunks...)
+
+    case CommandRebuild:
+        return s.Rebuild(cmd)
+    }
+
+    return fmt.Errorf("unknown command %q", cmd.Kind)
+}
+
+// CommandInbox runs the commands received from the NS and keeps their
+// acknowledgements until they are sent. The NS repeats a command until it
+// is acknowledged, so the inbox skips commands it is running or has
+// finished already.
+type CommandInbox struct {
+    Executor CommandExecutor
+
+    mu sync.Mutex
+    running map[uint64]bool
+    finished map[uint64]CommandAck
+    wg sync.WaitGroup
+}
+
+func NewCommandInbox(executor CommandExecutor) *CommandInbox {
+    return &CommandInbox{
+        Executor: executor,
+        running: make(map[uint64]bool),
+        finished: make(map[uint64]CommandAck),
+    }
+}
+
+// Dispatch starts every command that hasn't been seen yet. Commands run
+// concurrently, so a slow replication doesn't delay heartbeats.
+func (b *CommandInbox) Dispatch(cmds []*Command) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    for _, cmd := range cmds {
+        _, finished := b.finished[cmd.ID]
+        if b.running[cmd.ID] || finished {
+            continue
+        }
+
+        b.running[cmd.ID] = true
+        b.wg.Add(1)
+
+        go b.run(cmd)
+    }
+}
+
+func (b *CommandInbox) run(cmd *Command) {
+    defer b.wg.Done()
+
+    ack := CommandAck{ID: cmd.ID}
+
+    if err := b.Executor.Execute(cmd); err != nil {
+        log.Printf("warning: command %d (%s) failed, %v", cmd.ID, cmd.Kind, err)
+        ack.Error = err.Error()
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    delete(b.running, cmd.ID)
+    b.finished[cmd.ID] = ack
+}
+
+// Acks returns acknowledgements for the finished commands.
+func (b *CommandInbox) Acks() []CommandAck {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    acks := make([]CommandAck, 0, len(b.finished))
+    for _, ack := range b.finished {
+        acks = append(acks, ack)
+    }
+
+    return acks
+}
+
+// Acknowledged forgets the commands whose acknowledgements reached the NS.
+func (b *CommandInbox) Acknowledged(acks []CommandAck) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    for _, ack := range acks {
+        delete(b.finished, ack.ID)
+    }
+}
+
+// Wait blocks until all dispatched commands finish.
+func (b *CommandInbox) Wait() {
+    b.wg.Wait()
+}
@@ -0,0 +1,330 @@
+package tsuki
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+    ErrTooFewShards = ErasureError("too few shards to reconstruct")
+    ErrShardSize = ErasureError("shards differ in size")
+    ErrShardCount = ErasureError("wrong number of shards")
+)
+
+type ErasureError string
+
+func (e ErasureError) Error() string { return string(e) }
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+var (
+    gfExp [510]byte
+    gfLog [256]byte
+    gfMulTable [256][256]byte
+)
+
+func init() {
+    x := 1
+    for i := 0; i < 255; i++ {
+        gfExp[i] = byte(x)
+        gfExp[i + 255] = byte(x)
+        gfLog[x] = byte(i)
+
+        x <<= 1
+        if x & 0x100 != 0 {
+            x ^= 0x11d
+        }
+    }
+
+    for a := 1; a < 256; a++ {
+        for b := 1; b < 256; b++ {
+            gfMulTable[a][b] = gfExp[int(gfLog[a]) + int(gfLog[b])]
+        }
+    }
+}
+
+func gfMul(a, b byte) byte {
+    return gfMulTable[a][b]
+}
+
+func gfInv(a byte) byte {
+    return gfExp[255 - int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+    if n == 0 {
+        return 1
+    }
+
+    if a == 0 {
+        return 0
+    }
+
+    return gfExp[(int(gfLog[a]) * n) % 255]
+}
+
+// invertMatrix inverts a square matrix by Gauss-Jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+    n := len(m)
+
+    work := make([][]byte, n)
+    for i := range m {
+        work[i] = make([]byte, 2 * n)
+        copy(work[i], m[i])
+        work[i][n + i] = 1
+    }
+
+    for col := 0; col < n; col++ {
+        pivot := col
+        for pivot < n && work[pivot][col] == 0 {
+            pivot++
+        }
+
+        if pivot == n {
+            return nil, fmt.Errorf("invert matrix: singular matrix")
+        }
+        work[col], work[pivot] = work[pivot], work[col]
+
+        scale := gfInv(work[col][col])
+        for j := range work[col] {
+            work[col][j] = gfMul(work[col][j], scale)
+        }
+
+        for row := 0; row < n; row++ {
+            factor := work[row][col]
+            if row == col || factor == 0 {
+                continue
+            }
+
+            for j := range work[row] {
+                work[row][j] ^= gfMul(factor, work[col][j])
+            }
+        }
+    }
+
+    inv := make([][]byte, n)
+    for i := range work {
+        inv[i] = work[i][n:]
+    }
+
+    return inv, nil
+}
+
+func multiplyMatrices(a, b [][]byte) [][]byte {
+    out := make([][]byte, len(a))
+    for i := range a {
+        out[i] = make([]byte, len(b[0]))
+        for j := range b[0] {
+            var sum byte
+            for k := range b {
+                sum ^= gfMul(a[i][k], b[k][j])
+            }
+            out[i][j] = sum
+        }
+    }
+
+    return out
+}
+
+// ReedSolomon splits data into DataShards shards and computes ParityShards
+// parity shards, so that any DataShards of them are enough to restore the
+// data. The code is systematic: the data shards hold the data as is.
+type ReedSolomon struct {
+    DataShards int
+    ParityShards int
+
+    // matrix maps data shards to all shards. Its top rows are the
+    // identity matrix.
+    matrix [][]byte
+}
+
+func NewReedSolomon(data, parity int) (*ReedSolomon, error) {
+    if data <= 0 || parity <= 0 || data + parity > 256 {
+        return nil, fmt.Errorf("reed-solomon: unsupported rs(%d,%d)", data, parity)
+    }
+
+    total := data + parity
+
+    // Any data rows of a Vandermonde matrix are independent, and so are
+    // they after it is turned systematic.
+    vandermonde := make([][]byte, total)
+    for r := range vandermonde {
+        vandermonde[r] = make([]byte, data)
+        for c := range vandermonde[r] {
+            vandermonde[r][c] = gfPow(byte(r), c)
+        }
+    }
+
+    top, err := invertMatrix(vandermonde[:data])
+    if err != nil {
+        return nil, fmt.Errorf("reed-solomon: %v", err)
+    }
+
+    return &ReedSolomon{
+        DataShards: data,
+        ParityShards: parity,
+        matrix: multiplyMatrices(vandermonde, top),
+    }, nil
+}
+
+func (rs *ReedSolomon) Shards() int {
+    return rs.DataShards + rs.ParityShards
+}
+
+// ShardSize returns the size of every shard of size bytes of data.
+func (rs *ReedSolomon) ShardSize(size int) int {
+    return (size + rs.DataShards - 1) / rs.DataShards
+}
+
+// Split cuts data into data shards, padding the last one with zeros, and
+// allocates empty parity shards for Encode.
+func (rs *ReedSolomon) Split(data []byte) [][]byte {
+    size := rs.ShardSize(len(data))
+
+    shards := make([][]byte, rs.Shards())
+    for i := range shards {
+        shards[i] = make([]byte, size)
+        if i < rs.DataShards && i * size < len(data) {
+            copy(shards[i], data[i * size:])
+        }
+    }
+
+    return shards
+}
+
+// codeShards computes out[i] as the row rows[i] of the matrix applied to
+// the inputs.
+func codeShards(rows [][]byte, inputs, outputs [][]byte) {
+    for i, out := range outputs {
+        for j := range out {
+            out[j] = 0
+        }
+
+        for k, in := range inputs {
+            coef := rows[i][k]
+            if coef == 0 {
+                continue
+            }
+
+            mul := &gfMulTable[coef]
+            for j, b := range in {
+                out[j] ^= mul[b]
+            }
+        }
+    }
+}
+
+func (rs *ReedSolomon) checkShards(shards [][]byte, allowMissing bool) (int, error) {
+    if len(shards) != rs.Shards() {
+        return 0, ErrShardCount
+    }
+
+    size := -1
+    for _, shard := range shards {
+        if shard == nil && allowMissing {
+            continue
+        }
+
+        if size == -1 {
+            size = len(shard)
+        }
+
+        if len(shard) != size {
+            return 0, ErrShardSize
+        }
+    }
+
+    return size, nil
+}
+
+// Encode fills the parity shards from the data shards.
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+    if _, err := rs.checkShards(shards, false); err != nil {
+        return fmt.Errorf("encode: %v", err)
+    }
+
+    codeShards(rs.matrix[rs.DataShards:], shards[:rs.DataShards], shards[rs.DataShards:])
+    return nil
+}
+
+// Reconstruct restores the missing shards, marked with nil, from any
+// DataShards of the present ones.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+    size, err := rs.checkShards(shards, true)
+    if err != nil {
+        return fmt.Errorf("reconstruct: %v", err)
+    }
+
+    var rows [][]byte
+    var inputs [][]byte
+    for i, shard := range shards {
+        if shard != nil && len(inputs) < rs.DataShards {
+            rows = append(rows, rs.matrix[i])
+            inputs = append(inputs, shard)
+        }
+    }
+
+    if len(inputs) < rs.DataShards {
+        return fmt.Errorf("reconstruct: %v", ErrTooFewShards)
+    }
+
+    decode, err := invertMatrix(rows)
+    if err != nil {
+        return fmt.Errorf("reconstruct: %v", err)
+    }
+
+    var missingRows [][]byte
+    var missing [][]byte
+    for i := 0; i < rs.DataShards; i++ {
+        if shards[i] == nil {
+            shards[i] = make([]byte, size)
+            missingRows = append(missingRows, decode[i])
+            missing = append(missing, shards[i])
+        }
+    }
+    codeShards(missingRows, inputs, missing)
+
+    missingRows, missing = nil, nil
+    for i := rs.DataShards; i < rs.Shards(); i++ {
+        if shards[i] == nil {
+            shards[i] = make([]byte, size)
+            missingRows = append(missingRows, rs.matrix[i])
+            missing = append(missing, shards[i])
+        }
+    }
+    codeShards(missingRows, shards[:rs.DataShards], missing)
+
+    return nil
+}
+
+// Join writes the first size bytes of data held by the data shards.
+func (rs *ReedSolomon) Join(w io.Writer, shards [][]byte, size int) error {
+    if len(shards) < rs.DataShards {
+        return fmt.Errorf("join: %v", ErrTooFewShards)
+    }
+
+    for _, shard := range shards[:rs.DataShards] {
+        if size == 0 {
+            break
+        }
+
+        if shard == nil {
+            return fmt.Errorf("join: %v", ErrTooFewShards)
+        }
+
+        part := shard
+        if len(part) > size {
+            part = part[:size]
+        }
+
+        if _, err := w.Write(part); err != nil {
+            return fmt.Errorf("join: %v", err)
+        }
+        size -= len(part)
+    }
+
+    if size != 0 {
+        return fmt.Errorf("join: %v", ErrTooFewShards)
+    }
+
+    return nil
+}
@@ -0,0 +1,77 @@
+package tsuki_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/kureduro/tsuki"
+)
+
+func TestReedSolomon(t *testing.T) {
+    rs, err := tsuki.NewReedSolomon(6, 3)
+    if err != nil {
+        t.Fatalf("could not create codec, %v", err)
+    }
+
+    data := make([]byte, 1000)
+    rand.New(rand.NewSource(1)).Read(data)
+
+    shards := rs.Split(data)
+    if err := rs.Encode(shards); err != nil {
+        t.Fatalf("could not encode, %v", err)
+    }
+
+    cases := []struct{
+        name string
+        lost []int
+    }{
+        {"nothing lost", nil},
+        {"parity lost", []int{6, 7, 8}},
+        {"data lost", []int{0, 2, 5}},
+        {"data and parity lost", []int{1, 4, 8}},
+    }
+
+    for _, test := range cases {
+        t.Run(test.name,
+        func (t *testing.T) {
+            damaged := make([][]byte, len(shards))
+            for i := range shards {
+                damaged[i] = append([]byte(nil), shards[i]...)
+            }
+
+            for _, i := range test.lost {
+                damaged[i] = nil
+            }
+
+            if err := rs.Reconstruct(damaged); err != nil {
+                t.Fatalf("could not reconstruct, %v", err)
+            }
+
+            for i := range shards {
+                if !bytes.Equal(damaged[i], shards[i]) {
+                    t.Errorf("shard %d was restored wrong", i)
+                }
+            }
+
+            restored := &bytes.Buffer{}
+            if err := rs.Join(restored, damaged, len(data)); err != nil {
+                t.Fatalf("could not join, %v", err)
+            }
+
+            if !bytes.Equal(restored.Bytes(), data) {
+                t.Errorf("joined data differs from the original")
+            }
+        })
+    }
+
+    t.Run("too many lost",
+    func (t *testing.T) {
+        damaged := append([][]byte(nil), shards...)
+        damaged[0], damaged[3], damaged[6], damaged[7] = nil, nil, nil, nil
+
+        if err := rs.Reconstruct(damaged); err == nil {
+            t.Errorf("reconstructed from %d shards, want an error", 5)
+        }
+    })
+}
@@ -5,4 +5,5 @@ go 1.15
 require (
 	github.com/cheggaaa/pb/v3 v3.0.5 // indirect
 	github.com/urfave/cli/v2 v2.2.0
+	golang.org/x/crypto v0.14.0
 )
@@ -1,88 +1,442 @@
 package tsuki
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const NSPORT = ":7071"
 
+// NodePortHeader carries the private port of the fileserver in its requests
+// to the NS. It tells apart fileservers that share a host.
+const NodePortHeader = "X-Tsuki-Port"
+
+// EpochHeader carries the epoch of the NS in its responses. The epoch grows
+// every time a standby takes over, so responses of a deposed primary carry
+// an older one.
+const EpochHeader = "X-Tsuki-Epoch"
+
 type NSConnector interface {
     ReceivedChunk(id string)
+    Register(reg *Registration) error
 
     SetNSAddr(addr string)
     GetNSAddr() string
+    GetNSAddrs() []string
     IsNS(addr string) bool
 
     Poller
 }
 
+// HTTPNSConnector talks to the NS over HTTP. It may know several NS
+// endpoints, in order of preference. Requests go to the current one and
+// fail over to the following ones when it is unreachable, is a standby, or
+// is a deposed primary.
 type HTTPNSConnector struct {
-    Addr string
-    httpAddr string
-    ip string
-}
+    mu sync.Mutex
+    endpoints []string
+    current int
 
-func (c *HTTPNSConnector) ReceivedChunk(id string) {
-    url := fmt.Sprintf("%s/confirm/receivedChunk?chunkID=%s", c.httpAddr, id)
-    log.Printf("ReceivedChunk: %s", url)
-    go http.Get(url)
+    // epoch is the newest NS epoch seen.
+    epoch int64
+
+    // Registration, if set, is sent to the NS before the first heartbeat
+    // and again whenever the NS stops recognizing our heartbeats.
+    Registration *Registration
+    registered bool
+
+    // PrivatePort, if set, is the port the NS reaches the fileserver at.
+    // It is sent with every request.
+    PrivatePort int
+
+    // Reporter, if set, provides the status sent with each heartbeat.
+    Reporter StatusReporter
+
+    // Inbox, if set, runs the commands the NS sends back in response to
+    // heartbeats.
+    Inbox *CommandInbox
+
+    // Outbox, if set, keeps chunk confirmations until the NS gets them.
+    // Without it, a confirmation is sent once and may be lost.
+    Outbox *ConfirmationOutbox
+
+    // Inventory, if set, provides the full list of chunks sent with every
+    // InventoryPeriod'th heartbeat and with the first one after
+    // registration. Zero period means DefaultInventoryPeriod.
+    Inventory InventoryReporter
+    InventoryPeriod int
+    beats int
 }
 
-func (c *HTTPNSConnector) GetNSAddr() string {
-    return c.Addr
+const DefaultInventoryPeriod = 100
+
+var nsClient = &http.Client{
+    Timeout: 5 * time.Second,
 }
 
-func (c *HTTPNSConnector) SetNSAddr(addr string) {
+func hostOf(addr string) string {
     colon := strings.IndexRune(addr, ':')
     if colon == -1 {
         colon = len(addr)
     }
 
-    c.ip = addr[:colon]
+    return addr[:colon]
+}
+
+// do sends a request to the current NS. If the NS is unreachable or says
+// it is unavailable, the remaining endpoints are tried in order, and the
+// first one to answer becomes current.
+func (c *HTTPNSConnector) do(method, path string, body []byte) (*http.Response, error) {
+    c.mu.Lock()
+    endpoints := c.endpoints
+    start := c.current
+    c.mu.Unlock()
+
+    if len(endpoints) == 0 {
+        return nil, fmt.Errorf("NS address is unknown")
+    }
+
+    var lastErr error
+    for i := range endpoints {
+        addr := endpoints[(start + i) % len(endpoints)]
+
+        req, err := http.NewRequest(method, "http://" + addr + path, bytes.NewReader(body))
+        if err != nil {
+            return nil, err
+        }
+
+        if body != nil {
+            req.Header.Set("Content-Type", "application/json")
+        }
+
+        if c.PrivatePort != 0 {
+            req.Header.Set(NodePortHeader, strconv.Itoa(c.PrivatePort))
+        }
+
+        resp, err := nsClient.Do(req)
+        if err == nil {
+            err = c.admit(addr, resp)
+            if err != nil {
+                resp.Body.Close()
+            }
+        }
+
+        if err == nil {
+            if i != 0 {
+                log.Printf("warning: NS %s is unavailable, failed over to %s", endpoints[start], addr)
+                c.setCurrent(addr)
+            }
+
+            return resp, nil
+        }
+
+        lastErr = err
+    }
+
+    return nil, lastErr
+}
+
+// admit checks that the response comes from the primary NS and remembers
+// its epoch. Responses without an epoch come from older nameservers and
+// are accepted.
+func (c *HTTPNSConnector) admit(addr string, resp *http.Response) error {
+    if resp.StatusCode == http.StatusServiceUnavailable {
+        return fmt.Errorf("%s is unavailable", addr)
+    }
+
+    header := resp.Header.Get(EpochHeader)
+    if header == "" {
+        return nil
+    }
+
+    epoch, err := strconv.ParseInt(header, 10, 64)
+    if err != nil {
+        return fmt.Errorf("%s sent malformed epoch %q", addr, header)
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if epoch < c.epoch {
+        return fmt.Errorf("%s is deposed: its epoch is %d, but %d is seen", addr, epoch, c.epoch)
+    }
+
+    c.epoch = epoch
+    return nil
+}
+
+// Epoch returns the newest NS epoch seen.
+func (c *HTTPNSConnector) Epoch() int64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return c.epoch
+}
+
+func (c *HTTPNSConnector) setCurrent(addr string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for i, endpoint := range c.endpoints {
+        if endpoint == addr {
+            c.current = i
+            return
+        }
+    }
+}
+
+func (c *HTTPNSConnector) ReceivedChunk(id string) {
+    if c.Outbox != nil {
+        err := c.Outbox.Add(id)
+        if err == nil {
+            return
+        }
+
+        log.Printf("warning: couldn't journal confirmation of %s, sending it directly, %v", id, err)
+    }
+
+    path := fmt.Sprintf("/confirm/receivedChunk?chunkID=%s", id)
+    log.Printf("ReceivedChunk: %s", path)
+
+    go func() {
+        resp, err := c.do(http.MethodGet, path, nil)
+        if err != nil {
+            log.Printf("warning: couldn't confirm chunk %s, %v", id, err)
+            return
+        }
+        resp.Body.Close()
+    }()
+}
+
+// ConfirmChunks tells the NS about several received chunks at once. It is
+// meant to be the Send function of a ConfirmationOutbox.
+func (c *HTTPNSConnector) ConfirmChunks(ids []string) error {
+    body, err := json.Marshal(ids)
+    if err != nil {
+        return err
+    }
+
+    resp, err := c.do(http.MethodPost, "/confirm/receivedChunks", body)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("NS answered %s", resp.Status)
+    }
+
+    return nil
+}
+
+func (c *HTTPNSConnector) Register(reg *Registration) error {
+    body, err := json.Marshal(reg)
+    if err != nil {
+        return fmt.Errorf("register: %v", err)
+    }
+
+    resp, err := c.do(http.MethodPost, "/register", body)
+    if err != nil {
+        return fmt.Errorf("register: %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        msg, _ := ioutil.ReadAll(resp.Body)
+        return fmt.Errorf("register: %s, %s", resp.Status, strings.TrimSpace(string(msg)))
+    }
+
+    c.registered = true
+
+    return nil
+}
+
+// GetNSAddr returns the endpoint requests currently go to.
+func (c *HTTPNSConnector) GetNSAddr() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if len(c.endpoints) == 0 {
+        return ""
+    }
+
+    return c.endpoints[c.current]
+}
 
-    c.Addr = c.ip + NSPORT
-    c.httpAddr = "http://" + c.Addr
+func (c *HTTPNSConnector) GetNSAddrs() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
 
-    log.Printf("SetNSAddr: %#v", c)
+    return append([]string(nil), c.endpoints...)
 }
 
+// SetNSAddrs sets the NS endpoints in order of preference. Endpoints
+// without a port get the default NSPORT.
+func (c *HTTPNSConnector) SetNSAddrs(addrs []string) {
+    endpoints := make([]string, 0, len(addrs))
+    for _, addr := range addrs {
+        addr = strings.TrimSpace(addr)
+        if addr == "" {
+            continue
+        }
+
+        if !strings.ContainsRune(addr, ':') {
+            addr += NSPORT
+        }
+
+        endpoints = append(endpoints, addr)
+    }
+
+    c.mu.Lock()
+    c.endpoints = endpoints
+    c.current = 0
+    c.mu.Unlock()
+
+    log.Printf("SetNSAddrs: %v", endpoints)
+}
+
+// SetNSAddr is called with the remote address of a probing NS. If the NS
+// is one of the known endpoints, it becomes current. Otherwise, it becomes
+// the only endpoint, with the default NSPORT.
+func (c *HTTPNSConnector) SetNSAddr(addr string) {
+    host := hostOf(addr)
+
+    c.mu.Lock()
+    for i, endpoint := range c.endpoints {
+        if hostOf(endpoint) == host {
+            c.current = i
+            c.mu.Unlock()
+            return
+        }
+    }
+    c.mu.Unlock()
+
+    c.SetNSAddrs([]string{host})
+}
+
+// IsNS reports whether addr belongs to any of the known NS endpoints. Any
+// address is accepted while no endpoint is known.
 func (c *HTTPNSConnector) IsNS(addr string) bool {
-    if c.ip == "" {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if len(c.endpoints) == 0 {
         return true
     }
 
-    colon := strings.IndexRune(addr, ':')
-    if colon == -1 {
-        colon = len(addr)
+    host := hostOf(addr)
+    for _, endpoint := range c.endpoints {
+        if hostOf(endpoint) == host {
+            return true
+        }
     }
 
-    ip := addr[:colon]
-
-    return c.ip == ip
+    return false
 }
 
 func (c *HTTPNSConnector) Poll() {
-    _, err := http.Get(c.httpAddr + "/pulse")
+    if c.Registration != nil && !c.registered {
+        if err := c.Register(c.Registration); err != nil {
+            log.Printf("warning: couldn't register at NS, %v", err)
+        } else {
+            c.beats = 0
+        }
+    }
+
+    beat := &Heartbeat{Epoch: c.Epoch()}
+    if c.Reporter != nil {
+        beat.NodeStatus = *c.Reporter.Status()
+    }
+
+    period := c.InventoryPeriod
+    if period <= 0 {
+        period = DefaultInventoryPeriod
+    }
+
+    if c.Inventory != nil && c.beats % period == 0 {
+        beat.Inventory = c.Inventory.Inventory()
+    }
+    c.beats++
+
+    if c.Inbox != nil {
+        beat.Acks = c.Inbox.Acks()
+    }
+
+    body, _ := json.Marshal(beat)
+
+    resp, err := c.do(http.MethodPost, "/pulse", body)
 
     if err != nil {
-        log.Printf("warning: couldn't send hertbeat to %s", c.httpAddr + "/pulse")
+        log.Printf("warning: couldn't send hertbeat, %v", err)
+        return
+    }
+    defer resp.Body.Close()
+
+    // The NS answers NotFound to fileservers it doesn't know, which
+    // happens, for example, after the NS restarts.
+    if resp.StatusCode == http.StatusNotFound {
+        c.registered = false
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return
+    }
+
+    if c.Reporter != nil {
+        c.Reporter.Reported(&beat.NodeStatus)
+    }
+
+    if c.Inbox == nil {
+        return
+    }
+
+    c.Inbox.Acknowledged(beat.Acks)
+
+    var cmds []*Command
+    if err := json.NewDecoder(resp.Body).Decode(&cmds); err != nil {
+        log.Printf("warning: couldn't parse commands from NS, %v", err)
+        return
     }
+
+    c.Inbox.Dispatch(cmds)
 }
 
 
 type SpyNSConnector struct {
     receivedChunks []string
+    Registrations []*Registration
     Addr string
     PulseCount int
+
+    Reporter StatusReporter
+    Statuses []*NodeStatus
+
+    Inventory InventoryReporter
+    Inventories []*Inventory
+
+    // Commands are dispatched to Inbox on the next heartbeat.
+    Inbox *CommandInbox
+    Commands []*Command
+    Acks []CommandAck
 }
 
 func (c *SpyNSConnector) ReceivedChunk(id string) {
     c.receivedChunks = append(c.receivedChunks, id)
 }
 
+func (c *SpyNSConnector) Register(reg *Registration) error {
+    c.Registrations = append(c.Registrations, reg)
+    return nil
+}
+
 func (c *SpyNSConnector) Reset() {
     c.receivedChunks = nil
 }
@@ -91,6 +445,14 @@ func (c *SpyNSConnector) GetNSAddr() string {
     return c.Addr
 }
 
+func (c *SpyNSConnector) GetNSAddrs() []string {
+    if c.Addr == "" {
+        return nil
+    }
+
+    return []string{c.Addr}
+}
+
 func (c *SpyNSConnector) SetNSAddr(addr string) {
     c.Addr = addr
 }
@@ -106,5 +468,24 @@ func (c *SpyNSConnector) IsNS(addr string) bool {
 func (c *SpyNSConnector) Poll() {
     if c.Addr != "" {
         c.PulseCount++
+
+        if c.Reporter != nil {
+            status := c.Reporter.Status()
+            c.Statuses = append(c.Statuses, status)
+            c.Reporter.Reported(status)
+        }
+
+        if c.Inventory != nil {
+            c.Inventories = append(c.Inventories, c.Inventory.Inventory())
+        }
+
+        if c.Inbox != nil {
+            acks := c.Inbox.Acks()
+            c.Acks = append(c.Acks, acks...)
+            c.Inbox.Acknowledged(acks)
+
+            c.Inbox.Dispatch(c.Commands)
+            c.Commands = nil
+        }
     }       
 }
@@ -0,0 +1,284 @@
+package tsuki_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kureduro/tsuki"
+)
+
+func TestHTTPNSConnector_Endpoints(t *testing.T) {
+    conn := &tsuki.HTTPNSConnector{}
+
+    t.Run("anybody is NS before endpoints are known",
+    func (t *testing.T) {
+        if !conn.IsNS("10.0.0.9:4321") {
+            t.Errorf("expected any address to be accepted")
+        }
+    })
+
+    conn.SetNSAddrs([]string{"10.0.0.1:8071", "10.0.0.2"})
+
+    t.Run("endpoints keep explicit ports",
+    func (t *testing.T) {
+        want := []string{"10.0.0.1:8071", "10.0.0.2" + tsuki.NSPORT}
+        if got := conn.GetNSAddrs(); !reflect.DeepEqual(got, want) {
+            t.Errorf("got endpoints %v, want %v", got, want)
+        }
+    })
+
+    t.Run("any configured NS may probe",
+    func (t *testing.T) {
+        if !conn.IsNS("10.0.0.1:51234") || !conn.IsNS("10.0.0.2:51234") {
+            t.Errorf("expected both configured nameservers to be accepted")
+        }
+
+        if conn.IsNS("10.0.0.3:51234") {
+            t.Errorf("expected unknown address to be rejected")
+        }
+    })
+
+    t.Run("probing NS becomes current",
+    func (t *testing.T) {
+        conn.SetNSAddr("10.0.0.2:51234")
+
+        if got := conn.GetNSAddr(); got != "10.0.0.2" + tsuki.NSPORT {
+            t.Errorf("got current NS %s, want %s", got, "10.0.0.2" + tsuki.NSPORT)
+        }
+
+        if got := len(conn.GetNSAddrs()); got != 2 {
+            t.Errorf("probe changed the list of endpoints, got %d of them", got)
+        }
+    })
+}
+
+func TestHTTPNSConnector_Failover(t *testing.T) {
+    down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer down.Close()
+
+    pulses := make(chan string, 10)
+    confirmations := make(chan string, 10)
+    up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/pulse":
+            pulses <- r.Method
+            w.Write([]byte("[]"))
+        case "/confirm/receivedChunk":
+            confirmations <- r.URL.Query().Get("chunkID")
+        }
+    }))
+    defer up.Close()
+
+    gone := httptest.NewServer(http.NotFoundHandler())
+    gone.Close()
+
+    downAddr := strings.TrimPrefix(down.URL, "http://")
+    upAddr := strings.TrimPrefix(up.URL, "http://")
+    goneAddr := strings.TrimPrefix(gone.URL, "http://")
+
+    conn := &tsuki.HTTPNSConnector{}
+    conn.SetNSAddrs([]string{goneAddr, downAddr, upAddr})
+
+    conn.Poll()
+
+    select {
+    case <-pulses:
+    case <-time.After(time.Second):
+        t.Fatalf("heartbeat did not reach the available NS")
+    }
+
+    if got := conn.GetNSAddr(); got != upAddr {
+        t.Errorf("got current NS %s, want %s", got, upAddr)
+    }
+
+    conn.ReceivedChunk("abc")
+
+    select {
+    case id := <-confirmations:
+        if id != "abc" {
+            t.Errorf("got confirmation for chunk %s, want %s", id, "abc")
+        }
+    case <-time.After(time.Second):
+        t.Fatalf("chunk confirmation did not reach the available NS")
+    }
+}
+
+func TestHTTPNSConnector_PrivatePort(t *testing.T) {
+    ports := make(chan string, 1)
+    ns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ports <- r.Header.Get(tsuki.NodePortHeader)
+        w.Write([]byte("[]"))
+    }))
+    defer ns.Close()
+
+    conn := &tsuki.HTTPNSConnector{PrivatePort: 7001}
+    conn.SetNSAddrs([]string{strings.TrimPrefix(ns.URL, "http://")})
+    conn.Poll()
+
+    if got := <-ports; got != "7001" {
+        t.Errorf("got private port %q in the heartbeat, want 7001", got)
+    }
+}
+
+func TestHTTPNSConnector_StatusKeptUntilAccepted(t *testing.T) {
+    var accept int32
+    var reported []int
+    ns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if atomic.LoadInt32(&accept) == 0 {
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+
+        beat := &tsuki.Heartbeat{}
+        json.NewDecoder(r.Body).Decode(beat)
+        reported = append(reported, beat.ReadErrors)
+        w.Write([]byte("[]"))
+    }))
+    defer ns.Close()
+
+    store := tsuki.NewInMemoryChunkStorage(map[string]string{"0": "chunk0"})
+    conn := &tsuki.HTTPNSConnector{}
+    conn.SetNSAddrs([]string{strings.TrimPrefix(ns.URL, "http://")})
+    fsd := tsuki.NewFileServer(store, conn)
+    conn.Reporter = fsd
+
+    // A read of a chunk lost after it was expected fails.
+    fsd.Expect("read", tsuki.ExpectActionRead, "0")
+    store.Remove("0")
+    fsd.ServeClient(httptest.NewRecorder(), tsuki.NewGetChunkRequest("0", "read"))
+
+    conn.Poll()
+
+    atomic.StoreInt32(&accept, 1)
+    conn.Poll()
+    conn.Poll()
+
+    if !reflect.DeepEqual(reported, []int{1, 0}) {
+        t.Errorf("got read errors %v in accepted heartbeats, want [1 0]", reported)
+    }
+}
+
+// epochNS answers heartbeats with the given epoch, or as a standby when
+// the epoch is zero.
+type epochNS struct {
+    epoch int64
+    pulses chan int64
+}
+
+func (ns *epochNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    epoch := atomic.LoadInt64(&ns.epoch)
+    if epoch == 0 {
+        w.WriteHeader(http.StatusServiceUnavailable)
+        return
+    }
+
+    var beat tsuki.Heartbeat
+    json.NewDecoder(r.Body).Decode(&beat)
+    ns.pulses <- beat.Epoch
+
+    w.Header().Set(tsuki.EpochHeader, strconv.FormatInt(epoch, 10))
+    w.Write([]byte("[]"))
+}
+
+func TestHTTPNSConnector_Epoch(t *testing.T) {
+    old := &epochNS{epoch: 1, pulses: make(chan int64, 10)}
+    oldServer := httptest.NewServer(old)
+    defer oldServer.Close()
+
+    standby := &epochNS{pulses: make(chan int64, 10)}
+    standbyServer := httptest.NewServer(standby)
+    defer standbyServer.Close()
+
+    oldAddr := strings.TrimPrefix(oldServer.URL, "http://")
+    standbyAddr := strings.TrimPrefix(standbyServer.URL, "http://")
+
+    conn := &tsuki.HTTPNSConnector{}
+    conn.SetNSAddrs([]string{oldAddr, standbyAddr})
+
+    conn.Poll()
+    if len(old.pulses) != 1 || conn.Epoch() != 1 {
+        t.Fatalf("heartbeat did not reach the primary")
+    }
+    <-old.pulses
+
+    // The primary dies and the standby takes over.
+    atomic.StoreInt64(&old.epoch, 0)
+    atomic.StoreInt64(&standby.epoch, 2)
+
+    conn.Poll()
+    if len(standby.pulses) != 1 || conn.Epoch() != 2 {
+        t.Fatalf("heartbeat did not reach the new primary")
+    }
+    <-standby.pulses
+
+    // The old primary comes back unaware and probes the fileserver.
+    atomic.StoreInt64(&old.epoch, 1)
+    conn.SetNSAddr(oldAddr)
+
+    conn.Poll()
+    <-old.pulses
+
+    if got := conn.GetNSAddr(); got != standbyAddr {
+        t.Errorf("got current NS %s, want the new primary %s", got, standbyAddr)
+    }
+
+    select {
+    case epoch := <-standby.pulses:
+        if epoch != 2 {
+            t.Errorf("heartbeat carries epoch %d, want %d", epoch, 2)
+        }
+    default:
+        t.Errorf("heartbeat did not fail over from the deposed primary")
+    }
+}
+
+type fixedInventory []string
+
+func (inv fixedInventory) Inventory() *tsuki.Inventory {
+    return &tsuki.Inventory{Chunks: inv}
+}
+
+func TestHTTPNSConnector_Inventory(t *testing.T) {
+    var beats []*tsuki.Heartbeat
+    ns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        beat := &tsuki.Heartbeat{}
+        json.NewDecoder(r.Body).Decode(beat)
+        beats = append(beats, beat)
+        w.Write([]byte("[]"))
+    }))
+    defer ns.Close()
+
+    conn := &tsuki.HTTPNSConnector{
+        Inventory: fixedInventory{"a", "b"},
+        InventoryPeriod: 3,
+    }
+    conn.SetNSAddrs([]string{strings.TrimPrefix(ns.URL, "http://")})
+
+    for i := 0; i < 4; i++ {
+        conn.Poll()
+    }
+
+    if len(beats) != 4 {
+        t.Fatalf("got %d heartbeats, want 4", len(beats))
+    }
+
+    for i, beat := range beats {
+        withInventory := i % 3 == 0
+        if (beat.Inventory != nil) != withInventory {
+            t.Errorf("heartbeat %d has inventory %v, want it: %v", i, beat.Inventory, withInventory)
+        }
+    }
+
+    if got := beats[0].Inventory.Chunks; !reflect.DeepEqual(got, []string{"a", "b"}) {
+        t.Errorf("got inventory %v, want [a b]", got)
+    }
+}
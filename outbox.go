@@ -0,0 +1,281 @@
+package tsuki
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfirmationOutbox keeps chunk confirmations until the NS acknowledges
+// them. Every confirmation is journaled before it is sent, so it survives
+// both NS outages and fileserver restarts. The journal is a list of lines,
+// "+id" when a confirmation is added and "-id" when the NS got it.
+type ConfirmationOutbox struct {
+    // Send delivers a batch of confirmations. The batch counts as
+    // acknowledged if it returns nil.
+    Send func(ids []string) error
+
+    BatchSize int
+    MinBackoff time.Duration
+    MaxBackoff time.Duration
+    SleepFunc func(time.Duration)
+
+    mu sync.Mutex
+    filename string
+    journal *os.File
+    pending []string
+    queued map[string]bool
+    wake chan struct{}
+}
+
+func OpenConfirmationOutbox(filename string, send func(ids []string) error) (*ConfirmationOutbox, error) {
+    o := &ConfirmationOutbox{
+        Send: send,
+        BatchSize: 64,
+        MinBackoff: 100 * time.Millisecond,
+        MaxBackoff: 30 * time.Second,
+        SleepFunc: time.Sleep,
+        filename: filename,
+        queued: make(map[string]bool),
+        wake: make(chan struct{}, 1),
+    }
+
+    if err := o.replay(); err != nil {
+        return nil, fmt.Errorf("open outbox: %v", err)
+    }
+
+    // Rewriting the journal drops the entries that were acknowledged.
+    if err := o.compact(); err != nil {
+        return nil, fmt.Errorf("open outbox: %v", err)
+    }
+
+    return o, nil
+}
+
+func (o *ConfirmationOutbox) replay() error {
+    file, err := os.Open(o.filename)
+    if os.IsNotExist(err) {
+        return nil
+    }
+
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    acked := make(map[string]bool)
+    var added []string
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if len(line) < 2 {
+            continue
+        }
+
+        id := line[1:]
+        switch line[0] {
+        case '+':
+            added = append(added, id)
+            delete(acked, id)
+        case '-':
+            acked[id] = true
+        }
+    }
+
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+
+    for _, id := range added {
+        if !acked[id] && !o.queued[id] {
+            o.pending = append(o.pending, id)
+            o.queued[id] = true
+        }
+    }
+
+    return nil
+}
+
+// compact rewrites the journal with only the pending confirmations. Must
+// be called with o.mu held or before the outbox is shared.
+func (o *ConfirmationOutbox) compact() error {
+    if o.journal != nil {
+        o.journal.Close()
+        o.journal = nil
+    }
+
+    tmpName := o.filename + ".tmp"
+    tmp, err := os.Create(tmpName)
+    if err != nil {
+        return err
+    }
+
+    w := bufio.NewWriter(tmp)
+    for _, id := range o.pending {
+        fmt.Fprintf(w, "+%s\n", id)
+    }
+
+    if err := w.Flush(); err != nil {
+        tmp.Close()
+        return err
+    }
+
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    tmp.Close()
+
+    if err := os.Rename(tmpName, o.filename); err != nil {
+        return err
+    }
+
+    o.journal, err = os.OpenFile(o.filename, os.O_APPEND|os.O_WRONLY, 0644)
+    return err
+}
+
+func (o *ConfirmationOutbox) appendJournal(lines string) error {
+    if _, err := o.journal.WriteString(lines); err != nil {
+        return err
+    }
+
+    return o.journal.Sync()
+}
+
+// Retain drops pending confirmations for which keep returns false, e.g.,
+// for chunks that didn't survive a restart.
+func (o *ConfirmationOutbox) Retain(keep func(id string) bool) error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    kept := o.pending[:0]
+    for _, id := range o.pending {
+        if keep(id) {
+            kept = append(kept, id)
+        } else {
+            delete(o.queued, id)
+        }
+    }
+    o.pending = kept
+
+    return o.compact()
+}
+
+// Add journals the confirmation and schedules it for sending.
+func (o *ConfirmationOutbox) Add(id string) error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    if o.queued[id] {
+        return nil
+    }
+
+    if err := o.appendJournal("+" + id + "\n"); err != nil {
+        return fmt.Errorf("outbox add: %v", err)
+    }
+
+    o.pending = append(o.pending, id)
+    o.queued[id] = true
+
+    select {
+    case o.wake <- struct{}{}:
+    default:
+    }
+
+    return nil
+}
+
+func (o *ConfirmationOutbox) Pending() []string {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    return append([]string(nil), o.pending...)
+}
+
+// Flush sends one batch of pending confirmations.
+func (o *ConfirmationOutbox) Flush() error {
+    o.mu.Lock()
+    size := len(o.pending)
+    if o.BatchSize > 0 && size > o.BatchSize {
+        size = o.BatchSize
+    }
+    batch := append([]string(nil), o.pending[:size]...)
+    o.mu.Unlock()
+
+    if len(batch) == 0 {
+        return nil
+    }
+
+    if err := o.Send(batch); err != nil {
+        return fmt.Errorf("send confirmations: %v", err)
+    }
+
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    sent := make(map[string]bool, len(batch))
+    acks := &strings.Builder{}
+    for _, id := range batch {
+        sent[id] = true
+        delete(o.queued, id)
+        fmt.Fprintf(acks, "-%s\n", id)
+    }
+
+    left := o.pending[:0]
+    for _, id := range o.pending {
+        if !sent[id] {
+            left = append(left, id)
+        }
+    }
+    o.pending = left
+
+    if len(o.pending) == 0 {
+        return o.compact()
+    }
+
+    return o.appendJournal(acks.String())
+}
+
+// Run sends confirmations as they come, backing off exponentially while
+// the NS doesn't accept them. It never returns.
+func (o *ConfirmationOutbox) Run() {
+    backoff := o.MinBackoff
+
+    for {
+        if len(o.Pending()) == 0 {
+            <-o.wake
+            continue
+        }
+
+        if err := o.Flush(); err != nil {
+            log.Printf("warning: %v, retrying in %v", err, backoff)
+            o.SleepFunc(backoff)
+
+            backoff *= 2
+            if backoff > o.MaxBackoff {
+                backoff = o.MaxBackoff
+            }
+            continue
+        }
+
+        backoff = o.MinBackoff
+    }
+}
+
+func (o *ConfirmationOutbox) Close() error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    if o.journal == nil {
+        return nil
+    }
+
+    err := o.journal.Close()
+    o.journal = nil
+    return err
+}
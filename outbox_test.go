@@ -0,0 +1,92 @@
+package tsuki_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/kureduro/tsuki"
+)
+
+func TestConfirmationOutbox(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tsuki")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := path.Join(dir, ".tsukioutbox")
+
+    var sent [][]string
+    failing := true
+    send := func(ids []string) error {
+        if failing {
+            return errors.New("NS is down")
+        }
+
+        sent = append(sent, ids)
+        return nil
+    }
+
+    outbox, err := tsuki.OpenConfirmationOutbox(filename, send)
+    if err != nil {
+        t.Fatalf("could not open outbox, %v", err)
+    }
+    outbox.BatchSize = 2
+
+    for _, id := range []string{"a", "b", "c", "a"} {
+        if err := outbox.Add(id); err != nil {
+            t.Fatalf("could not add %s, %v", id, err)
+        }
+    }
+
+    if err := outbox.Flush(); err == nil {
+        t.Errorf("flush succeeded while the NS is down")
+    }
+    outbox.Close()
+
+    t.Run("survives restart",
+        func(t *testing.T) {
+            reopened, err := tsuki.OpenConfirmationOutbox(filename, send)
+            if err != nil {
+                t.Fatalf("could not reopen outbox, %v", err)
+            }
+            defer reopened.Close()
+            reopened.BatchSize = 2
+
+            want := []string{"a", "b", "c"}
+            if got := reopened.Pending(); !reflect.DeepEqual(got, want) {
+                t.Fatalf("got pending %v, want %v", got, want)
+            }
+
+            failing = false
+            if err := reopened.Flush(); err != nil {
+                t.Fatalf("could not flush, %v", err)
+            }
+
+            if !reflect.DeepEqual(sent, [][]string{{"a", "b"}}) {
+                t.Errorf("got batches %v, want [[a b]]", sent)
+            }
+        })
+
+    t.Run("acknowledged confirmations are not resent",
+        func(t *testing.T) {
+            reopened, err := tsuki.OpenConfirmationOutbox(filename, send)
+            if err != nil {
+                t.Fatalf("could not reopen outbox, %v", err)
+            }
+            defer reopened.Close()
+
+            if got := reopened.Pending(); !reflect.DeepEqual(got, []string{"c"}) {
+                t.Fatalf("got pending %v, want [c]", got)
+            }
+
+            reopened.Retain(func(id string) bool { return id != "c" })
+            if got := reopened.Pending(); len(got) != 0 {
+                t.Errorf("got pending %v after retain, want none", got)
+            }
+        })
+}
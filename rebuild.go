@@ -0,0 +1,108 @@
+package tsuki
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Rebuild restores a lost shard of an erasure coded stripe, the only
+// chunk of the command. It reads enough of the other shards from their
+// sources and stores the restored shard as if it was uploaded.
+func (s *FileServer) Rebuild(cmd *Command) error {
+    if len(cmd.Chunks) != 1 || len(cmd.Sources) != len(cmd.Stripe) {
+        return fmt.Errorf("rebuild: malformed command")
+    }
+    id := cmd.Chunks[0]
+
+    rs, err := NewReedSolomon(cmd.DataShards, cmd.ParityShards)
+    if err != nil {
+        return fmt.Errorf("rebuild %s: %v", id, err)
+    }
+
+    if len(cmd.Stripe) != rs.Shards() {
+        return fmt.Errorf("rebuild %s: %v", id, ErrShardCount)
+    }
+
+    index := -1
+    for i, shard := range cmd.Stripe {
+        if shard == id {
+            index = i
+        }
+    }
+
+    if index == -1 {
+        return fmt.Errorf("rebuild %s: shard is not in the stripe", id)
+    }
+
+    defer s.counters.beginTransfer()()
+
+    shards := make([][]byte, rs.Shards())
+    fetched := 0
+    for i, addr := range cmd.Sources {
+        if addr == "" || i == index || fetched == rs.DataShards {
+            continue
+        }
+
+        shard, err := fetchChunk(addr, cmd.Stripe[i], cmd.Token)
+        if err != nil {
+            atomic.AddInt64(&s.counters.replicationErrors, 1)
+            log.Printf("warning: could not fetch shard %s for rebuild, %v", cmd.Stripe[i], err)
+            continue
+        }
+
+        shards[i] = shard
+        fetched++
+    }
+
+    if err := rs.Reconstruct(shards); err != nil {
+        return fmt.Errorf("rebuild %s: %v", id, err)
+    }
+
+    chunk, finishChunk, err := s.chunks.Create(id)
+    if err != nil {
+        finishChunk()
+        atomic.AddInt64(&s.counters.writeErrors, 1)
+        return fmt.Errorf("rebuild %s: %v", id, err)
+    }
+
+    _, err = chunk.Write(shards[index])
+    finishChunk()
+
+    // Like an upload, a partial shard is not kept and the shard is
+    // confirmed only once it is complete.
+    if err != nil {
+        atomic.AddInt64(&s.counters.writeErrors, 1)
+
+        if err := s.chunks.Remove(id); err != nil {
+            log.Printf("warning: partial shard %s is not removed, %v", id, err)
+        }
+
+        return fmt.Errorf("rebuild %s: %v", id, err)
+    }
+
+    s.nsConn.ReceivedChunk(id)
+    return nil
+}
+
+func fetchChunk(addr, id, token string) ([]byte, error) {
+    resp, err := http.Get(fmt.Sprintf("http://%s/chunks/%s?token=%s", addr, id, token))
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s answered %s", addr, resp.Status)
+    }
+
+    buf := &bytes.Buffer{}
+    if _, err := io.Copy(buf, resp.Body); err != nil {
+        return nil, err
+    }
+
+    return buf.Bytes(), nil
+}
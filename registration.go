@@ -0,0 +1,60 @@
+package tsuki
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Registration is what a fileserver tells the NS about itself when it joins
+// the cluster on its own instead of being listed in the NS config.
+type Registration struct {
+    // NodeID identifies the fileserver across restarts. See LoadNodeID.
+    NodeID string `json:"nodeID"`
+
+    // PrivateHost may be left empty, the NS will use the address the
+    // registration came from.
+    PrivateHost string `json:"privateHost"`
+    PublicHost string `json:"publicHost"`
+    PrivatePort int `json:"privatePort"`
+    PublicPort int `json:"publicPort"`
+
+    Available int `json:"available"`
+
+    // Secret is the join secret shared with the NS, if it requires one.
+    Secret string `json:"secret"`
+}
+
+// LoadNodeID reads the node ID from filename, or generates a new one and
+// stores it there if the file does not exist yet.
+func LoadNodeID(filename string) (string, error) {
+    contents, err := ioutil.ReadFile(filename)
+    if err == nil {
+        id := strings.TrimSpace(string(contents))
+        if id == "" {
+            return "", fmt.Errorf("load node id: %s is empty", filename)
+        }
+
+        return id, nil
+    }
+
+    if !os.IsNotExist(err) {
+        return "", fmt.Errorf("load node id: %v", err)
+    }
+
+    idBytes := make([]byte, 16)
+    if _, err := rand.Read(idBytes); err != nil {
+        return "", fmt.Errorf("generate node id: %v", err)
+    }
+
+    id := hex.EncodeToString(idBytes)
+
+    if err := ioutil.WriteFile(filename, []byte(id), 0644); err != nil {
+        return "", fmt.Errorf("save node id: %v", err)
+    }
+
+    return id, nil
+}
@@ -0,0 +1,38 @@
+package tsuki_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/kureduro/tsuki"
+)
+
+func TestLoadNodeID(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tsuki")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := path.Join(dir, ".tsukiid")
+
+    first, err := tsuki.LoadNodeID(filename)
+    if err != nil {
+        t.Fatalf("could not generate node id, %v", err)
+    }
+
+    if first == "" {
+        t.Fatalf("generated node id is empty")
+    }
+
+    second, err := tsuki.LoadNodeID(filename)
+    if err != nil {
+        t.Fatalf("could not load node id, %v", err)
+    }
+
+    if first != second {
+        t.Errorf("node id changed between loads, got %q, want %q", second, first)
+    }
+}
@@ -0,0 +1,86 @@
+package tsuki
+
+import (
+	"sync/atomic"
+)
+
+// NodeStatus is sent to the NS with every heartbeat.
+type NodeStatus struct {
+    Available int `json:"available"`
+    ChunkCount int `json:"chunkCount"`
+    ActiveTransfers int `json:"activeTransfers"`
+
+    // Error counts since the previous report.
+    ReadErrors int `json:"readErrors"`
+    WriteErrors int `json:"writeErrors"`
+    ReplicationErrors int `json:"replicationErrors"`
+
+    // DiskError is empty while the chunk storage is healthy.
+    DiskError string `json:"diskError"`
+}
+
+type StatusReporter interface {
+    Status() *NodeStatus
+
+    // Reported is called with the status once the NS has accepted it.
+    Reported(status *NodeStatus)
+}
+
+// Inventory lists every chunk the fileserver holds. It goes with some of
+// the heartbeats, so that the NS can find the chunks it lost track of.
+type Inventory struct {
+    Chunks []string `json:"chunks"`
+}
+
+type InventoryReporter interface {
+    Inventory() *Inventory
+}
+
+// Counters are int64 and stay at the top of the struct, so that atomic
+// operations on them are aligned on 32-bit platforms as well.
+type nodeCounters struct {
+    activeTransfers int64
+    readErrors int64
+    writeErrors int64
+    replicationErrors int64
+}
+
+func (c *nodeCounters) beginTransfer() func() {
+    atomic.AddInt64(&c.activeTransfers, 1)
+
+    return func() {
+        atomic.AddInt64(&c.activeTransfers, -1)
+    }
+}
+
+// Status reports the current load of the fileserver. Error counters keep
+// counting until the NS accepts the status, so that errors are not lost
+// with a heartbeat that doesn't get through.
+func (s *FileServer) Status() *NodeStatus {
+    status := &NodeStatus{
+        Available: s.chunks.BytesAvailable(),
+        ChunkCount: s.chunks.Count(),
+        ActiveTransfers: int(atomic.LoadInt64(&s.counters.activeTransfers)),
+        ReadErrors: int(atomic.LoadInt64(&s.counters.readErrors)),
+        WriteErrors: int(atomic.LoadInt64(&s.counters.writeErrors)),
+        ReplicationErrors: int(atomic.LoadInt64(&s.counters.replicationErrors)),
+    }
+
+    if err := s.chunks.Health(); err != nil {
+        status.DiskError = err.Error()
+    }
+
+    return status
+}
+
+// Reported takes the reported errors off the counters. Errors counted
+// since the status was taken are left for the next one.
+func (s *FileServer) Reported(status *NodeStatus) {
+    atomic.AddInt64(&s.counters.readErrors, -int64(status.ReadErrors))
+    atomic.AddInt64(&s.counters.writeErrors, -int64(status.WriteErrors))
+    atomic.AddInt64(&s.counters.replicationErrors, -int64(status.ReplicationErrors))
+}
+
+func (s *FileServer) Inventory() *Inventory {
+    return &Inventory{Chunks: s.chunks.List()}
+}
@@ -0,0 +1,195 @@
+package tsuki
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// A chunk stream lets a client fetch several chunks covered by one read
+// token in a single response. The body is a sequence of frames. Each frame
+// starts with a kind byte:
+//
+//     FrameChunk: kind | id length (uint16) | id | data length (uint64) | data
+//     FrameEnd:   kind | report length (uint64) | JSON-encoded StreamReport
+//
+// All integers are big endian. A well-formed stream always ends with
+// FrameEnd. If the connection breaks before it, the client may rely only
+// on the chunks it has read completely.
+const (
+    FrameChunk = byte(1)
+    FrameEnd = byte(2)
+)
+
+const (
+    ErrStreamTruncated = StreamError("chunk stream ended before the end frame")
+    ErrStreamCorrupted = StreamError("unknown frame in chunk stream")
+)
+
+type StreamError string
+
+func (e StreamError) Error() string { return string(e) }
+
+// StreamReport closes every chunk stream. Delivered lists chunks that were
+// sent in full, in the order they were sent. If Error is not empty, the
+// server stopped early and the chunks not in Delivered are still expected
+// under the same token.
+type StreamReport struct {
+    Delivered []string
+    Error string
+}
+
+func WriteChunkFrame(w io.Writer, id string, data []byte) error {
+    header := make([]byte, 0, 1 + 2 + len(id) + 8)
+    header = append(header, FrameChunk)
+    header = appendUint16(header, uint16(len(id)))
+    header = append(header, id...)
+    header = appendUint64(header, uint64(len(data)))
+
+    if _, err := w.Write(header); err != nil {
+        return fmt.Errorf("write chunk frame: %v", err)
+    }
+
+    if _, err := w.Write(data); err != nil {
+        return fmt.Errorf("write chunk frame: %v", err)
+    }
+
+    return nil
+}
+
+func WriteEndFrame(w io.Writer, report *StreamReport) error {
+    payload, err := json.Marshal(report)
+    if err != nil {
+        return fmt.Errorf("write end frame: %v", err)
+    }
+
+    header := make([]byte, 0, 1 + 8)
+    header = append(header, FrameEnd)
+    header = appendUint64(header, uint64(len(payload)))
+
+    if _, err := w.Write(header); err != nil {
+        return fmt.Errorf("write end frame: %v", err)
+    }
+
+    if _, err := w.Write(payload); err != nil {
+        return fmt.Errorf("write end frame: %v", err)
+    }
+
+    return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+    var buf [2]byte
+    binary.BigEndian.PutUint16(buf[:], v)
+    return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+    var buf [8]byte
+    binary.BigEndian.PutUint64(buf[:], v)
+    return append(b, buf[:]...)
+}
+
+// ChunkStreamReader decodes a chunk stream frame by frame.
+type ChunkStreamReader struct {
+    r *bufio.Reader
+    current io.Reader
+    report *StreamReport
+}
+
+func NewChunkStreamReader(r io.Reader) *ChunkStreamReader {
+    return &ChunkStreamReader{
+        r: bufio.NewReader(r),
+    }
+}
+
+// Next advances to the next chunk and returns its ID and contents. The
+// contents are valid until the following call to Next. After the end frame
+// Next returns io.EOF, and Report becomes available.
+func (s *ChunkStreamReader) Next() (string, io.Reader, error) {
+    if s.report != nil {
+        return "", nil, io.EOF
+    }
+
+    if s.current != nil {
+        if _, err := io.Copy(ioutil.Discard, s.current); err != nil {
+            return "", nil, ErrStreamTruncated
+        }
+        s.current = nil
+    }
+
+    kind, err := s.r.ReadByte()
+    if err != nil {
+        return "", nil, ErrStreamTruncated
+    }
+
+    switch kind {
+    case FrameChunk:
+        var idLen uint16
+        if err := binary.Read(s.r, binary.BigEndian, &idLen); err != nil {
+            return "", nil, ErrStreamTruncated
+        }
+
+        id := make([]byte, idLen)
+        if _, err := io.ReadFull(s.r, id); err != nil {
+            return "", nil, ErrStreamTruncated
+        }
+
+        var dataLen uint64
+        if err := binary.Read(s.r, binary.BigEndian, &dataLen); err != nil {
+            return "", nil, ErrStreamTruncated
+        }
+
+        s.current = &truncationReader{io.LimitReader(s.r, int64(dataLen)), int64(dataLen)}
+        return string(id), s.current, nil
+
+    case FrameEnd:
+        var reportLen uint64
+        if err := binary.Read(s.r, binary.BigEndian, &reportLen); err != nil {
+            return "", nil, ErrStreamTruncated
+        }
+
+        payload := make([]byte, reportLen)
+        if _, err := io.ReadFull(s.r, payload); err != nil {
+            return "", nil, ErrStreamTruncated
+        }
+
+        report := &StreamReport{}
+        if err := json.Unmarshal(payload, report); err != nil {
+            return "", nil, fmt.Errorf("read end frame: %v", err)
+        }
+
+        s.report = report
+        return "", nil, io.EOF
+    }
+
+    return "", nil, ErrStreamCorrupted
+}
+
+// Report returns the server's report, or nil if the end frame has not been
+// read yet.
+func (s *ChunkStreamReader) Report() *StreamReport {
+    return s.report
+}
+
+// truncationReader turns a premature EOF inside a chunk frame into
+// ErrStreamTruncated, so that a broken connection is not mistaken for a
+// short chunk.
+type truncationReader struct {
+    r io.Reader
+    left int64
+}
+
+func (t *truncationReader) Read(p []byte) (int, error) {
+    n, err := t.r.Read(p)
+    t.left -= int64(n)
+
+    if err == io.EOF && t.left > 0 {
+        return n, ErrStreamTruncated
+    }
+
+    return n, err
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -56,6 +57,13 @@ func NewReplicateRequest(addr, token string, chunks ...string) *http.Request {
     return req
 }
 
+func NewStreamRequest(token string, chunks ...string) *http.Request {
+    b, _ := json.Marshal(chunks)
+    url := fmt.Sprintf("/stream?token=%s", token)
+    req, _ := http.NewRequest(http.MethodGet, url, bytes.NewBuffer(b))
+    return req
+}
+
 func AssertChunkContents(t *testing.T, chunks ChunkDB, id, want string) {
     t.Helper()
 
@@ -135,3 +143,22 @@ func (s *SpySleeperTime) Sleep(duration time.Duration) {
     s.DurationSlept = duration
 }
 
+
+
+type SpyCommandExecutor struct {
+    mu sync.Mutex
+    Executed []*Command
+}
+
+func (e *SpyCommandExecutor) Execute(cmd *Command) error {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    e.Executed = append(e.Executed, cmd)
+
+    if cmd.Kind == "fail" {
+        return fmt.Errorf("failed on purpose")
+    }
+
+    return nil
+}